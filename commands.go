@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/reconcile"
+	"github.com/vocdoni/vocfaucet/storage"
+	"github.com/vocdoni/vocfaucet/stripehandler"
+	"go.vocdoni.io/dvote/log"
+)
+
+// storageCommandConfig holds the parameters of the storage commands.
+type storageCommandConfig struct {
+	dbType     string
+	dataDir    string
+	waitPeriod time.Duration
+	dbPrefix   []byte
+	dumpFile   string
+	dumpFormat string
+	toDbType   string
+	toDataDir  string
+	overwrite  bool
+}
+
+// storageCommand is a command that operates on the faucet database instead of starting the API.
+type storageCommand struct {
+	name        string
+	description string
+	run         func(st *storage.KVStorage, cfg *storageCommandConfig) error
+}
+
+var storageCommands = []storageCommand{
+	{
+		name:        "export",
+		description: "export the faucet database into --dumpFile",
+		run:         exportCommand,
+	},
+	{
+		name:        "import",
+		description: "import --dumpFile into the faucet database",
+		run:         importCommand,
+	},
+	{
+		name:        "migrate",
+		description: "copy the faucet database into the --toDbType database at --toDataDir",
+		run:         migrateCommand,
+	},
+}
+
+// reconcileCommandConfig holds the parameters of the reconcile command.
+type reconcileCommandConfig struct {
+	dbType       string
+	dataDir      string
+	waitPeriod   time.Duration
+	dbPrefix     []byte
+	stripeKey    string
+	paymentLinks string
+	from         string
+	to           string
+	reportFile   string
+	reportFormat string
+}
+
+// runStorageCommand opens the faucet database and runs the given command on it.
+func runStorageCommand(name string, cfg *storageCommandConfig) error {
+	for _, c := range storageCommands {
+		if c.name != name {
+			continue
+		}
+		st, err := storage.New(cfg.dbType, cfg.dataDir, cfg.waitPeriod, cfg.dbPrefix)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := st.Close(); err != nil {
+				log.Warnw("error closing storage", "err", err)
+			}
+		}()
+		return c.run(st, cfg)
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func exportCommand(st *storage.KVStorage, cfg *storageCommandConfig) error {
+	if cfg.dumpFile == "" {
+		return fmt.Errorf("missing --dumpFile")
+	}
+	fd, err := os.OpenFile(cfg.dumpFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	summary, err := st.Export(fd, cfg.dumpFormat)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	log.Infow("database exported", "file", cfg.dumpFile, "entries", summary.Entries, "checksum", summary.Checksum)
+	return nil
+}
+
+func importCommand(st *storage.KVStorage, cfg *storageCommandConfig) error {
+	if cfg.dumpFile == "" {
+		return fmt.Errorf("missing --dumpFile")
+	}
+	fd, err := os.Open(cfg.dumpFile)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	summary, err := st.Import(fd, cfg.dumpFormat, cfg.overwrite)
+	if err != nil {
+		return err
+	}
+	log.Infow("database imported", "file", cfg.dumpFile, "entries", summary.Entries, "checksum", summary.Checksum)
+	return nil
+}
+
+func migrateCommand(st *storage.KVStorage, cfg *storageCommandConfig) error {
+	if cfg.toDbType == "" || cfg.toDataDir == "" {
+		return fmt.Errorf("missing --toDbType or --toDataDir")
+	}
+	if cfg.toDbType == cfg.dbType && filepath.Clean(cfg.toDataDir) == filepath.Clean(cfg.dataDir) {
+		return fmt.Errorf("source and destination databases are the same")
+	}
+	dst, err := storage.New(cfg.toDbType, cfg.toDataDir, cfg.waitPeriod, cfg.dbPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dst.Close(); err != nil {
+			log.Warnw("error closing destination storage", "err", err)
+		}
+	}()
+	summary, err := st.CopyTo(dst, cfg.overwrite)
+	if err != nil {
+		return err
+	}
+	log.Infow("database migrated", "from", cfg.dbType, "to", cfg.toDbType,
+		"entries", summary.Entries, "checksum", summary.Checksum)
+	return nil
+}
+
+// runReconcileCommand writes the reconciliation report of the Stripe checkout sessions created
+// within the --from and --to dates into --reportFile, or to the standard output.
+func runReconcileCommand(cfg *reconcileCommandConfig) error {
+	if cfg.stripeKey == "" {
+		return fmt.Errorf("missing stripeKey")
+	}
+	from, to, err := reconcile.ParseRange(cfg.from, cfg.to)
+	if err != nil {
+		return err
+	}
+	links, err := stripehandler.ParsePaymentLinks(cfg.paymentLinks)
+	if err != nil {
+		return err
+	}
+	st, err := storage.Open(cfg.dbType, cfg.dataDir, cfg.waitPeriod, cfg.dbPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := st.Close(); err != nil {
+			log.Warnw("error closing storage", "err", err)
+		}
+	}()
+	stripe.Key = cfg.stripeKey
+	report, err := reconcile.Generate(&stripehandler.StripeHandler{Storage: st, PaymentLinks: links}, st, from, to)
+	if err != nil {
+		return err
+	}
+	if cfg.reportFile == "" {
+		return report.Write(os.Stdout, cfg.reportFormat)
+	}
+	fd, err := os.OpenFile(cfg.reportFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(fd, cfg.reportFormat); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	log.Infow("reconciliation report written", "file", cfg.reportFile, "rows", len(report.Rows), "mismatches", report.Mismatches)
+	return nil
+}
@@ -0,0 +1,263 @@
+package erc20handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+// currencyDecimals are the decimals of the prices, which are set in cents.
+const currencyDecimals = 2
+
+// rpcTimeout is the timeout of the JSON-RPC requests.
+const rpcTimeout = 30 * time.Second
+
+// checkoutMessage is the message the payer signs to create a checkout, proving it controls the
+// payer address, and checkoutMaxAge the maximum age of the signed requests.
+const (
+	checkoutMessage = "vocfaucet erc20 checkout"
+	checkoutMaxAge  = 10 * time.Minute
+)
+
+// transferTopic is the topic of the ERC-20 Transfer(address,address,uint256) event.
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
+// ErrInvalidPayer is returned when the checkout has no valid payer address.
+var ErrInvalidPayer = errors.New("invalid payer address")
+
+// ChainReader is the subset of the JSON-RPC client used to find the token transfers. It is
+// implemented by ethclient.Client.
+type ChainReader interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// ERC20Handler is a payment provider that sells faucet tokens for an ERC-20 stablecoin. The
+// buyer signs the checkout request with the address that will pay, and the payment is
+// confirmed once a Transfer of at least the price from that address to the receiver address
+// is found on chain, sent after the checkout was created.
+type ERC20Handler struct {
+	Chain          ChainReader    // The JSON-RPC client of the chain of the token.
+	Token          common.Address // The address of the ERC-20 token contract.
+	Decimals       uint8          // The decimals of the token.
+	Receiver       common.Address // The address that receives the payments.
+	Confirmations  uint64         // The blocks a transfer needs on top to be accepted.
+	LookbackBlocks uint64         // How many blocks back to look for transfers.
+	Prices         *pricing.Table // The price tiers, in cents of the stablecoin.
+	DefaultAmount  int64          // The default amount of tokens bought.
+	Storage        storage.Storage
+	Faucet         *faucet.Faucet
+	Fulfiller      *payment.Fulfiller
+}
+
+// check that ERC20Handler implements the payment.Provider interface
+var _ payment.Provider = (*ERC20Handler)(nil)
+
+// Instructions are the details the buyer needs to send the payment.
+type Instructions struct {
+	Token    string `json:"token"`
+	Receiver string `json:"receiver"`
+	Payer    string `json:"payer"`
+	Amount   string `json:"amount"` // In the token base units.
+}
+
+// NewERC20Handler creates a new ERC-20 payment provider.
+func NewERC20Handler(chain ChainReader, token, receiver common.Address, decimals uint8, prices *pricing.Table,
+	defaultAmount int64, f *faucet.Faucet, st storage.Storage,
+) (*ERC20Handler, error) {
+	if chain == nil || prices == nil || st == nil {
+		return nil, errors.New("missing required parameters")
+	}
+	if token == (common.Address{}) || receiver == (common.Address{}) {
+		return nil, errors.New("missing token or receiver address")
+	}
+	if decimals < currencyDecimals {
+		return nil, fmt.Errorf("token decimals must be at least %d", currencyDecimals)
+	}
+	return &ERC20Handler{
+		Chain:          chain,
+		Token:          token,
+		Decimals:       decimals,
+		Receiver:       receiver,
+		Confirmations:  12,
+		LookbackBlocks: 50000,
+		Prices:         prices,
+		DefaultAmount:  defaultAmount,
+		Storage:        st,
+		Faucet:         f,
+		Fulfiller:      payment.NewFulfiller(f, st),
+	}, nil
+}
+
+// Name returns the name of the provider.
+func (e *ERC20Handler) Name() string {
+	return faucet.AuthTypeERC20
+}
+
+// baseAmount converts a price in cents into token base units.
+func (e *ERC20Handler) baseAmount(price int64) *big.Int {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(e.Decimals-currencyDecimals)), nil)
+	return scale.Mul(scale, big.NewInt(price))
+}
+
+// CreateCheckout stores a payment for the purchase and returns the transfer the payer has to send.
+// The payer must have been verified by the caller, and the current chain head is recorded so
+// that only later transfers pay it.
+func (e *ERC20Handler) CreateCheckout(req *payment.CheckoutRequest) (*payment.Checkout, error) {
+	if err := payment.CheckDenylist(e.Storage, req.Recipient); err != nil {
+		return nil, err
+	}
+	if !common.IsHexAddress(req.Payer) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPayer, req.Payer)
+	}
+	payer := common.HexToAddress(req.Payer)
+	quote, err := e.Prices.Quote(req.Quantity)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	head, err := e.Chain.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	p := &storage.Payment{
+		ID:         "erc20_" + hex.EncodeToString(id),
+		State:      storage.PaymentCreated,
+		Recipient:  req.Recipient.Hex(),
+		Quantity:   uint64(req.Quantity),
+		Price:      quote.Total,
+		Currency:   e.Prices.Currency,
+		Customer:   payer.Hex(),
+		Referral:   req.Referral,
+		StartBlock: head,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := e.Storage.SetPayment(p); err != nil {
+		return nil, err
+	}
+	return &payment.Checkout{
+		Payment: p,
+		ID:      p.ID,
+		Instructions: &Instructions{
+			Token:    e.Token.Hex(),
+			Receiver: e.Receiver.Hex(),
+			Payer:    payer.Hex(),
+			Amount:   e.baseAmount(quote.Total).String(),
+		},
+	}, nil
+}
+
+// ConfirmPayment looks for a confirmed Transfer from the payer to the receiver of at least the
+// price of the payment, sent after the payment was created. Each transfer pays a single
+// payment, the ones already used are recorded as processed webhook events, which are never
+// removed.
+func (e *ERC20Handler) ConfirmPayment(id string) (*payment.Status, error) {
+	p, err := e.Storage.Payment(id)
+	if err != nil {
+		return nil, err
+	}
+	status := &payment.Status{
+		Status:        payment.StatusOpen,
+		PaymentStatus: payment.PaymentUnpaid,
+		Recipient:     p.Recipient,
+		Quantity:      int64(p.Quantity),
+		Price:         p.Price,
+		Currency:      p.Currency,
+		Customer:      p.Customer,
+	}
+	switch p.State {
+	case storage.PaymentCreated:
+	case storage.PaymentPaid, storage.PaymentFulfilled:
+		status.Status, status.PaymentStatus = payment.StatusComplete, payment.PaymentStatusPaid
+		return status, nil
+	default:
+		status.Status = payment.StatusExpired
+		return status, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	head, err := e.Chain.BlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if head < e.Confirmations {
+		return status, nil
+	}
+	to := head - e.Confirmations
+	from := p.StartBlock + 1
+	if to > e.LookbackBlocks && to-e.LookbackBlocks > from {
+		from = to - e.LookbackBlocks
+	}
+	if from > to {
+		return status, nil
+	}
+	logs, err := e.Chain.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: []common.Address{e.Token},
+		Topics: [][]common.Hash{
+			{transferTopic},
+			{common.BytesToHash(common.HexToAddress(p.Customer).Bytes())},
+			{common.BytesToHash(e.Receiver.Bytes())},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	expected := e.baseAmount(p.Price)
+	for _, l := range logs {
+		if l.Removed || new(big.Int).SetBytes(l.Data).Cmp(expected) < 0 {
+			continue
+		}
+		transfer := fmt.Sprintf("%s%s:%d", storage.TransferEventPrefix, l.TxHash.Hex(), l.Index)
+		used, err := e.Storage.CheckWebhookEvent(transfer)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			continue
+		}
+		// mark the transfer as used before recording the payment, so a failure never lets it
+		// pay twice, a payment lost that way is logged to be settled by hand
+		if err := e.Storage.AddWebhookEvent(transfer); err != nil {
+			return nil, err
+		}
+		p.State = storage.PaymentPaid
+		p.UpdatedAt = time.Now()
+		if err := e.Storage.SetPayment(p); err != nil {
+			log.Warnw("transfer used by an unrecorded payment", "transfer", transfer, "payment", p.ID, "err", err)
+			return nil, err
+		}
+		status.Status, status.PaymentStatus = payment.StatusComplete, payment.PaymentStatusPaid
+		return status, nil
+	}
+	return status, nil
+}
+
+// HandleWebhook is not supported, the payments are confirmed by looking for the transfers.
+func (e *ERC20Handler) HandleWebhook(_ []byte, _ http.Header) error {
+	return payment.ErrNotSupported
+}
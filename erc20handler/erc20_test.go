@@ -0,0 +1,141 @@
+package erc20handler
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/storage"
+	dvoteethereum "go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// testChain is a local chain stand-in that serves the logs added to it.
+type testChain struct {
+	head uint64
+	logs []types.Log
+}
+
+func (c *testChain) BlockNumber(_ context.Context) (uint64, error) {
+	return c.head, nil
+}
+
+func (c *testChain) FilterLogs(_ context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	for _, l := range c.logs {
+		if l.BlockNumber < q.FromBlock.Uint64() || l.BlockNumber > q.ToBlock.Uint64() || l.Address != q.Addresses[0] {
+			continue
+		}
+		match := true
+		for i, topics := range q.Topics {
+			if len(topics) > 0 && l.Topics[i] != topics[0] {
+				match = false
+			}
+		}
+		if match {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+// transfer adds a Transfer log of the given amount to the chain, at the current head.
+func (c *testChain) transfer(token, from, to common.Address, amount *big.Int) {
+	c.logs = append(c.logs, types.Log{
+		Address: token,
+		Topics: []common.Hash{
+			transferTopic,
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+		},
+		Data:        common.LeftPadBytes(amount.Bytes(), 32),
+		BlockNumber: c.head,
+		TxHash:      common.BigToHash(big.NewInt(int64(len(c.logs) + 1))),
+	})
+}
+
+func TestERC20Payment(t *testing.T) {
+	signer := dvoteethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	f := &faucet.Faucet{Signer: signer, Storage: st}
+	tiers, err := pricing.ParseTiers("1:10")
+	if err != nil {
+		t.Fatalf("failed to parse tiers: %v", err)
+	}
+	prices, err := pricing.NewTable("usdc", tiers)
+	if err != nil {
+		t.Fatalf("failed to create price table: %v", err)
+	}
+	chain := &testChain{head: 100}
+	token := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	receiver := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	payer := common.HexToAddress("0x00000000000000000000000000000000000000cc")
+	recipient := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	e, err := NewERC20Handler(chain, token, receiver, 6, prices, 100, f, st)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	e.Confirmations = 2
+
+	// a transfer sent before the checkout is created does not pay it
+	chain.transfer(token, payer, receiver, big.NewInt(10000000))
+	checkout, err := e.CreateCheckout(&payment.CheckoutRequest{Recipient: recipient, Quantity: 100, Payer: payer.Hex()})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	// 100 tokens at 10 cents are 10 usdc, with 6 decimals
+	if amount := checkout.Instructions.(*Instructions).Amount; amount != "10000000" {
+		t.Fatalf("unexpected amount %s", amount)
+	}
+	other, err := e.CreateCheckout(&payment.CheckoutRequest{Recipient: recipient, Quantity: 100, Payer: payer.Hex()})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+
+	// a smaller transfer and a transfer without confirmations do not pay it
+	chain.head++
+	chain.transfer(token, payer, receiver, big.NewInt(9999999))
+	chain.transfer(token, payer, receiver, big.NewInt(10000000))
+	status, err := e.Fulfiller.Fulfill(e, checkout.ID)
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if status.Paid() || status.FaucetPackage != nil || status.State != string(storage.PaymentCreated) {
+		t.Fatalf("expected unpaid status, got %+v", status)
+	}
+
+	// once confirmed, the package is issued, and the same package is returned again
+	chain.head += 2
+	status, err = e.Fulfiller.Fulfill(e, checkout.ID)
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if !status.Paid() || status.FaucetPackage == nil || status.State != string(storage.PaymentFulfilled) {
+		t.Fatalf("expected fulfilled status, got %+v", status)
+	}
+	again, err := e.Fulfiller.Fulfill(e, checkout.ID)
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if string(again.FaucetPackage) != string(status.FaucetPackage) {
+		t.Fatalf("expected the same package to be returned")
+	}
+	entries, err := st.LedgerEntries(time.Time{}, time.Now().Add(time.Minute))
+	if err != nil || len(entries) != 1 || entries[0].AuthType != faucet.AuthTypeERC20 || entries[0].Reference != checkout.ID {
+		t.Fatalf("expected a single ledger entry, got %+v (%v)", entries, err)
+	}
+
+	// the transfer cannot pay another checkout
+	if status, err := e.Fulfiller.Fulfill(e, other.ID); err != nil || status.Paid() {
+		t.Fatalf("expected the transfer not to be reused, got %+v (%v)", status, err)
+	}
+}
@@ -0,0 +1,118 @@
+package erc20handler
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	hr "github.com/vocdoni/vocfaucet/handlersresponse"
+	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/httprouter/apirest"
+	"go.vocdoni.io/dvote/log"
+	"go.vocdoni.io/dvote/types"
+)
+
+// Register the handlers URLs
+func (e *ERC20Handler) RegisterHandlers(api *apirest.API) {
+	if err := api.RegisterMethod(
+		"/erc20/checkout/{to}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		e.createCheckout,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/erc20/checkout/{to}/{amount}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		e.createCheckout,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/erc20/status/{id}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		e.paymentStatus,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/erc20/prices",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		e.prices,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// createCheckout creates a new payment and returns the transfer to send. The payer is the address
+// that signed the request data, a JSON object with the checkout message and the unix timestamp
+// of the request.
+func (e *ERC20Handler) createCheckout(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, err := helpers.StringToAddress(ctx.URLParam("to"))
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	quantity := e.DefaultAmount
+	if amount := ctx.URLParam("amount"); amount != "" {
+		quantity, err = strconv.ParseInt(amount, 10, 64)
+		if err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+	}
+	newRequest := struct {
+		Data      string         `json:"data"`
+		Signature types.HexBytes `json:"signature"`
+		Referral  string         `json:"referral"`
+	}{}
+	if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	payer, err := helpers.VerifySignedRequest(newRequest.Data, newRequest.Signature, checkoutMessage, checkoutMaxAge)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrSignature)
+	}
+	checkout, err := e.CreateCheckout(&payment.CheckoutRequest{
+		Recipient: addr,
+		Quantity:  quantity,
+		Payer:     payer.Hex(),
+		Referral:  newRequest.Referral,
+	})
+	switch {
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case errors.Is(err, ErrInvalidPayer):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	case errors.Is(err, pricing.ErrNoTier), errors.Is(err, pricing.ErrOverflow):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrQuantityOutOfRange)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(checkout).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// paymentStatus returns the status of a payment, and its faucet package once paid
+func (e *ERC20Handler) paymentStatus(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	status, err := e.Fulfiller.Fulfill(e, ctx.URLParam("id"))
+	if errors.Is(err, payment.ErrProvider) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(status).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// prices returns the price tiers, in cents of the stablecoin
+func (e *ERC20Handler) prices(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	return ctx.Send(new(hr.HandlerResponse).Set(e.Prices).MustMarshall(), apirest.HTTPstatusOK)
+}
@@ -2,22 +2,47 @@ package faucet
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/oauthhandler"
 	"github.com/vocdoni/vocfaucet/storage"
 	"go.vocdoni.io/dvote/api"
 	vFaucet "go.vocdoni.io/dvote/api/faucet"
 	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
 	"go.vocdoni.io/dvote/vochain"
 )
 
+// BudgetName is the name of the storage budget that limits the tokens issued by the faucet.
+const BudgetName = "faucet"
+
+var (
+	// ErrInsufficientFunds is returned when the tokens of a purchase cannot be reserved.
+	ErrInsufficientFunds = errors.New("insufficient faucet funds")
+	// ErrDenylisted is returned when issuing tokens to a denylisted address.
+	ErrDenylisted = errors.New("address is denylisted")
+)
+
 type Faucet struct {
-	Signer     *ethereum.SignKeys
-	AuthTypes  map[string]uint64
-	WaitPeriod time.Duration
-	Storage    *storage.Storage
+	Signer       *ethereum.SignKeys
+	AuthTypes    map[string]uint64
+	WaitPeriod   time.Duration
+	Storage      storage.Storage
+	Budget       uint64        // Max tokens issued per budget period, 0 means no limit.
+	BudgetPeriod time.Duration // The period of the budget.
+	// Balance returns the tokens held by the signer, if set. The reservations of the pending
+	// purchases cannot exceed it.
+	Balance func() (uint64, error)
+	// OAuthProviders are the providers of the oauth auth type, by name, loaded at startup.
+	OAuthProviders map[string]*oauthhandler.Provider
+	oauthLock      sync.Mutex
+	// reserved are the active reservations by ID, loaded from the storage on first use
+	reserved    map[string]storage.Reservation
+	reserveLock sync.Mutex
 }
 
 // prepareFaucetPackage prepares a Faucet package, including the signature, for the given address.
@@ -27,24 +52,43 @@ func (f *Faucet) prepareFaucetPackage(toAddr common.Address, authTypeName string
 	if _, ok := f.AuthTypes[authTypeName]; !ok {
 		return nil, fmt.Errorf("auth type %s not supported", authTypeName)
 	}
+	return f.IssueFaucetPackage(toAddr, f.AuthTypes[authTypeName], authTypeName, "")
+}
 
-	// generate Faucet package
-	fpackage, err := vochain.GenerateFaucetPackage(f.Signer, toAddr, f.AuthTypes[authTypeName])
-	if err != nil {
-		return nil, api.ErrCantGenerateFaucetPkg.WithErr(err)
+// IssueFaucetPackage prepares a Faucet package for the given address and amount, spending it
+// from the faucet budget and recording it in the ledger with the given auth type and reference.
+// The tokens reserved for other purchases cannot be spent, and the reservation of the purchase
+// with the reference as ID, if any, is committed. Denylisted addresses are refused. The budget
+// is only spent once the package is ready, and given back if it cannot be recorded.
+func (f *Faucet) IssueFaucetPackage(toAddr common.Address, amount uint64, authTypeName, reference string) (*vFaucet.FaucetResponse, error) {
+	if entry, err := f.Storage.DenylistEntry(storage.DenylistAddress, toAddr.Hex()); err == nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrDenylisted, toAddr.Hex(), entry.Reason)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
 	}
-	fpackageBytes, err := json.Marshal(vFaucet.FaucetPackage{
-		FaucetPayload: fpackage.Payload,
-		Signature:     fpackage.Signature,
-	})
+	data, err := f.PrepareFaucetPackageWithAmount(toAddr, amount)
 	if err != nil {
 		return nil, err
 	}
-	// send response
-	return &vFaucet.FaucetResponse{
-		Amount:        fmt.Sprint(f.AuthTypes[authTypeName]),
-		FaucetPackage: fpackageBytes,
-	}, nil
+	now := time.Now()
+	if err := f.spendBudget(amount, reference); err != nil {
+		return nil, fmt.Errorf("cannot issue %d tokens: %w", amount, err)
+	}
+	if err := f.Storage.AddLedgerEntry(&storage.LedgerEntry{
+		Time:      now,
+		Recipient: toAddr.Hex(),
+		Amount:    amount,
+		AuthType:  authTypeName,
+		Reference: reference,
+	}); err != nil {
+		// the package is not returned, so it is not spent either
+		f.releaseBudget(amount, now)
+		return nil, fmt.Errorf("cannot record %d tokens issued: %w", amount, err)
+	}
+	if err := f.Release(reference); err != nil {
+		log.Warnw("failed to commit reservation", "id", reference, "err", err)
+	}
+	return data, nil
 }
 
 // PrepareFaucetPackageWithAmount prepares a Faucet package, including the signature, for the given address.
@@ -72,3 +116,151 @@ func (f *Faucet) PrepareFaucetPackageWithAmount(toAddr common.Address, amount ui
 		FaucetPackage: fpackageBytes,
 	}, nil
 }
+
+// spendBudget spends amount from the faucet budget, except the tokens reserved for purchases
+// other than the one with the given ID.
+func (f *Faucet) spendBudget(amount uint64, id string) error {
+	if f.Budget == 0 {
+		return nil
+	}
+	f.reserveLock.Lock()
+	defer f.reserveLock.Unlock()
+	reserved, err := f.reservedTokens(id)
+	if err != nil {
+		return err
+	}
+	if reserved >= f.Budget {
+		return storage.ErrBudgetExceeded
+	}
+	_, err = f.Storage.SpendBudget(BudgetName, f.BudgetPeriod, amount, f.Budget-reserved)
+	return err
+}
+
+// releaseBudget gives back amount, spent at the given time, to the faucet budget. Failures are
+// only logged, since they only leave the budget stricter.
+func (f *Faucet) releaseBudget(amount uint64, spentAt time.Time) {
+	if f.Budget == 0 {
+		return
+	}
+	if err := f.Storage.ReleaseBudget(BudgetName, f.BudgetPeriod, amount, spentAt); err != nil {
+		log.Warnw("failed to release budget", "amount", amount, "err", err)
+	}
+}
+
+// Reserve holds amount tokens for the pending purchase with the given ID until expiresAt, so
+// they are not issued to anyone else. It returns ErrInsufficientFunds if the tokens left in the
+// budget, or the signer balance, do not cover them besides the other reservations. Reserving
+// again with the same ID replaces the reservation.
+func (f *Faucet) Reserve(id string, amount uint64, expiresAt time.Time) error {
+	f.reserveLock.Lock()
+	defer f.reserveLock.Unlock()
+	reserved, err := f.reservedTokens(id)
+	if err != nil {
+		return err
+	}
+	if f.Budget > 0 {
+		spent, err := f.Storage.BudgetSpent(BudgetName, f.BudgetPeriod)
+		if err != nil {
+			return err
+		}
+		if spent+reserved+amount > f.Budget {
+			return fmt.Errorf("%w: %d tokens spent and %d reserved out of a budget of %d",
+				ErrInsufficientFunds, spent, reserved, f.Budget)
+		}
+	}
+	if f.Balance != nil {
+		balance, err := f.Balance()
+		if err != nil {
+			return fmt.Errorf("cannot get the faucet balance: %w", err)
+		}
+		if reserved+amount > balance {
+			return fmt.Errorf("%w: %d tokens reserved out of a balance of %d", ErrInsufficientFunds, reserved, balance)
+		}
+	}
+	reservation := storage.Reservation{ID: id, Amount: amount, ExpiresAt: expiresAt}
+	if err := f.Storage.SetReservation(&reservation); err != nil {
+		return err
+	}
+	f.reserved[id] = reservation
+	return nil
+}
+
+// ExtendReservation moves the expiration of the reservation with the given ID, if any, to
+// expiresAt.
+func (f *Faucet) ExtendReservation(id string, expiresAt time.Time) error {
+	f.reserveLock.Lock()
+	defer f.reserveLock.Unlock()
+	reservations, err := f.reservations()
+	if err != nil {
+		return err
+	}
+	reservation, ok := reservations[id]
+	if !ok {
+		return nil
+	}
+	reservation.ExpiresAt = expiresAt
+	if err := f.Storage.SetReservation(&reservation); err != nil {
+		return err
+	}
+	reservations[id] = reservation
+	return nil
+}
+
+// Release frees the tokens reserved with the given ID, if any.
+func (f *Faucet) Release(id string) error {
+	if id == "" {
+		return nil
+	}
+	f.reserveLock.Lock()
+	defer f.reserveLock.Unlock()
+	reservations, err := f.reservations()
+	if err != nil {
+		return err
+	}
+	if _, ok := reservations[id]; !ok {
+		return nil
+	}
+	if err := f.Storage.DeleteReservation(id); err != nil {
+		return err
+	}
+	delete(reservations, id)
+	return nil
+}
+
+// reservations returns the active reservations by ID, loading them from the storage the first
+// time. The reserve lock must be held.
+func (f *Faucet) reservations() (map[string]storage.Reservation, error) {
+	if f.reserved == nil {
+		list, err := f.Storage.Reservations()
+		if err != nil {
+			return nil, err
+		}
+		f.reserved = make(map[string]storage.Reservation, len(list))
+		for _, reservation := range list {
+			f.reserved[reservation.ID] = *reservation
+		}
+	}
+	now := time.Now()
+	for id, reservation := range f.reserved {
+		if !reservation.ExpiresAt.After(now) {
+			delete(f.reserved, id)
+		}
+	}
+	return f.reserved, nil
+}
+
+// reservedTokens returns the tokens reserved for the purchases other than the one with the
+// given ID. The reserve lock must be held.
+func (f *Faucet) reservedTokens(id string) (uint64, error) {
+	reservations, err := f.reservations()
+	if err != nil {
+		return 0, err
+	}
+	reserved := uint64(0)
+	for _, reservation := range reservations {
+		if reservation.ID != id {
+			reserved += reservation.Amount
+		}
+	}
+	return reserved, nil
+}
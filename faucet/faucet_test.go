@@ -0,0 +1,140 @@
+package faucet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestReservations(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	balance := uint64(1000)
+	f := &Faucet{
+		Signer:       signer,
+		Storage:      st,
+		Budget:       100,
+		BudgetPeriod: time.Hour,
+		Balance:      func() (uint64, error) { return balance, nil },
+	}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	expiresAt := time.Now().Add(time.Hour)
+
+	// reservations cannot exceed the budget, and reserving again replaces the reservation
+	if err := f.Reserve("cs_1", 60, expiresAt); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	if err := f.Reserve("cs_2", 50, expiresAt); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := f.Reserve("cs_1", 70, expiresAt); err != nil {
+		t.Fatalf("failed to reserve again: %v", err)
+	}
+
+	// the reserved tokens are not issued to anyone else
+	if _, err := f.IssueFaucetPackage(addr, 40, AuthTypeOpen, ""); !errors.Is(err, storage.ErrBudgetExceeded) {
+		t.Fatalf("expected budget exceeded, got %v", err)
+	}
+	if _, err := f.IssueFaucetPackage(addr, 30, AuthTypeOpen, ""); err != nil {
+		t.Fatalf("failed to issue unreserved tokens: %v", err)
+	}
+
+	// issuing the package of the purchase commits its reservation
+	if _, err := f.IssueFaucetPackage(addr, 70, AuthTypeStripe, "cs_1"); err != nil {
+		t.Fatalf("failed to issue reserved tokens: %v", err)
+	}
+	if reservations, err := st.Reservations(); err != nil || len(reservations) != 0 {
+		t.Fatalf("expected the reservation to be committed, got %+v (%v)", reservations, err)
+	}
+
+	// reservations cannot exceed the signer balance either, and released ones are freed
+	f.Budget = 0
+	balance = 50
+	if err := f.Reserve("cs_3", 40, expiresAt); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	if err := f.Reserve("cs_4", 20, expiresAt); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := f.Release("cs_3"); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if err := f.Reserve("cs_4", 20, expiresAt); err != nil {
+		t.Fatalf("failed to reserve after release: %v", err)
+	}
+
+	// expired reservations are ignored
+	if err := f.ExtendReservation("cs_4", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("failed to extend reservation: %v", err)
+	}
+	if err := f.Reserve("cs_5", 50, expiresAt); err != nil {
+		t.Fatalf("failed to reserve after expiration: %v", err)
+	}
+}
+
+// failingLedger is a storage whose ledger entries cannot be added.
+type failingLedger struct {
+	storage.Storage
+}
+
+func (failingLedger) AddLedgerEntry(*storage.LedgerEntry) error {
+	return errors.New("ledger unavailable")
+}
+
+func TestIssueFaucetPackage(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	f := &Faucet{Signer: signer, Storage: st, Budget: 100, BudgetPeriod: time.Hour}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	// denylisted addresses are refused with an error the handlers can tell apart
+	if err := st.AddDenylistEntry(&storage.DenylistEntry{Kind: storage.DenylistAddress, Value: addr.Hex(),
+		Reason: "refunded", Time: time.Now()}); err != nil {
+		t.Fatalf("failed to add denylist entry: %v", err)
+	}
+	if _, err := f.IssueFaucetPackage(addr, 10, AuthTypeOpen, ""); !errors.Is(err, ErrDenylisted) {
+		t.Fatalf("expected denylisted address, got %v", err)
+	}
+	addr = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+
+	// packages that cannot be prepared do not spend the budget
+	if _, err := f.IssueFaucetPackage(addr, 0, AuthTypeOpen, ""); err == nil {
+		t.Fatalf("expected invalid amount")
+	}
+	if spent, err := st.BudgetSpent(BudgetName, f.BudgetPeriod); err != nil || spent != 0 {
+		t.Fatalf("expected nothing spent, got %d (%v)", spent, err)
+	}
+
+	// packages that cannot be recorded are not returned, and their budget and reservation
+	// are kept
+	if err := f.Reserve("cs_1", 60, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	f.Storage = failingLedger{st}
+	if data, err := f.IssueFaucetPackage(addr, 60, AuthTypeStripe, "cs_1"); err == nil || data != nil {
+		t.Fatalf("expected the ledger error, got %v", err)
+	}
+	if spent, err := st.BudgetSpent(BudgetName, f.BudgetPeriod); err != nil || spent != 0 {
+		t.Fatalf("expected the budget to be given back, got %d (%v)", spent, err)
+	}
+	if reservations, err := st.Reservations(); err != nil || len(reservations) != 1 {
+		t.Fatalf("expected the reservation to be kept, got %+v (%v)", reservations, err)
+	}
+	f.Storage = st
+	if _, err := f.IssueFaucetPackage(addr, 60, AuthTypeStripe, "cs_1"); err != nil {
+		t.Fatalf("failed to issue the package again: %v", err)
+	}
+	if spent, err := st.BudgetSpent(BudgetName, f.BudgetPeriod); err != nil || spent != 60 {
+		t.Fatalf("expected 60 spent, got %d (%v)", spent, err)
+	}
+}
@@ -2,13 +2,14 @@ package faucet
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/vocdoni/vocfaucet/aragondaohandler"
 	hr "github.com/vocdoni/vocfaucet/handlersresponse"
 	"github.com/vocdoni/vocfaucet/helpers"
-	"github.com/vocdoni/vocfaucet/oauthhandler"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/httprouter/apirest"
 	"go.vocdoni.io/dvote/log"
@@ -69,13 +70,41 @@ func (f *Faucet) RegisterHandlers(api *apirest.API) {
 	}
 }
 
+// RegisterAdminHandlers registers the admin URLs, which require the API admin token
+func (f *Faucet) RegisterAdminHandlers(api *apirest.API) {
+	if err := api.RegisterMethod(
+		"/admin/storageStats",
+		"GET",
+		apirest.MethodAccessTypeAdmin,
+		f.storageStatsHandler,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
 // Returns the list of supported auth types
 func (f *Faucet) authTypesHandler(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	data := &AuthTypes{
 		AuthTypes:   f.AuthTypes,
 		WaitSeconds: uint64(f.WaitPeriod.Seconds()),
 	}
+	if f.AuthTypes[AuthTypeOauth] > 0 && len(f.OAuthProviders) > 0 {
+		data.OAuthProviders = make(map[string]OAuthProvider, len(f.OAuthProviders))
+		for name, provider := range f.OAuthProviders {
+			data.OAuthProviders[name] = OAuthProvider{
+				Name:        provider.Name,
+				Amount:      f.OAuthAmount(provider),
+				WaitSeconds: uint64(f.OAuthWaitPeriod(provider).Seconds()),
+			}
+		}
+	}
+
+	return ctx.Send(new(hr.HandlerResponse).Set(data).MustMarshall(), apirest.HTTPstatusOK)
+}
 
+// Returns the storage garbage collector counters
+func (f *Faucet) storageStatsHandler(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	data := f.Storage.GCStats()
 	return ctx.Send(new(hr.HandlerResponse).Set(data).MustMarshall(), apirest.HTTPstatusOK)
 }
 
@@ -94,6 +123,9 @@ func (f *Faucet) authOpenHandler(_ *apirest.APIdata, ctx *httprouter.HTTPContext
 		return ctx.Send(new(hr.HandlerResponse).SetError(errReason).MustMarshall(), hr.CodeErrFlood)
 	}
 	data, err := f.prepareFaucetPackage(addr, AuthTypeOpen)
+	if errors.Is(err, ErrDenylisted) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	}
 	if err != nil {
 		return err
 	}
@@ -115,6 +147,7 @@ func (f *Faucet) authOAuthHandler(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 		Code        string `json:"code"`
 		RedirectURL string `json:"redirectURL"`
 		Recipient   string `json:"recipient"`
+		State       string `json:"state"`
 	}
 	newRequest := r{}
 	if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
@@ -131,84 +164,103 @@ func (f *Faucet) authOAuthHandler(msg *apirest.APIdata, ctx *httprouter.HTTPCont
 	}
 
 	// Convert the provided "code" to an oAuth Token
-	providers, err := oauthhandler.InitProviders()
-	if err != nil {
+	if f.OAuthProviders == nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrInitProviders).MustMarshall(), hr.CodeErrInitProviders)
 	}
 
-	provider, ok := providers[newRequest.Provider]
+	provider, ok := f.OAuthProviders[newRequest.Provider]
 	if !ok {
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrOauthProviderNotFound).MustMarshall(), hr.CodeErrOauthProviderNotFound)
 	}
 
-	token, err := provider.GetOAuthToken(newRequest.Code, newRequest.RedirectURL)
+	// The state must be the one issued for this recipient, and the state and code are used once
+	state, err := f.UseOAuthState(newRequest.State, newRequest.Code, newRequest.Provider, addr, newRequest.RedirectURL)
+	if errors.Is(err, ErrOAuthState) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrOauthInvalidState)
+	}
 	if err != nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrOauthProviderError).MustMarshall(), hr.CodeErrOauthProviderError)
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
 	}
 
-	profileRaw, err := provider.GetOAuthProfile(token)
+	token, err := provider.GetOAuthToken(newRequest.Code, state.RedirectURL, state.Verifier)
 	if err != nil {
-		log.Warnw("error obtaining the profile", "err", err)
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrOauthProviderError).MustMarshall(), hr.CodeErrOauthProviderError)
 	}
 
-	var profile map[string]interface{}
-	if err := json.Unmarshal(profileRaw, &profile); err != nil {
-		log.Warnw("error marshalling the profile", "err", err)
+	// The identity is the username field of the profile, or the claims of the verified ID token
+	fundedProfileField, err := provider.Identity(token, state.Nonce)
+	if err != nil {
+		log.Warnw("error obtaining the oauth identity", "provider", newRequest.Provider, "err", err)
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrOauthProviderError).MustMarshall(), hr.CodeErrOauthProviderError)
 	}
 
 	// Check if the oauth profile is already funded
-	fundedProfileField := profile[provider.UsernameField].(string)
 	fundedAuthType := "oauth_" + newRequest.Provider
 	if funded, t := f.Storage.CheckFundedUserWithWaitTime([]byte(fundedProfileField), fundedAuthType); funded {
 		errReason := fmt.Sprintf("user %s already funded, wait until %s", fundedProfileField, t)
 		return ctx.Send(new(hr.HandlerResponse).SetError(errReason).MustMarshall(), hr.CodeErrFlood)
 	}
 
-	data, err := f.prepareFaucetPackage(addr, AuthTypeOauth)
+	// The amount and wait period are the ones of the provider, if configured
+	data, err := f.IssueFaucetPackage(addr, f.OAuthAmount(provider), AuthTypeOauth, "")
+	if errors.Is(err, ErrDenylisted) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Add address and profile to the funded list
-	if err := f.Storage.AddFundedUserWithWaitTime(addr.Bytes(), AuthTypeOauth); err != nil {
+	waitUntil := time.Now().Add(f.OAuthWaitPeriod(provider))
+	if err := f.Storage.AddFundedUserUntil(addr.Bytes(), AuthTypeOauth, waitUntil); err != nil {
 		return err
 	}
-	if err := f.Storage.AddFundedUserWithWaitTime([]byte(fundedProfileField), fundedAuthType); err != nil {
+	if err := f.Storage.AddFundedUserUntil([]byte(fundedProfileField), fundedAuthType, waitUntil); err != nil {
 		return err
 	}
 
 	return ctx.Send(new(hr.HandlerResponse).Set(data).MustMarshall(), apirest.HTTPstatusOK)
 }
 
-// oAuth Faucet handler (returns the oAuth URL)
+// oAuth Faucet handler (returns the oAuth URL). The state of the authorization is created by
+// the faucet, bound to the recipient, and must be sent back with the code to claim.
 func (f *Faucet) authOAuthUrl(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
-	providers, err := oauthhandler.InitProviders()
-	if err != nil {
+	if f.OAuthProviders == nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrInitProviders).MustMarshall(), hr.CodeErrInitProviders)
 	}
 
 	type r struct {
 		Provider    string `json:"provider"`
 		RedirectURL string `json:"redirectURL"`
-		State       string `json:"state"`
+		Recipient   string `json:"recipient"`
 	}
 	newAuthUrlRequest := r{}
 	if err := json.Unmarshal(msg.Data, &newAuthUrlRequest); err != nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
 	}
+	addr, err := helpers.StringToAddress(newAuthUrlRequest.Recipient)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
 
-	provider, ok := providers[newAuthUrlRequest.Provider]
-	if !ok {
+	state, authURL, err := f.StartOAuth(newAuthUrlRequest.Provider, addr, newAuthUrlRequest.RedirectURL)
+	if errors.Is(err, ErrOAuthProviderNotFound) {
 		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrOauthProviderNotFound).MustMarshall(), hr.CodeErrOauthProviderNotFound)
 	}
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
 
 	type urlResponse struct {
-		Url string `json:"url"`
-	}
-	authURL := urlResponse{Url: provider.GetAuthURL(newAuthUrlRequest.RedirectURL, newAuthUrlRequest.State)}
-	return ctx.Send(new(hr.HandlerResponse).Set(authURL).MustMarshall(), apirest.HTTPstatusOK)
+		Url       string    `json:"url"`
+		State     string    `json:"state"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(urlResponse{
+		Url:       authURL,
+		State:     state.State,
+		ExpiresAt: state.ExpiresAt,
+	}).MustMarshall(), apirest.HTTPstatusOK)
 }
 
 func (f *Faucet) authAragonDaoHandler(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
@@ -260,6 +312,9 @@ func (f *Faucet) authAragonDaoHandler(msg *apirest.APIdata, ctx *httprouter.HTTP
 	}
 
 	data, err := f.prepareFaucetPackage(addr, AuthTypeAragonDao)
+	if errors.Is(err, ErrDenylisted) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	}
 	if err != nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
 	}
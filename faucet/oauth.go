@@ -0,0 +1,129 @@
+package faucet
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/oauthhandler"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+// OAuthStateTTL is the time an OAuth authorization must be claimed in, once its URL is built.
+const OAuthStateTTL = 10 * time.Minute
+
+// ErrOAuthProviderNotFound is returned when the OAuth provider is not configured.
+var ErrOAuthProviderNotFound = errors.New("oauth provider not found")
+
+// ErrOAuthState is returned when an OAuth claim does not match an authorization started by
+// the faucet, or the authorization was already claimed or expired.
+var ErrOAuthState = errors.New("invalid oauth state")
+
+// OAuthAmount returns the tokens of a claim with the given provider, its own amount, or the
+// amount of the oauth auth type if unset.
+func (f *Faucet) OAuthAmount(provider *oauthhandler.Provider) uint64 {
+	if provider.Amount > 0 {
+		return provider.Amount
+	}
+	return f.AuthTypes[AuthTypeOauth]
+}
+
+// OAuthWaitPeriod returns the wait between claims with the given provider, its own wait
+// period, or the wait period of the faucet if unset.
+func (f *Faucet) OAuthWaitPeriod(provider *oauthhandler.Provider) time.Duration {
+	if provider.WaitPeriod > 0 {
+		return provider.WaitPeriod
+	}
+	return f.WaitPeriod
+}
+
+// StartOAuth starts an OAuth authorization of the given provider for the recipient. It stores
+// a random state and PKCE code verifier, so only the claim of this authorization, for the
+// same recipient, is accepted, and returns the state and the authorization URL.
+func (f *Faucet) StartOAuth(providerName string, recipient common.Address, redirectURL string) (*storage.OAuthState, string, error) {
+	provider, ok := f.OAuthProviders[providerName]
+	if !ok {
+		return nil, "", ErrOAuthProviderNotFound
+	}
+	state, err := oauthhandler.NewRandomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	verifier, err := oauthhandler.NewRandomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	var nonce string
+	if provider.Kind == oauthhandler.KindOIDC {
+		if nonce, err = oauthhandler.NewRandomToken(); err != nil {
+			return nil, "", err
+		}
+	}
+	now := time.Now()
+	s := &storage.OAuthState{
+		State:       state,
+		Provider:    providerName,
+		Recipient:   recipient.Hex(),
+		Verifier:    verifier,
+		Nonce:       nonce,
+		RedirectURL: redirectURL,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(OAuthStateTTL),
+	}
+	if err := f.Storage.SetOAuthState(s); err != nil {
+		return nil, "", err
+	}
+	return s, provider.GetAuthURL(redirectURL, state, verifier, nonce), nil
+}
+
+// UseOAuthState checks that the claim of the given code matches the OAuth authorization with
+// the given state, and marks both the state and the code as used, so they cannot be claimed
+// again. An empty redirect URL is the one of the authorization. It returns the state, whose
+// code verifier is sent with the code to the provider, or an error wrapping ErrOAuthState.
+func (f *Faucet) UseOAuthState(state, code, providerName string, recipient common.Address,
+	redirectURL string,
+) (*storage.OAuthState, error) {
+	if state == "" || code == "" {
+		return nil, fmt.Errorf("%w: missing state or code", ErrOAuthState)
+	}
+	f.oauthLock.Lock()
+	defer f.oauthLock.Unlock()
+	s, err := f.Storage.OAuthState(state)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("%w: unknown state", ErrOAuthState)
+	}
+	if err != nil {
+		return nil, err
+	}
+	codeHash := fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+	used, err := f.Storage.CheckOAuthCode(codeHash)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !s.UsedAt.IsZero():
+		return nil, fmt.Errorf("%w: state already used", ErrOAuthState)
+	case used:
+		return nil, fmt.Errorf("%w: code already used", ErrOAuthState)
+	case time.Now().After(s.ExpiresAt):
+		return nil, fmt.Errorf("%w: state expired", ErrOAuthState)
+	case s.Provider != providerName:
+		return nil, fmt.Errorf("%w: state issued for another provider", ErrOAuthState)
+	case s.Recipient != recipient.Hex():
+		return nil, fmt.Errorf("%w: state issued for another recipient", ErrOAuthState)
+	case redirectURL != "" && s.RedirectURL != redirectURL:
+		return nil, fmt.Errorf("%w: state issued for another redirect URL", ErrOAuthState)
+	}
+	// the state and the code are used before the token request, so a failed or concurrent
+	// claim cannot be retried with them
+	s.UsedAt = time.Now()
+	if err := f.Storage.SetOAuthState(s); err != nil {
+		return nil, err
+	}
+	if err := f.Storage.AddOAuthCode(codeHash); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,97 @@
+package faucet
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/oauthhandler"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+func TestOAuthState(t *testing.T) {
+	st := storage.NewMemory(time.Hour)
+	f := &Faucet{
+		Storage: st,
+		OAuthProviders: map[string]*oauthhandler.Provider{
+			"github": {AuthURL: "https://github.com/login/oauth/authorize", ClientID: "id"},
+		},
+	}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	other := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	redirectURL := "https://example.com/callback"
+
+	if _, _, err := f.StartOAuth("unknown", addr, redirectURL); !errors.Is(err, ErrOAuthProviderNotFound) {
+		t.Fatalf("expected provider not found, got %v", err)
+	}
+	state, authURL, err := f.StartOAuth("github", addr, redirectURL)
+	if err != nil {
+		t.Fatalf("failed to start oauth: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid auth url %s: %v", authURL, err)
+	}
+	if q := u.Query(); q.Get("state") != state.State || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") != oauthhandler.CodeChallenge(state.Verifier) {
+		t.Fatalf("unexpected auth url %s", authURL)
+	}
+
+	// the claim must match the authorization, and mismatches do not use the state
+	for name, claim := range map[string]struct {
+		state, provider string
+		recipient       common.Address
+		redirectURL     string
+	}{
+		"unknown state":      {"unknown", "github", addr, redirectURL},
+		"other provider":     {state.State, "google", addr, redirectURL},
+		"other recipient":    {state.State, "github", other, redirectURL},
+		"other redirect URL": {state.State, "github", addr, "https://example.com/other"},
+	} {
+		if _, err := f.UseOAuthState(claim.state, "code_1", claim.provider, claim.recipient, claim.redirectURL); !errors.Is(err, ErrOAuthState) {
+			t.Fatalf("%s: expected invalid state, got %v", name, err)
+		}
+	}
+	used, err := f.UseOAuthState(state.State, "code_1", "github", addr, "")
+	if err != nil || used.Verifier != state.Verifier || used.RedirectURL != redirectURL {
+		t.Fatalf("unexpected used state %+v (%v)", used, err)
+	}
+
+	// states and codes are used once
+	if _, err := f.UseOAuthState(state.State, "code_2", "github", addr, redirectURL); !errors.Is(err, ErrOAuthState) {
+		t.Fatalf("expected reused state error, got %v", err)
+	}
+	state, _, err = f.StartOAuth("github", addr, redirectURL)
+	if err != nil {
+		t.Fatalf("failed to start oauth: %v", err)
+	}
+	if _, err := f.UseOAuthState(state.State, "code_1", "github", addr, redirectURL); !errors.Is(err, ErrOAuthState) {
+		t.Fatalf("expected reused code error, got %v", err)
+	}
+
+	// expired states are refused
+	state.ExpiresAt = time.Now().Add(-time.Second)
+	if err := st.SetOAuthState(state); err != nil {
+		t.Fatalf("failed to set oauth state: %v", err)
+	}
+	if _, err := f.UseOAuthState(state.State, "code_3", "github", addr, redirectURL); !errors.Is(err, ErrOAuthState) {
+		t.Fatalf("expected expired state error, got %v", err)
+	}
+}
+
+func TestOAuthProviderLimits(t *testing.T) {
+	f := &Faucet{
+		AuthTypes:  map[string]uint64{AuthTypeOauth: 100},
+		WaitPeriod: time.Hour,
+	}
+	github := &oauthhandler.Provider{Amount: 500, WaitPeriod: 24 * time.Hour}
+	facebook := &oauthhandler.Provider{}
+	if amount, wait := f.OAuthAmount(github), f.OAuthWaitPeriod(github); amount != 500 || wait != 24*time.Hour {
+		t.Fatalf("unexpected provider amount %d and wait period %s", amount, wait)
+	}
+	if amount, wait := f.OAuthAmount(facebook), f.OAuthWaitPeriod(facebook); amount != 100 || wait != time.Hour {
+		t.Fatalf("unexpected default amount %d and wait period %s", amount, wait)
+	}
+}
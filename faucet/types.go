@@ -4,6 +4,16 @@ package faucet
 type AuthTypes struct {
 	AuthTypes   map[string]uint64 `json:"auth"`
 	WaitSeconds uint64            `json:"waitSeconds"`
+	// OAuthProviders are the effective amount and wait period of the claims of each oauth
+	// provider, by name.
+	OAuthProviders map[string]OAuthProvider `json:"oauthProviders,omitempty"`
+}
+
+// OAuthProvider is a struct to return the amount and wait period of an oauth provider.
+type OAuthProvider struct {
+	Name        string `json:"name"`
+	Amount      uint64 `json:"amount"`
+	WaitSeconds uint64 `json:"waitSeconds"`
 }
 
 const (
@@ -11,6 +21,11 @@ const (
 	AuthTypeOauth     = "oauth"
 	AuthTypeAragonDao = "aragondao"
 	AuthTypeStripe    = "stripe"
+	AuthTypeERC20     = "erc20"
+	AuthTypeReferral  = "referral"
+	// AuthTypeStripeSubscription is the auth type of the packages claimed from the allowance
+	// of Stripe subscriptions, recorded apart from the Stripe checkouts.
+	AuthTypeStripeSubscription = "stripeSubscription"
 )
 
 type ErrorResponse struct {
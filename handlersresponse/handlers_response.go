@@ -21,6 +21,25 @@ const (
 	ReasonErrAragonDaoAddress      = "could not find the signer address in any Aragon DAO"
 	CodeErrProviderError           = 410
 	ReasonErrProviderError         = "error obtaining the oAuthToken"
+	CodeErrDenylisted              = 411
+	ReasonErrDenylisted            = "address is denylisted"
+	CodeErrQuantityOutOfRange      = 412
+	CodeErrDailyLimitExceeded      = 413
+	CodeErrReferralCodeTaken       = 414
+	CodeErrReferrerNotFound        = 415
+	ReasonErrReferrerNotFound      = "referrer not found"
+	CodeErrNothingToClaim          = 416
+	CodeErrGiftNotFound            = 417
+	CodeErrGiftExpired             = 418
+	CodeErrGiftNotAvailable        = 419
+	CodeErrInsufficientFunds       = 420
+	ReasonErrInsufficientFunds     = "not enough faucet funds for this purchase, try a smaller amount or later"
+	CodeErrSignature               = 421
+	CodeErrPurchaseNotFound        = 422
+	ReasonErrPurchaseNotFound      = "purchase not found"
+	CodeErrSubscriptionNotFound    = 423
+	CodeErrUnknownCurrency         = 424
+	CodeErrOauthInvalidState       = 425
 )
 
 // HandlerResponse is the response format for the Handlers
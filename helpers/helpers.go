@@ -1,8 +1,14 @@
 package helpers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"go.vocdoni.io/dvote/api"
+	"go.vocdoni.io/dvote/crypto/ethereum"
 )
 
 func StringToAddress(addr string) (common.Address, error) {
@@ -11,3 +17,27 @@ func StringToAddress(addr string) (common.Address, error) {
 	}
 	return common.HexToAddress(addr), nil
 }
+
+// VerifySignedRequest returns the address that signed the given data, which must be a JSON
+// object with the expected message and the unix timestamp of the request, no older than maxAge.
+func VerifySignedRequest(data string, signature []byte, message string, maxAge time.Duration) (common.Address, error) {
+	addr, err := ethereum.AddrFromSignature([]byte(data), signature)
+	if err != nil {
+		return addr, err
+	}
+	signatureData := struct {
+		Message   string `json:"message"`
+		Timestamp int64  `json:"timestamp"`
+	}{}
+	if err := json.Unmarshal([]byte(data), &signatureData); err != nil {
+		return addr, err
+	}
+	if signatureData.Message != message {
+		return addr, fmt.Errorf("signed message is not %q", message)
+	}
+	age := time.Since(time.Unix(signatureData.Timestamp, 0))
+	if age > maxAge || age < -maxAge {
+		return addr, errors.New("signature timestamp is too old")
+	}
+	return addr, nil
+}
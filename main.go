@@ -2,19 +2,30 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/vocdoni/vocfaucet/erc20handler"
 	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/oauthhandler"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/reconcile"
+	"github.com/vocdoni/vocfaucet/referral"
 	"github.com/vocdoni/vocfaucet/storage"
 	"github.com/vocdoni/vocfaucet/stripehandler"
+	"go.vocdoni.io/dvote/apiclient"
 	"go.vocdoni.io/dvote/crypto/ethereum"
 	"go.vocdoni.io/dvote/db"
 	"go.vocdoni.io/dvote/httprouter"
@@ -27,6 +38,7 @@ var supportedAuthTypes = map[string]string{
 	"oauth":     "with oauth2 authentication",
 	"aragondao": "signed message from addresses belonging to at least one aragon dao",
 	"stripe":    "with stripe payment",
+	"erc20":     "with erc20 stablecoin payment",
 }
 
 func main() {
@@ -39,11 +51,71 @@ func main() {
 	flag.String("privKey", "", "private key for the faucet signer (hexadecimal)")
 	flag.String("auth", "open", "authentication types to use (comma separated): open, oauth")
 	flag.String("amounts", "100", "tokens to send per request (comma separated), the order must match the auth types")
+	flag.String("oauthConfig", oauthhandler.DefaultConfigPath, "path of the oauth providers configuration file "+
+		"(relative paths not found in the working directory are looked up next to the executable)")
 	flag.Duration("waitPeriod", 1*time.Hour, "wait period between requests for the same user")
-	flag.StringP("dbType", "t", db.TypePebble, fmt.Sprintf("key-value db type [%s,%s,%s]", db.TypePebble, db.TypeLevelDB, db.TypeMongo))
+	flag.Duration("retentionPeriod", 7*24*time.Hour, "time to keep expired entries in the database before removing them")
+	flag.Duration("gcInterval", 1*time.Hour, "interval between database garbage collection runs")
+	flag.StringP("dbType", "t", db.TypePebble, fmt.Sprintf("db type [%s,%s,%s,%s,%s,%s]",
+		db.TypePebble, db.TypeLevelDB, db.TypeMongo, storage.TypeSQLite, storage.TypePostgres, storage.TypeMemory))
+	flag.Uint64("budget", 0, "max tokens issued per budget period (0 means no limit)")
+	flag.Duration("budgetPeriod", 24*time.Hour, "period of the tokens budget")
+	flag.String("adminToken", "", "bearer token of the admin API endpoints (disabled if empty)")
+	flag.String("vochainAPI", "", "vochain API URL used to check the signer balance before accepting purchases (disabled if empty)")
 	flag.String("stripeKey", "", "stripe secret key")
 	flag.String("stripeProductID", "", "stripe price id")
 	flag.String("stripeWebhookSecret", "", "stripe webhook secret key")
+	flag.String("stripeAPIURL", "", "URL of the stripe API, such as a local mock server (the stripe API if empty)")
+	flag.Bool("stripeFake", false, "use a local fake stripe backend instead of the stripe API, for offline "+
+		"end-to-end testing (checkout sessions are paid with POST {baseRoute}/stripeFake/pay/{sessionID}, only with an empty or sk_test_ stripeKey)")
+	flag.Uint64("stripeMinQuantity", 0, "min number of tokens per stripe purchase (0 means no limit)")
+	flag.Uint64("stripeMaxQuantity", 0, "max number of tokens per stripe purchase (0 means no limit)")
+	flag.Uint64("stripeDailyLimit", 0, "max number of tokens bought with stripe per recipient, buyer and UTC day (0 means no limit)")
+	flag.String("stripePriceTiers", "", "local stripe price tiers as minQuantity:unitPrice pairs, such as 1:10,100:8, "+
+		"or by currency, such as eur=1:10,100:8;usd=1:11,100:9 (unit prices in the smallest currency unit, "+
+		"the stripe product prices are used if empty)")
+	flag.String("stripeCurrency", "eur", "default stripe checkout currency, used when the client currency cannot be determined")
+	flag.Duration("stripePriceCacheTTL", stripehandler.DefaultPriceCacheTTL, "time the stripe price tiers are cached for")
+	flag.String("stripeAlertURL", "", "URL to post stripe refund and dispute alerts to, such as a Slack webhook")
+	flag.Duration("stripeGiftTTL", payment.DefaultGiftTTL, "time a paid stripe gift can be redeemed for")
+	flag.String("stripePaymentLinks", "", "accepted stripe payment links as paymentLinkID:tokens pairs, such as plink_1:100,plink_2:1000")
+	flag.Uint64("stripeSubscriptionRollover", 0, "unused monthly allowances carried over by the stripe subscriptions (0 disables the rollover)")
+	flag.String("stripeGiftURL", "", "base URL of the gift claim links, which are GiftURL/{id}/{token}")
+	flag.Int("webhookWorkers", payment.DefaultWebhookWorkers, "webhook events processed at the same time "+
+		"from the webhook queue (0 processes them as they are received, without queue)")
+	flag.Int("webhookMaxAttempts", payment.DefaultWebhookMaxAttempts, "attempts to process a webhook event before it is dead-lettered")
+	flag.Duration("webhookRetryDelay", payment.DefaultWebhookRetryDelay, "delay before retrying a failed webhook event, doubled on every retry")
+	flag.String("erc20RPC", "", "JSON-RPC endpoint of the chain of the erc20 payment token")
+	flag.String("erc20Token", "", "address of the erc20 payment token")
+	flag.Uint8("erc20Decimals", 6, "decimals of the erc20 payment token")
+	flag.String("erc20Receiver", "", "address that receives the erc20 payments")
+	flag.Uint64("erc20Confirmations", 12, "blocks on top of an erc20 payment needed to accept it")
+	flag.Uint64("erc20LookbackBlocks", 50000, "blocks to look back for erc20 payments, at most since their checkout was created")
+	flag.String("erc20PriceTiers", "", "erc20 price tiers as minQuantity:unitPrice pairs, such as 1:10,100:8 (unit prices in cents)")
+	flag.String("erc20Currency", "usdc", "currency of the erc20 price tiers")
+	flag.Uint64("referralPercent", 0, "percentage of the tokens bought earned by the referrer (0 disables referrals)")
+	// commands flags, they are not stored in the config file
+	dumpFile := flag.String("dumpFile", "", "dump file to write or read (export and import commands)")
+	dumpFormat := flag.String("dumpFormat", storage.DumpFormatJSON,
+		fmt.Sprintf("dump file format [%s,%s] (export and import commands)", storage.DumpFormatJSON, storage.DumpFormatCBOR))
+	toDbType := flag.String("toDbType", "", fmt.Sprintf("destination key-value db type [%s,%s,%s] (migrate command)",
+		db.TypePebble, db.TypeLevelDB, db.TypeMongo))
+	toDataDir := flag.String("toDataDir", "", "destination data directory (migrate command)")
+	overwrite := flag.Bool("overwrite", false, "allow importing into a non empty database (import and migrate commands)")
+	from := flag.String("from", "", "first day of the report, as 2006-01-02 (reconcile command)")
+	to := flag.String("to", "", "last day of the report, as 2006-01-02 (reconcile command)")
+	reportFile := flag.String("reportFile", "", "report file to write, the standard output if empty (reconcile command)")
+	reportFormat := flag.String("reportFormat", reconcile.FormatCSV,
+		fmt.Sprintf("report format [%s,%s] (reconcile command)", reconcile.FormatCSV, reconcile.FormatJSON))
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+		for _, c := range storageCommands {
+			fmt.Fprintf(os.Stderr, "  %-10s%s\n", c.name, c.description)
+		}
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", "reconcile", "write the stripe reconciliation report of the --from and --to dates")
+		fmt.Fprintf(os.Stderr, "\nWithout command, the faucet API is started.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Setting up viper
@@ -87,12 +159,33 @@ func main() {
 	if err := viper.BindPFlag("amounts", flag.Lookup("amounts")); err != nil {
 		panic(err)
 	}
+	if err := viper.BindPFlag("oauthConfig", flag.Lookup("oauthConfig")); err != nil {
+		panic(err)
+	}
 	if err := viper.BindPFlag("waitPeriod", flag.Lookup("waitPeriod")); err != nil {
 		panic(err)
 	}
+	if err := viper.BindPFlag("retentionPeriod", flag.Lookup("retentionPeriod")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("gcInterval", flag.Lookup("gcInterval")); err != nil {
+		panic(err)
+	}
 	if err := viper.BindPFlag("dbType", flag.Lookup("dbType")); err != nil {
 		panic(err)
 	}
+	if err := viper.BindPFlag("budget", flag.Lookup("budget")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("budgetPeriod", flag.Lookup("budgetPeriod")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("adminToken", flag.Lookup("adminToken")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("vochainAPI", flag.Lookup("vochainAPI")); err != nil {
+		panic(err)
+	}
 	if err := viper.BindPFlag("stripeKey", flag.Lookup("stripeKey")); err != nil {
 		panic(err)
 	}
@@ -102,6 +195,65 @@ func main() {
 	if err := viper.BindPFlag("stripeWebhookSecret", flag.Lookup("stripeWebhookSecret")); err != nil {
 		panic(err)
 	}
+	if err := viper.BindPFlag("stripeAPIURL", flag.Lookup("stripeAPIURL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeFake", flag.Lookup("stripeFake")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeMinQuantity", flag.Lookup("stripeMinQuantity")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeMaxQuantity", flag.Lookup("stripeMaxQuantity")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeDailyLimit", flag.Lookup("stripeDailyLimit")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripePriceTiers", flag.Lookup("stripePriceTiers")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeCurrency", flag.Lookup("stripeCurrency")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripePriceCacheTTL", flag.Lookup("stripePriceCacheTTL")); err != nil {
+		panic(err)
+	}
+	for _, name := range []string{
+		"erc20RPC", "erc20Token", "erc20Decimals", "erc20Receiver",
+		"erc20Confirmations", "erc20LookbackBlocks", "erc20PriceTiers", "erc20Currency",
+	} {
+		if err := viper.BindPFlag(name, flag.Lookup(name)); err != nil {
+			panic(err)
+		}
+	}
+	if err := viper.BindPFlag("stripeAlertURL", flag.Lookup("stripeAlertURL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeGiftTTL", flag.Lookup("stripeGiftTTL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeGiftURL", flag.Lookup("stripeGiftURL")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripePaymentLinks", flag.Lookup("stripePaymentLinks")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("stripeSubscriptionRollover", flag.Lookup("stripeSubscriptionRollover")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("webhookWorkers", flag.Lookup("webhookWorkers")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("webhookMaxAttempts", flag.Lookup("webhookMaxAttempts")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("webhookRetryDelay", flag.Lookup("webhookRetryDelay")); err != nil {
+		panic(err)
+	}
+	if err := viper.BindPFlag("referralPercent", flag.Lookup("referralPercent")); err != nil {
+		panic(err)
+	}
 
 	// check if config file exists
 	_, err := os.Stat(path.Join(dataDir, "faucet.yml"))
@@ -139,10 +291,36 @@ func main() {
 	amounts := viper.GetString("amounts")
 
 	waitPeriod := viper.GetDuration("waitPeriod")
+	oauthConfig := viper.GetString("oauthConfig")
+	retentionPeriod := viper.GetDuration("retentionPeriod")
+	gcInterval := viper.GetDuration("gcInterval")
 	dbType := viper.GetString("dbType")
+	budget := viper.GetUint64("budget")
+	budgetPeriod := viper.GetDuration("budgetPeriod")
+	adminToken := viper.GetString("adminToken")
+	vochainAPI := viper.GetString("vochainAPI")
 	stripeKey := viper.GetString("stripeKey")
 	stripeProductID := viper.GetString("stripeProductID")
 	stripeWebhookSecret := viper.GetString("stripeWebhookSecret")
+	stripeAPIURL := viper.GetString("stripeAPIURL")
+	stripeFake := viper.GetBool("stripeFake")
+	stripeAlertURL := viper.GetString("stripeAlertURL")
+	stripePriceCacheTTL := viper.GetDuration("stripePriceCacheTTL")
+	stripePriceTiers := viper.GetString("stripePriceTiers")
+	stripeCurrency := viper.GetString("stripeCurrency")
+	stripeGiftTTL := viper.GetDuration("stripeGiftTTL")
+	stripeGiftURL := viper.GetString("stripeGiftURL")
+	stripePaymentLinks := viper.GetString("stripePaymentLinks")
+	stripeSubscriptionRollover := viper.GetUint64("stripeSubscriptionRollover")
+	webhookWorkers := viper.GetInt("webhookWorkers")
+	webhookMaxAttempts := viper.GetInt("webhookMaxAttempts")
+	webhookRetryDelay := viper.GetDuration("webhookRetryDelay")
+	referralPercent := viper.GetUint64("referralPercent")
+	stripeLimits := stripehandler.PurchaseLimits{
+		MinQuantity: viper.GetUint64("stripeMinQuantity"),
+		MaxQuantity: viper.GetUint64("stripeMaxQuantity"),
+		DailyLimit:  viper.GetUint64("stripeDailyLimit"),
+	}
 
 	// parse auth types and amounts
 	authNames := strings.Split(auth, ",")
@@ -181,6 +359,51 @@ func main() {
 		log.Warnf("please send VOC tokens to %s", signer.AddressString())
 	}
 
+	if stripeAPIURL != "" {
+		stripehandler.SetAPIURL(stripeAPIURL)
+		log.Warnw("stripe API requests sent to a custom URL", "url", stripeAPIURL)
+	}
+
+	// run the reconcile or storage command, if any, instead of the faucet API
+	if cmd := flag.Arg(0); cmd == "reconcile" {
+		if privKey == "" {
+			log.Fatal("privKey is required to locate the faucet database")
+		}
+		if err := runReconcileCommand(&reconcileCommandConfig{
+			dbType:       dbType,
+			dataDir:      dataDir,
+			waitPeriod:   waitPeriod,
+			dbPrefix:     signer.Address().Bytes()[:8],
+			stripeKey:    stripeKey,
+			paymentLinks: stripePaymentLinks,
+			from:         *from,
+			to:           *to,
+			reportFile:   *reportFile,
+			reportFormat: *reportFormat,
+		}); err != nil {
+			log.Fatalf("%s command failed: %v", cmd, err)
+		}
+		return
+	} else if cmd != "" {
+		if privKey == "" {
+			log.Fatal("privKey is required to locate the faucet database")
+		}
+		if err := runStorageCommand(cmd, &storageCommandConfig{
+			dbType:     dbType,
+			dataDir:    dataDir,
+			waitPeriod: waitPeriod,
+			dbPrefix:   signer.Address().Bytes()[:8],
+			dumpFile:   *dumpFile,
+			dumpFormat: *dumpFormat,
+			toDbType:   *toDbType,
+			toDataDir:  *toDataDir,
+			overwrite:  *overwrite,
+		}); err != nil {
+			log.Fatalf("%s command failed: %v", cmd, err)
+		}
+		return
+	}
+
 	// init HTTP router
 	var httpRouter httprouter.HTTProuter
 	httpRouter.TLSdomain = tlsDomain
@@ -190,19 +413,61 @@ func main() {
 	}
 
 	// init storage
-	storage, err := storage.New(dbType, dataDir, waitPeriod, signer.Address().Bytes()[:8])
+	storage, err := storage.Open(dbType, dataDir, waitPeriod, signer.Address().Bytes()[:8])
 	if err != nil {
 		log.Fatal(err)
 	}
+	if gcInterval > 0 {
+		storage.StartGarbageCollector(gcInterval, retentionPeriod)
+	}
 	// create the faucet instance
 	f := faucet.Faucet{
-		Signer:     &signer,
-		AuthTypes:  authTypes,
-		WaitPeriod: waitPeriod,
-		Storage:    storage,
+		Signer:       &signer,
+		AuthTypes:    authTypes,
+		WaitPeriod:   waitPeriod,
+		Storage:      storage,
+		Budget:       budget,
+		BudgetPeriod: budgetPeriod,
+	}
+	if vochainAPI != "" {
+		if f.Balance, err = signerBalance(vochainAPI, signer.Address()); err != nil {
+			log.Fatalf("vochain API initialization error: %s", err)
+		}
+		log.Infow("purchases limited to the signer balance", "api", vochainAPI)
+	}
+	if f.AuthTypes[faucet.AuthTypeOauth] > 0 {
+		if f.OAuthProviders, err = oauthhandler.LoadProviders(oauthConfig); err != nil {
+			log.Fatalf("oauth initialization error: %s", err)
+		}
+		names := make([]string, 0, len(f.OAuthProviders))
+		for name := range f.OAuthProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Infow("oauth providers loaded", "config", oauthConfig, "providers", names)
+		for _, name := range names {
+			provider := f.OAuthProviders[name]
+			log.Infow("oauth provider", "provider", name, "amount", f.OAuthAmount(provider),
+				"waitPeriod", f.OAuthWaitPeriod(provider))
+		}
 	}
 	var s *stripehandler.StripeHandler
 	if amount := f.AuthTypes[faucet.AuthTypeStripe]; amount > 0 {
+		if stripeFake {
+			if err := checkFakeStripeKey(stripeKey); err != nil {
+				log.Fatalf("stripe initialization error: %s", err)
+			}
+			// the fake backend needs no account, but the same configuration as the real one
+			if stripeKey == "" {
+				stripeKey = "sk_test_fake"
+			}
+			if stripeProductID == "" {
+				stripeProductID = "prod_fake"
+			}
+			if stripeWebhookSecret == "" {
+				stripeWebhookSecret = "whsec_fake"
+			}
+		}
 		s, err = stripehandler.NewStripeClient(
 			stripeKey,
 			stripeProductID,
@@ -211,13 +476,75 @@ func main() {
 			&f,
 			storage,
 		)
+		if err == nil {
+			err = stripeLimits.Validate()
+		}
+		if err == nil && stripePriceTiers != "" {
+			s.LocalPrices, err = pricing.ParseCatalog(stripeCurrency, stripePriceTiers)
+		}
+		if err == nil {
+			s.PaymentLinks, err = stripehandler.ParsePaymentLinks(stripePaymentLinks)
+		}
 		if err != nil {
 			log.Fatalf("stripe initialization error: %s", err)
 		} else {
+			s.AlertURL = stripeAlertURL
+			s.Limits = stripeLimits
+			s.PriceCacheTTL = stripePriceCacheTTL
+			s.DefaultCurrency = stripeCurrency
+			s.Fulfiller.GiftTTL = stripeGiftTTL
+			s.GiftURL = stripeGiftURL
+			s.SubscriptionRollover = stripeSubscriptionRollover
+			if stripeFake {
+				fakeTiers := stripePriceTiers
+				if fakeTiers == "" {
+					fakeTiers = stripehandler.DefaultFakePrices
+				}
+				fakePrices, err := pricing.ParseCatalog(stripeCurrency, fakeTiers)
+				if err != nil {
+					log.Fatalf("stripe initialization error: %s", err)
+				}
+				fake := stripehandler.NewFakeBackend(fakePrices)
+				fake.CheckoutURL = fmt.Sprintf("http://localhost:%d%s/stripeFake/pay", listenPort, baseRoute)
+				s.UseFakeBackend(fake)
+				log.Warnw("stripe API requests sent to the local fake backend", "checkoutURL", fake.CheckoutURL)
+			}
+			if webhookWorkers > 0 {
+				q := payment.NewWebhookQueue(storage)
+				q.Workers = webhookWorkers
+				q.MaxAttempts = webhookMaxAttempts
+				q.RetryDelay = webhookRetryDelay
+				s.SetWebhookQueue(q)
+				q.Start()
+			}
 			log.Infof("stripe enabled with price id %s", stripeProductID)
 		}
 	}
 
+	var e *erc20handler.ERC20Handler
+	if amount := f.AuthTypes[faucet.AuthTypeERC20]; amount > 0 {
+		e, err = newERC20Handler(viper, int64(amount), &f, storage)
+		if err != nil {
+			log.Fatalf("erc20 initialization error: %s", err)
+		}
+		log.Infow("erc20 payments enabled", "token", e.Token.Hex(), "receiver", e.Receiver.Hex())
+	}
+
+	var r *referral.Program
+	if referralPercent > 0 {
+		r, err = referral.NewProgram(&f, storage, referralPercent)
+		if err != nil {
+			log.Fatalf("referral initialization error: %s", err)
+		}
+		if s != nil {
+			s.Fulfiller.Hooks = append(s.Fulfiller.Hooks, r)
+		}
+		if e != nil {
+			e.Fulfiller.Hooks = append(e.Fulfiller.Hooks, r)
+		}
+		log.Infow("referrals enabled", "percent", referralPercent)
+	}
+
 	// init API
 	api, err := apirest.NewAPI(&httpRouter, baseRoute)
 	if err != nil {
@@ -225,8 +552,7 @@ func main() {
 	}
 
 	// register handlers
-	f.RegisterHandlers(api)
-	s.RegisterHandlers(api)
+	registerHandlers(api, adminToken, &f, s, e, r)
 	log.Infof("API available at %s", baseRoute)
 	log.Info("startup complete")
 	// close if interrupt received
@@ -236,3 +562,94 @@ func main() {
 	log.Warnf("received SIGTERM, exiting at %s", time.Now().Format(time.RFC850))
 	os.Exit(0)
 }
+
+// checkFakeStripeKey returns an error if the given Stripe key is not empty nor a test one. The
+// fake backend pays any checkout on request, so it must never run along a live account.
+func checkFakeStripeKey(key string) error {
+	if key != "" && !strings.HasPrefix(key, "sk_test_") {
+		return fmt.Errorf("the fake stripe backend requires an empty or test (sk_test_) key")
+	}
+	return nil
+}
+
+// registerHandlers registers the URLs of the faucet and of the enabled handlers, which are nil
+// if disabled. The admin handlers are only registered with an admin token, since they would be
+// open to anyone with an empty one.
+func registerHandlers(api *apirest.API, adminToken string, f *faucet.Faucet, s *stripehandler.StripeHandler,
+	e *erc20handler.ERC20Handler, r *referral.Program,
+) {
+	f.RegisterHandlers(api)
+	if s != nil {
+		s.RegisterHandlers(api)
+	}
+	if adminToken != "" {
+		api.SetAdminToken(adminToken)
+		f.RegisterAdminHandlers(api)
+		if s != nil {
+			s.RegisterAdminHandlers(api)
+		}
+	}
+	if e != nil {
+		e.RegisterHandlers(api)
+	}
+	if r != nil {
+		r.RegisterHandlers(api)
+	}
+}
+
+// newERC20Handler creates the erc20 payment provider from the erc20 flags.
+func newERC20Handler(v *viper.Viper, defaultAmount int64, f *faucet.Faucet, st storage.Storage) (*erc20handler.ERC20Handler, error) {
+	for _, name := range []string{"erc20Token", "erc20Receiver"} {
+		if !common.IsHexAddress(v.GetString(name)) {
+			return nil, fmt.Errorf("invalid %s address %q", name, v.GetString(name))
+		}
+	}
+	tiers, err := pricing.ParseTiers(v.GetString("erc20PriceTiers"))
+	if err != nil {
+		return nil, err
+	}
+	prices, err := pricing.NewTable(v.GetString("erc20Currency"), tiers)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ethclient.Dial(v.GetString("erc20RPC"))
+	if err != nil {
+		return nil, err
+	}
+	e, err := erc20handler.NewERC20Handler(
+		client,
+		common.HexToAddress(v.GetString("erc20Token")),
+		common.HexToAddress(v.GetString("erc20Receiver")),
+		uint8(v.GetUint("erc20Decimals")),
+		prices,
+		defaultAmount,
+		f,
+		st,
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.Confirmations = v.GetUint64("erc20Confirmations")
+	e.LookbackBlocks = v.GetUint64("erc20LookbackBlocks")
+	return e, nil
+}
+
+// signerBalance returns a function that gets the balance of the given signer from the given
+// vochain API.
+func signerBalance(apiURL string, signer common.Address) (func() (uint64, error), error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := apiclient.NewHTTPclient(u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func() (uint64, error) {
+		account, err := client.Account(signer.Hex())
+		if err != nil {
+			return 0, err
+		}
+		return account.Balance, nil
+	}, nil
+}
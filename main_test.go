@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/httprouter/apirest"
+)
+
+func TestRegisterHandlers(t *testing.T) {
+	var router httprouter.HTTProuter
+	if err := router.Init("127.0.0.1", 0); err != nil {
+		t.Fatalf("failed to init router: %v", err)
+	}
+	api, err := apirest.NewAPI(&router, "/v2")
+	if err != nil {
+		t.Fatalf("failed to create api: %v", err)
+	}
+	f := &faucet.Faucet{
+		AuthTypes:  map[string]uint64{faucet.AuthTypeOpen: 100},
+		WaitPeriod: time.Hour,
+		Storage:    storage.NewMemory(time.Hour),
+	}
+
+	// the default configuration starts with stripe, erc20 and referrals disabled, and their
+	// paths are unknown to the router, which only matches them for CORS preflight requests
+	registerHandlers(api, "admin_token", f, nil, nil, nil)
+
+	for _, c := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/v2/authTypes", "", http.StatusOK},
+		{http.MethodPost, "/v2/createCheckoutSession/0x00000000000000000000000000000000000000aa", "", http.StatusMethodNotAllowed},
+		// the storage stats are only given to the admin
+		{http.MethodGet, "/v2/storageStats", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v2/admin/storageStats", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v2/admin/storageStats", "admin_token", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		router.Mux.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Fatalf("unexpected status %d of %s %s, expected %d", rec.Code, c.method, c.path, c.want)
+		}
+	}
+}
+
+func TestCheckFakeStripeKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"":                true,
+		"sk_test_1234":    true,
+		"sk_live_1234":    false,
+		"rk_live_1234":    false,
+		"sk_testing_1234": false,
+	} {
+		if err := checkFakeStripeKey(key); (err == nil) != valid {
+			t.Fatalf("unexpected check of key %q: %v", key, err)
+		}
+	}
+}
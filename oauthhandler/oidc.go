@@ -0,0 +1,198 @@
+package oauthhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Provider kinds. OAuth2 providers take the identity from a field of the profile returned by
+// their profile URL, OpenID Connect providers from the claims of the verified ID token.
+const (
+	KindOAuth2 = "oauth2"
+	KindOIDC   = "oidc"
+)
+
+// DefaultIdentityClaims are the ID token claims the identity of OpenID Connect providers is
+// taken from, when none are configured.
+var DefaultIdentityClaims = []string{"sub"}
+
+// oidcHTTPClient is the client of the discovery and JWKS requests.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcKeysRefreshInterval is the minimum time between two fetches of the keys of an issuer
+// for tokens signed with an unknown key, so that such tokens cannot make the faucet fetch
+// them on every request.
+var oidcKeysRefreshInterval = time.Minute
+
+// oidcSigningAlgorithms are the ID token signature algorithms accepted, the asymmetric ones,
+// since the keys are taken from the public JWKS of the issuer.
+var oidcSigningAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// oidcDiscovery is the part of the OpenID Connect discovery document used by the faucet.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcKeys are the signing keys of an OpenID Connect issuer, fetched from its JWKS URI.
+type oidcKeys struct {
+	uri       string
+	keys      *jose.JSONWebKeySet
+	refreshed time.Time // When the keys were last fetched again.
+	lock      sync.Mutex
+}
+
+// Discover fetches the discovery document of the OpenID Connect issuer of the provider, and
+// sets its authorization and token URLs, unless configured, and its JWKS URI. The issuer of
+// the document must be the configured one.
+func (p *Provider) Discover() error {
+	var doc oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+	if doc.Issuer != p.Issuer {
+		return fmt.Errorf("discovery document of issuer %q for %q", doc.Issuer, p.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return errors.New("discovery document without jwks_uri")
+	}
+	if p.AuthURL == "" {
+		p.AuthURL = doc.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = doc.TokenEndpoint
+	}
+	p.keys = &oidcKeys{uri: doc.JWKSURI}
+	if _, err := p.keys.get(false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// get returns the signing keys of the issuer, fetched again if refresh is set, such as when
+// a token is signed with an unknown key after the issuer rotated them. They are fetched again
+// at most once per oidcKeysRefreshInterval, the current ones are returned otherwise.
+func (k *oidcKeys) get(refresh bool) (*jose.JSONWebKeySet, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys != nil && (!refresh || time.Since(k.refreshed) < oidcKeysRefreshInterval) {
+		return k.keys, nil
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := getJSON(k.uri, keys); err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	if k.keys != nil {
+		k.refreshed = time.Now()
+	}
+	k.keys = keys
+	return keys, nil
+}
+
+// VerifyIDToken verifies the signature of the given ID token with the keys of the issuer, and
+// its issuer, audience, expiry and nonce, and returns its claims.
+func (p *Provider) VerifyIDToken(idToken, nonce string) (map[string]any, error) {
+	if p.keys == nil {
+		return nil, errors.New("provider issuer not discovered")
+	}
+	token, err := jwt.ParseSigned(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if len(token.Headers) != 1 || !oidcSigningAlgorithms[token.Headers[0].Algorithm] {
+		return nil, errors.New("id token signed with an unsupported algorithm")
+	}
+	keys, err := p.keys.get(false)
+	if err != nil {
+		return nil, err
+	}
+	if kid := token.Headers[0].KeyID; kid != "" && len(keys.Key(kid)) == 0 {
+		if keys, err = p.keys.get(true); err != nil {
+			return nil, err
+		}
+	}
+	// tokens without key ID are verified with any of the keys of the issuer
+	candidates := keys.Keys
+	if kid := token.Headers[0].KeyID; kid != "" {
+		candidates = keys.Key(kid)
+	}
+	claims := jwt.Claims{}
+	extra := map[string]any{}
+	err = errors.New("no signing key found")
+	for _, key := range candidates {
+		if err = token.Claims(key.Key, &claims, &extra); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token signature: %w", err)
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("id token without expiry")
+	}
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   p.Issuer,
+		Audience: jwt.Audience{p.ClientID},
+		Time:     time.Now(),
+	}); err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if tokenNonce, _ := extra["nonce"].(string); nonce == "" || tokenNonce != nonce {
+		return nil, errors.New("invalid id token nonce")
+	}
+	return extra, nil
+}
+
+// claimsIdentity returns the value of the first of the given claims that is set. Email claims
+// are only taken if the email_verified claim is true, a missing one counts as unverified.
+func claimsIdentity(claims map[string]any, names []string) (string, error) {
+	for _, name := range names {
+		value, ok := claims[name].(string)
+		if !ok || value == "" {
+			continue
+		}
+		if verified, _ := claims["email_verified"].(bool); name == "email" && !verified {
+			continue
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("id token without any of the claims %s", strings.Join(names, ", "))
+}
+
+// getJSON decodes the JSON document at the given URL into v.
+func getJSON(url string, v any) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnw("error closing HTTP body", "err", err)
+		}
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,200 @@
+package oauthhandler
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// testIssuer is a local OpenID Connect issuer, which returns an ID token with its claims from
+// its token endpoint, signed with its current key.
+type testIssuer struct {
+	t       *testing.T
+	server  *httptest.Server
+	keys    []jose.JSONWebKey // The published keys, the last one signs the tokens.
+	claims  map[string]any
+	fetches atomic.Int32 // The number of fetches of the keys.
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{t: t}
+	iss.rotate("key_1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 iss.server.URL,
+			"authorization_endpoint": iss.server.URL + "/authorize",
+			"token_endpoint":         iss.server.URL + "/token",
+			"jwks_uri":               iss.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		iss.fetches.Add(1)
+		set := jose.JSONWebKeySet{}
+		for _, key := range iss.keys {
+			set.Keys = append(set.Keys, key.Public())
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "token",
+			"token_type":   "bearer",
+			"id_token":     iss.sign(iss.keys[len(iss.keys)-1], iss.claims),
+		})
+	})
+	iss.server = httptest.NewServer(mux)
+	t.Cleanup(iss.server.Close)
+	return iss
+}
+
+// rotate adds a new signing key with the given ID.
+func (iss *testIssuer) rotate(kid string) jose.JSONWebKey {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		iss.t.Fatalf("failed to generate key: %v", err)
+	}
+	key := jose.JSONWebKey{Key: priv, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+	iss.keys = append(iss.keys, key)
+	return key
+}
+
+// sign returns an ID token with the given claims signed with the given key.
+func (iss *testIssuer) sign(key jose.JSONWebKey, claims map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", key.KeyID))
+	if err != nil {
+		iss.t.Fatalf("failed to create signer: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		iss.t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestOIDCProvider(t *testing.T) {
+	iss := newTestIssuer(t)
+	t.Setenv("TEST_OIDC_ID", "client_1")
+	t.Setenv("TEST_OIDC_SECRET", "secret")
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(`providers:
+  local:
+    name: Local
+    kind: oidc
+    issuer: `+iss.server.URL+`
+    client_id: TEST_OIDC_ID
+    client_secret: TEST_OIDC_SECRET
+    scope: email
+    identity_claims: [email, sub]
+`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	providers, err := LoadProviders(path)
+	if err != nil {
+		t.Fatalf("failed to load providers: %v", err)
+	}
+	p := providers["local"]
+	if p.AuthURL != iss.server.URL+"/authorize" || p.TokenURL != iss.server.URL+"/token" || p.Scope != "openid email" {
+		t.Fatalf("unexpected discovered provider %+v", p)
+	}
+	authURL, err := url.Parse(p.GetAuthURL("https://example.com/callback", "state", "verifier", "nonce_1"))
+	if err != nil || authURL.Query().Get("nonce") != "nonce_1" {
+		t.Fatalf("unexpected auth url %v (%v)", authURL, err)
+	}
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":            iss.server.URL,
+			"aud":            "client_1",
+			"sub":            "user_1",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"nonce":          "nonce_1",
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	identity := func() (string, error) {
+		token, err := p.GetOAuthToken("code", "https://example.com/callback", "verifier")
+		if err != nil {
+			t.Fatalf("failed to get token: %v", err)
+		}
+		return p.Identity(token, "nonce_1")
+	}
+
+	// the identity is the first identity claim set, and unverified emails are skipped
+	iss.claims = valid()
+	if id, err := identity(); err != nil || id != "user@example.com" {
+		t.Fatalf("unexpected identity %q (%v)", id, err)
+	}
+	iss.claims["email_verified"] = false
+	if id, err := identity(); err != nil || id != "user_1" {
+		t.Fatalf("unexpected identity with unverified email %q (%v)", id, err)
+	}
+	delete(iss.claims, "email_verified")
+	if id, err := identity(); err != nil || id != "user_1" {
+		t.Fatalf("unexpected identity without email_verified %q (%v)", id, err)
+	}
+
+	// tokens signed with a rotated key are verified once the keys are fetched again
+	iss.rotate("key_2")
+	iss.claims = valid()
+	if id, err := identity(); err != nil || id != "user@example.com" {
+		t.Fatalf("unexpected identity after key rotation %q (%v)", id, err)
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Fatalf("expected 2 fetches of the keys, got %d", n)
+	}
+
+	// tokens signed with unknown keys do not fetch the keys again within the refresh interval
+	for i := 0; i < 2; i++ {
+		unknown := iss.sign(jose.JSONWebKey{Key: mustRSAKey(t), KeyID: "key_3"}, valid())
+		if _, err := p.VerifyIDToken(unknown, "nonce_1"); err == nil {
+			t.Fatal("expected invalid id token with an unknown key")
+		}
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Fatalf("expected no more fetches of the keys, got %d", n)
+	}
+
+	// every check of the ID token is enforced
+	for name, change := range map[string]func(claims map[string]any){
+		"wrong issuer":   func(c map[string]any) { c["iss"] = "https://other.example.com" },
+		"wrong audience": func(c map[string]any) { c["aud"] = "client_2" },
+		"expired":        func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":      func(c map[string]any) { delete(c, "exp") },
+		"wrong nonce":    func(c map[string]any) { c["nonce"] = "nonce_2" },
+		"no identity":    func(c map[string]any) { delete(c, "sub"); delete(c, "email") },
+	} {
+		iss.claims = valid()
+		change(iss.claims)
+		if _, err := identity(); err == nil {
+			t.Fatalf("%s: expected invalid id token", name)
+		}
+	}
+	forged := iss.sign(jose.JSONWebKey{Key: mustRSAKey(t), KeyID: "key_2"}, valid())
+	if _, err := p.VerifyIDToken(forged, "nonce_1"); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
@@ -1,47 +1,72 @@
 package oauthhandler
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.vocdoni.io/dvote/log"
 	"gopkg.in/yaml.v3"
 )
 
+// DefaultConfigPath is the default path of the providers configuration file.
+const DefaultConfigPath = "oauthhandler/config.yml"
+
 // Config represents the configuration file.
 type Config struct {
 	Providers map[string]ProviderConfig `yaml:"providers"`
 }
 
-// ProviderConfig represents the configuration for an OAuth provider.
+// ProviderConfig represents the configuration for an OAuth provider. OpenID Connect providers
+// (kind oidc) are configured with their issuer instead of their URLs and username field. The
+// amount and wait period of the claims default to the ones of the oauth auth type if unset,
+// and disabled providers are not loaded.
 type ProviderConfig struct {
-	Name          string `yaml:"name"`
-	AuthURL       string `yaml:"auth_url"`
-	TokenURL      string `yaml:"token_url"`
-	ProfileURL    string `yaml:"profile_url"`
-	ClientID      string `yaml:"client_id"`
-	ClientSecret  string `yaml:"client_secret"`
-	Scope         string `yaml:"scope"`
-	UsernameField string `yaml:"username_field"`
+	Name           string        `yaml:"name"`
+	Kind           string        `yaml:"kind"` // oauth2 (the default) or oidc.
+	Issuer         string        `yaml:"issuer"`
+	AuthURL        string        `yaml:"auth_url"`
+	TokenURL       string        `yaml:"token_url"`
+	ProfileURL     string        `yaml:"profile_url"`
+	ClientID       string        `yaml:"client_id"`
+	ClientSecret   string        `yaml:"client_secret"`
+	Scope          string        `yaml:"scope"`
+	UsernameField  string        `yaml:"username_field"`
+	IdentityClaims []string      `yaml:"identity_claims"` // The ID token claims of the identity, by preference.
+	Enabled        *bool         `yaml:"enabled"`         // Enabled unless set to false.
+	Amount         uint64        `yaml:"amount"`
+	WaitPeriod     time.Duration `yaml:"wait_period"` // Such as 24h.
 }
 
 // Provider is the OAuth provider.
 type Provider struct {
-	Name          string
-	AuthURL       string
-	TokenURL      string
-	ProfileURL    string
-	ClientID      string
-	ClientSecret  string
-	Scope         string
-	UsernameField string
+	Name           string
+	Kind           string
+	Issuer         string
+	AuthURL        string
+	TokenURL       string
+	ProfileURL     string
+	ClientID       string
+	ClientSecret   string
+	Scope          string
+	UsernameField  string
+	IdentityClaims []string
+	Amount         uint64        // The tokens of a claim, the oauth auth type amount if 0.
+	WaitPeriod     time.Duration // The wait between claims, the faucet wait period if 0.
+	keys           *oidcKeys     // The signing keys of the OpenID Connect issuer.
 }
 
 // OAuthToken is the OAuth token.
@@ -49,12 +74,14 @@ type OAuthToken struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
 	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"` // The ID token of OpenID Connect providers.
 }
 
 // NewProvider creates a new OAuth provider.
 func NewProvider(name, authURL, tokenURL, profileURL, clientID, clientSecret, scope string, usernameField string) *Provider {
 	return &Provider{
 		Name:          name,
+		Kind:          KindOAuth2,
 		AuthURL:       authURL,
 		TokenURL:      tokenURL,
 		ProfileURL:    profileURL,
@@ -65,14 +92,41 @@ func NewProvider(name, authURL, tokenURL, profileURL, clientID, clientSecret, sc
 	}
 }
 
-func InitProviders() (map[string]*Provider, error) {
+// NewOIDCProvider creates a new OpenID Connect provider of the given issuer, whose identity
+// is the first of the given ID token claims that is set, sub if none. The openid scope is
+// always requested. Its URLs are set by Discover.
+func NewOIDCProvider(name, issuer, clientID, clientSecret, scope string, identityClaims []string) *Provider {
+	if len(identityClaims) == 0 {
+		identityClaims = DefaultIdentityClaims
+	}
+	scopes := strings.Fields(scope)
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return &Provider{
+		Name:           name,
+		Kind:           KindOIDC,
+		Issuer:         issuer,
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		Scope:          strings.Join(scopes, " "),
+		IdentityClaims: identityClaims,
+	}
+}
+
+// LoadProviders reads the providers of the configuration file at the given path, resolving
+// their client IDs and secrets from the environment variables named in the file. A relative
+// path that does not exist in the working directory is looked up next to the executable too.
+// Providers whose credentials are not set in the environment are not configured, and skipped,
+// as are disabled ones. The configured providers are validated, and the error reports every
+// broken one.
+func LoadProviders(path string) (map[string]*Provider, error) {
 	// Load the environment variables.
 	viper := viper.New()
 	viper.AutomaticEnv()
 
 	// Read the configuration file.
-	filename := filepath.Join("oauthhandler", "config.yml")
-	data, err := os.ReadFile(filename)
+	data, err := os.ReadFile(configPath(path))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read configuration file: %v", err)
 	}
@@ -84,27 +138,151 @@ func InitProviders() (map[string]*Provider, error) {
 		return nil, fmt.Errorf("failed to parse configuration file: %v", err)
 	}
 
-	// Initialize the providers.
+	// Initialize and validate the providers.
+	names := make([]string, 0, len(cfg.Providers))
+	for name := range cfg.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	providers := make(map[string]*Provider, len(cfg.Providers))
-	for name, conf := range cfg.Providers {
-		provider := NewProvider(
-			conf.Name,
-			conf.AuthURL,
-			conf.TokenURL,
-			conf.ProfileURL,
-			viper.GetString(conf.ClientID),
-			viper.GetString(conf.ClientSecret),
-			conf.Scope,
-			conf.UsernameField,
-		)
+	var errs []error
+	for _, name := range names {
+		conf := cfg.Providers[name]
+		if conf.Enabled != nil && !*conf.Enabled {
+			log.Infow("oauth provider disabled, skipping", "provider", name)
+			continue
+		}
+		var provider *Provider
+		switch conf.Kind {
+		case "", KindOAuth2:
+			provider = NewProvider(
+				conf.Name,
+				conf.AuthURL,
+				conf.TokenURL,
+				conf.ProfileURL,
+				viper.GetString(conf.ClientID),
+				viper.GetString(conf.ClientSecret),
+				conf.Scope,
+				conf.UsernameField,
+			)
+		case KindOIDC:
+			provider = NewOIDCProvider(
+				conf.Name,
+				conf.Issuer,
+				viper.GetString(conf.ClientID),
+				viper.GetString(conf.ClientSecret),
+				conf.Scope,
+				conf.IdentityClaims,
+			)
+			// the URLs are discovered, unless overridden
+			provider.AuthURL, provider.TokenURL = conf.AuthURL, conf.TokenURL
+		default:
+			errs = append(errs, fmt.Errorf("provider %s: unknown kind %q", name, conf.Kind))
+			continue
+		}
+		provider.Amount, provider.WaitPeriod = conf.Amount, conf.WaitPeriod
+		if provider.ClientID == "" && provider.ClientSecret == "" {
+			log.Warnw("oauth provider not configured, skipping", "provider", name,
+				"clientIdEnv", conf.ClientID, "clientSecretEnv", conf.ClientSecret)
+			continue
+		}
+		if provider.Kind == KindOIDC {
+			if err := provider.Discover(); err != nil {
+				errs = append(errs, fmt.Errorf("provider %s: %w", name, err))
+				continue
+			}
+		}
+		if err := provider.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("provider %s: %w", name, err))
+			continue
+		}
 		providers[name] = provider
 	}
-
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid oauth providers in %s: %w", path, errors.Join(errs...))
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no oauth providers configured in %s", path)
+	}
 	return providers, nil
 }
 
-// GetAuthURL returns the OAuth authorize URL for the provider.
-func (p *Provider) GetAuthURL(redirectURL string, state string) string {
+// configPath returns the path of the configuration file, next to the executable if it is
+// relative and does not exist in the working directory.
+func configPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return path
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(exe), path)); err != nil {
+		return path
+	}
+	return filepath.Join(filepath.Dir(exe), path)
+}
+
+// Validate checks that the provider has the fields required for the OAuth flow, its client
+// credentials, and absolute http(s) URLs. OpenID Connect providers need their issuer and
+// identity claims instead of the profile URL and username field.
+func (p *Provider) Validate() error {
+	var errs []error
+	if p.ClientID == "" {
+		errs = append(errs, errors.New("missing client id"))
+	}
+	if p.ClientSecret == "" {
+		errs = append(errs, errors.New("missing client secret"))
+	}
+	urls := []struct{ field, value string }{
+		{"auth_url", p.AuthURL},
+		{"token_url", p.TokenURL},
+	}
+	if p.Kind == KindOIDC {
+		if len(p.IdentityClaims) == 0 {
+			errs = append(errs, errors.New("missing identity_claims"))
+		}
+		urls = append(urls, struct{ field, value string }{"issuer", p.Issuer})
+	} else {
+		if p.UsernameField == "" {
+			errs = append(errs, errors.New("missing username_field"))
+		}
+		urls = append(urls, struct{ field, value string }{"profile_url", p.ProfileURL})
+	}
+	for _, u := range urls {
+		parsed, err := url.Parse(u.value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid %s %q", u.field, u.value))
+		}
+	}
+	if p.WaitPeriod < 0 {
+		errs = append(errs, fmt.Errorf("negative wait_period %s", p.WaitPeriod))
+	}
+	return errors.Join(errs...)
+}
+
+// NewRandomToken returns a random URL-safe token, such as an OAuth state or a PKCE code
+// verifier (RFC 7636), which takes 43 to 128 characters.
+func NewRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge of the given code verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GetAuthURL returns the OAuth authorize URL for the provider, with the PKCE code challenge
+// of the given code verifier, and the nonce of the ID token of OpenID Connect providers.
+func (p *Provider) GetAuthURL(redirectURL, state, verifier, nonce string) string {
 	u, _ := url.Parse(p.AuthURL)
 	q := u.Query()
 	q.Set("client_id", p.ClientID)
@@ -112,17 +290,24 @@ func (p *Provider) GetAuthURL(redirectURL string, state string) string {
 	q.Set("scope", p.Scope)
 	q.Set("response_type", "code")
 	q.Set("state", state)
+	q.Set("code_challenge", CodeChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	if p.Kind == KindOIDC {
+		q.Set("nonce", nonce)
+	}
 	u.RawQuery = q.Encode()
 	return u.String()
 }
 
-// GetOAuthToken obtains the OAuth token for the provider using the authorization code.
-func (p *Provider) GetOAuthToken(code string, redirectURL string) (*OAuthToken, error) {
+// GetOAuthToken obtains the OAuth token for the provider using the authorization code and the
+// PKCE code verifier of the authorization.
+func (p *Provider) GetOAuthToken(code, redirectURL, verifier string) (*OAuthToken, error) {
 	data := url.Values{}
 	data.Set("grant_type", "authorization_code")
 	data.Set("client_id", p.ClientID)
 	data.Set("client_secret", p.ClientSecret)
 	data.Set("redirect_uri", redirectURL)
+	data.Set("code_verifier", verifier)
 
 	unescapedCode, err := url.QueryUnescape(code)
 	if err != nil {
@@ -201,3 +386,33 @@ func (p *Provider) GetOAuthProfile(token *OAuthToken) ([]byte, error) {
 
 	return body, nil
 }
+
+// Identity returns the identity of the user that authorized the given token, which can only
+// claim from the faucet once per wait period. It is the username field of the profile, or the
+// identity claims of the verified ID token of OpenID Connect providers, whose nonce must be
+// the given one.
+func (p *Provider) Identity(token *OAuthToken, nonce string) (string, error) {
+	if p.Kind == KindOIDC {
+		if token.IDToken == "" {
+			return "", errors.New("token response without id token")
+		}
+		claims, err := p.VerifyIDToken(token.IDToken, nonce)
+		if err != nil {
+			return "", err
+		}
+		return claimsIdentity(claims, p.IdentityClaims)
+	}
+	profileRaw, err := p.GetOAuthProfile(token)
+	if err != nil {
+		return "", err
+	}
+	var profile map[string]interface{}
+	if err := json.Unmarshal(profileRaw, &profile); err != nil {
+		return "", fmt.Errorf("invalid profile: %w", err)
+	}
+	identity, ok := profile[p.UsernameField].(string)
+	if !ok || identity == "" {
+		return "", fmt.Errorf("profile without %s", p.UsernameField)
+	}
+	return identity, nil
+}
@@ -0,0 +1,132 @@
+package oauthhandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadProviders(t *testing.T) {
+	write := func(config string) string {
+		path := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		return path
+	}
+	t.Setenv("TEST_GITHUB_ID", "id")
+	t.Setenv("TEST_GITHUB_SECRET", "secret")
+	t.Setenv("TEST_BROKEN_ID", "id")
+
+	// providers without credentials are skipped
+	providers, err := LoadProviders(write(`providers:
+  github:
+    name: Github
+    auth_url: https://github.com/login/oauth/authorize
+    token_url: https://github.com/login/oauth/access_token
+    profile_url: https://api.github.com/user
+    client_id: TEST_GITHUB_ID
+    client_secret: TEST_GITHUB_SECRET
+    username_field: login
+  unset:
+    name: Unset
+    client_id: TEST_UNSET_ID
+    client_secret: TEST_UNSET_SECRET
+`))
+	if err != nil || len(providers) != 1 || providers["github"].ClientSecret != "secret" {
+		t.Fatalf("unexpected providers %+v (%v)", providers, err)
+	}
+
+	// the amount and wait period are per provider, and disabled providers are skipped
+	providers, err = LoadProviders(write(`providers:
+  github:
+    name: Github
+    auth_url: https://github.com/login/oauth/authorize
+    token_url: https://github.com/login/oauth/access_token
+    profile_url: https://api.github.com/user
+    client_id: TEST_GITHUB_ID
+    client_secret: TEST_GITHUB_SECRET
+    username_field: login
+    amount: 500
+    wait_period: 24h
+  disabled:
+    name: Disabled
+    client_id: TEST_GITHUB_ID
+    client_secret: TEST_GITHUB_SECRET
+    enabled: false
+`))
+	if err != nil || len(providers) != 1 || providers["github"].Amount != 500 || providers["github"].WaitPeriod != 24*time.Hour {
+		t.Fatalf("unexpected providers %+v (%v)", providers, err)
+	}
+
+	// every broken provider is reported
+	_, err = LoadProviders(write(`providers:
+  broken:
+    name: Broken
+    auth_url: /authorize
+    token_url: https://example.com/token
+    profile_url: ftp://example.com/me
+    client_id: TEST_BROKEN_ID
+    client_secret: TEST_BROKEN_SECRET
+    wait_period: -1h
+  nouser:
+    name: NoUser
+    auth_url: https://example.com/authorize
+    token_url: https://example.com/token
+    profile_url: https://example.com/me
+    client_id: TEST_GITHUB_ID
+    client_secret: TEST_GITHUB_SECRET
+`))
+	if err == nil {
+		t.Fatalf("expected invalid providers error")
+	}
+	for _, want := range []string{
+		"provider broken: missing client secret",
+		"invalid auth_url",
+		"invalid profile_url",
+		"negative wait_period",
+		"provider nouser: missing username_field",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error %q", want, err)
+		}
+	}
+
+	// the shipped configuration is valid once its credentials are set
+	for _, name := range []string{"FACEBOOK", "GITHUB", "TWITTER", "SPOTIFY", "LINKEDIN", "GOOGLE"} {
+		t.Setenv(name+"_CLIENT_ID", "id")
+		t.Setenv(name+"_CLIENT_SECRET", "secret")
+	}
+	if providers, err := LoadProviders("config.yml"); err != nil || len(providers) != 6 {
+		t.Fatalf("unexpected shipped providers %+v (%v)", providers, err)
+	}
+	if _, err := LoadProviders(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Fatalf("expected error reading a missing file")
+	}
+}
+
+func TestGetOAuthToken(t *testing.T) {
+	var verifier string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		verifier = r.PostForm.Get("code_verifier")
+		fmt.Fprint(w, `{"access_token":"token","token_type":"bearer"}`)
+	}))
+	defer server.Close()
+
+	p := NewProvider("Test", server.URL, server.URL, server.URL, "id", "secret", "", "login")
+	if token, err := p.GetOAuthToken("code", "https://example.com/callback", "verifier"); err != nil || token.AccessToken != "token" {
+		t.Fatalf("unexpected token %+v (%v)", token, err)
+	}
+	if verifier != "verifier" {
+		t.Fatalf("expected the code verifier in the token request, got %q", verifier)
+	}
+}
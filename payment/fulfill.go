@@ -0,0 +1,177 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Fulfiller issues the faucet packages of the paid payments. Each payment is fulfilled once,
+// the package is stored with it and returned again by the following requests.
+type Fulfiller struct {
+	Storage storage.Storage
+	Faucet  *faucet.Faucet
+	GiftTTL time.Duration // The time a paid gift can be redeemed for.
+	// Hooks are called after the provider hook, for every fulfilled payment, and for every
+	// revoked payment if they implement RevocationHook.
+	Hooks []FulfillmentHook
+	lock  sync.Mutex
+}
+
+// NewFulfiller creates a new Fulfiller.
+func NewFulfiller(f *faucet.Faucet, st storage.Storage) *Fulfiller {
+	return &Fulfiller{Storage: st, Faucet: f, GiftTTL: DefaultGiftTTL}
+}
+
+// Fulfill returns the status of the payment with the given ID. Once the provider confirms the
+// payment, the faucet package is issued, stored with the payment and returned in the status.
+func (f *Fulfiller) Fulfill(p Provider, id string) (*Status, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	payment, err := f.Storage.Payment(id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	if payment != nil && payment.State == storage.PaymentFulfilled {
+		return storedStatus(payment), nil
+	}
+	status, err := p.ConfirmPayment(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	now := time.Now()
+	if payment == nil {
+		// the checkout was created before payments were recorded
+		payment = &storage.Payment{ID: id, State: storage.PaymentCreated, CreatedAt: now}
+	}
+	// the provider is the source of truth for what was bought and paid
+	payment.Recipient = status.Recipient
+	payment.Quantity = uint64(status.Quantity)
+	payment.Price = status.Price
+	payment.Currency = status.Currency
+	if status.Referral != "" {
+		payment.Referral = status.Referral
+	}
+	if status.CustomerEmail != "" {
+		payment.Email = status.CustomerEmail
+	}
+	if status.Customer != "" {
+		payment.Customer = status.Customer
+	}
+	if !status.Paid() {
+		status.State = string(payment.State)
+		return status, nil
+	}
+	if payment.State == storage.PaymentCreated {
+		// record the payment before issuing the package, so it is not lost if that fails
+		payment.State = storage.PaymentPaid
+		payment.UpdatedAt = now
+		if err := f.Storage.SetPayment(payment); err != nil {
+			return nil, err
+		}
+	}
+	if !payment.State.CanTransitionTo(storage.PaymentFulfilled) {
+		return nil, fmt.Errorf("%w: payment %s is %s", ErrNotFulfillable, id, payment.State)
+	}
+	if payment.Gift != nil {
+		// gifts are fulfilled once redeemed, until then the buyer gets the gift claim
+		if payment.Gift.ExpiresAt.IsZero() {
+			payment.Gift.ExpiresAt = now.Add(f.GiftTTL)
+			payment.UpdatedAt = now
+			if err := f.Storage.SetPayment(payment); err != nil {
+				return nil, err
+			}
+		}
+		status.State = string(payment.State)
+		status.Gift = giftStatus(payment)
+		return status, nil
+	}
+	addr, err := helpers.StringToAddress(payment.Recipient)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.fulfill(p, payment, addr); err != nil {
+		return nil, err
+	}
+	status.State = string(payment.State)
+	status.FaucetPackage = payment.Package
+	return status, nil
+}
+
+// fulfill issues the faucet package of the given paid payment to the given address, stores
+// it with the payment, records its customer and calls the hooks.
+func (f *Fulfiller) fulfill(p Provider, payment *storage.Payment, addr common.Address) error {
+	payment.Recipient = addr.Hex()
+	if payment.Quantity == 0 {
+		return fmt.Errorf("invalid requested amount")
+	}
+	// the buyers of revoked payments are refused whatever the recipient
+	if err := CheckBuyerDenylist(f.Storage, payment.Customer, payment.Email); err != nil {
+		return err
+	}
+	if check, ok := p.(FulfillmentCheck); ok {
+		if err := check.CheckFulfillment(payment); err != nil {
+			return err
+		}
+	}
+	data, err := f.Faucet.IssueFaucetPackage(addr, payment.Quantity, p.Name(), payment.ID)
+	if err != nil {
+		return err
+	}
+	payment.State = storage.PaymentFulfilled
+	payment.Package = data.FaucetPackage
+	payment.UpdatedAt = time.Now()
+	// if the package cannot be stored it is not returned either, so it is never delivered twice
+	if err := f.Storage.SetPayment(payment); err != nil {
+		return err
+	}
+	f.recordCustomer(payment)
+	if hook, ok := p.(FulfillmentHook); ok {
+		hook.Fulfilled(payment)
+	}
+	for _, hook := range f.Hooks {
+		hook.Fulfilled(payment)
+	}
+	return nil
+}
+
+// recordCustomer adds the given fulfilled payment to the customer of its buyer email and
+// recipient, if the email is known.
+func (f *Fulfiller) recordCustomer(payment *storage.Payment) {
+	email := NormalizeEmail(payment.Email)
+	if email == "" {
+		return
+	}
+	customer, err := f.Storage.Customer(email, payment.Recipient)
+	if errors.Is(err, storage.ErrNotFound) {
+		customer = &storage.Customer{Email: email, Address: payment.Recipient, FirstPurchaseAt: payment.CreatedAt}
+	} else if err != nil {
+		log.Warnw("failed to get customer", "email", email, "payment", payment.ID, "err", err)
+		return
+	}
+	customer.Purchases++
+	customer.Tokens += payment.Quantity
+	customer.LastPurchaseAt = payment.CreatedAt
+	if payment.Customer != "" {
+		customer.ProviderID = payment.Customer
+	}
+	if err := f.Storage.SetCustomer(customer); err != nil {
+		log.Warnw("failed to record customer", "email", email, "payment", payment.ID, "err", err)
+	}
+}
+
+// Revoked notifies the hooks that the given payment has been refunded or disputed.
+func (f *Fulfiller) Revoked(payment *storage.Payment) {
+	for _, hook := range f.Hooks {
+		if hook, ok := hook.(RevocationHook); ok {
+			hook.Revoked(payment)
+		}
+	}
+}
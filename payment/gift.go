@@ -0,0 +1,151 @@
+package payment
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+// DefaultGiftTTL is the default time a paid gift can be redeemed for.
+const DefaultGiftTTL = 30 * 24 * time.Hour
+
+// NewGift returns a gift with new random claim and refund tokens, for a gift checkout.
+func NewGift() (*storage.Gift, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	refundToken := make([]byte, 32)
+	if _, err := rand.Read(refundToken); err != nil {
+		return nil, err
+	}
+	return &storage.Gift{Token: hex.EncodeToString(token), RefundToken: hex.EncodeToString(refundToken)}, nil
+}
+
+// giftStatus returns the claim of the given gift payment, without its token.
+func giftStatus(payment *storage.Payment) *GiftStatus {
+	return &GiftStatus{
+		ID:        payment.ID,
+		ExpiresAt: payment.Gift.ExpiresAt,
+		Redeemed:  payment.State == storage.PaymentFulfilled,
+	}
+}
+
+// giftPayment returns the gift payment with the given ID.
+func (f *Fulfiller) giftPayment(id string) (*storage.Payment, error) {
+	payment, err := f.Storage.Payment(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrGiftNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if payment.Gift == nil {
+		return nil, ErrGiftNotFound
+	}
+	return payment, nil
+}
+
+// checkRefundToken returns ErrGiftNotFound if the given token is not the refund token of the
+// given gift payment. The gifts bought before the refund tokens have none, and never match.
+func checkRefundToken(payment *storage.Payment, refundToken string) error {
+	if payment.Gift.RefundToken == "" ||
+		subtle.ConstantTimeCompare([]byte(refundToken), []byte(payment.Gift.RefundToken)) != 1 {
+		return ErrGiftNotFound
+	}
+	return nil
+}
+
+// GiftClaim returns the claim of the gift with the given ID, including its token, to the buyer
+// with the given refund token, so it can share the claim link again.
+func (f *Fulfiller) GiftClaim(id, refundToken string) (*GiftStatus, error) {
+	payment, err := f.giftPayment(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefundToken(payment, refundToken); err != nil {
+		return nil, err
+	}
+	claim := giftStatus(payment)
+	claim.Token = payment.Gift.Token
+	return claim, nil
+}
+
+// checkGiftAvailable returns ErrGiftNotAvailable if the given gift is not paid, or already
+// redeemed or refunded.
+func checkGiftAvailable(payment *storage.Payment) error {
+	if payment.State != storage.PaymentPaid || payment.Gift.ExpiresAt.IsZero() {
+		return fmt.Errorf("%w: payment %s is %s", ErrGiftNotAvailable, payment.ID, payment.State)
+	}
+	return nil
+}
+
+// RedeemGift issues the faucet package of the paid gift with the given ID and token to the
+// given address. Each gift is redeemed once, and only before it expires.
+func (f *Fulfiller) RedeemGift(p Provider, id, token string, addr common.Address) (*Status, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	payment, err := f.giftPayment(id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(payment.Gift.Token)) != 1 {
+		return nil, ErrGiftNotFound
+	}
+	if err := checkGiftAvailable(payment); err != nil {
+		return nil, err
+	}
+	if time.Now().After(payment.Gift.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrGiftExpired, payment.Gift.ExpiresAt)
+	}
+	if err := CheckDenylist(f.Storage, addr); err != nil {
+		return nil, err
+	}
+	if err := f.fulfill(p, payment, addr); err != nil {
+		return nil, err
+	}
+	status := storedStatus(payment)
+	status.FaucetPackage = payment.Package
+	return status, nil
+}
+
+// RefundGift refunds the expired gift with the given ID if it was never redeemed. Only the
+// buyer can refund it, with the refund token returned at checkout, since the claim link is
+// shared. The payment is refunded at the provider, which must implement Refunder.
+func (f *Fulfiller) RefundGift(p Provider, id, refundToken string) (*Status, error) {
+	refunder, ok := p.(Refunder)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	payment, err := f.giftPayment(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRefundToken(payment, refundToken); err != nil {
+		return nil, err
+	}
+	if err := checkGiftAvailable(payment); err != nil {
+		return nil, err
+	}
+	if time.Now().Before(payment.Gift.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expires at %s", ErrGiftNotExpired, payment.Gift.ExpiresAt)
+	}
+	if err := refunder.Refund(payment); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	payment.State = storage.PaymentRefunded
+	payment.UpdatedAt = time.Now()
+	if err := f.Storage.SetPayment(payment); err != nil {
+		return nil, err
+	}
+	f.Revoked(payment)
+	return storedStatus(payment), nil
+}
@@ -0,0 +1,141 @@
+package payment
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// giftProvider is a payment provider that reports every stored payment as paid, and records
+// its refunds.
+type giftProvider struct {
+	st       storage.Storage
+	refunded []string
+}
+
+func (*giftProvider) Name() string { return "test" }
+
+func (*giftProvider) CreateCheckout(*CheckoutRequest) (*Checkout, error) {
+	return nil, ErrNotSupported
+}
+
+func (p *giftProvider) ConfirmPayment(id string) (*Status, error) {
+	pay, err := p.st.Payment(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Status{
+		Status:        StatusComplete,
+		PaymentStatus: PaymentStatusPaid,
+		Recipient:     pay.Recipient,
+		Quantity:      int64(pay.Quantity),
+	}, nil
+}
+
+func (*giftProvider) HandleWebhook([]byte, http.Header) error {
+	return ErrNotSupported
+}
+
+func (p *giftProvider) Refund(pay *storage.Payment) error {
+	p.refunded = append(p.refunded, pay.ID)
+	return nil
+}
+
+func TestGift(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	fulfiller := NewFulfiller(&faucet.Faucet{Signer: signer, Storage: st}, st)
+	provider := &giftProvider{st: st}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	buy := func(id string) *GiftStatus {
+		gift, err := NewGift()
+		if err != nil {
+			t.Fatalf("failed to create gift: %v", err)
+		}
+		if err := st.SetPayment(&storage.Payment{
+			ID: id, State: storage.PaymentCreated, Quantity: 100, Gift: gift, CreatedAt: time.Now(),
+		}); err != nil {
+			t.Fatalf("failed to set payment: %v", err)
+		}
+		status, err := fulfiller.Fulfill(provider, id)
+		if err != nil {
+			t.Fatalf("failed to confirm gift: %v", err)
+		}
+		if status.FaucetPackage != nil || status.Gift == nil || status.Gift.Token != "" || status.Gift.ExpiresAt.IsZero() {
+			t.Fatalf("unexpected gift status %+v", status)
+		}
+		// the claim token is only given to the buyer, with the refund token
+		if _, err := fulfiller.GiftClaim(id, gift.Token); !errors.Is(err, ErrGiftNotFound) {
+			t.Fatalf("expected the claim token not to give the claim, got %v", err)
+		}
+		claim, err := fulfiller.GiftClaim(id, gift.RefundToken)
+		if err != nil || claim.Token != gift.Token {
+			t.Fatalf("unexpected gift claim %+v (%v)", claim, err)
+		}
+		return claim
+	}
+
+	// redeem
+	gift := buy("g1")
+	if _, err := fulfiller.RedeemGift(provider, "g1", "wrong", addr); !errors.Is(err, ErrGiftNotFound) {
+		t.Fatalf("expected gift not found for a wrong token, got %v", err)
+	}
+	pay, err := st.Payment("g1")
+	if err != nil {
+		t.Fatalf("failed to get payment: %v", err)
+	}
+	if _, err := fulfiller.RefundGift(provider, "g1", pay.Gift.RefundToken); !errors.Is(err, ErrGiftNotExpired) {
+		t.Fatalf("expected gift not expired, got %v", err)
+	}
+	status, err := fulfiller.RedeemGift(provider, "g1", gift.Token, addr)
+	if err != nil || status.FaucetPackage == nil {
+		t.Fatalf("failed to redeem gift: %+v (%v)", status, err)
+	}
+	if _, err := fulfiller.RedeemGift(provider, "g1", gift.Token, addr); !errors.Is(err, ErrGiftNotAvailable) {
+		t.Fatalf("expected gift not available after redeeming it, got %v", err)
+	}
+	status, err = fulfiller.Fulfill(provider, "g1")
+	if err != nil || status.FaucetPackage != nil || !status.Gift.Redeemed {
+		t.Fatalf("expected the buyer to see the gift redeemed, got %+v (%v)", status, err)
+	}
+
+	// expire and refund
+	gift = buy("g2")
+	pay, err = st.Payment("g2")
+	if err != nil {
+		t.Fatalf("failed to get payment: %v", err)
+	}
+	pay.Gift.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := st.SetPayment(pay); err != nil {
+		t.Fatalf("failed to set payment: %v", err)
+	}
+	if _, err := fulfiller.RedeemGift(provider, "g2", gift.Token, addr); !errors.Is(err, ErrGiftExpired) {
+		t.Fatalf("expected gift expired, got %v", err)
+	}
+	// only the buyer can refund it, not whoever has the claim link
+	for _, token := range []string{"", gift.Token} {
+		if _, err := fulfiller.RefundGift(provider, "g2", token); !errors.Is(err, ErrGiftNotFound) {
+			t.Fatalf("expected gift not found for refund token %q, got %v", token, err)
+		}
+	}
+	status, err = fulfiller.RefundGift(provider, "g2", pay.Gift.RefundToken)
+	if err != nil || status.State != string(storage.PaymentRefunded) {
+		t.Fatalf("failed to refund gift: %+v (%v)", status, err)
+	}
+	if len(provider.refunded) != 1 || provider.refunded[0] != "g2" {
+		t.Fatalf("unexpected refunds %v", provider.refunded)
+	}
+	if _, err := fulfiller.RefundGift(provider, "g2", pay.Gift.RefundToken); !errors.Is(err, ErrGiftNotAvailable) {
+		t.Fatalf("expected gift not available after refunding it, got %v", err)
+	}
+}
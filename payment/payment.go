@@ -0,0 +1,202 @@
+// Package payment defines the interface of the payment providers that sell faucet tokens, and
+// the fulfillment of their payments, which issues the faucet package exactly once.
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+// Checkout and payment statuses reported by the providers.
+const (
+	StatusOpen        = "open"
+	StatusComplete    = "complete"
+	StatusExpired     = "expired"
+	PaymentStatusPaid = "paid"
+	PaymentUnpaid     = "unpaid"
+)
+
+var (
+	// ErrNotSupported is returned by the providers that do not support an operation.
+	ErrNotSupported = errors.New("not supported by the payment provider")
+	// ErrProvider wraps the errors returned by the payment provider.
+	ErrProvider = errors.New("payment provider error")
+	// ErrDenylisted is returned when the recipient address, or the buyer, is denylisted. It is
+	// the faucet error, so the addresses refused when the package is issued match it too.
+	ErrDenylisted = faucet.ErrDenylisted
+	// ErrNotFulfillable is returned when the payment is in a state that cannot be fulfilled.
+	ErrNotFulfillable = errors.New("payment cannot be fulfilled")
+	// ErrGiftNotFound is returned when there is no gift with the given ID and token.
+	ErrGiftNotFound = errors.New("gift not found")
+	// ErrGiftExpired is returned when redeeming an expired gift.
+	ErrGiftExpired = errors.New("gift expired")
+	// ErrGiftNotAvailable is returned when the gift is not paid, or already redeemed or refunded.
+	ErrGiftNotAvailable = errors.New("gift not available")
+	// ErrGiftNotExpired is returned when refunding a gift that can still be redeemed.
+	ErrGiftNotExpired = errors.New("gift not expired yet")
+)
+
+// Provider is a way to pay for faucet tokens.
+type Provider interface {
+	// Name returns the name of the provider, which is the auth type of the faucet packages
+	// issued for its payments.
+	Name() string
+	// CreateCheckout starts a purchase. The payment is stored in the created state and
+	// returned along with the data the client needs to pay.
+	CreateCheckout(req *CheckoutRequest) (*Checkout, error)
+	// ConfirmPayment returns the status of the payment with the given ID at the provider.
+	ConfirmPayment(id string) (*Status, error)
+	// HandleWebhook processes a notification sent by the provider. The providers that do
+	// not send notifications return ErrNotSupported.
+	HandleWebhook(body []byte, header http.Header) error
+}
+
+// Refunder is implemented by the providers that can refund a payment, which is required to
+// refund the gifts never redeemed.
+type Refunder interface {
+	Refund(payment *storage.Payment) error
+}
+
+// FulfillmentHook is implemented by the providers, and the Fulfiller hooks, that need to act
+// once a payment has been fulfilled.
+type FulfillmentHook interface {
+	Fulfilled(payment *storage.Payment)
+}
+
+// FulfillmentCheck is implemented by the providers that check a paid payment right before its
+// faucet package is issued, such as against purchase limits that depend on the buyer. The
+// package is not issued if the check fails.
+type FulfillmentCheck interface {
+	CheckFulfillment(payment *storage.Payment) error
+}
+
+// RevocationHook is implemented by the Fulfiller hooks that need to act once a payment has
+// been refunded or disputed.
+type RevocationHook interface {
+	Revoked(payment *storage.Payment)
+}
+
+// CheckoutRequest are the parameters of a purchase.
+type CheckoutRequest struct {
+	Recipient common.Address
+	Quantity  int64
+	Payer     string // The account the payment is sent from, for on-chain providers.
+	ReturnURL string
+	Referral  string
+	Gift      bool // Buy a gift, redeemed later for any address, instead of paying a recipient.
+	// Hosted checkouts redirect the customer to a provider page, and back to SuccessURL or
+	// CancelURL, instead of being embedded in the client with ReturnURL.
+	Hosted     bool
+	SuccessURL string
+	CancelURL  string
+	Currency   string // The currency of the prices, the provider default if empty.
+	Email      string // The buyer email, prefilled at the provider if set.
+}
+
+// Checkout is a purchase started at a provider.
+type Checkout struct {
+	Payment      *storage.Payment `json:"-"`
+	ID           string           `json:"id"`
+	ClientSecret string           `json:"clientSecret,omitempty"`
+	URL          string           `json:"url,omitempty"`         // The page of hosted checkouts.
+	RefundToken  string           `json:"refundToken,omitempty"` // Of gifts, only given to the buyer here.
+	GiftToken    string           `json:"giftToken,omitempty"`   // The claim token of gifts, also given here.
+	Instructions any              `json:"instructions,omitempty"`
+}
+
+// Status is the status of a payment, as returned to the client.
+type Status struct {
+	Status        string      `json:"status"`
+	PaymentStatus string      `json:"payment_status"`
+	State         string      `json:"state"`
+	CustomerEmail string      `json:"customer_email"`
+	FaucetPackage []byte      `json:"faucet_package"`
+	Recipient     string      `json:"recipient"`
+	Quantity      int64       `json:"quantity"`
+	Price         int64       `json:"price"`
+	Currency      string      `json:"currency"`
+	Gift          *GiftStatus `json:"gift,omitempty"`
+	Customer      string      `json:"-"`
+	Referral      string      `json:"-"`
+}
+
+// GiftStatus is the claim of a paid gift, as returned to the buyer. The claim token is only
+// set for whoever proves to be the buyer, since the session ID may leak.
+type GiftStatus struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Redeemed  bool      `json:"redeemed"`
+	Link      string    `json:"link,omitempty"`
+}
+
+// Paid returns true if the checkout is complete and its payment has been received.
+func (s *Status) Paid() bool {
+	return s.Status == StatusComplete && s.PaymentStatus == PaymentStatusPaid
+}
+
+// CheckDenylist returns ErrDenylisted if the given address is in the denylist.
+func CheckDenylist(st storage.Storage, addr common.Address) error {
+	return checkDenylistEntry(st, storage.DenylistAddress, addr.Hex())
+}
+
+// CheckBuyerDenylist returns ErrDenylisted if the given customer ID at the payment provider,
+// or the given email, is in the denylist. Empty values are not checked.
+func CheckBuyerDenylist(st storage.Storage, customer, email string) error {
+	if customer != "" {
+		if err := checkDenylistEntry(st, storage.DenylistCustomer, customer); err != nil {
+			return err
+		}
+	}
+	if email = NormalizeEmail(email); email != "" {
+		return checkDenylistEntry(st, storage.DenylistEmail, email)
+	}
+	return nil
+}
+
+// checkDenylistEntry returns ErrDenylisted if the given value is in the denylist.
+func checkDenylistEntry(st storage.Storage, kind, value string) error {
+	entry, err := st.DenylistEntry(kind, value)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrDenylisted, entry.Reason)
+}
+
+// NormalizeEmail returns the given email as stored in the customers and the denylist.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// storedStatus returns the status of a fulfilled payment, as stored. The package of a gift
+// belongs to whoever redeemed it, so it is not returned.
+func storedStatus(payment *storage.Payment) *Status {
+	status := &Status{
+		Status:        StatusComplete,
+		PaymentStatus: PaymentStatusPaid,
+		State:         string(payment.State),
+		CustomerEmail: payment.Email,
+		FaucetPackage: payment.Package,
+		Recipient:     payment.Recipient,
+		Quantity:      int64(payment.Quantity),
+		Price:         payment.Price,
+		Currency:      payment.Currency,
+		Customer:      payment.Customer,
+		Referral:      payment.Referral,
+	}
+	if payment.Gift != nil {
+		status.FaucetPackage = nil
+		status.Gift = giftStatus(payment)
+	}
+	return status
+}
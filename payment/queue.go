@@ -0,0 +1,318 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Defaults of the webhook queue.
+const (
+	DefaultWebhookWorkers       = 2
+	DefaultWebhookMaxAttempts   = 8
+	DefaultWebhookRetryDelay    = 30 * time.Second
+	DefaultWebhookMaxRetryDelay = time.Hour
+)
+
+// webhookPollInterval is the interval the queue looks for due jobs at, besides when a job is
+// queued, so the retries are picked up.
+const webhookPollInterval = 5 * time.Second
+
+// ErrWebhookJobNotDead is returned when retrying a webhook job that has not failed.
+var ErrWebhookJobNotDead = errors.New("webhook job is not dead")
+
+// WebhookHandler processes a verified webhook event of a provider. It might be called more
+// than once for the same event, like the providers deliver them at least once.
+type WebhookHandler func(job *storage.WebhookJob) error
+
+// WebhookQueueStatus are the jobs of the queue in a state and the number of jobs in each one.
+type WebhookQueueStatus struct {
+	Pending int                   `json:"pending"`
+	Done    int                   `json:"done"`
+	Dead    int                   `json:"dead"`
+	Jobs    []*storage.WebhookJob `json:"jobs"`
+}
+
+// WebhookQueue processes the verified webhook events in the background, so they are
+// acknowledged as soon as they are stored. The jobs are stored, so the pending ones are
+// processed after a restart too. Failed jobs are retried with an exponential backoff, and
+// dead-lettered once they fail MaxAttempts times, until an operator retries them.
+type WebhookQueue struct {
+	Storage       storage.Storage
+	Workers       int           // The number of jobs processed at the same time.
+	MaxAttempts   int           // The attempts to process a job before it is dead-lettered.
+	RetryDelay    time.Duration // The delay before the first retry, doubled on every following one.
+	MaxRetryDelay time.Duration // The maximum delay between retries.
+	// DeadLetter is called with every job that is dead-lettered, if set.
+	DeadLetter func(job *storage.WebhookJob)
+	handlers   map[string]WebhookHandler
+	inflight   map[string]bool
+	wake       chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	lock       sync.Mutex
+}
+
+// NewWebhookQueue creates a new WebhookQueue with the default parameters.
+func NewWebhookQueue(st storage.Storage) *WebhookQueue {
+	return &WebhookQueue{
+		Storage:       st,
+		Workers:       DefaultWebhookWorkers,
+		MaxAttempts:   DefaultWebhookMaxAttempts,
+		RetryDelay:    DefaultWebhookRetryDelay,
+		MaxRetryDelay: DefaultWebhookMaxRetryDelay,
+		handlers:      make(map[string]WebhookHandler),
+		inflight:      make(map[string]bool),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Handle sets the handler of the jobs of the given provider.
+func (q *WebhookQueue) Handle(provider string, handler WebhookHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.handlers[provider] = handler
+}
+
+// Enqueue stores a verified webhook event of the given provider as a pending job, and wakes
+// the workers up. Events already queued are ignored, since the providers deliver them at
+// least once.
+func (q *WebhookQueue) Enqueue(provider, id, eventType string, payload []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, err := q.Storage.WebhookJob(id); err == nil {
+		return nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	now := time.Now()
+	if err := q.Storage.SetWebhookJob(&storage.WebhookJob{
+		ID:          id,
+		Provider:    provider,
+		Type:        eventType,
+		Payload:     payload,
+		State:       storage.WebhookJobPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Retry moves a dead job back to pending, with its attempts reset, so it is processed again.
+func (q *WebhookQueue) Retry(id string) (*storage.WebhookJob, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job, err := q.Storage.WebhookJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != storage.WebhookJobDead {
+		return nil, fmt.Errorf("%w: job %s is %s", ErrWebhookJobNotDead, id, job.State)
+	}
+	now := time.Now()
+	job.State, job.Attempts, job.NextAttempt, job.UpdatedAt = storage.WebhookJobPending, 0, now, now
+	if err := q.Storage.SetWebhookJob(job); err != nil {
+		return nil, err
+	}
+	q.notify()
+	job.Payload = nil
+	return job, nil
+}
+
+// Status returns the jobs in the given state, or all of them if it is empty, without their
+// payloads, and the number of jobs in each state.
+func (q *WebhookQueue) Status(state storage.WebhookJobState) (*WebhookQueueStatus, error) {
+	jobs, err := q.Storage.WebhookJobs("")
+	if err != nil {
+		return nil, err
+	}
+	status := &WebhookQueueStatus{Jobs: []*storage.WebhookJob{}}
+	for _, job := range jobs {
+		switch job.State {
+		case storage.WebhookJobPending:
+			status.Pending++
+		case storage.WebhookJobDone:
+			status.Done++
+		case storage.WebhookJobDead:
+			status.Dead++
+		}
+		if state == "" || job.State == state {
+			job.Payload = nil
+			status.Jobs = append(status.Jobs, job)
+		}
+	}
+	return status, nil
+}
+
+// Start starts the workers, which process the pending jobs, including the ones queued before
+// a restart. Calling it while running does nothing.
+func (q *WebhookQueue) Start() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.stop != nil {
+		return
+	}
+	q.stop = make(chan struct{})
+	jobs := make(chan *storage.WebhookJob)
+	for i := 0; i < max(q.Workers, 1); i++ {
+		q.wg.Add(1)
+		go q.work(q.stop, jobs)
+	}
+	q.wg.Add(1)
+	go q.dispatch(q.stop, jobs)
+	log.Infow("webhook queue started", "workers", max(q.Workers, 1), "maxAttempts", q.MaxAttempts)
+}
+
+// Stop stops the workers, waiting for the jobs being processed.
+func (q *WebhookQueue) Stop() {
+	q.lock.Lock()
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+	q.lock.Unlock()
+	q.wg.Wait()
+}
+
+// notify wakes the dispatcher up, if it is not awake yet.
+func (q *WebhookQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sends the due jobs to the workers every time a job is queued, and periodically for
+// the retries.
+func (q *WebhookQueue) dispatch(stop chan struct{}, jobs chan<- *storage.WebhookJob) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		q.dispatchDue(stop, jobs)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// dispatchDue sends the pending jobs whose next attempt is due to the workers, except the
+// ones being processed already.
+func (q *WebhookQueue) dispatchDue(stop chan struct{}, jobs chan<- *storage.WebhookJob) {
+	pending, err := q.Storage.WebhookJobs(storage.WebhookJobPending)
+	if err != nil {
+		log.Warnw("failed to list pending webhook jobs", "err", err)
+		return
+	}
+	now := time.Now()
+	for _, job := range pending {
+		if job.NextAttempt.After(now) || !q.claim(job.ID) {
+			continue
+		}
+		select {
+		case jobs <- job:
+		case <-stop:
+			q.release(job.ID)
+			return
+		}
+	}
+}
+
+// work processes the jobs sent by the dispatcher until the queue is stopped.
+func (q *WebhookQueue) work(stop chan struct{}, jobs <-chan *storage.WebhookJob) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case job := <-jobs:
+			q.process(job)
+			q.release(job.ID)
+		}
+	}
+}
+
+// claim marks the job with the given ID as being processed, and returns false if it already
+// was.
+func (q *WebhookQueue) claim(id string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	q.inflight[id] = true
+	return true
+}
+
+// release unmarks the job with the given ID as being processed.
+func (q *WebhookQueue) release(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.inflight, id)
+}
+
+// process runs the handler of the given job and stores the result. Failed jobs are scheduled
+// for a retry, or dead-lettered once they reach MaxAttempts.
+func (q *WebhookQueue) process(job *storage.WebhookJob) {
+	q.lock.Lock()
+	handler, ok := q.handlers[job.Provider]
+	q.lock.Unlock()
+	err := fmt.Errorf("no webhook handler for provider %s", job.Provider)
+	if ok {
+		err = handler(job)
+	}
+	now := time.Now()
+	job.Attempts++
+	job.UpdatedAt = now
+	switch {
+	case err == nil:
+		job.State, job.LastError = storage.WebhookJobDone, ""
+	case job.Attempts >= q.MaxAttempts:
+		job.State, job.LastError = storage.WebhookJobDead, err.Error()
+	default:
+		job.LastError = err.Error()
+		job.NextAttempt = now.Add(q.retryDelay(job.Attempts))
+	}
+	// if the result cannot be stored the job stays pending and is processed again, which the
+	// handlers tolerate
+	if err := q.Storage.SetWebhookJob(job); err != nil {
+		log.Warnw("failed to store webhook job", "id", job.ID, "err", err)
+		return
+	}
+	switch job.State {
+	case storage.WebhookJobDone:
+		log.Debugw("webhook job done", "id", job.ID, "type", job.Type, "attempts", job.Attempts)
+	case storage.WebhookJobDead:
+		log.Warnw("webhook job dead-lettered", "id", job.ID, "type", job.Type, "attempts", job.Attempts, "err", job.LastError)
+		if q.DeadLetter != nil {
+			q.DeadLetter(job)
+		}
+	default:
+		log.Infow("webhook job failed, retrying", "id", job.ID, "type", job.Type, "attempts", job.Attempts,
+			"nextAttempt", job.NextAttempt, "err", job.LastError)
+	}
+}
+
+// retryDelay returns the delay before the next attempt of a job that failed the given number
+// of attempts.
+func (q *WebhookQueue) retryDelay(attempts int) time.Duration {
+	delay := q.RetryDelay
+	for i := 1; i < attempts && (q.MaxRetryDelay <= 0 || delay < q.MaxRetryDelay); i++ {
+		delay *= 2
+	}
+	if q.MaxRetryDelay > 0 && delay > q.MaxRetryDelay {
+		delay = q.MaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,84 @@
+package payment
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+func TestWebhookQueue(t *testing.T) {
+	st := storage.NewMemory(time.Hour)
+	q := NewWebhookQueue(st)
+	q.MaxAttempts = 3
+	var dead []string
+	q.DeadLetter = func(job *storage.WebhookJob) { dead = append(dead, job.ID) }
+
+	var lock sync.Mutex
+	processed := make(map[string]int)
+	done := make(chan string, 10)
+	q.Handle("test", func(job *storage.WebhookJob) error {
+		lock.Lock()
+		processed[job.ID]++
+		lock.Unlock()
+		if string(job.Payload) == "fail" {
+			return errors.New("failed")
+		}
+		done <- job.ID
+		return nil
+	})
+
+	// the queued jobs are processed in the background, and queued once
+	q.Start()
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue("test", "evt_1", "test.event", []byte("ok")); err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job not processed")
+	}
+	q.Stop()
+	if job, err := st.WebhookJob("evt_1"); err != nil || job.State != storage.WebhookJobDone || processed["evt_1"] != 1 {
+		t.Fatalf("unexpected job %+v (%v)", job, err)
+	}
+
+	// failed jobs are retried with an exponential backoff until they are dead-lettered
+	if err := q.Enqueue("test", "evt_2", "test.event", []byte("fail")); err != nil {
+		t.Fatalf("failed to enqueue: %v", err)
+	}
+	job, err := st.WebhookJob("evt_2")
+	if err != nil {
+		t.Fatalf("failed to get job: %v", err)
+	}
+	for i := 1; i <= q.MaxAttempts; i++ {
+		before := time.Now()
+		q.process(job)
+		if i < q.MaxAttempts && (job.State != storage.WebhookJobPending || job.NextAttempt.Before(before.Add(q.retryDelay(i)))) {
+			t.Fatalf("attempt %d: unexpected job %+v", i, job)
+		}
+	}
+	if job.State != storage.WebhookJobDead || job.LastError != "failed" || len(dead) != 1 {
+		t.Fatalf("expected dead job, got %+v", job)
+	}
+	if q.retryDelay(1) != q.RetryDelay || q.retryDelay(2) != 2*q.RetryDelay || q.retryDelay(20) != q.MaxRetryDelay {
+		t.Fatalf("unexpected retry delays %v %v %v", q.retryDelay(1), q.retryDelay(2), q.retryDelay(20))
+	}
+
+	status, err := q.Status(storage.WebhookJobDead)
+	if err != nil || status.Done != 1 || status.Dead != 1 || len(status.Jobs) != 1 || status.Jobs[0].Payload != nil {
+		t.Fatalf("unexpected status %+v (%v)", status, err)
+	}
+
+	// dead jobs are retried by the operator from scratch
+	if _, err := q.Retry("evt_1"); !errors.Is(err, ErrWebhookJobNotDead) {
+		t.Fatalf("expected job not dead, got %v", err)
+	}
+	if job, err := q.Retry("evt_2"); err != nil || job.State != storage.WebhookJobPending || job.Attempts != 0 {
+		t.Fatalf("unexpected retried job %+v (%v)", job, err)
+	}
+}
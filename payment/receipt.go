@@ -0,0 +1,181 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/types"
+)
+
+// Receipt is the record of a purchase, as returned to the recipient. Fulfilled purchases
+// include their faucet package, so a receipt can be downloaded again to redeem the purchase if
+// the package was lost.
+type Receipt struct {
+	ID          string    `json:"id"`
+	Provider    string    `json:"provider"`
+	State       string    `json:"state"`
+	Recipient   string    `json:"recipient"`
+	Quantity    uint64    `json:"quantity"`
+	Price       int64     `json:"price"` // Total price in the smallest currency unit.
+	Currency    string    `json:"currency"`
+	Email       string    `json:"email,omitempty"`
+	Package     []byte    `json:"package,omitempty"`
+	PurchasedAt time.Time `json:"purchasedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Issuer      string    `json:"issuer,omitempty"` // The faucet signer, set with IssuedAt in signed receipts.
+	IssuedAt    time.Time `json:"issuedAt"`
+}
+
+// SignedReceipt is a receipt and the signature of its JSON encoding by the faucet signer.
+type SignedReceipt struct {
+	Receipt   json.RawMessage `json:"receipt"`
+	Signature types.HexBytes  `json:"signature"`
+}
+
+// NewReceipt returns the receipt of the given payment made with the given provider.
+func NewReceipt(provider string, payment *storage.Payment) *Receipt {
+	receipt := &Receipt{
+		ID:          payment.ID,
+		Provider:    provider,
+		State:       string(payment.State),
+		Recipient:   payment.Recipient,
+		Quantity:    payment.Quantity,
+		Price:       payment.Price,
+		Currency:    payment.Currency,
+		Email:       payment.Email,
+		PurchasedAt: payment.CreatedAt,
+		UpdatedAt:   payment.UpdatedAt,
+	}
+	// refunded and disputed purchases cannot be redeemed again
+	if payment.State == storage.PaymentFulfilled {
+		receipt.Package = payment.Package
+	}
+	return receipt
+}
+
+// Sign returns the receipt signed by the given faucet signer.
+func (r *Receipt) Sign(signer *ethereum.SignKeys) (*SignedReceipt, error) {
+	r.Issuer = signer.Address().Hex()
+	r.IssuedAt = time.Now().UTC().Truncate(time.Second)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.SignEthereum(data)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedReceipt{Receipt: data, Signature: signature}, nil
+}
+
+// Verify checks that the receipt was signed by its issuer and returns it.
+func (s *SignedReceipt) Verify() (*Receipt, error) {
+	receipt := &Receipt{}
+	if err := json.Unmarshal(s.Receipt, receipt); err != nil {
+		return nil, fmt.Errorf("invalid receipt: %w", err)
+	}
+	signer, err := ethereum.AddrFromSignature(s.Receipt, s.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt signature: %w", err)
+	}
+	if !common.IsHexAddress(receipt.Issuer) || signer != common.HexToAddress(receipt.Issuer) {
+		return nil, errors.New("receipt not signed by its issuer")
+	}
+	return receipt, nil
+}
+
+// PDF returns a printable, single page, PDF document of the signed receipt. The signed JSON
+// document is the one to keep to redeem the purchase again.
+func (s *SignedReceipt) PDF() ([]byte, error) {
+	r, err := s.Verify()
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{
+		"Faucet purchase receipt",
+		"",
+		"Receipt: " + r.ID,
+		"Provider: " + r.Provider,
+		"State: " + r.State,
+		"Recipient: " + r.Recipient,
+		fmt.Sprintf("Tokens: %d", r.Quantity),
+		fmt.Sprintf("Price: %d %s (in the smallest currency unit)", r.Price, strings.ToUpper(r.Currency)),
+		"Purchased at: " + r.PurchasedAt.UTC().Format(time.RFC1123),
+		"Issued at: " + r.IssuedAt.UTC().Format(time.RFC1123),
+		"Issuer: " + r.Issuer,
+	}
+	if r.Email != "" {
+		lines = append(lines, "Email: "+r.Email)
+	}
+	lines = append(lines, "", "Signature:")
+	lines = append(lines, wrap(s.Signature.String(), 80)...)
+	return textPDF(lines), nil
+}
+
+// wrap splits the given string in lines of at most n characters.
+func wrap(s string, n int) []string {
+	var lines []string
+	for len(s) > n {
+		lines = append(lines, s[:n])
+		s = s[n:]
+	}
+	return append(lines, s)
+}
+
+// textPDF returns a single page A4 PDF document with the given lines of text, written in
+// Courier so no font needs to be embedded.
+func textPDF(lines []string) []byte {
+	content := &bytes.Buffer{}
+	content.WriteString("BT\n/F1 10 Tf\n12 TL\n50 790 Td\n")
+	for _, line := range lines {
+		fmt.Fprintf(content, "(%s) '\n", pdfEscape(line))
+	}
+	content.WriteString("ET\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+	}
+	pdf := &bytes.Buffer{}
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(pdf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+// pdfEscape escapes the given text for a PDF string, replacing the characters out of the
+// printable ASCII range, which the standard fonts cannot render.
+func pdfEscape(s string) string {
+	b := strings.Builder{}
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package payment
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestReceipt(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	fulfiller := NewFulfiller(&faucet.Faucet{Signer: signer, Storage: st}, st)
+	provider := &giftProvider{st: st}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+
+	// fulfilled purchases are recorded for the customer of the buyer email and recipient
+	for _, id := range []string{"r1", "r2"} {
+		if err := st.SetPayment(&storage.Payment{
+			ID: id, State: storage.PaymentCreated, Recipient: addr.Hex(), Quantity: 100,
+			Price: 500, Currency: "eur", Email: " Buyer@Example.com", CreatedAt: time.Now(),
+		}); err != nil {
+			t.Fatalf("failed to set payment: %v", err)
+		}
+		if _, err := fulfiller.Fulfill(provider, id); err != nil {
+			t.Fatalf("failed to fulfill payment: %v", err)
+		}
+	}
+	customers, err := st.Customers(addr.Hex())
+	if err != nil || len(customers) != 1 {
+		t.Fatalf("expected one customer, got %+v (%v)", customers, err)
+	}
+	if c := customers[0]; c.Email != "buyer@example.com" || c.Purchases != 2 || c.Tokens != 200 {
+		t.Fatalf("unexpected customer %+v", c)
+	}
+
+	// the signed receipt includes the package and is verified against its issuer
+	pay, err := st.Payment("r1")
+	if err != nil {
+		t.Fatalf("failed to get payment: %v", err)
+	}
+	signed, err := NewReceipt(provider.Name(), pay).Sign(signer)
+	if err != nil {
+		t.Fatalf("failed to sign receipt: %v", err)
+	}
+	receipt, err := signed.Verify()
+	if err != nil {
+		t.Fatalf("failed to verify receipt: %v", err)
+	}
+	if receipt.ID != "r1" || receipt.Issuer != signer.Address().Hex() || !bytes.Equal(receipt.Package, pay.Package) {
+		t.Fatalf("unexpected receipt %+v", receipt)
+	}
+	tampered := *signed
+	tampered.Receipt = bytes.Replace(signed.Receipt, []byte(`"quantity":100`), []byte(`"quantity":900`), 1)
+	if _, err := tampered.Verify(); err == nil {
+		t.Fatalf("expected a tampered receipt to fail verification")
+	}
+	pdf, err := signed.PDF()
+	if err != nil || !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.Contains(pdf, []byte("Receipt: r1")) {
+		t.Fatalf("unexpected receipt pdf (%v)", err)
+	}
+}
@@ -0,0 +1,140 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnknownCurrency is returned when there are no prices in the requested currency.
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// Catalog is a set of price tables, one per currency, with the same tier logic applied within
+// each one.
+type Catalog struct {
+	Default string            `json:"default"` // The currency used when none is requested or derived.
+	Tables  map[string]*Table `json:"tables"`  // By lowercase currency code.
+}
+
+// NewCatalog returns a catalog with the given tables, which must have different currencies.
+// The default currency must be one of them.
+func NewCatalog(defaultCurrency string, tables ...*Table) (*Catalog, error) {
+	c := &Catalog{Default: strings.ToLower(defaultCurrency), Tables: make(map[string]*Table, len(tables))}
+	for _, t := range tables {
+		if _, ok := c.Tables[t.Currency]; ok {
+			return nil, fmt.Errorf("duplicated price tiers for currency %s", t.Currency)
+		}
+		c.Tables[t.Currency] = t
+	}
+	if _, ok := c.Tables[c.Default]; !ok {
+		return nil, fmt.Errorf("%w: no price tiers for the default currency %q", ErrUnknownCurrency, defaultCurrency)
+	}
+	return c, nil
+}
+
+// ParseCatalog parses the price tiers of one or more currencies. Tiers of several currencies
+// are separated by semicolons and prefixed by their currency code, such as
+// "eur=1:10,100:8;usd=1:11,100:9". Tiers without a currency code, as accepted by ParseTiers,
+// are in the default currency.
+func ParseCatalog(defaultCurrency, s string) (*Catalog, error) {
+	var tables []*Table
+	for _, item := range strings.Split(s, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		currency, tiers, ok := strings.Cut(item, "=")
+		if !ok {
+			currency, tiers = defaultCurrency, item
+		}
+		parsed, err := ParseTiers(tiers)
+		if err != nil {
+			return nil, err
+		}
+		table, err := NewTable(strings.TrimSpace(currency), parsed)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return NewCatalog(defaultCurrency, tables...)
+}
+
+// Currencies returns the currencies of the catalog, sorted.
+func (c *Catalog) Currencies() []string {
+	currencies := make([]string, 0, len(c.Tables))
+	for currency := range c.Tables {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// Table returns the price table of the given currency, or of the default currency if it is
+// empty.
+func (c *Catalog) Table(currency string) (*Table, error) {
+	if currency == "" {
+		currency = c.Default
+	}
+	t, ok := c.Tables[strings.ToLower(currency)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q, available currencies are %s", ErrUnknownCurrency, currency,
+			strings.Join(c.Currencies(), ", "))
+	}
+	return t, nil
+}
+
+// Resolve returns the currency of a purchase. A requested currency must be in the catalog.
+// Otherwise, the currency of the client country is used, then the currency of the regions of
+// the client locales, as in an Accept-Language header, and then the default currency.
+func (c *Catalog) Resolve(currency, country, locales string) (string, error) {
+	if currency != "" {
+		t, err := c.Table(currency)
+		if err != nil {
+			return "", err
+		}
+		return t.Currency, nil
+	}
+	candidates := []string{country}
+	for _, locale := range strings.Split(locales, ",") {
+		// drop the quality value, such as in "en-US;q=0.8"
+		tag, _, _ := strings.Cut(strings.TrimSpace(locale), ";")
+		parts := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' })
+		if len(parts) > 1 {
+			candidates = append(candidates, parts[len(parts)-1])
+		}
+	}
+	for _, country := range candidates {
+		if cur, ok := countryCurrencies[strings.ToUpper(strings.TrimSpace(country))]; ok {
+			if _, ok := c.Tables[cur]; ok {
+				return cur, nil
+			}
+		}
+	}
+	return c.Default, nil
+}
+
+// Quote returns the price of the given quantity of tokens in the given currency, or in the
+// default currency if it is empty.
+func (c *Catalog) Quote(quantity int64, currency string) (*Quote, error) {
+	t, err := c.Table(currency)
+	if err != nil {
+		return nil, err
+	}
+	return t.Quote(quantity)
+}
+
+// countryCurrencies are the currencies of the countries, by ISO 3166 code, for the currencies
+// accepted by Stripe in most of them.
+var countryCurrencies = map[string]string{
+	// eurozone
+	"AT": "eur", "BE": "eur", "CY": "eur", "DE": "eur", "EE": "eur", "ES": "eur", "FI": "eur",
+	"FR": "eur", "GR": "eur", "HR": "eur", "IE": "eur", "IT": "eur", "LT": "eur", "LU": "eur",
+	"LV": "eur", "MT": "eur", "NL": "eur", "PT": "eur", "SI": "eur", "SK": "eur",
+	"BG": "eur", "AD": "eur", "MC": "eur", "SM": "eur", "VA": "eur", "ME": "eur", "XK": "eur",
+	// others
+	"US": "usd", "PR": "usd", "EC": "usd", "SV": "usd", "PA": "usd",
+	"GB": "gbp", "CH": "chf", "LI": "chf", "CA": "cad", "AU": "aud", "NZ": "nzd", "JP": "jpy",
+	"SE": "sek", "NO": "nok", "DK": "dkk", "PL": "pln", "CZ": "czk", "HU": "huf", "RO": "ron",
+	"MX": "mxn", "BR": "brl", "IN": "inr", "SG": "sgd", "HK": "hkd",
+}
@@ -0,0 +1,181 @@
+// Package pricing computes the price of token purchases from a table of volume tiers, using
+// exact rational arithmetic, so quotes and checkout line items always agree.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxDecimals is the max number of decimals of a unit price, as accepted by Stripe.
+const MaxDecimals = 12
+
+// maxSignificantDigits is the max number of significant digits of a unit price, so it can be
+// represented as a float64 without changing its decimal representation.
+const maxSignificantDigits = 15
+
+var (
+	// ErrNoTier is returned when no tier applies to the requested quantity.
+	ErrNoTier = errors.New("no price tier for quantity")
+	// ErrOverflow is returned when a price does not fit in an int64.
+	ErrOverflow = errors.New("price overflow")
+)
+
+// Tier is a volume tier. Packages of PackageSize tokens cost PackagePrice, in the smallest
+// currency unit, and the tier applies to purchases of at least MinQuantity tokens, up to the
+// MinQuantity of the next tier.
+type Tier struct {
+	MinQuantity  int64  `json:"minQuantity"`
+	PackageSize  int64  `json:"packageSize"`
+	PackagePrice int64  `json:"packagePrice"`
+	UnitPrice    string `json:"unitPrice"` // Decimal price of a token, set by NewTable.
+	PriceID      string `json:"priceId,omitempty"`
+}
+
+// unitPrice returns the exact price of a token.
+func (t *Tier) unitPrice() *big.Rat {
+	return big.NewRat(t.PackagePrice, t.PackageSize)
+}
+
+// Table is a set of volume tiers sorted by MinQuantity.
+type Table struct {
+	Currency string `json:"currency"`
+	Tiers    []Tier `json:"tiers"`
+}
+
+// Quote is the price of a purchase. If the unit price is an integer, UnitAmount is set and the
+// total is exactly UnitAmount*Quantity, otherwise the total is UnitAmountDecimal*Quantity
+// rounded half up.
+type Quote struct {
+	Quantity          int64  `json:"quantity"`
+	Tier              Tier   `json:"tier"`
+	UnitAmount        int64  `json:"unitAmount,omitempty"`
+	UnitAmountDecimal string `json:"unitAmountDecimal"`
+	Total             int64  `json:"total"`
+	Currency          string `json:"currency"`
+}
+
+// NewTable returns a table with the given tiers, sorted by MinQuantity, after validating them.
+func NewTable(currency string, tiers []Tier) (*Table, error) {
+	if currency == "" {
+		return nil, fmt.Errorf("missing currency")
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no price tiers")
+	}
+	sorted := make([]Tier, len(tiers))
+	copy(sorted, tiers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].MinQuantity < sorted[j].MinQuantity
+	})
+	for i := range sorted {
+		t := &sorted[i]
+		if t.MinQuantity <= 0 || t.PackageSize <= 0 || t.PackagePrice < 0 {
+			return nil, fmt.Errorf("invalid price tier %+v", *t)
+		}
+		if i > 0 && t.MinQuantity == sorted[i-1].MinQuantity {
+			return nil, fmt.Errorf("duplicated price tier for quantity %d", t.MinQuantity)
+		}
+		t.UnitPrice = unitDecimal(t.unitPrice())
+	}
+	return &Table{Currency: strings.ToLower(currency), Tiers: sorted}, nil
+}
+
+// ParseTiers parses a comma separated list of minQuantity:unitPrice pairs, where unitPrice is
+// the decimal price of a token in the smallest currency unit, such as "1:10,100:8,1000:4.5".
+func ParseTiers(s string) ([]Tier, error) {
+	var tiers []Tier
+	for _, item := range strings.Split(s, ",") {
+		minQuantity, unitPrice, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid price tier %q, expected minQuantity:unitPrice", item)
+		}
+		q, err := strconv.ParseInt(minQuantity, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price tier quantity %q: %w", minQuantity, err)
+		}
+		price, ok := new(big.Rat).SetString(unitPrice)
+		if !ok || price.Sign() < 0 {
+			return nil, fmt.Errorf("invalid price tier unit price %q", unitPrice)
+		}
+		if !price.Num().IsInt64() || !price.Denom().IsInt64() {
+			return nil, fmt.Errorf("%w: unit price %q", ErrOverflow, unitPrice)
+		}
+		tiers = append(tiers, Tier{
+			MinQuantity:  q,
+			PackageSize:  price.Denom().Int64(),
+			PackagePrice: price.Num().Int64(),
+		})
+	}
+	return tiers, nil
+}
+
+// Tier returns the tier that applies to the given quantity, the one with the largest
+// MinQuantity not greater than the quantity.
+func (t *Table) Tier(quantity int64) (Tier, error) {
+	i := sort.Search(len(t.Tiers), func(i int) bool {
+		return t.Tiers[i].MinQuantity > quantity
+	})
+	if i == 0 {
+		return Tier{}, fmt.Errorf("%w: %d", ErrNoTier, quantity)
+	}
+	return t.Tiers[i-1], nil
+}
+
+// Quote returns the price of the given quantity of tokens.
+func (t *Table) Quote(quantity int64) (*Quote, error) {
+	tier, err := t.Tier(quantity)
+	if err != nil {
+		return nil, err
+	}
+	q := &Quote{
+		Quantity:          quantity,
+		Tier:              tier,
+		UnitAmountDecimal: tier.UnitPrice,
+		Currency:          t.Currency,
+	}
+	unit, ok := new(big.Rat).SetString(tier.UnitPrice)
+	if !ok {
+		return nil, fmt.Errorf("invalid unit price %q", tier.UnitPrice)
+	}
+	total := roundHalfUp(new(big.Rat).Mul(unit, new(big.Rat).SetInt64(quantity)))
+	if !total.IsInt64() {
+		return nil, fmt.Errorf("%w: %d tokens at %s", ErrOverflow, quantity, tier.UnitPrice)
+	}
+	q.Total = total.Int64()
+	if unit.IsInt() {
+		q.UnitAmount = unit.Num().Int64()
+	}
+	return q, nil
+}
+
+// UnitAmountFloat returns the unit price as a float64. The decimal representation of the
+// returned value is exactly UnitAmountDecimal.
+func (q *Quote) UnitAmountFloat() float64 {
+	f, _ := strconv.ParseFloat(q.UnitAmountDecimal, 64)
+	return f
+}
+
+// unitDecimal returns the decimal representation of the given price, rounded half up to at
+// most MaxDecimals decimals and maxSignificantDigits significant digits.
+func unitDecimal(price *big.Rat) string {
+	intDigits := len(new(big.Int).Quo(price.Num(), price.Denom()).String())
+	decimals := min(MaxDecimals, max(0, maxSignificantDigits-intDigits))
+	s := price.FloatString(decimals)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// roundHalfUp rounds the given non negative rational to the nearest integer, rounding halves up.
+func roundHalfUp(r *big.Rat) *big.Int {
+	num := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	num.Add(num, r.Denom())
+	den := new(big.Int).Mul(r.Denom(), big.NewInt(2))
+	return num.Quo(num, den)
+}
@@ -0,0 +1,178 @@
+package pricing
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+func testTable(t *testing.T) *Table {
+	tiers, err := ParseTiers("1:10,100:8,1000:4.5,10000:3.333333333333333")
+	if err != nil {
+		t.Fatalf("failed to parse tiers: %v", err)
+	}
+	table, err := NewTable("EUR", tiers)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	return table
+}
+
+func TestQuote(t *testing.T) {
+	table := testTable(t)
+	for quantity, expected := range map[int64]struct {
+		minQuantity int64
+		unit        string
+		total       int64
+	}{
+		1:     {1, "10", 10},
+		99:    {1, "10", 990},
+		100:   {100, "8", 800},
+		999:   {100, "8", 7992},
+		1000:  {1000, "4.5", 4500},
+		1001:  {1000, "4.5", 4505}, // 4504.5 rounded half up
+		10000: {10000, "3.333333333333", 33333},
+	} {
+		q, err := table.Quote(quantity)
+		if err != nil {
+			t.Fatalf("failed to quote %d: %v", quantity, err)
+		}
+		if q.Tier.MinQuantity != expected.minQuantity || q.UnitAmountDecimal != expected.unit ||
+			q.Total != expected.total || q.Currency != "eur" {
+			t.Fatalf("unexpected quote for %d: %+v", quantity, q)
+		}
+	}
+	if _, err := table.Quote(0); !errors.Is(err, ErrNoTier) {
+		t.Fatalf("expected no tier, got %v", err)
+	}
+	if _, err := NewTable("eur", []Tier{{MinQuantity: 1, PackageSize: 1, PackagePrice: 1}, {MinQuantity: 1, PackageSize: 1, PackagePrice: 2}}); err == nil {
+		t.Fatalf("expected duplicated tiers to fail")
+	}
+}
+
+// TestQuoteProperties checks the invariants of quotes for random tiers and quantities.
+func TestQuoteProperties(t *testing.T) {
+	property := func(packageSize, packagePrice uint32, quantity uint32) bool {
+		tier := Tier{
+			MinQuantity:  1,
+			PackageSize:  int64(packageSize%100000) + 1,
+			PackagePrice: int64(packagePrice),
+		}
+		table, err := NewTable("eur", []Tier{tier})
+		if err != nil {
+			return false
+		}
+		qty := int64(quantity%1000000) + 1
+		q, err := table.Quote(qty)
+		if err != nil {
+			return false
+		}
+		// the same quote is always returned
+		if again, err := table.Quote(qty); err != nil || *again != *q {
+			return false
+		}
+		// the decimal unit price is exactly represented as a float64
+		if strconv.FormatFloat(q.UnitAmountFloat(), 'f', -1, 64) != q.UnitAmountDecimal {
+			return false
+		}
+		// integer unit prices give exact totals
+		if q.UnitAmount != 0 && q.Total != q.UnitAmount*qty {
+			return false
+		}
+		// the total is within half a unit, plus the rounding of the unit price, of the exact price
+		exact := new(big.Rat).Mul(big.NewRat(tier.PackagePrice, tier.PackageSize), new(big.Rat).SetInt64(qty))
+		diff := new(big.Rat).Sub(new(big.Rat).SetInt64(q.Total), exact)
+		intDigits := len(strconv.FormatInt(tier.PackagePrice/tier.PackageSize, 10))
+		decimals := min(MaxDecimals, max(0, maxSignificantDigits-intDigits))
+		unitRounding := new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Mul(big.NewInt(2),
+			new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+		bound := new(big.Rat).Add(big.NewRat(1, 2), unitRounding.Mul(unitRounding, new(big.Rat).SetInt64(qty)))
+		if diff.Abs(diff).Cmp(bound) > 0 {
+			return false
+		}
+		// buying more never costs less within a tier
+		if next, err := table.Quote(qty + 1); err != nil || next.Total < q.Total {
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTierProperties checks that the selected tier is the last one not above the quantity.
+func TestTierProperties(t *testing.T) {
+	property := func(minQuantities []uint16, quantity uint32) bool {
+		tiers := []Tier{{MinQuantity: 1, PackageSize: 1, PackagePrice: 100}}
+		seen := map[int64]bool{1: true}
+		for i, m := range minQuantities {
+			minQuantity := int64(m) + 1
+			if seen[minQuantity] {
+				continue
+			}
+			seen[minQuantity] = true
+			tiers = append(tiers, Tier{MinQuantity: minQuantity, PackageSize: minQuantity, PackagePrice: int64(i)})
+		}
+		table, err := NewTable("eur", tiers)
+		if err != nil {
+			return false
+		}
+		qty := int64(quantity%70000) + 1
+		tier, err := table.Tier(qty)
+		if err != nil || tier.MinQuantity > qty {
+			return false
+		}
+		for _, other := range table.Tiers {
+			if other.MinQuantity > tier.MinQuantity && other.MinQuantity <= qty {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	catalog, err := ParseCatalog("eur", "1:10,100:8; usd=1:11,100:9; gbp=1:9")
+	if err != nil {
+		t.Fatalf("failed to parse catalog: %v", err)
+	}
+	if currencies := catalog.Currencies(); len(currencies) != 3 || currencies[0] != "eur" || currencies[2] != "usd" {
+		t.Fatalf("unexpected currencies %v", currencies)
+	}
+	// the same tier logic applies within each currency
+	if quote, err := catalog.Quote(150, "USD"); err != nil || quote.Currency != "usd" || quote.Total != 1350 {
+		t.Fatalf("unexpected usd quote %+v (%v)", quote, err)
+	}
+	if quote, err := catalog.Quote(150, ""); err != nil || quote.Currency != "eur" || quote.Total != 1200 {
+		t.Fatalf("unexpected default quote %+v (%v)", quote, err)
+	}
+
+	for _, c := range []struct {
+		currency, country, locales, expected string
+	}{
+		{"GBP", "US", "en-US", "gbp"},
+		{"", "us", "en-GB", "usd"},
+		{"", "", "fr-CH;q=0.9, en-GB;q=0.8", "gbp"},
+		{"", "JP", "ja_JP", "eur"},
+		{"", "", "", "eur"},
+	} {
+		if got, err := catalog.Resolve(c.currency, c.country, c.locales); err != nil || got != c.expected {
+			t.Fatalf("resolve(%q, %q, %q): expected %s, got %s (%v)", c.currency, c.country, c.locales, c.expected, got, err)
+		}
+	}
+	if _, err := catalog.Resolve("jpy", "", ""); !errors.Is(err, ErrUnknownCurrency) {
+		t.Fatalf("expected unknown currency, got %v", err)
+	}
+
+	for _, invalid := range []string{"usd=1:10", "eur=1:10;eur=1:9", "eur=x"} {
+		if _, err := ParseCatalog("eur", invalid); err == nil {
+			t.Fatalf("expected invalid catalog %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Package reconcile matches the charges reported by a payment provider to the payments stored
+// by the faucet and the tokens actually issued for them, as recorded in the faucet ledger.
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+// Report output formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Mismatches between the provider charges, the stored payments and the issued tokens.
+const (
+	// MismatchUnfulfilled is a paid charge, not refunded, for which no tokens were issued.
+	MismatchUnfulfilled = "paid_unfulfilled"
+	// MismatchUnpaid is a payment for which tokens were issued without a paid charge.
+	MismatchUnpaid = "fulfilled_without_payment"
+	// MismatchQuantity is a payment for which a different number of tokens was issued.
+	MismatchQuantity = "tokens_mismatch"
+	// MismatchAmount is a payment whose stored price differs from the charged amount.
+	MismatchAmount = "amount_mismatch"
+	// MismatchNotStored is a paid charge without a stored payment.
+	MismatchNotStored = "payment_not_stored"
+)
+
+// ErrInvalidRange is returned when the report date range is empty.
+var ErrInvalidRange = errors.New("invalid date range")
+
+// Charge is a checkout as reported by the payment provider.
+type Charge struct {
+	ID             string    // The checkout ID, which is the ID of the stored payment.
+	PaymentID      string    // The ID of the payment at the provider, if any.
+	Paid           bool      // True if the payment has been received.
+	Amount         int64     // The amount charged, in the smallest currency unit.
+	AmountRefunded int64     // The amount refunded, in the smallest currency unit.
+	Disputed       bool      // True if the charge has been disputed.
+	Currency       string    // The currency of the amounts.
+	CreatedAt      time.Time // The time the checkout was created.
+}
+
+// Source lists the charges of a payment provider.
+type Source interface {
+	// Name returns the name of the provider, which is the auth type of its ledger entries.
+	Name() string
+	// Charges returns the checkouts created within [from, to).
+	Charges(from, to time.Time) ([]*Charge, error)
+}
+
+// Row is the reconciliation of a charge, or of a payment issued without a charge.
+type Row struct {
+	ID             string    `json:"id"`
+	PaymentID      string    `json:"paymentId,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	Recipient      string    `json:"recipient,omitempty"`
+	State          string    `json:"state,omitempty"` // The state of the stored payment.
+	Paid           bool      `json:"paid"`
+	Amount         int64     `json:"amount"`
+	AmountRefunded int64     `json:"amountRefunded"`
+	Currency       string    `json:"currency"`
+	Refund         string    `json:"refund"` // none, partial, full or disputed
+	Quantity       uint64    `json:"quantity"`
+	Issued         uint64    `json:"issued"`
+	Mismatches     []string  `json:"mismatches,omitempty"`
+}
+
+// Total are the totals of the report rows in a currency.
+type Total struct {
+	Charged  int64  `json:"charged"`
+	Refunded int64  `json:"refunded"`
+	Issued   uint64 `json:"issued"`
+}
+
+// Report is the reconciliation of the charges of a provider within [From, To).
+type Report struct {
+	Provider   string            `json:"provider"`
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Rows       []*Row            `json:"rows"`
+	Totals     map[string]*Total `json:"totals"` // By currency.
+	Mismatches int               `json:"mismatches"`
+}
+
+// Generate returns the reconciliation of the charges of the given source created within
+// [from, to). The tokens issued for them are looked up in the ledger from the start of the
+// range until now, since gifts can be redeemed after the range ends.
+func Generate(src Source, st storage.Storage, from, to time.Time) (*Report, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w: %s is not before %s", ErrInvalidRange, from, to)
+	}
+	charges, err := src.Charges(from, to)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := st.LedgerEntries(from, time.Now().Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	issued := make(map[string]uint64)
+	issuedAt := make(map[string]time.Time)
+	for _, e := range entries {
+		if e.AuthType != src.Name() || e.Reference == "" {
+			continue
+		}
+		issued[e.Reference] += e.Amount
+		if _, ok := issuedAt[e.Reference]; !ok {
+			issuedAt[e.Reference] = e.Time
+		}
+	}
+
+	report := &Report{Provider: src.Name(), From: from, To: to, Rows: []*Row{}, Totals: make(map[string]*Total)}
+	charged := make(map[string]bool, len(charges))
+	for _, c := range charges {
+		charged[c.ID] = true
+		row := &Row{
+			ID:             c.ID,
+			PaymentID:      c.PaymentID,
+			CreatedAt:      c.CreatedAt,
+			Paid:           c.Paid,
+			AmountRefunded: c.AmountRefunded,
+			Currency:       c.Currency,
+			Refund:         refundStatus(c),
+			Issued:         issued[c.ID],
+		}
+		if c.Paid {
+			row.Amount = c.Amount
+		}
+		payment, err := st.Payment(c.ID)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			if c.Paid {
+				row.Mismatches = append(row.Mismatches, MismatchNotStored)
+			}
+		case err != nil:
+			return nil, err
+		default:
+			row.Recipient = payment.Recipient
+			row.State = string(payment.State)
+			row.Quantity = payment.Quantity
+			if c.Paid && payment.Price != c.Amount {
+				row.Mismatches = append(row.Mismatches, MismatchAmount)
+			}
+		}
+		switch {
+		case row.Issued > 0 && !c.Paid:
+			row.Mismatches = append(row.Mismatches, MismatchUnpaid)
+		case row.Issued == 0 && c.Paid && row.Refund == "none" && !pendingGift(payment):
+			row.Mismatches = append(row.Mismatches, MismatchUnfulfilled)
+		case row.Issued > 0 && row.Quantity > 0 && row.Issued != row.Quantity:
+			row.Mismatches = append(row.Mismatches, MismatchQuantity)
+		}
+		report.add(row)
+	}
+
+	// tokens issued within the range for checkouts the provider did not report, unless the
+	// checkout was created before the range and so belongs to a previous report
+	for id, amount := range issued {
+		if charged[id] || !issuedAt[id].Before(to) {
+			continue
+		}
+		row := &Row{ID: id, CreatedAt: issuedAt[id], Refund: "none", Issued: amount, Mismatches: []string{MismatchUnpaid}}
+		payment, err := st.Payment(id)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		if payment != nil {
+			if payment.CreatedAt.Before(from) {
+				continue
+			}
+			row.CreatedAt = payment.CreatedAt
+			row.Recipient = payment.Recipient
+			row.State = string(payment.State)
+			row.Quantity = payment.Quantity
+			row.Currency = payment.Currency
+		}
+		report.add(row)
+	}
+	sort.SliceStable(report.Rows, func(i, j int) bool {
+		return report.Rows[i].CreatedAt.Before(report.Rows[j].CreatedAt)
+	})
+	return report, nil
+}
+
+// add adds the given row to the report and its totals.
+func (r *Report) add(row *Row) {
+	r.Rows = append(r.Rows, row)
+	total, ok := r.Totals[row.Currency]
+	if !ok {
+		total = &Total{}
+		r.Totals[row.Currency] = total
+	}
+	total.Charged += row.Amount
+	total.Refunded += row.AmountRefunded
+	total.Issued += row.Issued
+	if len(row.Mismatches) > 0 {
+		r.Mismatches++
+	}
+}
+
+// refundStatus returns the refund status of the given charge.
+func refundStatus(c *Charge) string {
+	switch {
+	case c.Disputed:
+		return "disputed"
+	case c.AmountRefunded == 0:
+		return "none"
+	case c.AmountRefunded < c.Amount:
+		return "partial"
+	default:
+		return "full"
+	}
+}
+
+// pendingGift returns true if the given payment is a gift that can still be redeemed.
+func pendingGift(p *storage.Payment) bool {
+	return p != nil && p.Gift != nil && p.State == storage.PaymentPaid && time.Now().Before(p.Gift.ExpiresAt)
+}
+
+// Write writes the report to w in the given format, json or csv. The CSV document has a row
+// per charge, without the totals.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{
+			"id", "payment_id", "created_at", "recipient", "state", "paid", "amount", "amount_refunded",
+			"currency", "refund", "quantity", "issued", "mismatches",
+		}); err != nil {
+			return err
+		}
+		for _, row := range r.Rows {
+			if err := cw.Write([]string{
+				row.ID,
+				row.PaymentID,
+				row.CreatedAt.UTC().Format(time.RFC3339),
+				row.Recipient,
+				row.State,
+				strconv.FormatBool(row.Paid),
+				strconv.FormatInt(row.Amount, 10),
+				strconv.FormatInt(row.AmountRefunded, 10),
+				row.Currency,
+				row.Refund,
+				strconv.FormatUint(row.Quantity, 10),
+				strconv.FormatUint(row.Issued, 10),
+				strings.Join(row.Mismatches, ";"),
+			}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// ParseRange parses the given report range dates, formatted as 2006-01-02 (UTC). The range
+// includes the whole to day.
+func ParseRange(from, to string) (time.Time, time.Time, error) {
+	f, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+	}
+	t, err := time.Parse(time.DateOnly, to)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+	}
+	return f, t.AddDate(0, 0, 1), nil
+}
@@ -0,0 +1,105 @@
+package referral
+
+import (
+	"encoding/json"
+	"errors"
+
+	hr "github.com/vocdoni/vocfaucet/handlersresponse"
+	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/httprouter"
+	"go.vocdoni.io/dvote/httprouter/apirest"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Register the handlers URLs
+func (p *Program) RegisterHandlers(api *apirest.API) {
+	if err := api.RegisterMethod(
+		"/referrals/register/{address}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		p.register,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/referrals/{code}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		p.stats,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/referrals/{code}/claim",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		p.claim,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// register registers a referral code for an address, the address itself if no code is given
+func (p *Program) register(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, err := helpers.StringToAddress(ctx.URLParam("address"))
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	newRequest := struct {
+		Code string `json:"code"`
+	}{}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+	}
+	referrer, err := p.Register(newRequest.Code, addr)
+	switch {
+	case errors.Is(err, ErrInvalidCode):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	case errors.Is(err, ErrCodeTaken):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrReferralCodeTaken)
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(referrer).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// stats returns the statistics and the claims of a referrer
+func (p *Program) stats(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	stats, err := p.Stats(ctx.URLParam("code"))
+	switch {
+	case errors.Is(err, ErrInvalidCode):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	case errors.Is(err, storage.ErrNotFound):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrReferrerNotFound).MustMarshall(), hr.CodeErrReferrerNotFound)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(stats).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// claim issues a faucet package to a referrer for its pending rewards. The package can only
+// be used by the referrer address, and it is also returned by the stats of the referrer.
+func (p *Program) claim(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	claim, err := p.Claim(ctx.URLParam("code"))
+	switch {
+	case errors.Is(err, ErrInvalidCode):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	case errors.Is(err, storage.ErrNotFound):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrReferrerNotFound).MustMarshall(), hr.CodeErrReferrerNotFound)
+	case errors.Is(err, ErrNothingToClaim):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrNothingToClaim)
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(claim).MustMarshall(), apirest.HTTPstatusOK)
+}
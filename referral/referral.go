@@ -0,0 +1,307 @@
+// Package referral rewards the referrers of the faucet token purchases. A registered referrer
+// earns a percentage of the tokens bought with its code, which it can claim as a faucet package.
+package referral
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+var (
+	// ErrInvalidCode is returned when a referral code is not valid.
+	ErrInvalidCode = errors.New("invalid referral code")
+	// ErrCodeTaken is returned when a referral code is registered to another address.
+	ErrCodeTaken = errors.New("referral code already taken")
+	// ErrNothingToClaim is returned when a referrer has no pending rewards.
+	ErrNothingToClaim = errors.New("no pending referral rewards")
+)
+
+// codeRegexp matches the custom referral codes, which are stored lowercase. Addresses are
+// valid codes too.
+var codeRegexp = regexp.MustCompile(`^[a-z0-9_-]{3,32}$`)
+
+// Program issues the referral rewards. It is a payment fulfillment hook, so a reward is
+// recorded for every fulfilled purchase with the code of a registered referrer, and revoked
+// if the purchase is refunded or disputed before it is claimed.
+type Program struct {
+	Storage storage.Storage
+	Faucet  *faucet.Faucet
+	Percent uint64 // The percentage of the tokens bought earned by the referrer.
+	lock    sync.Mutex
+}
+
+// check that Program implements the payment hooks
+var (
+	_ payment.FulfillmentHook = (*Program)(nil)
+	_ payment.RevocationHook  = (*Program)(nil)
+)
+
+// Stats are the statistics of a referrer. Revoked rewards are not counted as referrals.
+type Stats struct {
+	Referrer  *storage.Referrer        `json:"referrer"`
+	Referrals uint64                   `json:"referrals"`
+	Bought    uint64                   `json:"bought"` // The tokens bought with the code.
+	Earned    uint64                   `json:"earned"`
+	Claimed   uint64                   `json:"claimed"`
+	Pending   uint64                   `json:"pending"`
+	Revoked   uint64                   `json:"revoked"`
+	Claims    []*storage.ReferralClaim `json:"claims"`
+}
+
+// NewProgram creates a new referral program that rewards the given percentage of the tokens
+// bought.
+func NewProgram(f *faucet.Faucet, st storage.Storage, percent uint64) (*Program, error) {
+	if f == nil || st == nil {
+		return nil, errors.New("missing required parameters")
+	}
+	if percent == 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid referral percentage %d", percent)
+	}
+	return &Program{Storage: st, Faucet: f, Percent: percent}, nil
+}
+
+// NormalizeCode returns the stored form of the given referral code: the checksummed address
+// for addresses, lowercase otherwise.
+func NormalizeCode(code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if common.IsHexAddress(code) {
+		return common.HexToAddress(code).Hex(), nil
+	}
+	code = strings.ToLower(code)
+	if !codeRegexp.MatchString(code) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCode, code)
+	}
+	return code, nil
+}
+
+// Register registers the given code for the given address. If code is empty, the address is
+// the code. Registering a code again for the same address is a no-op.
+func (p *Program) Register(code string, addr common.Address) (*storage.Referrer, error) {
+	if code == "" {
+		code = addr.Hex()
+	}
+	code, err := NormalizeCode(code)
+	if err != nil {
+		return nil, err
+	}
+	if common.IsHexAddress(code) && code != addr.Hex() {
+		return nil, fmt.Errorf("%w: address codes must be the address of the referrer", ErrInvalidCode)
+	}
+	if err := payment.CheckDenylist(p.Storage, addr); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	referrer, err := p.Storage.Referrer(code)
+	switch {
+	case err == nil && referrer.Address == addr.Hex():
+		return referrer, nil
+	case err == nil:
+		return nil, fmt.Errorf("%w: %s", ErrCodeTaken, code)
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	}
+	referrer = &storage.Referrer{Code: code, Address: addr.Hex(), CreatedAt: time.Now()}
+	if err := p.Storage.SetReferrer(referrer); err != nil {
+		return nil, err
+	}
+	return referrer, nil
+}
+
+// referrer returns the registered referrer of the given referral, or nil if there is none.
+// Referrals are free text sent by the clients, so invalid codes are not an error.
+func (p *Program) referrer(referral string) (*storage.Referrer, error) {
+	if referral == "" {
+		return nil, nil
+	}
+	code, err := NormalizeCode(referral)
+	if err != nil {
+		return nil, nil
+	}
+	referrer, err := p.Storage.Referrer(code)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	return referrer, err
+}
+
+// reward returns the tokens earned for a purchase of the given quantity, rounded down.
+func (p *Program) reward(quantity uint64) uint64 {
+	return quantity/100*p.Percent + quantity%100*p.Percent/100
+}
+
+// selfReferral returns true if the referrer is the recipient or the payer of the payment.
+func selfReferral(referrer *storage.Referrer, pay *storage.Payment) bool {
+	return strings.EqualFold(referrer.Address, pay.Recipient) || strings.EqualFold(referrer.Address, pay.Customer)
+}
+
+// Fulfilled records the reward of the referrer of the given payment, if any.
+func (p *Program) Fulfilled(pay *storage.Payment) {
+	referrer, err := p.referrer(pay.Referral)
+	if err != nil {
+		log.Warnw("failed to get referrer", "referral", pay.Referral, "payment", pay.ID, "err", err)
+		return
+	}
+	if referrer == nil {
+		return
+	}
+	if selfReferral(referrer, pay) {
+		log.Infow("ignoring self referral", "code", referrer.Code, "payment", pay.ID)
+		return
+	}
+	amount := p.reward(pay.Quantity)
+	if amount == 0 {
+		return
+	}
+	now := time.Now()
+	if err := p.Storage.SetReferralReward(&storage.ReferralReward{
+		PaymentID: pay.ID,
+		Code:      referrer.Code,
+		State:     storage.RewardPending,
+		Recipient: pay.Recipient,
+		Quantity:  pay.Quantity,
+		Amount:    amount,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		log.Warnw("failed to record referral reward", "code", referrer.Code, "payment", pay.ID, "err", err)
+	}
+}
+
+// Revoked revokes the pending reward of the given payment, if any. Rewards already claimed
+// cannot be revoked, so they are only logged.
+func (p *Program) Revoked(pay *storage.Payment) {
+	referrer, err := p.referrer(pay.Referral)
+	if err != nil || referrer == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rewards, err := p.Storage.ReferralRewards(referrer.Code)
+	if err != nil {
+		log.Warnw("failed to get referral rewards", "code", referrer.Code, "err", err)
+		return
+	}
+	for _, reward := range rewards {
+		if reward.PaymentID != pay.ID {
+			continue
+		}
+		switch reward.State {
+		case storage.RewardPending:
+			reward.State = storage.RewardRevoked
+			reward.UpdatedAt = time.Now()
+			if err := p.Storage.SetReferralReward(reward); err != nil {
+				log.Warnw("failed to revoke referral reward", "code", referrer.Code, "payment", pay.ID, "err", err)
+			}
+		case storage.RewardClaimed:
+			log.Warnw("revoked payment had its referral reward already claimed",
+				"code", referrer.Code, "payment", pay.ID, "claim", reward.ClaimID, "amount", reward.Amount)
+		}
+	}
+}
+
+// Claim issues a faucet package to the referrer with the given code, for all its pending
+// rewards. The claim is stored, so its package can be retrieved again with the stats.
+func (p *Program) Claim(code string) (*storage.ReferralClaim, error) {
+	code, err := NormalizeCode(code)
+	if err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	referrer, err := p.Storage.Referrer(code)
+	if err != nil {
+		return nil, err
+	}
+	rewards, err := p.Storage.ReferralRewards(code)
+	if err != nil {
+		return nil, err
+	}
+	var pending []*storage.ReferralReward
+	amount := uint64(0)
+	for _, reward := range rewards {
+		if reward.State == storage.RewardPending {
+			pending = append(pending, reward)
+			amount += reward.Amount
+		}
+	}
+	if amount == 0 {
+		return nil, ErrNothingToClaim
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	claim := &storage.ReferralClaim{
+		ID:        "referral_" + hex.EncodeToString(id),
+		Code:      code,
+		Address:   referrer.Address,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+	}
+	data, err := p.Faucet.IssueFaucetPackage(common.HexToAddress(referrer.Address), amount, faucet.AuthTypeReferral, claim.ID)
+	if err != nil {
+		return nil, err
+	}
+	claim.Package = data.FaucetPackage
+	// if the claim cannot be stored its package is not returned either, so the rewards can
+	// be claimed again
+	if err := p.Storage.AddReferralClaim(claim); err != nil {
+		return nil, err
+	}
+	for _, reward := range pending {
+		reward.State, reward.ClaimID, reward.UpdatedAt = storage.RewardClaimed, claim.ID, claim.CreatedAt
+		if err := p.Storage.SetReferralReward(reward); err != nil {
+			return nil, err
+		}
+	}
+	return claim, nil
+}
+
+// Stats returns the statistics of the referrer with the given code.
+func (p *Program) Stats(code string) (*Stats, error) {
+	code, err := NormalizeCode(code)
+	if err != nil {
+		return nil, err
+	}
+	referrer, err := p.Storage.Referrer(code)
+	if err != nil {
+		return nil, err
+	}
+	rewards, err := p.Storage.ReferralRewards(code)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.Storage.ReferralClaims(code)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Referrer: referrer, Claims: claims}
+	for _, reward := range rewards {
+		if reward.State == storage.RewardRevoked {
+			stats.Revoked += reward.Amount
+			continue
+		}
+		stats.Referrals++
+		stats.Bought += reward.Quantity
+		stats.Earned += reward.Amount
+		if reward.State == storage.RewardClaimed {
+			stats.Claimed += reward.Amount
+		} else {
+			stats.Pending += reward.Amount
+		}
+	}
+	return stats, nil
+}
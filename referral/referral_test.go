@@ -0,0 +1,144 @@
+package referral
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// paidProvider is a payment provider that reports every stored payment as paid.
+type paidProvider struct {
+	st storage.Storage
+}
+
+func (*paidProvider) Name() string { return "test" }
+
+func (*paidProvider) CreateCheckout(*payment.CheckoutRequest) (*payment.Checkout, error) {
+	return nil, payment.ErrNotSupported
+}
+
+func (p *paidProvider) ConfirmPayment(id string) (*payment.Status, error) {
+	pay, err := p.st.Payment(id)
+	if err != nil {
+		return nil, err
+	}
+	return &payment.Status{
+		Status:        payment.StatusComplete,
+		PaymentStatus: payment.PaymentStatusPaid,
+		Recipient:     pay.Recipient,
+		Quantity:      int64(pay.Quantity),
+		Customer:      pay.Customer,
+	}, nil
+}
+
+func (*paidProvider) HandleWebhook([]byte, http.Header) error {
+	return payment.ErrNotSupported
+}
+
+func TestReferralRewards(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	f := &faucet.Faucet{Signer: signer, Storage: st}
+	program, err := NewProgram(f, st, 10)
+	if err != nil {
+		t.Fatalf("failed to create program: %v", err)
+	}
+	fulfiller := payment.NewFulfiller(f, st)
+	fulfiller.Hooks = append(fulfiller.Hooks, program)
+	provider := &paidProvider{st: st}
+
+	alice := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	bob := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	buyer := common.HexToAddress("0x00000000000000000000000000000000000000cc")
+
+	// registration
+	if _, err := program.Register("Alice", alice); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if _, err := program.Register("alice", alice); err != nil {
+		t.Fatalf("expected registering again to be a no-op: %v", err)
+	}
+	if _, err := program.Register("alice", bob); !errors.Is(err, ErrCodeTaken) {
+		t.Fatalf("expected code taken, got %v", err)
+	}
+	if _, err := program.Register("a!", bob); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("expected invalid code, got %v", err)
+	}
+	if _, err := program.Register(alice.Hex(), bob); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("expected invalid code for the address of another referrer, got %v", err)
+	}
+	if referrer, err := program.Register("", bob); err != nil || referrer.Code != bob.Hex() {
+		t.Fatalf("expected the address to be the code, got %+v (%v)", referrer, err)
+	}
+
+	// purchases: referred, self referred by recipient and payer, unknown code and refunded
+	now := time.Now()
+	for _, p := range []*storage.Payment{
+		{ID: "p1", Recipient: buyer.Hex(), Quantity: 155, Referral: "ALICE"},
+		{ID: "p2", Recipient: alice.Hex(), Quantity: 100, Referral: "alice"},
+		{ID: "p3", Recipient: buyer.Hex(), Customer: alice.Hex(), Quantity: 100, Referral: "alice"},
+		{ID: "p4", Recipient: buyer.Hex(), Quantity: 100, Referral: "https://example.com/?ref=alice"},
+		{ID: "p5", Recipient: buyer.Hex(), Quantity: 50, Referral: "alice"},
+	} {
+		p.State, p.CreatedAt = storage.PaymentCreated, now
+		if err := st.SetPayment(p); err != nil {
+			t.Fatalf("failed to set payment: %v", err)
+		}
+		if status, err := fulfiller.Fulfill(provider, p.ID); err != nil || status.FaucetPackage == nil {
+			t.Fatalf("failed to fulfill payment %s: %+v (%v)", p.ID, status, err)
+		}
+	}
+	refunded, err := st.Payment("p5")
+	if err != nil {
+		t.Fatalf("failed to get payment: %v", err)
+	}
+	fulfiller.Revoked(refunded)
+
+	stats, err := program.Stats("alice")
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if stats.Referrals != 1 || stats.Bought != 155 || stats.Earned != 15 || stats.Pending != 15 || stats.Revoked != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// claim
+	claim, err := program.Claim("alice")
+	if err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	if claim.Amount != 15 || claim.Address != alice.Hex() || claim.Package == nil {
+		t.Fatalf("unexpected claim %+v", claim)
+	}
+	if _, err := program.Claim("alice"); !errors.Is(err, ErrNothingToClaim) {
+		t.Fatalf("expected nothing to claim, got %v", err)
+	}
+	if _, err := program.Claim("nobody"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected referrer not found, got %v", err)
+	}
+	stats, err = program.Stats("alice")
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if stats.Claimed != 15 || stats.Pending != 0 || len(stats.Claims) != 1 || stats.Claims[0].ID != claim.ID {
+		t.Fatalf("unexpected stats after claim %+v", stats)
+	}
+	entries, err := st.LedgerEntries(time.Time{}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to get ledger entries: %v", err)
+	}
+	last := entries[len(entries)-1]
+	if last.AuthType != faucet.AuthTypeReferral || last.Recipient != alice.Hex() || last.Amount != 15 {
+		t.Fatalf("unexpected ledger entry %+v", last)
+	}
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Supported dump formats. A dump is a sequence of records: a header, one record per key-value
+// pair and a footer with the number of entries and their checksum. In the JSON format every
+// record is written in its own line, in the CBOR format records are a CBOR sequence.
+const (
+	DumpFormatJSON = "json"
+	DumpFormatCBOR = "cbor"
+)
+
+// DumpHeader is the first record of a dump.
+type DumpHeader struct {
+	SchemaVersion uint64    `json:"schemaVersion" cbor:"schemaVersion"`
+	Created       time.Time `json:"created" cbor:"created"`
+}
+
+// DumpSummary is the last record of a dump. It is also returned by the export, import and
+// copy operations, to check the consistency of the data.
+type DumpSummary struct {
+	Entries  uint64 `json:"entries" cbor:"entries"`
+	Checksum string `json:"checksum" cbor:"checksum"`
+}
+
+// dumpRecord is a single record of a dump, only one of its fields is set.
+type dumpRecord struct {
+	Header *DumpHeader  `json:"header,omitempty" cbor:"header,omitempty"`
+	Entry  *dumpEntry   `json:"entry,omitempty" cbor:"entry,omitempty"`
+	Footer *DumpSummary `json:"footer,omitempty" cbor:"footer,omitempty"`
+}
+
+// dumpEntry is a key-value pair of the database.
+type dumpEntry struct {
+	Key   []byte `json:"k" cbor:"k"`
+	Value []byte `json:"v" cbor:"v"`
+}
+
+// dumpChecksum accumulates the number of entries and a hash of their keys and values.
+type dumpChecksum struct {
+	entries uint64
+	hash    []byte
+}
+
+func newDumpChecksum() *dumpChecksum {
+	return &dumpChecksum{hash: make([]byte, sha256.Size)}
+}
+
+// add adds the given entry to the checksum. The checksum does not depend on the order of
+// the entries, since every backend may iterate them in a different order.
+func (c *dumpChecksum) add(key, value []byte) {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+	h.Write(key)
+	h.Write(value)
+	for i, b := range h.Sum(nil) {
+		c.hash[i] ^= b
+	}
+	c.entries++
+}
+
+func (c *dumpChecksum) summary() *DumpSummary {
+	return &DumpSummary{
+		Entries:  c.entries,
+		Checksum: hex.EncodeToString(c.hash),
+	}
+}
+
+// dumpEncoder writes records in the given format.
+type dumpEncoder interface {
+	Encode(v any) error
+}
+
+// dumpDecoder reads records in the given format.
+type dumpDecoder interface {
+	Decode(v any) error
+}
+
+func newDumpEncoder(w io.Writer, format string) (dumpEncoder, error) {
+	switch format {
+	case DumpFormatJSON:
+		return json.NewEncoder(w), nil
+	case DumpFormatCBOR:
+		return cbor.NewEncoder(w), nil
+	default:
+		return nil, fmt.Errorf("invalid dump format: %q. Available formats: %q %q", format, DumpFormatJSON, DumpFormatCBOR)
+	}
+}
+
+func newDumpDecoder(r io.Reader, format string) (dumpDecoder, error) {
+	switch format {
+	case DumpFormatJSON:
+		return json.NewDecoder(r), nil
+	case DumpFormatCBOR:
+		return cbor.NewDecoder(r), nil
+	default:
+		return nil, fmt.Errorf("invalid dump format: %q. Available formats: %q %q", format, DumpFormatJSON, DumpFormatCBOR)
+	}
+}
+
+// Checksum returns the number of entries stored in the database and their checksum.
+func (st *KVStorage) Checksum() (*DumpSummary, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	sum := newDumpChecksum()
+	if err := st.kv.Iterate(nil, func(key, value []byte) bool {
+		sum.add(key, value)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return sum.summary(), nil
+}
+
+// Export writes every key-value pair stored in the database to w, using the given format.
+func (st *KVStorage) Export(w io.Writer, format string) (*DumpSummary, error) {
+	bw := bufio.NewWriter(w)
+	enc, err := newDumpEncoder(bw, format)
+	if err != nil {
+		return nil, err
+	}
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	version, err := st.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(&dumpRecord{Header: &DumpHeader{
+		SchemaVersion: version,
+		Created:       time.Now().UTC(),
+	}}); err != nil {
+		return nil, err
+	}
+	sum := newDumpChecksum()
+	var encErr error
+	if err := st.kv.Iterate(nil, func(key, value []byte) bool {
+		if encErr = enc.Encode(&dumpRecord{Entry: &dumpEntry{Key: key, Value: value}}); encErr != nil {
+			return false
+		}
+		sum.add(key, value)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if encErr != nil {
+		return nil, fmt.Errorf("failed to write entry: %w", encErr)
+	}
+	summary := sum.summary()
+	if err := enc.Encode(&dumpRecord{Footer: summary}); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	log.Infow("storage exported", "format", format, "entries", summary.Entries, "checksum", summary.Checksum)
+	return summary, nil
+}
+
+// Import reads a dump from r, in the given format, and writes its entries to the database.
+// The database must be empty, except for the schema version record, unless overwrite is set.
+// The dump is spooled to a temporary file and checked against its footer before anything is
+// written, so an inconsistent dump leaves the database untouched. If writing fails, an empty
+// database is wiped again, while an overwritten one may keep part of the dump. Once imported,
+// the pending schema migrations are run.
+func (st *KVStorage) Import(r io.Reader, format string, overwrite bool) (*DumpSummary, error) {
+	// check the format before reading the whole dump
+	if _, err := newDumpDecoder(r, format); err != nil {
+		return nil, err
+	}
+	if !overwrite {
+		empty := true
+		if err := st.kv.Iterate(nil, func(key, _ []byte) bool {
+			empty = bytes.Equal(key, schemaVersionKey)
+			return empty
+		}); err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, fmt.Errorf("destination database is not empty")
+		}
+	}
+
+	spool, err := os.CreateTemp("", "vocfaucet-import-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if _, err := io.Copy(spool, r); err != nil {
+		return nil, fmt.Errorf("failed to read dump: %w", err)
+	}
+	header, summary, err := readDump(spool, format, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("dump schema version %d is newer than the supported version %d",
+			header.SchemaVersion, SchemaVersion)
+	}
+
+	if err := st.importEntries(spool, format); err != nil {
+		if !overwrite {
+			if wipeErr := st.wipe(); wipeErr != nil {
+				log.Warnw("failed to wipe partially imported database", "err", wipeErr)
+			}
+		}
+		return nil, err
+	}
+	if header.SchemaVersion < SchemaVersion {
+		if err := st.Set(schemaVersionKey, uint64Bytes(header.SchemaVersion)); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.migrate(); err != nil {
+		return nil, err
+	}
+	log.Infow("storage imported", "format", format, "entries", summary.Entries, "checksum", summary.Checksum)
+	return summary, nil
+}
+
+// readDump reads the dump in the given file from its start, calling entry, if set, for every
+// key-value pair, and returns its header and summary once checked against its footer.
+func readDump(file io.ReadSeeker, format string, entry func(key, value []byte) error) (*DumpHeader, *DumpSummary, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	dec, err := newDumpDecoder(bufio.NewReader(file), format)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header dumpRecord
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read dump header: %w", err)
+	}
+	if header.Header == nil {
+		return nil, nil, fmt.Errorf("missing dump header")
+	}
+	sum := newDumpChecksum()
+	for {
+		var record dumpRecord
+		if err := dec.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil, fmt.Errorf("unexpected end of dump after %d entries, missing footer", sum.entries)
+			}
+			return nil, nil, fmt.Errorf("failed to read dump entry %d: %w", sum.entries, err)
+		}
+		if record.Footer != nil {
+			got := sum.summary()
+			if *got != *record.Footer {
+				return nil, nil, fmt.Errorf("dump is inconsistent: expected %d entries with checksum %s, got %d entries with checksum %s",
+					record.Footer.Entries, record.Footer.Checksum, got.Entries, got.Checksum)
+			}
+			return header.Header, got, nil
+		}
+		if record.Entry == nil {
+			return nil, nil, fmt.Errorf("unexpected record after %d entries", sum.entries)
+		}
+		if entry != nil {
+			if err := entry(record.Entry.Key, record.Entry.Value); err != nil {
+				return nil, nil, fmt.Errorf("failed to write entry %d: %w", sum.entries, err)
+			}
+		}
+		sum.add(record.Entry.Key, record.Entry.Value)
+	}
+}
+
+// importEntries writes the entries of the checked dump in the given file, in as many
+// transactions as needed.
+func (st *KVStorage) importEntries(file io.ReadSeeker, format string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	tx := st.kv.WriteTx()
+	defer func() { tx.Discard() }()
+	if _, _, err := readDump(file, format, func(key, value []byte) error {
+		err := tx.Set(key, value)
+		if errors.Is(err, db.ErrTxnTooBig) {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			tx = st.kv.WriteTx()
+			err = tx.Set(key, value)
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// wipe removes every key-value pair of the database, except the schema version record.
+func (st *KVStorage) wipe() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	keys := [][]byte{}
+	if err := st.kv.Iterate(nil, func(key, _ []byte) bool {
+		if !bytes.Equal(key, schemaVersionKey) {
+			keys = append(keys, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	tx := st.kv.WriteTx()
+	defer func() { tx.Discard() }()
+	for _, key := range keys {
+		err := tx.Delete(key)
+		if errors.Is(err, db.ErrTxnTooBig) {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			tx = st.kv.WriteTx()
+			err = tx.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CopyTo copies every key-value pair stored in the database to dst, which may use a different
+// backend, and checks that both databases hold the same data once done.
+func (st *KVStorage) CopyTo(dst *KVStorage, overwrite bool) (*DumpSummary, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := st.Export(pw, DumpFormatCBOR)
+		pw.CloseWithError(err)
+	}()
+	summary, err := dst.Import(pr, DumpFormatCBOR, overwrite)
+	// drain the pipe so the export routine can finish if the import failed
+	_, _ = io.Copy(io.Discard, pr)
+	if err != nil {
+		return nil, err
+	}
+	srcSum, err := st.Checksum()
+	if err != nil {
+		return nil, err
+	}
+	dstSum, err := dst.Checksum()
+	if err != nil {
+		return nil, err
+	}
+	if *srcSum != *dstSum {
+		return nil, fmt.Errorf("databases differ after copy: source has %d entries with checksum %s, destination has %d entries with checksum %s",
+			srcSum.Entries, srcSum.Checksum, dstSum.Entries, dstSum.Checksum)
+	}
+	return summary, nil
+}
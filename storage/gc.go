@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+)
+
+// GCStats holds the counters of the storage garbage collector.
+type GCStats struct {
+	Runs        uint64    `json:"runs"`
+	RemovedKeys uint64    `json:"removedKeys"`
+	LastRun     time.Time `json:"lastRun"`
+	LastRemoved int       `json:"lastRemoved"`
+}
+
+// garbageCollector runs the sweep function of a storage periodically and keeps its counters.
+// It is embedded by the storage implementations.
+type garbageCollector struct {
+	stop  chan struct{}
+	stats GCStats
+	lock  sync.Mutex
+}
+
+// start starts a background routine that calls sweep every interval with the given retention.
+// Calling it again restarts the routine with the new parameters.
+func (gc *garbageCollector) start(interval, retention time.Duration, sweep func(time.Duration) (int, error)) {
+	gc.halt()
+	stop := make(chan struct{})
+	gc.lock.Lock()
+	gc.stop = stop
+	gc.lock.Unlock()
+	log.Infow("storage garbage collector started", "interval", interval.String(), "retention", retention.String())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := sweep(retention); err != nil {
+					log.Warnw("storage garbage collector failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// halt stops the background routine, if running.
+func (gc *garbageCollector) halt() {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	if gc.stop != nil {
+		close(gc.stop)
+		gc.stop = nil
+	}
+}
+
+// record updates the counters after a sweep that removed the given number of keys.
+func (gc *garbageCollector) record(removed int) {
+	gc.lock.Lock()
+	gc.stats.Runs++
+	gc.stats.RemovedKeys += uint64(removed)
+	gc.stats.LastRun = time.Now()
+	gc.stats.LastRemoved = removed
+	total := gc.stats.RemovedKeys
+	gc.lock.Unlock()
+	log.Infow("storage garbage collector sweep done", "removed", removed, "totalRemoved", total)
+}
+
+// snapshot returns a copy of the counters.
+func (gc *garbageCollector) snapshot() GCStats {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return gc.stats
+}
+
+// StartGarbageCollector starts a background routine that sweeps the storage every interval,
+// removing the entries that expired more than retention ago. Calling it again restarts the
+// routine with the new parameters.
+func (st *KVStorage) StartGarbageCollector(interval, retention time.Duration) {
+	st.gc.start(interval, retention, st.Sweep)
+}
+
+// StopGarbageCollector stops the background garbage collector, if running.
+func (st *KVStorage) StopGarbageCollector() {
+	st.gc.halt()
+}
+
+// GCStats returns the counters of the storage garbage collector.
+func (st *KVStorage) GCStats() GCStats {
+	return st.gc.snapshot()
+}
+
+// Sweep removes the cooldown entries that expired more than retention ago, the budget windows
+// that ended more than retention ago, the webhook event and OAuth code markers stored more
+// than retention ago, the payments created more than retention ago that were never paid, the
+// token reservations and OAuth states that expired more than retention ago and the webhook
+// jobs processed more than retention ago. Cooldown entries expire when their wait period
+// ends, and the markers of on-chain transfers are kept. It returns the number of removed keys.
+func (st *KVStorage) Sweep(retention time.Duration) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	deadline := time.Now().Add(-retention).Unix()
+	var expired [][]byte
+	for _, ns := range []byte{nsCooldown, nsEvent, nsOAuthCode} {
+		if err := iterateNamespace(st.kv, ns, func(key, value []byte) bool {
+			if len(value) == 8 && int64(binary.LittleEndian.Uint64(value)) < deadline && !transferEventKey(key) {
+				expired = append(expired, bytes.Clone(key))
+			}
+			return true
+		}); err != nil {
+			return 0, fmt.Errorf("failed to iterate storage: %w", err)
+		}
+	}
+	if err := iterateNamespace(st.kv, nsPayment, func(key, value []byte) bool {
+		payment := &Payment{}
+		if err := json.Unmarshal(value, payment); err != nil {
+			log.Warnw("invalid payment record", "key", fmt.Sprintf("%x", key), "err", err)
+			return true
+		}
+		if payment.State == PaymentCreated && payment.CreatedAt.Unix() < deadline {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+	if err := iterateNamespace(st.kv, nsReserve, func(key, value []byte) bool {
+		reservation := &Reservation{}
+		if err := json.Unmarshal(value, reservation); err != nil {
+			log.Warnw("invalid reservation", "key", fmt.Sprintf("%x", key), "err", err)
+			return true
+		}
+		if reservation.ExpiresAt.Unix() < deadline {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+	if err := iterateNamespace(st.kv, nsWebhookJob, func(key, value []byte) bool {
+		job := &WebhookJob{}
+		if err := json.Unmarshal(value, job); err != nil {
+			log.Warnw("invalid webhook job", "key", fmt.Sprintf("%x", key), "err", err)
+			return true
+		}
+		if job.State == WebhookJobDone && job.UpdatedAt.Unix() < deadline {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+	if err := iterateNamespace(st.kv, nsOAuthState, func(key, value []byte) bool {
+		state := &OAuthState{}
+		if err := json.Unmarshal(value, state); err != nil {
+			log.Warnw("invalid oauth state", "key", fmt.Sprintf("%x", key), "err", err)
+			return true
+		}
+		if state.ExpiresAt.Unix() < deadline {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+	if err := iterateNamespace(st.kv, nsBudget, func(key, _ []byte) bool {
+		if end, ok := budgetKeyEnd(key); ok && end.Unix() < deadline {
+			expired = append(expired, bytes.Clone(key))
+		}
+		return true
+	}); err != nil {
+		return 0, fmt.Errorf("failed to iterate storage: %w", err)
+	}
+
+	tx := st.kv.WriteTx()
+	defer tx.Discard()
+	for _, key := range expired {
+		if err := tx.Delete(key); err != nil {
+			return 0, fmt.Errorf("failed to delete key %x: %w", key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	st.gc.record(len(expired))
+	return len(expired), nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.vocdoni.io/dvote/db"
+)
+
+// Key namespaces. Every key stored by the faucet starts with one of these bytes, followed by
+// its components, each one prefixed by its length encoded as an unsigned varint. This way keys
+// from different namespaces, or with different components, can never collide.
+const (
+	nsMeta         byte = 0x00
+	nsCooldown     byte = 0x01
+	nsSession      byte = 0x02 // Stripe session markers, replaced by payments in schema version 2.
+	nsLedger       byte = 0x03
+	nsBudget       byte = 0x04
+	nsDenylist     byte = 0x05
+	nsPayment      byte = 0x06
+	nsEvent        byte = 0x07
+	nsReferrer     byte = 0x08
+	nsReward       byte = 0x09
+	nsClaim        byte = 0x0a
+	nsReserve      byte = 0x0b
+	nsCustomer     byte = 0x0c
+	nsSubscription byte = 0x0d
+	nsWebhookJob   byte = 0x0e
+	nsOAuthState   byte = 0x0f
+	nsOAuthCode    byte = 0x10
+	nsQuarantine   byte = 0x11 // Legacy keys that could not be classified when namespaced.
+)
+
+// schemaVersionKey is the key where the current schema version is stored.
+var schemaVersionKey = buildKey(nsMeta, []byte("schema_version"))
+
+// buildKey builds a key for the given namespace and components.
+func buildKey(ns byte, components ...[]byte) []byte {
+	size := 1
+	for _, c := range components {
+		size += binary.MaxVarintLen64 + len(c)
+	}
+	key := make([]byte, 1, size)
+	key[0] = ns
+	for _, c := range components {
+		key = binary.AppendUvarint(key, uint64(len(c)))
+		key = append(key, c...)
+	}
+	return key
+}
+
+// parseKey splits the given key into its namespace and components. It fails if the key
+// was not built with buildKey.
+func parseKey(key []byte) (byte, [][]byte, error) {
+	if len(key) == 0 {
+		return 0, nil, fmt.Errorf("empty key")
+	}
+	ns := key[0]
+	var components [][]byte
+	for rest := key[1:]; len(rest) > 0; {
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return 0, nil, fmt.Errorf("malformed key %x", key)
+		}
+		components = append(components, rest[n:n+int(size)])
+		rest = rest[n+int(size):]
+	}
+	return ns, components, nil
+}
+
+// cooldownKey returns the key of the cooldown entry for the given user and auth type.
+func cooldownKey(userID []byte, authType string) []byte {
+	return buildKey(nsCooldown, userID, []byte(authType))
+}
+
+// sessionKey returns the key of the marker for the given Stripe checkout session ID.
+func sessionKey(sessionID string) []byte {
+	return buildKey(nsSession, []byte(sessionID))
+}
+
+// eventKey returns the key of the marker for the given processed webhook event ID.
+func eventKey(id string) []byte {
+	return buildKey(nsEvent, []byte(id))
+}
+
+// transferEventKey returns true if the given key is the marker of an on-chain transfer.
+func transferEventKey(key []byte) bool {
+	ns, components, err := parseKey(key)
+	return err == nil && ns == nsEvent && len(components) == 1 &&
+		strings.HasPrefix(string(components[0]), TransferEventPrefix)
+}
+
+// paymentKey returns the key of the payment record with the given ID.
+func paymentKey(id string) []byte {
+	return buildKey(nsPayment, []byte(id))
+}
+
+// referrerKey returns the key of the referrer with the given code.
+func referrerKey(code string) []byte {
+	return buildKey(nsReferrer, []byte(code))
+}
+
+// rewardKey returns the key of the referral reward for the given payment ID.
+func rewardKey(paymentID string) []byte {
+	return buildKey(nsReward, []byte(paymentID))
+}
+
+// claimKey returns the key of the referral claim with the given ID.
+func claimKey(id string) []byte {
+	return buildKey(nsClaim, []byte(id))
+}
+
+// reservationKey returns the key of the token reservation with the given ID.
+func reservationKey(id string) []byte {
+	return buildKey(nsReserve, []byte(id))
+}
+
+// customerKey returns the key of the customer with the given email and address.
+func customerKey(email, address string) []byte {
+	return buildKey(nsCustomer, []byte(email), []byte(address))
+}
+
+// subscriptionKey returns the key of the subscription with the given ID.
+func subscriptionKey(id string) []byte {
+	return buildKey(nsSubscription, []byte(id))
+}
+
+// webhookJobKey returns the key of the webhook job with the given ID.
+func webhookJobKey(id string) []byte {
+	return buildKey(nsWebhookJob, []byte(id))
+}
+
+// oauthStateKey returns the key of the OAuth state with the given state value.
+func oauthStateKey(state string) []byte {
+	return buildKey(nsOAuthState, []byte(state))
+}
+
+// oauthCodeKey returns the key of the marker for the used OAuth code with the given hash.
+func oauthCodeKey(hash string) []byte {
+	return buildKey(nsOAuthCode, []byte(hash))
+}
+
+// ledgerKey returns the key of a ledger entry. The time is encoded big endian so the entries
+// are sorted by time.
+func ledgerKey(entry *LedgerEntry) []byte {
+	return buildKey(nsLedger,
+		binary.BigEndian.AppendUint64(nil, uint64(entry.Time.UnixNano())),
+		[]byte(entry.Recipient),
+		[]byte(entry.AuthType),
+		[]byte(entry.Reference),
+	)
+}
+
+// quarantineKey returns the key where the unknown legacy key is kept.
+func quarantineKey(legacy []byte) []byte {
+	return buildKey(nsQuarantine, legacy)
+}
+
+// budgetKey returns the key of the spent counter of the named budget for the window that
+// starts at the given time and lasts period.
+func budgetKey(name string, start time.Time, period time.Duration) []byte {
+	return buildKey(nsBudget,
+		[]byte(name),
+		binary.BigEndian.AppendUint64(nil, uint64(start.Unix())),
+		binary.BigEndian.AppendUint64(nil, uint64(period.Seconds())),
+	)
+}
+
+// budgetKeyEnd returns the end of the window of the given budget key.
+func budgetKeyEnd(key []byte) (time.Time, bool) {
+	_, components, err := parseKey(key)
+	if err != nil || len(components) != 3 || len(components[1]) != 8 || len(components[2]) != 8 {
+		return time.Time{}, false
+	}
+	start := int64(binary.BigEndian.Uint64(components[1]))
+	period := int64(binary.BigEndian.Uint64(components[2]))
+	return time.Unix(start+period, 0), true
+}
+
+// denylistKey returns the key of the denylist entry for the given kind and value.
+func denylistKey(kind, value string) []byte {
+	return buildKey(nsDenylist, []byte(kind), []byte(value))
+}
+
+// iterateNamespace calls callback with every key-value pair of the given namespace. Keys are
+// passed complete, including the namespace byte. The database is iterated from its root, where
+// every backend passes the keys complete, and filtered here, since iterating with the namespace
+// as prefix passes the keys with or without it depending on the backend.
+func iterateNamespace(rd db.Reader, ns byte, callback func(key, value []byte) bool) error {
+	return rd.Iterate(nil, func(key, value []byte) bool {
+		if len(key) == 0 || key[0] != ns {
+			return true
+		}
+		return callback(key, value)
+	})
+}
@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage that keeps everything in memory. It is safe for concurrent use,
+// and meant for tests and ephemeral deployments, since nothing survives a restart.
+type MemoryStorage struct {
+	waitPeriod    time.Duration
+	cooldowns     map[string]time.Time
+	payments      map[string]*Payment
+	events        map[string]time.Time
+	ledger        []*LedgerEntry
+	budgets       map[string]uint64
+	denylist      map[string]DenylistEntry
+	referrers     map[string]Referrer
+	rewards       map[string]ReferralReward
+	claims        map[string]*ReferralClaim
+	reserved      map[string]Reservation
+	customers     map[string]Customer
+	subscriptions map[string]Subscription
+	webhookJobs   map[string]WebhookJob
+	oauthStates   map[string]OAuthState
+	oauthCodes    map[string]time.Time
+	lock          sync.RWMutex
+	gc            garbageCollector
+}
+
+// check that MemoryStorage implements the Storage interface
+var _ Storage = (*MemoryStorage)(nil)
+
+// NewMemory creates a new in-memory storage instance.
+func NewMemory(waitPeriod time.Duration) *MemoryStorage {
+	return &MemoryStorage{
+		waitPeriod:    waitPeriod,
+		cooldowns:     make(map[string]time.Time),
+		payments:      make(map[string]*Payment),
+		events:        make(map[string]time.Time),
+		budgets:       make(map[string]uint64),
+		denylist:      make(map[string]DenylistEntry),
+		referrers:     make(map[string]Referrer),
+		rewards:       make(map[string]ReferralReward),
+		claims:        make(map[string]*ReferralClaim),
+		reserved:      make(map[string]Reservation),
+		customers:     make(map[string]Customer),
+		subscriptions: make(map[string]Subscription),
+		webhookJobs:   make(map[string]WebhookJob),
+		oauthStates:   make(map[string]OAuthState),
+		oauthCodes:    make(map[string]time.Time),
+	}
+}
+
+// AddFundedUserWithWaitTime adds the given userID to the funded list, with the current time
+// plus the wait period as the wait period end time.
+func (st *MemoryStorage) AddFundedUserWithWaitTime(userID []byte, authType string) error {
+	return st.AddFundedUserUntil(userID, authType, time.Now().Add(st.waitPeriod))
+}
+
+// AddFundedUserUntil adds the given userID to the funded list, with the given time as the wait
+// period end time.
+func (st *MemoryStorage) AddFundedUserUntil(userID []byte, authType string, until time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.cooldowns[string(cooldownKey(userID, authType))] = until.Truncate(time.Second)
+	return nil
+}
+
+// CheckFundedUserWithWaitTime returns true if the given userID is funded within the wait
+// period time window, and the time when the window ends.
+func (st *MemoryStorage) CheckFundedUserWithWaitTime(userID []byte, authType string) (bool, time.Time) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	wp, ok := st.cooldowns[string(cooldownKey(userID, authType))]
+	if !ok {
+		return false, time.Time{}
+	}
+	return !wp.Before(time.Now().Truncate(time.Second)), wp
+}
+
+// SetPayment stores the given payment record, replacing any previous record with the same ID.
+func (st *MemoryStorage) SetPayment(payment *Payment) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.payments[payment.ID] = copyPayment(payment)
+	return nil
+}
+
+// Payment returns the payment record with the given ID, or ErrNotFound.
+func (st *MemoryStorage) Payment(id string) (*Payment, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	payment, ok := st.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyPayment(payment), nil
+}
+
+// AddWebhookEvent records that the webhook event with the given ID has been processed.
+func (st *MemoryStorage) AddWebhookEvent(id string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.events[id] = time.Now()
+	return nil
+}
+
+// CheckWebhookEvent returns true if the webhook event with the given ID has been processed.
+func (st *MemoryStorage) CheckWebhookEvent(id string) (bool, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	_, ok := st.events[id]
+	return ok, nil
+}
+
+// AddLedgerEntry records a faucet package issued by the faucet.
+func (st *MemoryStorage) AddLedgerEntry(entry *LedgerEntry) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	e := *entry
+	st.ledger = append(st.ledger, &e)
+	return nil
+}
+
+// LedgerEntries returns the ledger entries issued within [from, to), ordered by time.
+func (st *MemoryStorage) LedgerEntries(from, to time.Time) ([]*LedgerEntry, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var entries []*LedgerEntry
+	for _, entry := range st.ledger {
+		if !entry.Time.Before(from) && entry.Time.Before(to) {
+			e := *entry
+			entries = append(entries, &e)
+		}
+	}
+	sortLedgerEntries(entries)
+	return entries, nil
+}
+
+// SpendBudget adds amount to the spent counter of the named budget for the current period
+// window, if the result does not exceed limit (0 means no limit).
+func (st *MemoryStorage) SpendBudget(name string, period time.Duration, amount, limit uint64) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	key := string(budgetKey(name, budgetWindow(period), period))
+	spent := st.budgets[key]
+	if limit > 0 && spent+amount > limit {
+		return spent, ErrBudgetExceeded
+	}
+	st.budgets[key] = spent + amount
+	return spent + amount, nil
+}
+
+// BudgetSpent returns the spent counter of the named budget for the current period window.
+func (st *MemoryStorage) BudgetSpent(name string, period time.Duration) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.budgets[string(budgetKey(name, budgetWindow(period), period))], nil
+}
+
+// ReleaseBudget subtracts amount from the spent counter of the named budget for the period
+// window of spentAt, down to 0.
+func (st *MemoryStorage) ReleaseBudget(name string, period time.Duration, amount uint64, spentAt time.Time) error {
+	if period <= 0 {
+		return fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	key := string(budgetKey(name, budgetWindowAt(spentAt, period), period))
+	spent, ok := st.budgets[key]
+	if !ok {
+		return nil
+	}
+	st.budgets[key] = spent - min(spent, amount)
+	return nil
+}
+
+// AddDenylistEntry adds the given entry to the denylist, replacing any previous entry with
+// the same kind and value.
+func (st *MemoryStorage) AddDenylistEntry(entry *DenylistEntry) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.denylist[string(denylistKey(entry.Kind, entry.Value))] = *entry
+	return nil
+}
+
+// DenylistEntry returns the denylist entry for the given kind and value, or ErrNotFound.
+func (st *MemoryStorage) DenylistEntry(kind, value string) (*DenylistEntry, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	entry, ok := st.denylist[string(denylistKey(kind, value))]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &entry, nil
+}
+
+// DeleteDenylistEntry removes the denylist entry for the given kind and value.
+func (st *MemoryStorage) DeleteDenylistEntry(kind, value string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	delete(st.denylist, string(denylistKey(kind, value)))
+	return nil
+}
+
+// SetReferrer stores the given referrer, replacing any previous referrer with the same code.
+func (st *MemoryStorage) SetReferrer(referrer *Referrer) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.referrers[referrer.Code] = *referrer
+	return nil
+}
+
+// Referrer returns the referrer with the given code, or ErrNotFound.
+func (st *MemoryStorage) Referrer(code string) (*Referrer, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	referrer, ok := st.referrers[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &referrer, nil
+}
+
+// SetReferralReward stores the given referral reward, replacing any previous reward for the
+// same payment.
+func (st *MemoryStorage) SetReferralReward(reward *ReferralReward) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.rewards[reward.PaymentID] = *reward
+	return nil
+}
+
+// ReferralRewards returns the rewards of the referrer with the given code, ordered by time.
+func (st *MemoryStorage) ReferralRewards(code string) ([]*ReferralReward, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var rewards []*ReferralReward
+	for _, reward := range st.rewards {
+		if reward.Code == code {
+			r := reward
+			rewards = append(rewards, &r)
+		}
+	}
+	sortReferralRewards(rewards)
+	return rewards, nil
+}
+
+// AddReferralClaim records a claim of referral rewards.
+func (st *MemoryStorage) AddReferralClaim(claim *ReferralClaim) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	c := *claim
+	c.Package = bytes.Clone(claim.Package)
+	st.claims[claim.ID] = &c
+	return nil
+}
+
+// ReferralClaims returns the claims of the referrer with the given code, ordered by time.
+func (st *MemoryStorage) ReferralClaims(code string) ([]*ReferralClaim, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var claims []*ReferralClaim
+	for _, claim := range st.claims {
+		if claim.Code == code {
+			c := *claim
+			c.Package = bytes.Clone(claim.Package)
+			claims = append(claims, &c)
+		}
+	}
+	sortReferralClaims(claims)
+	return claims, nil
+}
+
+// RecipientPayments returns the payment records of the given recipient, ordered by creation
+// time.
+func (st *MemoryStorage) RecipientPayments(recipient string) ([]*Payment, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var payments []*Payment
+	for _, payment := range st.payments {
+		if payment.Recipient == recipient {
+			payments = append(payments, copyPayment(payment))
+		}
+	}
+	sortPayments(payments)
+	return payments, nil
+}
+
+// SetCustomer stores the given customer, replacing any previous customer with the same email
+// and address.
+func (st *MemoryStorage) SetCustomer(customer *Customer) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.customers[string(customerKey(customer.Email, customer.Address))] = *customer
+	return nil
+}
+
+// Customer returns the customer with the given email and address, or ErrNotFound.
+func (st *MemoryStorage) Customer(email, address string) (*Customer, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	customer, ok := st.customers[string(customerKey(email, address))]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &customer, nil
+}
+
+// Customers returns the customers that bought tokens for the given address, ordered by their
+// first purchase.
+func (st *MemoryStorage) Customers(address string) ([]*Customer, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var customers []*Customer
+	for _, customer := range st.customers {
+		if customer.Address == address {
+			c := customer
+			customers = append(customers, &c)
+		}
+	}
+	sortCustomers(customers)
+	return customers, nil
+}
+
+// SetSubscription stores the given subscription, replacing any previous subscription with the
+// same ID.
+func (st *MemoryStorage) SetSubscription(subscription *Subscription) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.subscriptions[subscription.ID] = *subscription
+	return nil
+}
+
+// Subscription returns the subscription with the given ID, or ErrNotFound.
+func (st *MemoryStorage) Subscription(id string) (*Subscription, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	subscription, ok := st.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &subscription, nil
+}
+
+// Subscriptions returns the subscriptions of the given subscriber address, ordered by creation
+// time.
+func (st *MemoryStorage) Subscriptions(subscriber string) ([]*Subscription, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var subscriptions []*Subscription
+	for _, subscription := range st.subscriptions {
+		if subscription.Subscriber == subscriber {
+			s := subscription
+			subscriptions = append(subscriptions, &s)
+		}
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions, nil
+}
+
+// SetWebhookJob stores the given webhook job, replacing any previous job with the same ID.
+func (st *MemoryStorage) SetWebhookJob(job *WebhookJob) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.webhookJobs[job.ID] = *job
+	return nil
+}
+
+// WebhookJob returns the webhook job with the given ID, or ErrNotFound.
+func (st *MemoryStorage) WebhookJob(id string) (*WebhookJob, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	job, ok := st.webhookJobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+// WebhookJobs returns the webhook jobs in the given state, or all of them if it is empty,
+// ordered by creation time.
+func (st *MemoryStorage) WebhookJobs(state WebhookJobState) ([]*WebhookJob, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var jobs []*WebhookJob
+	for _, job := range st.webhookJobs {
+		if state == "" || job.State == state {
+			j := job
+			jobs = append(jobs, &j)
+		}
+	}
+	sortWebhookJobs(jobs)
+	return jobs, nil
+}
+
+// SetOAuthState stores the given OAuth state, replacing any previous one with the same state
+// value.
+func (st *MemoryStorage) SetOAuthState(state *OAuthState) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.oauthStates[state.State] = *state
+	return nil
+}
+
+// OAuthState returns the OAuth state with the given state value, or ErrNotFound.
+func (st *MemoryStorage) OAuthState(state string) (*OAuthState, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	s, ok := st.oauthStates[state]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+// AddOAuthCode records that the OAuth authorization code with the given hash was used.
+func (st *MemoryStorage) AddOAuthCode(hash string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.oauthCodes[hash] = time.Now()
+	return nil
+}
+
+// CheckOAuthCode returns true if the OAuth authorization code with the given hash was used.
+func (st *MemoryStorage) CheckOAuthCode(hash string) (bool, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	_, ok := st.oauthCodes[hash]
+	return ok, nil
+}
+
+// SetReservation stores the given token reservation, replacing any previous reservation with
+// the same ID.
+func (st *MemoryStorage) SetReservation(reservation *Reservation) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.reserved[reservation.ID] = *reservation
+	return nil
+}
+
+// DeleteReservation removes the token reservation with the given ID, if any.
+func (st *MemoryStorage) DeleteReservation(id string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	delete(st.reserved, id)
+	return nil
+}
+
+// Reservations returns the token reservations that have not expired yet.
+func (st *MemoryStorage) Reservations() ([]*Reservation, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	now := time.Now()
+	var reservations []*Reservation
+	for _, reservation := range st.reserved {
+		if reservation.ExpiresAt.After(now) {
+			r := reservation
+			reservations = append(reservations, &r)
+		}
+	}
+	return reservations, nil
+}
+
+// StartGarbageCollector starts a background routine that sweeps the storage every interval,
+// removing the entries that expired more than retention ago.
+func (st *MemoryStorage) StartGarbageCollector(interval, retention time.Duration) {
+	st.gc.start(interval, retention, st.Sweep)
+}
+
+// Sweep removes the cooldown entries, webhook event and OAuth code markers, budget windows,
+// token reservations and OAuth states that expired more than retention ago, the payments
+// created more than retention ago that were never paid and the webhook jobs processed more
+// than retention ago. The markers of on-chain transfers are kept. It returns the number of
+// removed entries.
+func (st *MemoryStorage) Sweep(retention time.Duration) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	deadline := time.Now().Add(-retention)
+	removed := 0
+	for _, entries := range []map[string]time.Time{st.cooldowns, st.events, st.oauthCodes} {
+		for key, t := range entries {
+			if t.Before(deadline) && !strings.HasPrefix(key, TransferEventPrefix) {
+				delete(entries, key)
+				removed++
+			}
+		}
+	}
+	for id, payment := range st.payments {
+		if payment.State == PaymentCreated && payment.CreatedAt.Before(deadline) {
+			delete(st.payments, id)
+			removed++
+		}
+	}
+	for id, reservation := range st.reserved {
+		if reservation.ExpiresAt.Before(deadline) {
+			delete(st.reserved, id)
+			removed++
+		}
+	}
+	for id, job := range st.webhookJobs {
+		if job.State == WebhookJobDone && job.UpdatedAt.Before(deadline) {
+			delete(st.webhookJobs, id)
+			removed++
+		}
+	}
+	for id, state := range st.oauthStates {
+		if state.ExpiresAt.Before(deadline) {
+			delete(st.oauthStates, id)
+			removed++
+		}
+	}
+	for key := range st.budgets {
+		if end, ok := budgetKeyEnd([]byte(key)); ok && end.Before(deadline) {
+			delete(st.budgets, key)
+			removed++
+		}
+	}
+	st.gc.record(removed)
+	return removed, nil
+}
+
+// GCStats returns the counters of the storage garbage collector.
+func (st *MemoryStorage) GCStats() GCStats {
+	return st.gc.snapshot()
+}
+
+// Close stops the garbage collector.
+func (st *MemoryStorage) Close() error {
+	st.gc.halt()
+	return nil
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.vocdoni.io/dvote/db"
+	"go.vocdoni.io/dvote/log"
+)
+
+// SchemaVersion is the version of the key schema used by this version of the faucet.
+const SchemaVersion = 2
+
+// migration upgrades the database from version-1 to version inside the given transaction.
+type migration struct {
+	version uint64
+	name    string
+	run     func(kv db.Database, tx db.WriteTx) error
+}
+
+// migrations is the ordered list of schema migrations.
+var migrations = []migration{
+	{version: 1, name: "namespaced keys", run: migrateNamespacedKeys},
+	{version: 2, name: "stripe payments", run: migrateStripePayments},
+}
+
+// legacyAddressAuthTypes are the auth types that were stored along with a 20 bytes address
+// before the keys were namespaced.
+var legacyAddressAuthTypes = []string{"open", "oauth", "aragondao", "stripe"}
+
+// schemaVersion returns the schema version stored in the database, 0 if there is none.
+func (st *KVStorage) schemaVersion() (uint64, error) {
+	value, err := st.kv.Get(schemaVersionKey)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid schema version record %x", value)
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+// migrate runs the pending migrations, one transaction per migration, and records the new
+// schema version after each one.
+func (st *KVStorage) migrate() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	current, err := st.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, SchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Infow("running storage migration", "version", m.version, "name", m.name)
+		tx := st.kv.WriteTx()
+		if err := m.run(st.kv, tx); err != nil {
+			tx.Discard()
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if err := tx.Set(schemaVersionKey, uint64Bytes(m.version)); err != nil {
+			tx.Discard()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		current = m.version
+	}
+	return nil
+}
+
+// migrateNamespacedKeys moves the flat keys used before the schema was versioned into their
+// namespaces. Cooldown keys were built as userID+authType and Stripe session markers were
+// stored under the raw session ID, with an empty value. Keys that cannot be classified are
+// quarantined, with their values, under their own namespace, so operators can inspect them.
+func migrateNamespacedKeys(kv db.Database, tx db.WriteTx) error {
+	type entry struct {
+		key, value []byte
+	}
+	var entries []entry
+	if err := kv.Iterate(nil, func(key, value []byte) bool {
+		entries = append(entries, entry{
+			key:   bytes.Clone(key),
+			value: bytes.Clone(value),
+		})
+		return true
+	}); err != nil {
+		return err
+	}
+	// every legacy key is rewritten, so all of them are deleted before any new key is set,
+	// in case a new key matches a legacy one
+	for _, e := range entries {
+		if err := tx.Delete(e.key); err != nil {
+			return err
+		}
+	}
+	now := uint64Bytes(uint64(time.Now().Unix()))
+	quarantined := 0
+	for _, e := range entries {
+		newKey, value := legacyKey(e.key), e.value
+		if newKey == nil {
+			log.Warnw("quarantining unknown legacy storage key", "key", fmt.Sprintf("%x", e.key))
+			newKey = quarantineKey(e.key)
+			quarantined++
+		}
+		// session markers had no value, stamp them so the garbage collector can remove them
+		if newKey[0] == nsSession && len(value) == 0 {
+			value = now
+		}
+		if err := tx.Set(newKey, value); err != nil {
+			return err
+		}
+	}
+	log.Infow("migrated legacy storage keys", "count", len(entries), "quarantined", quarantined)
+	return nil
+}
+
+// legacyKey returns the namespaced key for the given legacy key, or nil if it is unknown.
+// The exact shape of the address cooldowns is checked first, since addresses are raw bytes that
+// may start like a session ID or contain an oauth auth type.
+func legacyKey(key []byte) []byte {
+	for _, authType := range legacyAddressAuthTypes {
+		if len(key) == 20+len(authType) && string(key[20:]) == authType {
+			return cooldownKey(key[:20], authType)
+		}
+	}
+	if bytes.HasPrefix(key, []byte("cs_")) {
+		return sessionKey(string(key))
+	}
+	if i := bytes.LastIndex(key, []byte("oauth_")); i > 0 {
+		return cooldownKey(key[:i], string(key[i:]))
+	}
+	return nil
+}
+
+// migrateStripePayments replaces the Stripe session markers with payment records. A marker was
+// only stored by the webhook once the checkout was completed, so the payments are paid but not
+// fulfilled yet. The recipient and quantity are not known, they are filled in from the Stripe
+// session when the payment is fulfilled.
+func migrateStripePayments(kv db.Database, tx db.WriteTx) error {
+	var payments []*Payment
+	var keys [][]byte
+	if err := iterateNamespace(kv, nsSession, func(key, value []byte) bool {
+		_, components, err := parseKey(key)
+		if err != nil || len(components) != 1 {
+			log.Warnw("dropping invalid stripe session key", "key", fmt.Sprintf("%x", key))
+			keys = append(keys, bytes.Clone(key))
+			return true
+		}
+		created := time.Now()
+		if len(value) == 8 {
+			created = time.Unix(int64(binary.LittleEndian.Uint64(value)), 0)
+		}
+		keys = append(keys, bytes.Clone(key))
+		payments = append(payments, &Payment{
+			ID:        string(components[0]),
+			State:     PaymentPaid,
+			CreatedAt: created,
+			UpdatedAt: created,
+		})
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, payment := range payments {
+		value, err := json.Marshal(payment)
+		if err != nil {
+			return err
+		}
+		if err := tx.Set(paymentKey(payment.ID), value); err != nil {
+			return err
+		}
+	}
+	log.Infow("migrated stripe sessions to payments", "count", len(payments))
+	return nil
+}
@@ -1,8 +1,14 @@
 package storage
 
 import (
+	"bytes"
+	"os"
+	"slices"
 	"testing"
 	"time"
+
+	"go.vocdoni.io/dvote/db/metadb"
+	"go.vocdoni.io/dvote/db/prefixeddb"
 )
 
 func TestAddFundedUserWithWaitTime(t *testing.T) {
@@ -37,3 +43,662 @@ func TestAddFundedUserWithWaitTime(t *testing.T) {
 	}
 
 }
+
+func TestSweep(t *testing.T) {
+	st, err := New("pebble", t.TempDir(), time.Second, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	defer st.Close()
+
+	if err := st.AddFundedUserWithWaitTime([]byte("user123"), "open"); err != nil {
+		t.Fatalf("failed to add funded user: %v", err)
+	}
+	created := time.Now()
+	for id, state := range map[string]PaymentState{"cs_created": PaymentCreated, "cs_paid": PaymentPaid} {
+		if err := st.SetPayment(&Payment{ID: id, State: state, CreatedAt: created, UpdatedAt: created}); err != nil {
+			t.Fatalf("failed to set payment: %v", err)
+		}
+	}
+
+	// nothing is expired yet
+	removed, err := st.Sweep(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if removed != 0 {
+		t.Fatalf("expected 0 removed keys, got %d", removed)
+	}
+
+	// the cooldown entry and the unpaid payment are expired with no retention
+	time.Sleep(time.Second * 2)
+	removed, err = st.Sweep(0)
+	if err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 removed keys, got %d", removed)
+	}
+	if _, err := st.Payment("cs_created"); err == nil {
+		t.Fatalf("expected unpaid payment to be removed")
+	}
+	if _, err := st.Payment("cs_paid"); err != nil {
+		t.Fatalf("expected paid payment to be kept: %v", err)
+	}
+	if stats := st.GCStats(); stats.Runs != 2 || stats.RemovedKeys != 2 {
+		t.Fatalf("unexpected gc stats: %+v", stats)
+	}
+}
+
+func TestKeysDoNotCollide(t *testing.T) {
+	// with flat keys "user"+"open" and "useropen"+"" were the same key
+	if bytes.Equal(cooldownKey([]byte("user"), "open"), cooldownKey([]byte("useropen"), "")) {
+		t.Fatalf("cooldown keys collide")
+	}
+	if bytes.Equal(cooldownKey([]byte("cs_1"), ""), sessionKey("cs_1")) {
+		t.Fatalf("cooldown and session keys collide")
+	}
+	ns, components, err := parseKey(cooldownKey([]byte("user"), "oauth_github"))
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+	if ns != nsCooldown || len(components) != 2 ||
+		string(components[0]) != "user" || string(components[1]) != "oauth_github" {
+		t.Fatalf("unexpected parsed key: %x %q", ns, components)
+	}
+}
+
+func TestMigrateNamespacedKeys(t *testing.T) {
+	dir := t.TempDir()
+	prefix := []byte("prefix")
+	addr := bytes.Repeat([]byte{0xaa}, 20)
+	// an address that starts like a legacy session ID
+	csAddr := append([]byte("cs_"), bytes.Repeat([]byte{0xbb}, 17)...)
+
+	// write some keys with the legacy flat schema
+	mdb, err := metadb.New("pebble", dir+"/db")
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	kv := prefixeddb.NewPrefixedDatabase(mdb, prefix)
+	tx := kv.WriteTx()
+	wp := uint64Bytes(uint64(time.Now().Add(time.Hour).Unix()))
+	for key, value := range map[string][]byte{
+		string(addr) + "open":     wp,
+		string(csAddr) + "stripe": wp,
+		"alice" + "oauth_github":  wp,
+		"cs_test_legacy":          nil,
+		"garbage":                 wp,
+	} {
+		if err := tx.Set([]byte(key), value); err != nil {
+			t.Fatalf("failed to set legacy key: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit legacy keys: %v", err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatalf("failed to close database: %v", err)
+	}
+
+	st, err := New("pebble", dir, time.Hour, prefix)
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	defer st.Close()
+
+	if version, err := st.schemaVersion(); err != nil || version != SchemaVersion {
+		t.Fatalf("expected schema version %d, got %d (%v)", SchemaVersion, version, err)
+	}
+	if funded, _ := st.CheckFundedUserWithWaitTime(addr, "open"); !funded {
+		t.Fatalf("expected address cooldown to be migrated")
+	}
+	if funded, _ := st.CheckFundedUserWithWaitTime([]byte("alice"), "oauth_github"); !funded {
+		t.Fatalf("expected profile cooldown to be migrated")
+	}
+	if funded, _ := st.CheckFundedUserWithWaitTime(csAddr, "stripe"); !funded {
+		t.Fatalf("expected the cooldown of an address like a session ID to be migrated")
+	}
+	if _, err := st.Payment(string(csAddr) + "stripe"); err == nil {
+		t.Fatalf("expected no payment for the cooldown of an address like a session ID")
+	}
+	// the legacy session marker is converted into a paid payment
+	if payment, err := st.Payment("cs_test_legacy"); err != nil || payment.State != PaymentPaid {
+		t.Fatalf("expected session marker to be migrated to a paid payment, got %+v (%v)", payment, err)
+	}
+	if _, err := st.Get([]byte("garbage")); err == nil {
+		t.Fatalf("expected unknown legacy key to be moved")
+	}
+	if value, err := st.Get(quarantineKey([]byte("garbage"))); err != nil || !bytes.Equal(value, wp) {
+		t.Fatalf("expected unknown legacy key to be quarantined with its value, got %x (%v)", value, err)
+	}
+	if _, err := st.Get(sessionKey("cs_test_legacy")); err == nil {
+		t.Fatalf("expected session marker to be removed")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := New("pebble", t.TempDir(), time.Hour, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	defer src.Close()
+	if err := src.AddFundedUserWithWaitTime([]byte("user123"), "open"); err != nil {
+		t.Fatalf("failed to add funded user: %v", err)
+	}
+	if err := src.SetPayment(&Payment{ID: "cs_test_123", State: PaymentPaid}); err != nil {
+		t.Fatalf("failed to set payment: %v", err)
+	}
+	srcSum, err := src.Checksum()
+	if err != nil {
+		t.Fatalf("failed to compute checksum: %v", err)
+	}
+
+	for _, format := range []string{DumpFormatJSON, DumpFormatCBOR} {
+		var dump bytes.Buffer
+		if _, err := src.Export(&dump, format); err != nil {
+			t.Fatalf("failed to export %s: %v", format, err)
+		}
+		dst, err := New("leveldb", t.TempDir(), time.Hour, []byte("prefix"))
+		if err != nil {
+			t.Fatalf("failed to create storage instance: %v", err)
+		}
+		summary, err := dst.Import(bytes.NewReader(dump.Bytes()), format, false)
+		if err != nil {
+			t.Fatalf("failed to import %s: %v", format, err)
+		}
+		if *summary != *srcSum {
+			t.Fatalf("unexpected %s import summary %+v, expected %+v", format, summary, srcSum)
+		}
+		if funded, _ := dst.CheckFundedUserWithWaitTime([]byte("user123"), "open"); !funded {
+			t.Fatalf("expected user to be funded after %s import", format)
+		}
+		// importing again into a non empty database must fail
+		if _, err := dst.Import(bytes.NewReader(dump.Bytes()), format, false); err == nil {
+			t.Fatalf("expected %s import into non empty database to fail", format)
+		}
+		dst.Close()
+	}
+
+	// a truncated dump must fail
+	var dump bytes.Buffer
+	if _, err := src.Export(&dump, DumpFormatJSON); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(dump.Bytes()), []byte("\n"))
+	truncated := bytes.Join(lines[:len(lines)-1], []byte("\n"))
+	dst, err := New("pebble", t.TempDir(), time.Hour, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	defer dst.Close()
+	if _, err := dst.Import(bytes.NewReader(truncated), DumpFormatJSON, false); err == nil {
+		t.Fatalf("expected truncated import to fail")
+	}
+
+	// a dump that does not match its footer must fail without writing anything, even when
+	// overwriting
+	inconsistent := bytes.Join(append(lines[:1:1], lines[2:]...), []byte("\n"))
+	emptySum, err := dst.Checksum()
+	if err != nil {
+		t.Fatalf("failed to compute checksum: %v", err)
+	}
+	for _, overwrite := range []bool{false, true} {
+		if _, err := dst.Import(bytes.NewReader(inconsistent), DumpFormatJSON, overwrite); err == nil {
+			t.Fatalf("expected inconsistent import to fail")
+		}
+		if sum, err := dst.Checksum(); err != nil || *sum != *emptySum {
+			t.Fatalf("expected nothing imported, got %+v (%v)", sum, err)
+		}
+	}
+
+	// copy between backends
+	other, err := New("leveldb", t.TempDir(), time.Hour, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	defer other.Close()
+	if _, err := src.CopyTo(other, false); err != nil {
+		t.Fatalf("failed to copy storage: %v", err)
+	}
+	if _, err := other.Payment("cs_test_123"); err != nil {
+		t.Fatalf("expected payment to be copied: %v", err)
+	}
+}
+
+func TestStorageImplementations(t *testing.T) {
+	kv, err := New("pebble", t.TempDir(), time.Hour, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create storage instance: %v", err)
+	}
+	sqlite, err := NewSQL(TypeSQLite, t.TempDir(), time.Hour, []byte("prefix"))
+	if err != nil {
+		t.Fatalf("failed to create sql storage instance: %v", err)
+	}
+	implementations := map[string]Storage{
+		"kv":     kv,
+		"memory": NewMemory(time.Hour),
+		"sqlite": sqlite,
+	}
+	// postgres is only tested if there is a database available
+	if os.Getenv("POSTGRES_URL") != "" {
+		postgres, err := NewSQL(TypePostgres, "", time.Hour, []byte(t.Name()+time.Now().String()))
+		if err != nil {
+			t.Fatalf("failed to create postgres storage instance: %v", err)
+		}
+		implementations["postgres"] = postgres
+	}
+	for name, st := range implementations {
+		t.Run(name, func(t *testing.T) {
+			defer st.Close()
+
+			// cooldowns
+			if funded, _ := st.CheckFundedUserWithWaitTime([]byte("user"), "open"); funded {
+				t.Fatalf("expected user not to be funded")
+			}
+			if err := st.AddFundedUserWithWaitTime([]byte("user"), "open"); err != nil {
+				t.Fatalf("failed to add funded user: %v", err)
+			}
+			if funded, _ := st.CheckFundedUserWithWaitTime([]byte("user"), "open"); !funded {
+				t.Fatalf("expected user to be funded")
+			}
+			if funded, _ := st.CheckFundedUserWithWaitTime([]byte("useropen"), ""); funded {
+				t.Fatalf("expected cooldown keys not to collide")
+			}
+			until := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+			if err := st.AddFundedUserUntil([]byte("user"), "oauth_github", until); err != nil {
+				t.Fatalf("failed to add funded user: %v", err)
+			}
+			if funded, wp := st.CheckFundedUserWithWaitTime([]byte("user"), "oauth_github"); !funded || !wp.Equal(until) {
+				t.Fatalf("unexpected cooldown until %s, expected %s", wp, until)
+			}
+			if err := st.AddFundedUserUntil([]byte("user"), "oauth_github", time.Now().Add(-time.Hour)); err != nil {
+				t.Fatalf("failed to add funded user: %v", err)
+			}
+			if funded, _ := st.CheckFundedUserWithWaitTime([]byte("user"), "oauth_github"); funded {
+				t.Fatalf("expected past cooldown not to be funded")
+			}
+
+			// payments
+			if _, err := st.Payment("cs_1"); err == nil {
+				t.Fatalf("expected missing payment")
+			}
+			payment := &Payment{
+				ID:        "cs_1",
+				State:     PaymentCreated,
+				Recipient: "0x01",
+				Quantity:  100,
+				Price:     1500,
+				Currency:  "eur",
+				Referral:  "alice",
+				Gift:      &Gift{Token: "secret", RefundToken: "refund"},
+				CreatedAt: time.Now(),
+			}
+			if err := st.SetPayment(payment); err != nil {
+				t.Fatalf("failed to set payment: %v", err)
+			}
+			if stored, err := st.Payment("cs_1"); err != nil || stored.Gift == nil || !stored.Gift.ExpiresAt.IsZero() {
+				t.Fatalf("unexpected stored gift payment %+v (%v)", stored, err)
+			}
+			payment.State, payment.Package = PaymentFulfilled, []byte("package")
+			payment.DailyLimits = []string{"stripe:0x01", "stripe:email:a@example.com"}
+			payment.Gift.ExpiresAt = payment.CreatedAt.Add(time.Hour)
+			payment.StartBlock = 1 << 40
+			if err := st.SetPayment(payment); err != nil {
+				t.Fatalf("failed to update payment: %v", err)
+			}
+			stored, err := st.Payment("cs_1")
+			if err != nil {
+				t.Fatalf("failed to get payment: %v", err)
+			}
+			if stored.State != PaymentFulfilled || stored.Recipient != "0x01" || stored.Quantity != 100 ||
+				stored.Price != 1500 || stored.Currency != "eur" || stored.Referral != "alice" || string(stored.Package) != "package" ||
+				!stored.CreatedAt.Equal(payment.CreatedAt) || stored.Gift.Token != "secret" || stored.Gift.RefundToken != "refund" ||
+				!stored.Gift.ExpiresAt.Equal(payment.Gift.ExpiresAt) || !slices.Equal(stored.DailyLimits, payment.DailyLimits) ||
+				stored.StartBlock != payment.StartBlock {
+				t.Fatalf("unexpected stored payment %+v", stored)
+			}
+			if !stored.State.CanTransitionTo(PaymentRefunded) || stored.State.CanTransitionTo(PaymentPaid) {
+				t.Fatalf("unexpected transitions from state %s", stored.State)
+			}
+			if err := st.SetPayment(&Payment{
+				ID: "cs_0", State: PaymentPaid, Recipient: "0x01", CreatedAt: payment.CreatedAt.Add(-time.Minute),
+			}); err != nil {
+				t.Fatalf("failed to set payment: %v", err)
+			}
+			payments, err := st.RecipientPayments("0x01")
+			if err != nil || len(payments) != 2 || payments[0].ID != "cs_0" || payments[1].ID != "cs_1" ||
+				string(payments[1].Package) != "package" {
+				t.Fatalf("unexpected recipient payments %+v (%v)", payments, err)
+			}
+			if payments, err := st.RecipientPayments("0x02"); err != nil || len(payments) != 0 {
+				t.Fatalf("unexpected recipient payments %+v (%v)", payments, err)
+			}
+
+			// customers
+			if _, err := st.Customer("a@example.com", "0x01"); err != ErrNotFound {
+				t.Fatalf("expected customer not found, got %v", err)
+			}
+			for i, email := range []string{"b@example.com", "a@example.com"} {
+				if err := st.SetCustomer(&Customer{
+					Email:           email,
+					Address:         "0x01",
+					ProviderID:      "cus_1",
+					Purchases:       1,
+					Tokens:          100,
+					FirstPurchaseAt: payment.CreatedAt.Add(time.Duration(i) * time.Minute),
+					LastPurchaseAt:  payment.CreatedAt,
+				}); err != nil {
+					t.Fatalf("failed to set customer: %v", err)
+				}
+			}
+			customer, err := st.Customer("a@example.com", "0x01")
+			if err != nil || customer.ProviderID != "cus_1" || customer.Tokens != 100 ||
+				!customer.LastPurchaseAt.Equal(payment.CreatedAt) {
+				t.Fatalf("unexpected customer %+v (%v)", customer, err)
+			}
+			customer.Purchases, customer.Tokens = 2, 300
+			if err := st.SetCustomer(customer); err != nil {
+				t.Fatalf("failed to update customer: %v", err)
+			}
+			customers, err := st.Customers("0x01")
+			if err != nil || len(customers) != 2 || customers[0].Email != "b@example.com" || customers[1].Tokens != 300 {
+				t.Fatalf("unexpected customers %+v (%v)", customers, err)
+			}
+
+			// subscriptions
+			if _, err := st.Subscription("sub_1"); err != ErrNotFound {
+				t.Fatalf("expected subscription not found, got %v", err)
+			}
+			for i, id := range []string{"sub_2", "sub_1"} {
+				if err := st.SetSubscription(&Subscription{
+					ID:         id,
+					Subscriber: "0x01",
+					Status:     "active",
+					Allowance:  100,
+					Available:  100,
+					PeriodEnd:  payment.CreatedAt.Add(30 * 24 * time.Hour),
+					CreatedAt:  payment.CreatedAt.Add(time.Duration(i) * time.Minute),
+					UpdatedAt:  payment.CreatedAt,
+				}); err != nil {
+					t.Fatalf("failed to set subscription: %v", err)
+				}
+			}
+			subscription, err := st.Subscription("sub_1")
+			if err != nil || subscription.Allowance != 100 || !subscription.PeriodEnd.Equal(payment.CreatedAt.Add(30*24*time.Hour)) {
+				t.Fatalf("unexpected subscription %+v (%v)", subscription, err)
+			}
+			subscription.Available, subscription.Claimed, subscription.LastInvoice = 50, 150, "in_1"
+			if err := st.SetSubscription(subscription); err != nil {
+				t.Fatalf("failed to update subscription: %v", err)
+			}
+			subscriptions, err := st.Subscriptions("0x01")
+			if err != nil || len(subscriptions) != 2 || subscriptions[0].ID != "sub_2" ||
+				subscriptions[1].Claimed != 150 || subscriptions[1].LastInvoice != "in_1" {
+				t.Fatalf("unexpected subscriptions %+v (%v)", subscriptions, err)
+			}
+
+			// webhook events
+			if processed, err := st.CheckWebhookEvent("evt_1"); err != nil || processed {
+				t.Fatalf("expected event not to be processed (%v)", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := st.AddWebhookEvent("evt_1"); err != nil {
+					t.Fatalf("failed to add webhook event: %v", err)
+				}
+			}
+			if processed, err := st.CheckWebhookEvent("evt_1"); err != nil || !processed {
+				t.Fatalf("expected event to be processed (%v)", err)
+			}
+
+			// webhook jobs
+			for i, id := range []string{"evt_3", "evt_2"} {
+				if err := st.SetWebhookJob(&WebhookJob{
+					ID:          id,
+					Provider:    "stripe",
+					Type:        "invoice.paid",
+					Payload:     []byte(`{"id":"` + id + `"}`),
+					State:       WebhookJobPending,
+					NextAttempt: payment.CreatedAt,
+					CreatedAt:   payment.CreatedAt.Add(time.Duration(i) * time.Minute),
+					UpdatedAt:   payment.CreatedAt,
+				}); err != nil {
+					t.Fatalf("failed to set webhook job: %v", err)
+				}
+			}
+			job, err := st.WebhookJob("evt_2")
+			if err != nil || string(job.Payload) != `{"id":"evt_2"}` || !job.NextAttempt.Equal(payment.CreatedAt) {
+				t.Fatalf("unexpected webhook job %+v (%v)", job, err)
+			}
+			job.State, job.Attempts, job.LastError = WebhookJobDead, 3, "failed"
+			if err := st.SetWebhookJob(job); err != nil {
+				t.Fatalf("failed to update webhook job: %v", err)
+			}
+			if jobs, err := st.WebhookJobs(WebhookJobDead); err != nil || len(jobs) != 1 || jobs[0].Attempts != 3 {
+				t.Fatalf("unexpected dead webhook jobs %+v (%v)", jobs, err)
+			}
+			if jobs, err := st.WebhookJobs(""); err != nil || len(jobs) != 2 || jobs[0].ID != "evt_3" {
+				t.Fatalf("unexpected webhook jobs %+v (%v)", jobs, err)
+			}
+
+			// oauth states and codes
+			if _, err := st.OAuthState("state_1"); err != ErrNotFound {
+				t.Fatalf("expected oauth state not found, got %v", err)
+			}
+			state := &OAuthState{
+				State:       "state_1",
+				Provider:    "github",
+				Recipient:   "0x01",
+				Verifier:    "verifier",
+				Nonce:       "nonce",
+				RedirectURL: "https://example.com/callback",
+				CreatedAt:   payment.CreatedAt,
+				ExpiresAt:   payment.CreatedAt.Add(10 * time.Minute),
+			}
+			if err := st.SetOAuthState(state); err != nil {
+				t.Fatalf("failed to set oauth state: %v", err)
+			}
+			if s, err := st.OAuthState("state_1"); err != nil || s.Verifier != "verifier" || s.Nonce != "nonce" || !s.UsedAt.IsZero() ||
+				!s.ExpiresAt.Equal(state.ExpiresAt) {
+				t.Fatalf("unexpected oauth state %+v (%v)", s, err)
+			}
+			state.UsedAt = payment.CreatedAt
+			if err := st.SetOAuthState(state); err != nil {
+				t.Fatalf("failed to update oauth state: %v", err)
+			}
+			if s, err := st.OAuthState("state_1"); err != nil || !s.UsedAt.Equal(payment.CreatedAt) {
+				t.Fatalf("unexpected used oauth state %+v (%v)", s, err)
+			}
+			if used, err := st.CheckOAuthCode("code_hash"); err != nil || used {
+				t.Fatalf("expected unused oauth code (%v)", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := st.AddOAuthCode("code_hash"); err != nil {
+					t.Fatalf("failed to add oauth code: %v", err)
+				}
+			}
+			if used, err := st.CheckOAuthCode("code_hash"); err != nil || !used {
+				t.Fatalf("expected used oauth code (%v)", err)
+			}
+
+			// referrals
+			now := time.Now()
+			if _, err := st.Referrer("alice"); err != ErrNotFound {
+				t.Fatalf("expected referrer not found, got %v", err)
+			}
+			if err := st.SetReferrer(&Referrer{Code: "alice", Address: "0x02", CreatedAt: now}); err != nil {
+				t.Fatalf("failed to set referrer: %v", err)
+			}
+			if referrer, err := st.Referrer("alice"); err != nil || referrer.Address != "0x02" {
+				t.Fatalf("unexpected referrer %+v (%v)", referrer, err)
+			}
+			for i, id := range []string{"cs_2", "cs_1", "cs_3"} {
+				code := "alice"
+				if id == "cs_3" {
+					code = "bob"
+				}
+				if err := st.SetReferralReward(&ReferralReward{
+					PaymentID: id,
+					Code:      code,
+					State:     RewardPending,
+					Recipient: "0x01",
+					Quantity:  100,
+					Amount:    uint64(10 * (i + 1)),
+					CreatedAt: now.Add(time.Duration(-i) * time.Minute),
+				}); err != nil {
+					t.Fatalf("failed to set referral reward: %v", err)
+				}
+			}
+			rewards, err := st.ReferralRewards("alice")
+			if err != nil {
+				t.Fatalf("failed to get referral rewards: %v", err)
+			}
+			if len(rewards) != 2 || rewards[0].PaymentID != "cs_1" || rewards[1].PaymentID != "cs_2" ||
+				rewards[0].Amount != 20 || rewards[0].State != RewardPending {
+				t.Fatalf("unexpected referral rewards: %+v", rewards)
+			}
+			rewards[0].State, rewards[0].ClaimID = RewardClaimed, "claim_1"
+			if err := st.SetReferralReward(rewards[0]); err != nil {
+				t.Fatalf("failed to update referral reward: %v", err)
+			}
+			if err := st.AddReferralClaim(&ReferralClaim{
+				ID:        "claim_1",
+				Code:      "alice",
+				Address:   "0x02",
+				Amount:    20,
+				Package:   []byte("package"),
+				CreatedAt: now,
+			}); err != nil {
+				t.Fatalf("failed to add referral claim: %v", err)
+			}
+			rewards, err = st.ReferralRewards("alice")
+			if err != nil || len(rewards) != 2 || rewards[0].State != RewardClaimed || rewards[0].ClaimID != "claim_1" {
+				t.Fatalf("unexpected referral rewards: %+v (%v)", rewards, err)
+			}
+			claims, err := st.ReferralClaims("alice")
+			if err != nil || len(claims) != 1 || claims[0].Amount != 20 || string(claims[0].Package) != "package" {
+				t.Fatalf("unexpected referral claims: %+v (%v)", claims, err)
+			}
+			if claims, err := st.ReferralClaims("bob"); err != nil || len(claims) != 0 {
+				t.Fatalf("unexpected referral claims: %+v (%v)", claims, err)
+			}
+
+			// ledger
+			for i, amount := range []uint64{10, 20, 30} {
+				if err := st.AddLedgerEntry(&LedgerEntry{
+					Time:      now.Add(time.Duration(i) * time.Minute),
+					Recipient: "0x01",
+					Amount:    amount,
+					AuthType:  "open",
+				}); err != nil {
+					t.Fatalf("failed to add ledger entry: %v", err)
+				}
+			}
+			entries, err := st.LedgerEntries(now, now.Add(2*time.Minute))
+			if err != nil {
+				t.Fatalf("failed to get ledger entries: %v", err)
+			}
+			if len(entries) != 2 || entries[0].Amount != 10 || entries[1].Amount != 20 {
+				t.Fatalf("unexpected ledger entries: %+v", entries)
+			}
+
+			// budgets
+			if spent, err := st.SpendBudget("faucet", time.Hour, 60, 100); err != nil || spent != 60 {
+				t.Fatalf("expected 60 spent, got %d (%v)", spent, err)
+			}
+			if _, err := st.SpendBudget("faucet", time.Hour, 60, 100); err != ErrBudgetExceeded {
+				t.Fatalf("expected budget exceeded, got %v", err)
+			}
+			if spent, err := st.BudgetSpent("faucet", time.Hour); err != nil || spent != 60 {
+				t.Fatalf("expected 60 spent, got %d (%v)", spent, err)
+			}
+			if spent, err := st.BudgetSpent("other", time.Hour); err != nil || spent != 0 {
+				t.Fatalf("expected 0 spent, got %d (%v)", spent, err)
+			}
+			// releases only count in the window they were spent in, and stop at 0
+			spentAt := time.Now()
+			if err := st.ReleaseBudget("faucet", time.Hour, 50, spentAt.Add(-time.Hour)); err != nil {
+				t.Fatalf("failed to release budget: %v", err)
+			}
+			if err := st.ReleaseBudget("faucet", time.Hour, 50, spentAt); err != nil {
+				t.Fatalf("failed to release budget: %v", err)
+			}
+			if spent, err := st.BudgetSpent("faucet", time.Hour); err != nil || spent != 10 {
+				t.Fatalf("expected 10 spent, got %d (%v)", spent, err)
+			}
+			if err := st.ReleaseBudget("faucet", time.Hour, 50, spentAt); err != nil {
+				t.Fatalf("failed to release budget: %v", err)
+			}
+			if spent, err := st.SpendBudget("faucet", time.Hour, 100, 100); err != nil || spent != 100 {
+				t.Fatalf("expected 100 spent, got %d (%v)", spent, err)
+			}
+
+			// reservations
+			for id, expiresAt := range map[string]time.Time{"cs_1": now.Add(time.Hour), "cs_2": now.Add(-time.Minute)} {
+				if err := st.SetReservation(&Reservation{ID: id, Amount: 10, ExpiresAt: expiresAt}); err != nil {
+					t.Fatalf("failed to set reservation: %v", err)
+				}
+			}
+			if err := st.SetReservation(&Reservation{ID: "cs_1", Amount: 15, ExpiresAt: now.Add(time.Hour)}); err != nil {
+				t.Fatalf("failed to set reservation: %v", err)
+			}
+			reservations, err := st.Reservations()
+			if err != nil || len(reservations) != 1 || reservations[0].ID != "cs_1" || reservations[0].Amount != 15 {
+				t.Fatalf("unexpected reservations: %+v (%v)", reservations, err)
+			}
+			if err := st.DeleteReservation("cs_1"); err != nil {
+				t.Fatalf("failed to delete reservation: %v", err)
+			}
+			if reservations, err := st.Reservations(); err != nil || len(reservations) != 0 {
+				t.Fatalf("unexpected reservations after delete: %+v (%v)", reservations, err)
+			}
+
+			// denylist
+			if _, err := st.DenylistEntry(DenylistAddress, "0x01"); err != ErrNotFound {
+				t.Fatalf("expected denylist entry not found, got %v", err)
+			}
+			if err := st.AddDenylistEntry(&DenylistEntry{
+				Kind:   DenylistAddress,
+				Value:  "0x01",
+				Reason: "refund",
+				Time:   now,
+			}); err != nil {
+				t.Fatalf("failed to add denylist entry: %v", err)
+			}
+			if entry, err := st.DenylistEntry(DenylistAddress, "0x01"); err != nil || entry.Reason != "refund" {
+				t.Fatalf("unexpected denylist entry %+v (%v)", entry, err)
+			}
+			if _, err := st.DenylistEntry(DenylistCustomer, "0x01"); err != ErrNotFound {
+				t.Fatalf("expected denylist entry not found, got %v", err)
+			}
+			if err := st.DeleteDenylistEntry(DenylistAddress, "0x01"); err != nil {
+				t.Fatalf("failed to delete denylist entry: %v", err)
+			}
+			if _, err := st.DenylistEntry(DenylistAddress, "0x01"); err != ErrNotFound {
+				t.Fatalf("expected denylist entry not found, got %v", err)
+			}
+
+			// garbage collection
+			if _, err := st.Sweep(time.Hour); err != nil {
+				t.Fatalf("failed to sweep: %v", err)
+			}
+			if funded, _ := st.CheckFundedUserWithWaitTime([]byte("user"), "open"); !funded {
+				t.Fatalf("expected user to be funded after sweep")
+			}
+
+			// the markers of on-chain transfers are never removed
+			if err := st.AddWebhookEvent(TransferEventPrefix + "0x01:0"); err != nil {
+				t.Fatalf("failed to add webhook event: %v", err)
+			}
+			if _, err := st.Sweep(-time.Hour); err != nil {
+				t.Fatalf("failed to sweep: %v", err)
+			}
+			if processed, err := st.CheckWebhookEvent("evt_1"); err != nil || processed {
+				t.Fatalf("expected event marker to be removed (%v)", err)
+			}
+			if processed, err := st.CheckWebhookEvent(TransferEventPrefix + "0x01:0"); err != nil || !processed {
+				t.Fatalf("expected transfer marker to be kept (%v)", err)
+			}
+		})
+	}
+}
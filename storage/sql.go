@@ -0,0 +1,1014 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"           // postgres driver
+	_ "github.com/mattn/go-sqlite3" // sqlite driver
+	"go.vocdoni.io/dvote/log"
+)
+
+// sqlSchema is the ordered list of statements that create the SQL schema. Every table has a
+// faucet column, holding the hex encoded database prefix, so several faucets can share the
+// same database. The schema_version table records how many statements have been applied.
+// Statements with a ? placeholder are run with the faucet column value.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS cooldowns (
+		faucet TEXT NOT NULL,
+		user_id BYTEA NOT NULL,
+		auth_type TEXT NOT NULL,
+		wait_until BIGINT NOT NULL,
+		PRIMARY KEY (faucet, user_id, auth_type)
+	)`,
+	`CREATE INDEX IF NOT EXISTS cooldowns_wait_until ON cooldowns (faucet, wait_until)`,
+	`CREATE TABLE IF NOT EXISTS stripe_sessions (
+		faucet TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, session_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS stripe_sessions_created_at ON stripe_sessions (faucet, created_at)`,
+	`CREATE TABLE IF NOT EXISTS ledger (
+		faucet TEXT NOT NULL,
+		issued_at BIGINT NOT NULL,
+		recipient TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		auth_type TEXT NOT NULL,
+		reference TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (faucet, issued_at, recipient, auth_type, reference)
+	)`,
+	`CREATE INDEX IF NOT EXISTS ledger_recipient ON ledger (faucet, recipient)`,
+	`CREATE INDEX IF NOT EXISTS ledger_reference ON ledger (faucet, reference)`,
+	`CREATE TABLE IF NOT EXISTS budgets (
+		faucet TEXT NOT NULL,
+		name TEXT NOT NULL,
+		window_start BIGINT NOT NULL,
+		period BIGINT NOT NULL,
+		spent BIGINT NOT NULL,
+		PRIMARY KEY (faucet, name, window_start, period)
+	)`,
+	`CREATE TABLE IF NOT EXISTS denylist (
+		faucet TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, kind, value)
+	)`,
+	`CREATE INDEX IF NOT EXISTS denylist_created_at ON denylist (faucet, created_at)`,
+	`CREATE TABLE IF NOT EXISTS payments (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		state TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		quantity BIGINT NOT NULL,
+		price BIGINT NOT NULL,
+		currency TEXT NOT NULL,
+		package BYTEA,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS payments_state ON payments (faucet, state, created_at)`,
+	// the stripe session markers were only stored for completed checkouts
+	`INSERT INTO payments (faucet, id, state, recipient, quantity, price, currency, created_at, updated_at)
+		SELECT faucet, session_id, 'paid', '', 0, 0, '', created_at, created_at FROM stripe_sessions WHERE faucet = ?`,
+	`DELETE FROM stripe_sessions WHERE faucet = ?`,
+	`ALTER TABLE payments ADD COLUMN customer TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS webhook_events (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		received_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`ALTER TABLE payments ADD COLUMN referral TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS referrers (
+		faucet TEXT NOT NULL,
+		code TEXT NOT NULL,
+		address TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS referral_rewards (
+		faucet TEXT NOT NULL,
+		payment_id TEXT NOT NULL,
+		code TEXT NOT NULL,
+		state TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		quantity BIGINT NOT NULL,
+		amount BIGINT NOT NULL,
+		claim_id TEXT NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, payment_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS referral_rewards_code ON referral_rewards (faucet, code, created_at)`,
+	`CREATE TABLE IF NOT EXISTS referral_claims (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		code TEXT NOT NULL,
+		address TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		package BYTEA,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS referral_claims_code ON referral_claims (faucet, code, created_at)`,
+	`ALTER TABLE payments ADD COLUMN gift_token TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN gift_expires_at BIGINT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS reservations (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS payments_recipient ON payments (faucet, recipient, created_at)`,
+	`CREATE TABLE IF NOT EXISTS customers (
+		faucet TEXT NOT NULL,
+		email TEXT NOT NULL,
+		address TEXT NOT NULL,
+		provider_id TEXT NOT NULL,
+		purchases BIGINT NOT NULL,
+		tokens BIGINT NOT NULL,
+		first_purchase_at BIGINT NOT NULL,
+		last_purchase_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, email, address)
+	)`,
+	`CREATE INDEX IF NOT EXISTS customers_address ON customers (faucet, address, first_purchase_at)`,
+	`CREATE TABLE IF NOT EXISTS subscriptions (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		subscriber TEXT NOT NULL,
+		status TEXT NOT NULL,
+		customer TEXT NOT NULL,
+		email TEXT NOT NULL,
+		allowance BIGINT NOT NULL,
+		available BIGINT NOT NULL,
+		claimed BIGINT NOT NULL,
+		last_invoice TEXT NOT NULL,
+		period_end BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS subscriptions_subscriber ON subscriptions (faucet, subscriber, created_at)`,
+	`CREATE TABLE IF NOT EXISTS webhook_jobs (
+		faucet TEXT NOT NULL,
+		id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		type TEXT NOT NULL,
+		payload BYTEA,
+		state TEXT NOT NULL,
+		attempts BIGINT NOT NULL,
+		last_error TEXT NOT NULL,
+		next_attempt BIGINT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_jobs_state ON webhook_jobs (faucet, state, created_at)`,
+	`CREATE TABLE IF NOT EXISTS oauth_states (
+		faucet TEXT NOT NULL,
+		state TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		verifier TEXT NOT NULL,
+		redirect_url TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		used_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, state)
+	)`,
+	`CREATE TABLE IF NOT EXISTS oauth_codes (
+		faucet TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		used_at BIGINT NOT NULL,
+		PRIMARY KEY (faucet, hash)
+	)`,
+	`ALTER TABLE oauth_states ADD COLUMN nonce TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN gift_refund_token TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN daily_limits TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payments ADD COLUMN start_block BIGINT NOT NULL DEFAULT 0`,
+}
+
+// SQLStorage is a Storage backed by a SQL database, either SQLite or Postgres. Unlike the
+// key-value storage, its tables can be queried directly by operators.
+type SQLStorage struct {
+	db         *sql.DB
+	dialect    string
+	faucet     string
+	waitPeriod time.Duration
+	gc         garbageCollector
+}
+
+// check that SQLStorage implements the Storage interface
+var _ Storage = (*SQLStorage)(nil)
+
+// NewSQL creates a new SQL storage instance. The SQLite database is created in the data
+// directory, the Postgres database is reached at the POSTGRES_URL env var. The schema is
+// created or upgraded on startup.
+func NewSQL(dbType string, dataDir string, waitPeriod time.Duration, dbPrefix []byte) (*SQLStorage, error) {
+	var driver, dsn string
+	switch dbType {
+	case TypeSQLite:
+		dir := filepath.Join(filepath.Clean(dataDir), "db")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		driver, dsn = "sqlite3", filepath.Join(dir, "faucet.sqlite")+"?_journal_mode=WAL&_busy_timeout=5000"
+	case TypePostgres:
+		driver, dsn = "postgres", os.Getenv("POSTGRES_URL")
+		if dsn == "" {
+			return nil, fmt.Errorf("missing POSTGRES_URL env var")
+		}
+	default:
+		return nil, fmt.Errorf("invalid SQL dbType: %q. Available types: %q %q", dbType, TypeSQLite, TypePostgres)
+	}
+	log.Infow("create sql storage", "type", dbType, "dir", dataDir, "prefix", hex.EncodeToString(dbPrefix))
+	sqlDB, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dbType == TypeSQLite {
+		// sqlite does not support concurrent writers
+		sqlDB.SetMaxOpenConns(1)
+	}
+	st := &SQLStorage{
+		db:         sqlDB,
+		dialect:    dbType,
+		faucet:     hex.EncodeToString(dbPrefix),
+		waitPeriod: waitPeriod,
+	}
+	if err := st.migrate(); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// rebind converts the ? placeholders of the query to the dialect of the database.
+func (st *SQLStorage) rebind(query string) string {
+	if st.dialect != TypePostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// exec runs the given statement, with ? placeholders, and returns the affected rows.
+func (st *SQLStorage) exec(query string, args ...any) (int64, error) {
+	res, err := st.db.Exec(st.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// migrate applies the schema statements not applied yet.
+func (st *SQLStorage) migrate() error {
+	if _, err := st.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		faucet TEXT PRIMARY KEY,
+		version BIGINT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	var current int
+	err := st.db.QueryRow(st.rebind(`SELECT version FROM schema_version WHERE faucet = ?`), st.faucet).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if current > len(sqlSchema) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, len(sqlSchema))
+	}
+	for i := current; i < len(sqlSchema); i++ {
+		statement := sqlSchema[i]
+		if st.dialect == TypeSQLite {
+			statement = strings.ReplaceAll(statement, "BYTEA", "BLOB")
+		}
+		var args []any
+		if strings.Contains(statement, "?") {
+			args = append(args, st.faucet)
+		}
+		if _, err := st.db.Exec(st.rebind(statement), args...); err != nil {
+			return fmt.Errorf("sql migration %d failed: %w", i+1, err)
+		}
+	}
+	if current < len(sqlSchema) {
+		log.Infow("sql schema upgraded", "from", current, "to", len(sqlSchema))
+		if _, err := st.exec(`INSERT INTO schema_version (faucet, version) VALUES (?, ?)
+			ON CONFLICT (faucet) DO UPDATE SET version = excluded.version`, st.faucet, len(sqlSchema)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddFundedUserWithWaitTime adds the given userID to the funded list, with the current time
+// plus the wait period as the wait period end time.
+func (st *SQLStorage) AddFundedUserWithWaitTime(userID []byte, authType string) error {
+	return st.AddFundedUserUntil(userID, authType, time.Now().Add(st.waitPeriod))
+}
+
+// AddFundedUserUntil adds the given userID to the funded list, with the given time as the wait
+// period end time.
+func (st *SQLStorage) AddFundedUserUntil(userID []byte, authType string, until time.Time) error {
+	_, err := st.exec(`INSERT INTO cooldowns (faucet, user_id, auth_type, wait_until) VALUES (?, ?, ?, ?)
+		ON CONFLICT (faucet, user_id, auth_type) DO UPDATE SET wait_until = excluded.wait_until`,
+		st.faucet, userID, authType, until.Unix())
+	return err
+}
+
+// CheckFundedUserWithWaitTime returns true if the given userID is funded within the wait
+// period time window, and the time when the window ends.
+func (st *SQLStorage) CheckFundedUserWithWaitTime(userID []byte, authType string) (bool, time.Time) {
+	var wp int64
+	if err := st.db.QueryRow(st.rebind(`SELECT wait_until FROM cooldowns
+		WHERE faucet = ? AND user_id = ? AND auth_type = ?`), st.faucet, userID, authType).Scan(&wp); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Warnw("failed to check cooldown", "err", err)
+		}
+		return false, time.Time{}
+	}
+	return wp >= time.Now().Unix(), time.Unix(wp, 0)
+}
+
+// SetPayment stores the given payment record, replacing any previous record with the same ID.
+// Gifts are stored in the gift columns, a payment with a gift token is a gift.
+func (st *SQLStorage) SetPayment(payment *Payment) error {
+	var giftToken, giftRefundToken string
+	var giftExpiresAt int64
+	if payment.Gift != nil {
+		giftToken, giftRefundToken = payment.Gift.Token, payment.Gift.RefundToken
+		if !payment.Gift.ExpiresAt.IsZero() {
+			giftExpiresAt = payment.Gift.ExpiresAt.UnixNano()
+		}
+	}
+	_, err := st.exec(`INSERT INTO payments
+		(faucet, id, state, recipient, quantity, price, currency, customer, email, referral, gift_token,
+		gift_refund_token, gift_expires_at, daily_limits, start_block, package, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, id) DO UPDATE SET state = excluded.state, recipient = excluded.recipient,
+		quantity = excluded.quantity, price = excluded.price, currency = excluded.currency,
+		customer = excluded.customer, email = excluded.email, referral = excluded.referral,
+		gift_token = excluded.gift_token, gift_refund_token = excluded.gift_refund_token,
+		gift_expires_at = excluded.gift_expires_at, daily_limits = excluded.daily_limits,
+		start_block = excluded.start_block, package = excluded.package, created_at = excluded.created_at,
+		updated_at = excluded.updated_at`,
+		st.faucet, payment.ID, string(payment.State), payment.Recipient, int64(payment.Quantity), payment.Price,
+		payment.Currency, payment.Customer, payment.Email, payment.Referral, giftToken, giftRefundToken,
+		giftExpiresAt, strings.Join(payment.DailyLimits, "\n"), int64(payment.StartBlock), payment.Package,
+		payment.CreatedAt.UnixNano(), payment.UpdatedAt.UnixNano())
+	return err
+}
+
+// paymentColumns are the columns of the payments table read by scanPayment.
+const paymentColumns = `id, state, recipient, quantity, price, currency, customer, email, referral,
+	gift_token, gift_refund_token, gift_expires_at, daily_limits, start_block, package, created_at, updated_at`
+
+// Payment returns the payment record with the given ID, or ErrNotFound.
+func (st *SQLStorage) Payment(id string) (*Payment, error) {
+	payment, err := scanPayment(st.db.QueryRow(st.rebind(`SELECT `+paymentColumns+`
+		FROM payments WHERE faucet = ? AND id = ?`), st.faucet, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return payment, err
+}
+
+// RecipientPayments returns the payment records of the given recipient, ordered by creation
+// time.
+func (st *SQLStorage) RecipientPayments(recipient string) ([]*Payment, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT `+paymentColumns+` FROM payments
+		WHERE faucet = ? AND recipient = ? ORDER BY created_at`), st.faucet, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payments []*Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+// scanPayment reads a payment record from the given row, with the paymentColumns.
+func scanPayment(row interface{ Scan(...any) error }) (*Payment, error) {
+	var state, giftToken, giftRefundToken, dailyLimits string
+	var quantity, giftExpiresAt, startBlock, createdAt, updatedAt int64
+	payment := &Payment{}
+	if err := row.Scan(&payment.ID, &state, &payment.Recipient, &quantity, &payment.Price, &payment.Currency,
+		&payment.Customer, &payment.Email, &payment.Referral, &giftToken, &giftRefundToken, &giftExpiresAt, &dailyLimits,
+		&startBlock, &payment.Package,
+		&createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	payment.State = PaymentState(state)
+	payment.Quantity = uint64(quantity)
+	payment.StartBlock = uint64(startBlock)
+	if giftToken != "" {
+		payment.Gift = &Gift{Token: giftToken, RefundToken: giftRefundToken}
+		if giftExpiresAt != 0 {
+			payment.Gift.ExpiresAt = time.Unix(0, giftExpiresAt)
+		}
+	}
+	if dailyLimits != "" {
+		payment.DailyLimits = strings.Split(dailyLimits, "\n")
+	}
+	payment.CreatedAt = time.Unix(0, createdAt)
+	payment.UpdatedAt = time.Unix(0, updatedAt)
+	return payment, nil
+}
+
+// AddWebhookEvent records that the webhook event with the given ID has been processed.
+func (st *SQLStorage) AddWebhookEvent(id string) error {
+	_, err := st.exec(`INSERT INTO webhook_events (faucet, id, received_at) VALUES (?, ?, ?)
+		ON CONFLICT (faucet, id) DO NOTHING`, st.faucet, id, time.Now().Unix())
+	return err
+}
+
+// CheckWebhookEvent returns true if the webhook event with the given ID has been processed.
+func (st *SQLStorage) CheckWebhookEvent(id string) (bool, error) {
+	var receivedAt int64
+	err := st.db.QueryRow(st.rebind(`SELECT received_at FROM webhook_events WHERE faucet = ? AND id = ?`),
+		st.faucet, id).Scan(&receivedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetReferrer stores the given referrer, replacing any previous referrer with the same code.
+func (st *SQLStorage) SetReferrer(referrer *Referrer) error {
+	_, err := st.exec(`INSERT INTO referrers (faucet, code, address, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (faucet, code) DO UPDATE SET address = excluded.address, created_at = excluded.created_at`,
+		st.faucet, referrer.Code, referrer.Address, referrer.CreatedAt.UnixNano())
+	return err
+}
+
+// Referrer returns the referrer with the given code, or ErrNotFound.
+func (st *SQLStorage) Referrer(code string) (*Referrer, error) {
+	var createdAt int64
+	referrer := &Referrer{Code: code}
+	err := st.db.QueryRow(st.rebind(`SELECT address, created_at FROM referrers WHERE faucet = ? AND code = ?`),
+		st.faucet, code).Scan(&referrer.Address, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	referrer.CreatedAt = time.Unix(0, createdAt)
+	return referrer, nil
+}
+
+// SetReferralReward stores the given referral reward, replacing any previous reward for the
+// same payment.
+func (st *SQLStorage) SetReferralReward(reward *ReferralReward) error {
+	_, err := st.exec(`INSERT INTO referral_rewards
+		(faucet, payment_id, code, state, recipient, quantity, amount, claim_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, payment_id) DO UPDATE SET code = excluded.code, state = excluded.state,
+		recipient = excluded.recipient, quantity = excluded.quantity, amount = excluded.amount,
+		claim_id = excluded.claim_id, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		st.faucet, reward.PaymentID, reward.Code, string(reward.State), reward.Recipient, int64(reward.Quantity),
+		int64(reward.Amount), reward.ClaimID, reward.CreatedAt.UnixNano(), reward.UpdatedAt.UnixNano())
+	return err
+}
+
+// ReferralRewards returns the rewards of the referrer with the given code, ordered by time.
+func (st *SQLStorage) ReferralRewards(code string) ([]*ReferralReward, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT payment_id, state, recipient, quantity, amount, claim_id,
+		created_at, updated_at FROM referral_rewards WHERE faucet = ? AND code = ? ORDER BY created_at`),
+		st.faucet, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rewards []*ReferralReward
+	for rows.Next() {
+		var state string
+		var quantity, amount, createdAt, updatedAt int64
+		reward := &ReferralReward{Code: code}
+		if err := rows.Scan(&reward.PaymentID, &state, &reward.Recipient, &quantity, &amount, &reward.ClaimID,
+			&createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		reward.State = RewardState(state)
+		reward.Quantity = uint64(quantity)
+		reward.Amount = uint64(amount)
+		reward.CreatedAt = time.Unix(0, createdAt)
+		reward.UpdatedAt = time.Unix(0, updatedAt)
+		rewards = append(rewards, reward)
+	}
+	return rewards, rows.Err()
+}
+
+// AddReferralClaim records a claim of referral rewards.
+func (st *SQLStorage) AddReferralClaim(claim *ReferralClaim) error {
+	_, err := st.exec(`INSERT INTO referral_claims (faucet, id, code, address, amount, package, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		st.faucet, claim.ID, claim.Code, claim.Address, int64(claim.Amount), claim.Package, claim.CreatedAt.UnixNano())
+	return err
+}
+
+// ReferralClaims returns the claims of the referrer with the given code, ordered by time.
+func (st *SQLStorage) ReferralClaims(code string) ([]*ReferralClaim, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT id, address, amount, package, created_at FROM referral_claims
+		WHERE faucet = ? AND code = ? ORDER BY created_at`), st.faucet, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var claims []*ReferralClaim
+	for rows.Next() {
+		var amount, createdAt int64
+		claim := &ReferralClaim{Code: code}
+		if err := rows.Scan(&claim.ID, &claim.Address, &amount, &claim.Package, &createdAt); err != nil {
+			return nil, err
+		}
+		claim.Amount = uint64(amount)
+		claim.CreatedAt = time.Unix(0, createdAt)
+		claims = append(claims, claim)
+	}
+	return claims, rows.Err()
+}
+
+// SetCustomer stores the given customer, replacing any previous customer with the same email
+// and address.
+func (st *SQLStorage) SetCustomer(customer *Customer) error {
+	_, err := st.exec(`INSERT INTO customers
+		(faucet, email, address, provider_id, purchases, tokens, first_purchase_at, last_purchase_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, email, address) DO UPDATE SET provider_id = excluded.provider_id,
+		purchases = excluded.purchases, tokens = excluded.tokens,
+		first_purchase_at = excluded.first_purchase_at, last_purchase_at = excluded.last_purchase_at`,
+		st.faucet, customer.Email, customer.Address, customer.ProviderID, int64(customer.Purchases),
+		int64(customer.Tokens), customer.FirstPurchaseAt.UnixNano(), customer.LastPurchaseAt.UnixNano())
+	return err
+}
+
+// Customer returns the customer with the given email and address, or ErrNotFound.
+func (st *SQLStorage) Customer(email, address string) (*Customer, error) {
+	customer, err := scanCustomer(st.db.QueryRow(st.rebind(`SELECT email, address, provider_id, purchases, tokens,
+		first_purchase_at, last_purchase_at FROM customers WHERE faucet = ? AND email = ? AND address = ?`),
+		st.faucet, email, address))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return customer, err
+}
+
+// Customers returns the customers that bought tokens for the given address, ordered by their
+// first purchase.
+func (st *SQLStorage) Customers(address string) ([]*Customer, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT email, address, provider_id, purchases, tokens,
+		first_purchase_at, last_purchase_at FROM customers WHERE faucet = ? AND address = ?
+		ORDER BY first_purchase_at`), st.faucet, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var customers []*Customer
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, customer)
+	}
+	return customers, rows.Err()
+}
+
+// scanCustomer reads a customer from the given row.
+func scanCustomer(row interface{ Scan(...any) error }) (*Customer, error) {
+	var purchases, tokens, firstPurchaseAt, lastPurchaseAt int64
+	customer := &Customer{}
+	if err := row.Scan(&customer.Email, &customer.Address, &customer.ProviderID, &purchases, &tokens,
+		&firstPurchaseAt, &lastPurchaseAt); err != nil {
+		return nil, err
+	}
+	customer.Purchases = uint64(purchases)
+	customer.Tokens = uint64(tokens)
+	customer.FirstPurchaseAt = time.Unix(0, firstPurchaseAt)
+	customer.LastPurchaseAt = time.Unix(0, lastPurchaseAt)
+	return customer, nil
+}
+
+// subscriptionColumns are the columns of the subscriptions table read by scanSubscription.
+const subscriptionColumns = `id, subscriber, status, customer, email, allowance, available, claimed,
+	last_invoice, period_end, created_at, updated_at`
+
+// SetSubscription stores the given subscription, replacing any previous subscription with the
+// same ID.
+func (st *SQLStorage) SetSubscription(subscription *Subscription) error {
+	_, err := st.exec(`INSERT INTO subscriptions (faucet, `+subscriptionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, id) DO UPDATE SET subscriber = excluded.subscriber, status = excluded.status,
+		customer = excluded.customer, email = excluded.email, allowance = excluded.allowance,
+		available = excluded.available, claimed = excluded.claimed, last_invoice = excluded.last_invoice,
+		period_end = excluded.period_end, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		st.faucet, subscription.ID, subscription.Subscriber, subscription.Status, subscription.Customer,
+		subscription.Email, int64(subscription.Allowance), int64(subscription.Available),
+		int64(subscription.Claimed), subscription.LastInvoice, subscription.PeriodEnd.UnixNano(),
+		subscription.CreatedAt.UnixNano(), subscription.UpdatedAt.UnixNano())
+	return err
+}
+
+// Subscription returns the subscription with the given ID, or ErrNotFound.
+func (st *SQLStorage) Subscription(id string) (*Subscription, error) {
+	subscription, err := scanSubscription(st.db.QueryRow(st.rebind(`SELECT `+subscriptionColumns+`
+		FROM subscriptions WHERE faucet = ? AND id = ?`), st.faucet, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return subscription, err
+}
+
+// Subscriptions returns the subscriptions of the given subscriber address, ordered by creation
+// time.
+func (st *SQLStorage) Subscriptions(subscriber string) ([]*Subscription, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT `+subscriptionColumns+` FROM subscriptions
+		WHERE faucet = ? AND subscriber = ? ORDER BY created_at`), st.faucet, subscriber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subscriptions []*Subscription
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// scanSubscription reads a subscription from the given row.
+func scanSubscription(row interface{ Scan(...any) error }) (*Subscription, error) {
+	var allowance, available, claimed, periodEnd, createdAt, updatedAt int64
+	subscription := &Subscription{}
+	if err := row.Scan(&subscription.ID, &subscription.Subscriber, &subscription.Status, &subscription.Customer,
+		&subscription.Email, &allowance, &available, &claimed, &subscription.LastInvoice, &periodEnd,
+		&createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	subscription.Allowance = uint64(allowance)
+	subscription.Available = uint64(available)
+	subscription.Claimed = uint64(claimed)
+	subscription.PeriodEnd = time.Unix(0, periodEnd)
+	subscription.CreatedAt = time.Unix(0, createdAt)
+	subscription.UpdatedAt = time.Unix(0, updatedAt)
+	return subscription, nil
+}
+
+// webhookJobColumns are the columns of the webhook_jobs table read by scanWebhookJob.
+const webhookJobColumns = `id, provider, type, payload, state, attempts, last_error, next_attempt,
+	created_at, updated_at`
+
+// SetWebhookJob stores the given webhook job, replacing any previous job with the same ID.
+func (st *SQLStorage) SetWebhookJob(job *WebhookJob) error {
+	_, err := st.exec(`INSERT INTO webhook_jobs (faucet, `+webhookJobColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, id) DO UPDATE SET provider = excluded.provider, type = excluded.type,
+		payload = excluded.payload, state = excluded.state, attempts = excluded.attempts,
+		last_error = excluded.last_error, next_attempt = excluded.next_attempt,
+		created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		st.faucet, job.ID, job.Provider, job.Type, job.Payload, string(job.State), job.Attempts,
+		job.LastError, job.NextAttempt.UnixNano(), job.CreatedAt.UnixNano(), job.UpdatedAt.UnixNano())
+	return err
+}
+
+// WebhookJob returns the webhook job with the given ID, or ErrNotFound.
+func (st *SQLStorage) WebhookJob(id string) (*WebhookJob, error) {
+	job, err := scanWebhookJob(st.db.QueryRow(st.rebind(`SELECT `+webhookJobColumns+`
+		FROM webhook_jobs WHERE faucet = ? AND id = ?`), st.faucet, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+// WebhookJobs returns the webhook jobs in the given state, or all of them if it is empty,
+// ordered by creation time.
+func (st *SQLStorage) WebhookJobs(state WebhookJobState) ([]*WebhookJob, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT `+webhookJobColumns+` FROM webhook_jobs
+		WHERE faucet = ? AND (? = '' OR state = ?) ORDER BY created_at`), st.faucet, string(state), string(state))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*WebhookJob
+	for rows.Next() {
+		job, err := scanWebhookJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// scanWebhookJob reads a webhook job from the given row.
+func scanWebhookJob(row interface{ Scan(...any) error }) (*WebhookJob, error) {
+	var state string
+	var attempts, nextAttempt, createdAt, updatedAt int64
+	job := &WebhookJob{}
+	if err := row.Scan(&job.ID, &job.Provider, &job.Type, &job.Payload, &state, &attempts, &job.LastError,
+		&nextAttempt, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	job.State = WebhookJobState(state)
+	job.Attempts = int(attempts)
+	job.NextAttempt = time.Unix(0, nextAttempt)
+	job.CreatedAt = time.Unix(0, createdAt)
+	job.UpdatedAt = time.Unix(0, updatedAt)
+	return job, nil
+}
+
+// SetOAuthState stores the given OAuth state, replacing any previous one with the same state
+// value. States not used yet have a zero used_at.
+func (st *SQLStorage) SetOAuthState(state *OAuthState) error {
+	var usedAt int64
+	if !state.UsedAt.IsZero() {
+		usedAt = state.UsedAt.UnixNano()
+	}
+	_, err := st.exec(`INSERT INTO oauth_states
+		(faucet, state, provider, recipient, verifier, nonce, redirect_url, created_at, expires_at, used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, state) DO UPDATE SET provider = excluded.provider,
+		recipient = excluded.recipient, verifier = excluded.verifier, nonce = excluded.nonce,
+		redirect_url = excluded.redirect_url, created_at = excluded.created_at,
+		expires_at = excluded.expires_at, used_at = excluded.used_at`,
+		st.faucet, state.State, state.Provider, state.Recipient, state.Verifier, state.Nonce, state.RedirectURL,
+		state.CreatedAt.UnixNano(), state.ExpiresAt.UnixNano(), usedAt)
+	return err
+}
+
+// OAuthState returns the OAuth state with the given state value, or ErrNotFound.
+func (st *SQLStorage) OAuthState(state string) (*OAuthState, error) {
+	var createdAt, expiresAt, usedAt int64
+	s := &OAuthState{State: state}
+	err := st.db.QueryRow(st.rebind(`SELECT provider, recipient, verifier, nonce, redirect_url, created_at,
+		expires_at, used_at FROM oauth_states WHERE faucet = ? AND state = ?`), st.faucet, state).Scan(
+		&s.Provider, &s.Recipient, &s.Verifier, &s.Nonce, &s.RedirectURL, &createdAt, &expiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.CreatedAt = time.Unix(0, createdAt)
+	s.ExpiresAt = time.Unix(0, expiresAt)
+	if usedAt != 0 {
+		s.UsedAt = time.Unix(0, usedAt)
+	}
+	return s, nil
+}
+
+// AddOAuthCode records that the OAuth authorization code with the given hash was used.
+func (st *SQLStorage) AddOAuthCode(hash string) error {
+	_, err := st.exec(`INSERT INTO oauth_codes (faucet, hash, used_at) VALUES (?, ?, ?)
+		ON CONFLICT (faucet, hash) DO NOTHING`, st.faucet, hash, time.Now().Unix())
+	return err
+}
+
+// CheckOAuthCode returns true if the OAuth authorization code with the given hash was used.
+func (st *SQLStorage) CheckOAuthCode(hash string) (bool, error) {
+	var usedAt int64
+	err := st.db.QueryRow(st.rebind(`SELECT used_at FROM oauth_codes WHERE faucet = ? AND hash = ?`),
+		st.faucet, hash).Scan(&usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetReservation stores the given token reservation, replacing any previous reservation with
+// the same ID.
+func (st *SQLStorage) SetReservation(reservation *Reservation) error {
+	_, err := st.exec(`INSERT INTO reservations (faucet, id, amount, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (faucet, id) DO UPDATE SET amount = excluded.amount, expires_at = excluded.expires_at`,
+		st.faucet, reservation.ID, int64(reservation.Amount), reservation.ExpiresAt.UnixNano())
+	return err
+}
+
+// DeleteReservation removes the token reservation with the given ID, if any.
+func (st *SQLStorage) DeleteReservation(id string) error {
+	_, err := st.exec(`DELETE FROM reservations WHERE faucet = ? AND id = ?`, st.faucet, id)
+	return err
+}
+
+// Reservations returns the token reservations that have not expired yet.
+func (st *SQLStorage) Reservations() ([]*Reservation, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT id, amount, expires_at FROM reservations
+		WHERE faucet = ? AND expires_at > ?`), st.faucet, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reservations []*Reservation
+	for rows.Next() {
+		var amount, expiresAt int64
+		reservation := &Reservation{}
+		if err := rows.Scan(&reservation.ID, &amount, &expiresAt); err != nil {
+			return nil, err
+		}
+		reservation.Amount = uint64(amount)
+		reservation.ExpiresAt = time.Unix(0, expiresAt)
+		reservations = append(reservations, reservation)
+	}
+	return reservations, rows.Err()
+}
+
+// AddLedgerEntry records a faucet package issued by the faucet.
+func (st *SQLStorage) AddLedgerEntry(entry *LedgerEntry) error {
+	_, err := st.exec(`INSERT INTO ledger (faucet, issued_at, recipient, amount, auth_type, reference)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		st.faucet, entry.Time.UnixNano(), entry.Recipient, int64(entry.Amount), entry.AuthType, entry.Reference)
+	return err
+}
+
+// LedgerEntries returns the ledger entries issued within [from, to), ordered by time.
+func (st *SQLStorage) LedgerEntries(from, to time.Time) ([]*LedgerEntry, error) {
+	rows, err := st.db.Query(st.rebind(`SELECT issued_at, recipient, amount, auth_type, reference FROM ledger
+		WHERE faucet = ? AND issued_at >= ? AND issued_at < ? ORDER BY issued_at`),
+		st.faucet, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*LedgerEntry
+	for rows.Next() {
+		var issuedAt, amount int64
+		entry := &LedgerEntry{}
+		if err := rows.Scan(&issuedAt, &entry.Recipient, &amount, &entry.AuthType, &entry.Reference); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(0, issuedAt)
+		entry.Amount = uint64(amount)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// SpendBudget adds amount to the spent counter of the named budget for the current period
+// window, if the result does not exceed limit (0 means no limit). The check and the update
+// are done in a single statement, so concurrent faucets sharing the database cannot overspend.
+func (st *SQLStorage) SpendBudget(name string, period time.Duration, amount, limit uint64) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	if limit > 0 && amount > limit {
+		return 0, ErrBudgetExceeded
+	}
+	start := budgetWindow(period).Unix()
+	var spent int64
+	err := st.db.QueryRow(st.rebind(`INSERT INTO budgets (faucet, name, window_start, period, spent)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, name, window_start, period) DO UPDATE SET spent = budgets.spent + excluded.spent
+		WHERE ? = 0 OR budgets.spent + excluded.spent <= ?
+		RETURNING spent`),
+		st.faucet, name, start, int64(period.Seconds()), int64(amount), int64(limit), int64(limit)).Scan(&spent)
+	if errors.Is(err, sql.ErrNoRows) {
+		current, err := st.BudgetSpent(name, period)
+		if err != nil {
+			return 0, err
+		}
+		return current, ErrBudgetExceeded
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(spent), nil
+}
+
+// BudgetSpent returns the spent counter of the named budget for the current period window.
+func (st *SQLStorage) BudgetSpent(name string, period time.Duration) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	var spent int64
+	err := st.db.QueryRow(st.rebind(`SELECT spent FROM budgets
+		WHERE faucet = ? AND name = ? AND window_start = ? AND period = ?`),
+		st.faucet, name, budgetWindow(period).Unix(), int64(period.Seconds())).Scan(&spent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return uint64(spent), err
+}
+
+// ReleaseBudget subtracts amount from the spent counter of the named budget for the period
+// window of spentAt, down to 0.
+func (st *SQLStorage) ReleaseBudget(name string, period time.Duration, amount uint64, spentAt time.Time) error {
+	if period <= 0 {
+		return fmt.Errorf("invalid budget period %s", period)
+	}
+	_, err := st.exec(`UPDATE budgets SET spent = CASE WHEN spent > ? THEN spent - ? ELSE 0 END
+		WHERE faucet = ? AND name = ? AND window_start = ? AND period = ?`,
+		int64(amount), int64(amount), st.faucet, name, budgetWindowAt(spentAt, period).Unix(), int64(period.Seconds()))
+	return err
+}
+
+// AddDenylistEntry adds the given entry to the denylist, replacing any previous entry with
+// the same kind and value.
+func (st *SQLStorage) AddDenylistEntry(entry *DenylistEntry) error {
+	_, err := st.exec(`INSERT INTO denylist (faucet, kind, value, reason, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (faucet, kind, value) DO UPDATE SET reason = excluded.reason, created_at = excluded.created_at`,
+		st.faucet, entry.Kind, entry.Value, entry.Reason, entry.Time.Unix())
+	return err
+}
+
+// DenylistEntry returns the denylist entry for the given kind and value, or ErrNotFound.
+func (st *SQLStorage) DenylistEntry(kind, value string) (*DenylistEntry, error) {
+	var createdAt int64
+	entry := &DenylistEntry{Kind: kind, Value: value}
+	err := st.db.QueryRow(st.rebind(`SELECT reason, created_at FROM denylist WHERE faucet = ? AND kind = ? AND value = ?`),
+		st.faucet, kind, value).Scan(&entry.Reason, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry.Time = time.Unix(createdAt, 0)
+	return entry, nil
+}
+
+// DeleteDenylistEntry removes the denylist entry for the given kind and value.
+func (st *SQLStorage) DeleteDenylistEntry(kind, value string) error {
+	_, err := st.exec(`DELETE FROM denylist WHERE faucet = ? AND kind = ? AND value = ?`, st.faucet, kind, value)
+	return err
+}
+
+// StartGarbageCollector starts a background routine that sweeps the storage every interval,
+// removing the entries that expired more than retention ago.
+func (st *SQLStorage) StartGarbageCollector(interval, retention time.Duration) {
+	st.gc.start(interval, retention, st.Sweep)
+}
+
+// Sweep removes the cooldown entries, webhook event and OAuth code markers, budget windows,
+// token reservations and OAuth states that expired more than retention ago, the payments
+// created more than retention ago that were never paid and the webhook jobs processed more
+// than retention ago. The markers of on-chain transfers are kept. It returns the number of
+// removed rows.
+func (st *SQLStorage) Sweep(retention time.Duration) (int, error) {
+	deadline := time.Now().Add(-retention)
+	var removed int64
+	for _, q := range []struct {
+		query    string
+		deadline int64
+	}{
+		{`DELETE FROM cooldowns WHERE faucet = ? AND wait_until < ?`, deadline.Unix()},
+		{`DELETE FROM budgets WHERE faucet = ? AND window_start + period < ?`, deadline.Unix()},
+		{`DELETE FROM webhook_events WHERE faucet = ? AND received_at < ? AND id NOT LIKE '` + TransferEventPrefix + `%'`,
+			deadline.Unix()},
+		{`DELETE FROM payments WHERE faucet = ? AND state = 'created' AND created_at < ?`, deadline.UnixNano()},
+		{`DELETE FROM reservations WHERE faucet = ? AND expires_at < ?`, deadline.UnixNano()},
+		{`DELETE FROM webhook_jobs WHERE faucet = ? AND state = 'done' AND updated_at < ?`, deadline.UnixNano()},
+		{`DELETE FROM oauth_states WHERE faucet = ? AND expires_at < ?`, deadline.UnixNano()},
+		{`DELETE FROM oauth_codes WHERE faucet = ? AND used_at < ?`, deadline.Unix()},
+	} {
+		n, err := st.exec(q.query, st.faucet, q.deadline)
+		if err != nil {
+			return 0, err
+		}
+		removed += n
+	}
+	st.gc.record(int(removed))
+	return int(removed), nil
+}
+
+// GCStats returns the counters of the storage garbage collector.
+func (st *SQLStorage) GCStats() GCStats {
+	return st.gc.snapshot()
+}
+
+// Close stops the garbage collector and closes the database.
+func (st *SQLStorage) Close() error {
+	st.gc.halt()
+	return st.db.Close()
+}
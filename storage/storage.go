@@ -3,6 +3,8 @@ package storage
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sync"
@@ -14,21 +16,40 @@ import (
 	"go.vocdoni.io/dvote/log"
 )
 
-// Storage is a key-value storage for the faucet.
-type Storage struct {
+// KVStorage is a key-value storage for the faucet, backed by any of the databases supported
+// by metadb.
+type KVStorage struct {
 	kv                db.Database
 	waitPeriodSeconds uint64
 	lock              sync.RWMutex
+	gc                garbageCollector
 }
 
-// New creates a new storage instance.
-func New(dbType string, dataDir string, waitPeriod time.Duration, dbPrefix []byte) (*Storage, error) {
+// check that KVStorage implements the Storage interface
+var _ Storage = (*KVStorage)(nil)
+
+// Open creates a new storage instance of the given type. The memory type does not use the
+// data directory nor the prefix.
+func Open(dbType string, dataDir string, waitPeriod time.Duration, dbPrefix []byte) (Storage, error) {
+	switch dbType {
+	case TypeMemory:
+		log.Infow("create memory storage")
+		return NewMemory(waitPeriod), nil
+	case TypeSQLite, TypePostgres:
+		return NewSQL(dbType, dataDir, waitPeriod, dbPrefix)
+	default:
+		return New(dbType, dataDir, waitPeriod, dbPrefix)
+	}
+}
+
+// New creates a new key-value storage instance.
+func New(dbType string, dataDir string, waitPeriod time.Duration, dbPrefix []byte) (*KVStorage, error) {
 	if dbType != db.TypePebble && dbType != db.TypeLevelDB && dbType != db.TypeMongo {
 		return nil, fmt.Errorf("invalid dbType: %q. Available types: %q %q %q",
 			dbType, db.TypePebble, db.TypeLevelDB, db.TypeMongo)
 	}
 	log.Infow("create db storage", "type", dbType, "dir", dataDir, "prefix", hex.EncodeToString(dbPrefix))
-	st := &Storage{}
+	st := &KVStorage{}
 	var err error
 	mdb, err := metadb.New(dbType, filepath.Join(filepath.Clean(dataDir), "db"))
 	if err != nil {
@@ -37,11 +58,14 @@ func New(dbType string, dataDir string, waitPeriod time.Duration, dbPrefix []byt
 
 	st.kv = prefixeddb.NewPrefixedDatabase(mdb, dbPrefix)
 	st.waitPeriodSeconds = uint64(waitPeriod.Seconds())
+	if err := st.migrate(); err != nil {
+		return nil, err
+	}
 	return st, nil
 }
 
 // Set sets the given key to the given value.
-func (st *Storage) Set(key, value []byte) error {
+func (st *KVStorage) Set(key, value []byte) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	tx := st.kv.WriteTx()
@@ -53,14 +77,14 @@ func (st *Storage) Set(key, value []byte) error {
 }
 
 // Get gets the value for the given key.
-func (st *Storage) Get(key []byte) ([]byte, error) {
+func (st *KVStorage) Get(key []byte) ([]byte, error) {
 	st.lock.RLock()
 	defer st.lock.RUnlock()
 	return st.kv.Get(key)
 }
 
 // Delete removes an existing value based on the given key
-func (st *Storage) Delete(key []byte) error {
+func (st *KVStorage) Delete(key []byte) error {
 	st.lock.Lock()
 	defer st.lock.Unlock()
 	tx := st.kv.WriteTx()
@@ -71,34 +95,492 @@ func (st *Storage) Delete(key []byte) error {
 	return tx.Commit()
 }
 
-// Close closes the storage.
-func (st *Storage) Close() error {
+// Close stops the garbage collector, if running, and closes the storage.
+func (st *KVStorage) Close() error {
+	st.gc.halt()
 	return st.kv.Close()
 }
 
 // AddFundedUserWithWaitTime adds the given userID to the funded list, with the current time
 // as the wait period end time.
-func (st *Storage) AddFundedUserWithWaitTime(userID []byte, authType string) error {
+func (st *KVStorage) AddFundedUserWithWaitTime(userID []byte, authType string) error {
+	return st.AddFundedUserUntil(userID, authType, time.Unix(time.Now().Unix()+int64(st.waitPeriodSeconds), 0))
+}
+
+// AddFundedUserUntil adds the given userID to the funded list, with the given time as the wait
+// period end time.
+func (st *KVStorage) AddFundedUserUntil(userID []byte, authType string, until time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	tx := st.kv.WriteTx()
 	defer tx.Discard()
-	key := append(userID, []byte(authType)...)
-	wp := uint64(time.Now().Unix()) + st.waitPeriodSeconds
-	wpBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(wpBytes, wp)
-	if err := tx.Set(key, wpBytes); err != nil {
+	key := cooldownKey(userID, authType)
+	if err := tx.Set(key, uint64Bytes(uint64(until.Unix()))); err != nil {
 		log.Error(err)
 	}
 	return tx.Commit()
 }
 
-// checkIsFundedUserID checks if the given text is funded and returns true if it is, within
-// the wait period time window. Otherwise, it returns false.
-func (st *Storage) CheckFundedUserWithWaitTime(userID []byte, authType string) (bool, time.Time) {
-	key := append(userID, []byte(authType)...)
+// CheckFundedUserWithWaitTime checks if the given text is funded and returns true if it is,
+// within the wait period time window. Otherwise, it returns false.
+func (st *KVStorage) CheckFundedUserWithWaitTime(userID []byte, authType string) (bool, time.Time) {
+	key := cooldownKey(userID, authType)
 	wpBytes, err := st.kv.Get(key)
 	if err != nil {
 		return false, time.Time{}
 	}
+	if len(wpBytes) != 8 {
+		return false, time.Time{}
+	}
 	wp := binary.LittleEndian.Uint64(wpBytes)
 	return wp >= uint64(time.Now().Unix()), time.Unix(int64(wp), 0)
 }
+
+// SetPayment stores the given payment record, replacing any previous record with the same ID.
+func (st *KVStorage) SetPayment(payment *Payment) error {
+	value, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+	return st.Set(paymentKey(payment.ID), value)
+}
+
+// Payment returns the payment record with the given ID, or ErrNotFound.
+func (st *KVStorage) Payment(id string) (*Payment, error) {
+	data, err := st.Get(paymentKey(id))
+	if err != nil {
+		return nil, err
+	}
+	payment := &Payment{}
+	if err := json.Unmarshal(data, payment); err != nil {
+		return nil, fmt.Errorf("failed to decode payment: %w", err)
+	}
+	return payment, nil
+}
+
+// AddWebhookEvent records that the webhook event with the given ID has been processed. The
+// value is the current time, so the garbage collector can remove it.
+func (st *KVStorage) AddWebhookEvent(id string) error {
+	return st.Set(eventKey(id), uint64Bytes(uint64(time.Now().Unix())))
+}
+
+// CheckWebhookEvent returns true if the webhook event with the given ID has been processed.
+func (st *KVStorage) CheckWebhookEvent(id string) (bool, error) {
+	_, err := st.Get(eventKey(id))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AddLedgerEntry records a faucet package issued by the faucet.
+func (st *KVStorage) AddLedgerEntry(entry *LedgerEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return st.Set(ledgerKey(entry), value)
+}
+
+// LedgerEntries returns the ledger entries issued within [from, to), ordered by time.
+func (st *KVStorage) LedgerEntries(from, to time.Time) ([]*LedgerEntry, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var entries []*LedgerEntry
+	var decodeErr error
+	if err := iterateNamespace(st.kv, nsLedger, func(_, value []byte) bool {
+		entry := &LedgerEntry{}
+		if decodeErr = json.Unmarshal(value, entry); decodeErr != nil {
+			return false
+		}
+		if !entry.Time.Before(from) && entry.Time.Before(to) {
+			entries = append(entries, entry)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to decode ledger entry: %w", decodeErr)
+	}
+	sortLedgerEntries(entries)
+	return entries, nil
+}
+
+// SpendBudget adds amount to the spent counter of the named budget for the current period
+// window, if the result does not exceed limit (0 means no limit).
+func (st *KVStorage) SpendBudget(name string, period time.Duration, amount, limit uint64) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	key := budgetKey(name, budgetWindow(period), period)
+	spent, err := st.budgetSpent(key)
+	if err != nil {
+		return 0, err
+	}
+	if limit > 0 && spent+amount > limit {
+		return spent, ErrBudgetExceeded
+	}
+	spent += amount
+	tx := st.kv.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set(key, uint64Bytes(spent)); err != nil {
+		return 0, err
+	}
+	return spent, tx.Commit()
+}
+
+// BudgetSpent returns the spent counter of the named budget for the current period window.
+func (st *KVStorage) BudgetSpent(name string, period time.Duration) (uint64, error) {
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.budgetSpent(budgetKey(name, budgetWindow(period), period))
+}
+
+// ReleaseBudget subtracts amount from the spent counter of the named budget for the period
+// window of spentAt, down to 0.
+func (st *KVStorage) ReleaseBudget(name string, period time.Duration, amount uint64, spentAt time.Time) error {
+	if period <= 0 {
+		return fmt.Errorf("invalid budget period %s", period)
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	key := budgetKey(name, budgetWindowAt(spentAt, period), period)
+	spent, err := st.budgetSpent(key)
+	if err != nil || spent == 0 {
+		return err
+	}
+	tx := st.kv.WriteTx()
+	defer tx.Discard()
+	if err := tx.Set(key, uint64Bytes(spent-min(spent, amount))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// budgetSpent returns the spent counter stored under the given budget key, 0 if missing.
+func (st *KVStorage) budgetSpent(key []byte) (uint64, error) {
+	value, err := st.kv.Get(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid budget value %x", value)
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+// AddDenylistEntry adds the given entry to the denylist, replacing any previous entry with
+// the same kind and value.
+func (st *KVStorage) AddDenylistEntry(entry *DenylistEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return st.Set(denylistKey(entry.Kind, entry.Value), value)
+}
+
+// DenylistEntry returns the denylist entry for the given kind and value, or ErrNotFound.
+func (st *KVStorage) DenylistEntry(kind, value string) (*DenylistEntry, error) {
+	data, err := st.Get(denylistKey(kind, value))
+	if err != nil {
+		return nil, err
+	}
+	entry := &DenylistEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("failed to decode denylist entry: %w", err)
+	}
+	return entry, nil
+}
+
+// DeleteDenylistEntry removes the denylist entry for the given kind and value.
+func (st *KVStorage) DeleteDenylistEntry(kind, value string) error {
+	return st.Delete(denylistKey(kind, value))
+}
+
+// SetReferrer stores the given referrer, replacing any previous referrer with the same code.
+func (st *KVStorage) SetReferrer(referrer *Referrer) error {
+	value, err := json.Marshal(referrer)
+	if err != nil {
+		return err
+	}
+	return st.Set(referrerKey(referrer.Code), value)
+}
+
+// Referrer returns the referrer with the given code, or ErrNotFound.
+func (st *KVStorage) Referrer(code string) (*Referrer, error) {
+	data, err := st.Get(referrerKey(code))
+	if err != nil {
+		return nil, err
+	}
+	referrer := &Referrer{}
+	if err := json.Unmarshal(data, referrer); err != nil {
+		return nil, fmt.Errorf("failed to decode referrer: %w", err)
+	}
+	return referrer, nil
+}
+
+// SetReferralReward stores the given referral reward, replacing any previous reward for the
+// same payment.
+func (st *KVStorage) SetReferralReward(reward *ReferralReward) error {
+	value, err := json.Marshal(reward)
+	if err != nil {
+		return err
+	}
+	return st.Set(rewardKey(reward.PaymentID), value)
+}
+
+// ReferralRewards returns the rewards of the referrer with the given code, ordered by time.
+func (st *KVStorage) ReferralRewards(code string) ([]*ReferralReward, error) {
+	rewards, err := listNamespace(st, nsReward, func(reward *ReferralReward) bool {
+		return reward.Code == code
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referral rewards: %w", err)
+	}
+	sortReferralRewards(rewards)
+	return rewards, nil
+}
+
+// AddReferralClaim records a claim of referral rewards.
+func (st *KVStorage) AddReferralClaim(claim *ReferralClaim) error {
+	value, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	return st.Set(claimKey(claim.ID), value)
+}
+
+// ReferralClaims returns the claims of the referrer with the given code, ordered by time.
+func (st *KVStorage) ReferralClaims(code string) ([]*ReferralClaim, error) {
+	claims, err := listNamespace(st, nsClaim, func(claim *ReferralClaim) bool {
+		return claim.Code == code
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referral claims: %w", err)
+	}
+	sortReferralClaims(claims)
+	return claims, nil
+}
+
+// RecipientPayments returns the payment records of the given recipient, ordered by creation
+// time.
+func (st *KVStorage) RecipientPayments(recipient string) ([]*Payment, error) {
+	payments, err := listNamespace(st, nsPayment, func(payment *Payment) bool {
+		return payment.Recipient == recipient
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list payments: %w", err)
+	}
+	sortPayments(payments)
+	return payments, nil
+}
+
+// SetCustomer stores the given customer, replacing any previous customer with the same email
+// and address.
+func (st *KVStorage) SetCustomer(customer *Customer) error {
+	value, err := json.Marshal(customer)
+	if err != nil {
+		return err
+	}
+	return st.Set(customerKey(customer.Email, customer.Address), value)
+}
+
+// Customer returns the customer with the given email and address, or ErrNotFound.
+func (st *KVStorage) Customer(email, address string) (*Customer, error) {
+	data, err := st.Get(customerKey(email, address))
+	if err != nil {
+		return nil, err
+	}
+	customer := &Customer{}
+	if err := json.Unmarshal(data, customer); err != nil {
+		return nil, fmt.Errorf("failed to decode customer: %w", err)
+	}
+	return customer, nil
+}
+
+// Customers returns the customers that bought tokens for the given address, ordered by their
+// first purchase.
+func (st *KVStorage) Customers(address string) ([]*Customer, error) {
+	customers, err := listNamespace(st, nsCustomer, func(customer *Customer) bool {
+		return customer.Address == address
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list customers: %w", err)
+	}
+	sortCustomers(customers)
+	return customers, nil
+}
+
+// SetSubscription stores the given subscription, replacing any previous subscription with the
+// same ID.
+func (st *KVStorage) SetSubscription(subscription *Subscription) error {
+	value, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	return st.Set(subscriptionKey(subscription.ID), value)
+}
+
+// Subscription returns the subscription with the given ID, or ErrNotFound.
+func (st *KVStorage) Subscription(id string) (*Subscription, error) {
+	data, err := st.Get(subscriptionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{}
+	if err := json.Unmarshal(data, subscription); err != nil {
+		return nil, fmt.Errorf("failed to decode subscription: %w", err)
+	}
+	return subscription, nil
+}
+
+// Subscriptions returns the subscriptions of the given subscriber address, ordered by creation
+// time.
+func (st *KVStorage) Subscriptions(subscriber string) ([]*Subscription, error) {
+	subscriptions, err := listNamespace(st, nsSubscription, func(subscription *Subscription) bool {
+		return subscription.Subscriber == subscriber
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	sortSubscriptions(subscriptions)
+	return subscriptions, nil
+}
+
+// SetWebhookJob stores the given webhook job, replacing any previous job with the same ID.
+func (st *KVStorage) SetWebhookJob(job *WebhookJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return st.Set(webhookJobKey(job.ID), value)
+}
+
+// WebhookJob returns the webhook job with the given ID, or ErrNotFound.
+func (st *KVStorage) WebhookJob(id string) (*WebhookJob, error) {
+	data, err := st.Get(webhookJobKey(id))
+	if err != nil {
+		return nil, err
+	}
+	job := &WebhookJob{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook job: %w", err)
+	}
+	return job, nil
+}
+
+// WebhookJobs returns the webhook jobs in the given state, or all of them if it is empty,
+// ordered by creation time.
+func (st *KVStorage) WebhookJobs(state WebhookJobState) ([]*WebhookJob, error) {
+	jobs, err := listNamespace(st, nsWebhookJob, func(job *WebhookJob) bool {
+		return state == "" || job.State == state
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook jobs: %w", err)
+	}
+	sortWebhookJobs(jobs)
+	return jobs, nil
+}
+
+// SetOAuthState stores the given OAuth state, replacing any previous one with the same state
+// value.
+func (st *KVStorage) SetOAuthState(state *OAuthState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return st.Set(oauthStateKey(state.State), value)
+}
+
+// OAuthState returns the OAuth state with the given state value, or ErrNotFound.
+func (st *KVStorage) OAuthState(state string) (*OAuthState, error) {
+	data, err := st.Get(oauthStateKey(state))
+	if err != nil {
+		return nil, err
+	}
+	s := &OAuthState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode oauth state: %w", err)
+	}
+	return s, nil
+}
+
+// AddOAuthCode records that the OAuth authorization code with the given hash was used. The
+// value is the current time, so the garbage collector can remove it.
+func (st *KVStorage) AddOAuthCode(hash string) error {
+	return st.Set(oauthCodeKey(hash), uint64Bytes(uint64(time.Now().Unix())))
+}
+
+// CheckOAuthCode returns true if the OAuth authorization code with the given hash was used.
+func (st *KVStorage) CheckOAuthCode(hash string) (bool, error) {
+	_, err := st.Get(oauthCodeKey(hash))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetReservation stores the given token reservation, replacing any previous reservation with
+// the same ID.
+func (st *KVStorage) SetReservation(reservation *Reservation) error {
+	value, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	return st.Set(reservationKey(reservation.ID), value)
+}
+
+// DeleteReservation removes the token reservation with the given ID, if any.
+func (st *KVStorage) DeleteReservation(id string) error {
+	return st.Delete(reservationKey(id))
+}
+
+// Reservations returns the token reservations that have not expired yet.
+func (st *KVStorage) Reservations() ([]*Reservation, error) {
+	now := time.Now()
+	reservations, err := listNamespace(st, nsReserve, func(reservation *Reservation) bool {
+		return reservation.ExpiresAt.After(now)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reservations: %w", err)
+	}
+	return reservations, nil
+}
+
+// listNamespace decodes the JSON values of the given namespace and returns the ones accepted
+// by keep.
+func listNamespace[T any](st *KVStorage, ns byte, keep func(*T) bool) ([]*T, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	var values []*T
+	var decodeErr error
+	if err := iterateNamespace(st.kv, ns, func(_, data []byte) bool {
+		value := new(T)
+		if decodeErr = json.Unmarshal(data, value); decodeErr != nil {
+			return false
+		}
+		if keep(value) {
+			values = append(values, value)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return values, decodeErr
+}
+
+// uint64Bytes encodes the given number, usually a unix timestamp, as it is stored in the database.
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"go.vocdoni.io/dvote/db"
+)
+
+// Storage types that are not key-value databases.
+const (
+	// TypeMemory defines the type of storage that keeps everything in memory.
+	TypeMemory = "memory"
+	// TypeSQLite defines the type of storage that uses a SQLite database file.
+	TypeSQLite = "sqlite"
+	// TypePostgres defines the type of storage that uses the Postgres database at POSTGRES_URL.
+	TypePostgres = "postgres"
+)
+
+// Denylist entry kinds.
+const (
+	DenylistAddress  = "address"
+	DenylistCustomer = "customer"
+	DenylistEmail    = "email"
+)
+
+// TransferEventPrefix prefixes the IDs of the processed event markers of on-chain transfers.
+// They are kept forever, since the transfers stay on chain and could pay again once removed.
+const TransferEventPrefix = "erc20:"
+
+// ErrNotFound is returned when the requested entry does not exist.
+var ErrNotFound = db.ErrKeyNotFound
+
+// ErrBudgetExceeded is returned when spending from a budget would exceed its limit.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Storage is the persistence layer of the faucet.
+type Storage interface {
+	// AddFundedUserWithWaitTime adds the given userID to the funded list, with the current
+	// time plus the wait period as the wait period end time.
+	AddFundedUserWithWaitTime(userID []byte, authType string) error
+	// AddFundedUserUntil adds the given userID to the funded list, with the given time as the
+	// wait period end time, for auth types with their own wait period.
+	AddFundedUserUntil(userID []byte, authType string, until time.Time) error
+	// CheckFundedUserWithWaitTime returns true if the given userID is funded within the wait
+	// period time window, and the time when the window ends.
+	CheckFundedUserWithWaitTime(userID []byte, authType string) (bool, time.Time)
+
+	// SetPayment stores the given payment record, replacing any previous record with the
+	// same ID.
+	SetPayment(payment *Payment) error
+	// Payment returns the payment record with the given ID, or ErrNotFound.
+	Payment(id string) (*Payment, error)
+
+	// AddWebhookEvent records that the webhook event with the given ID has been processed.
+	// The markers of on-chain transfers, with IDs prefixed by TransferEventPrefix, are never
+	// removed by the garbage collector.
+	AddWebhookEvent(id string) error
+	// CheckWebhookEvent returns true if the webhook event with the given ID has been processed.
+	CheckWebhookEvent(id string) (bool, error)
+
+	// SetReferrer stores the given referrer, replacing any previous referrer with the same code.
+	SetReferrer(referrer *Referrer) error
+	// Referrer returns the referrer with the given code, or ErrNotFound.
+	Referrer(code string) (*Referrer, error)
+	// SetReferralReward stores the given referral reward, replacing any previous reward for the
+	// same payment.
+	SetReferralReward(reward *ReferralReward) error
+	// ReferralRewards returns the rewards of the referrer with the given code, ordered by time.
+	ReferralRewards(code string) ([]*ReferralReward, error)
+	// AddReferralClaim records a claim of referral rewards.
+	AddReferralClaim(claim *ReferralClaim) error
+	// ReferralClaims returns the claims of the referrer with the given code, ordered by time.
+	ReferralClaims(code string) ([]*ReferralClaim, error)
+
+	// RecipientPayments returns the payment records of the given recipient, ordered by
+	// creation time.
+	RecipientPayments(recipient string) ([]*Payment, error)
+
+	// SetCustomer stores the given customer, replacing any previous customer with the same
+	// email and address.
+	SetCustomer(customer *Customer) error
+	// Customer returns the customer with the given email and address, or ErrNotFound.
+	Customer(email, address string) (*Customer, error)
+	// Customers returns the customers that bought tokens for the given address, ordered by
+	// their first purchase.
+	Customers(address string) ([]*Customer, error)
+
+	// SetSubscription stores the given subscription, replacing any previous subscription with
+	// the same ID.
+	SetSubscription(subscription *Subscription) error
+	// Subscription returns the subscription with the given ID, or ErrNotFound.
+	Subscription(id string) (*Subscription, error)
+	// Subscriptions returns the subscriptions of the given subscriber address, ordered by
+	// creation time.
+	Subscriptions(subscriber string) ([]*Subscription, error)
+
+	// SetWebhookJob stores the given webhook job, replacing any previous job with the same ID.
+	SetWebhookJob(job *WebhookJob) error
+	// WebhookJob returns the webhook job with the given ID, or ErrNotFound.
+	WebhookJob(id string) (*WebhookJob, error)
+	// WebhookJobs returns the webhook jobs in the given state, or all of them if it is empty,
+	// ordered by creation time.
+	WebhookJobs(state WebhookJobState) ([]*WebhookJob, error)
+
+	// SetOAuthState stores the given OAuth state, replacing any previous one with the same
+	// state value.
+	SetOAuthState(state *OAuthState) error
+	// OAuthState returns the OAuth state with the given state value, or ErrNotFound.
+	OAuthState(state string) (*OAuthState, error)
+	// AddOAuthCode records that the OAuth authorization code with the given hash was used.
+	AddOAuthCode(hash string) error
+	// CheckOAuthCode returns true if the OAuth authorization code with the given hash was used.
+	CheckOAuthCode(hash string) (bool, error)
+
+	// SetReservation stores the given token reservation, replacing any previous reservation
+	// with the same ID.
+	SetReservation(reservation *Reservation) error
+	// DeleteReservation removes the token reservation with the given ID, if any.
+	DeleteReservation(id string) error
+	// Reservations returns the token reservations that have not expired yet.
+	Reservations() ([]*Reservation, error)
+
+	// AddLedgerEntry records a faucet package issued by the faucet.
+	AddLedgerEntry(entry *LedgerEntry) error
+	// LedgerEntries returns the ledger entries issued within [from, to), ordered by time.
+	LedgerEntries(from, to time.Time) ([]*LedgerEntry, error)
+
+	// SpendBudget adds amount to the spent counter of the named budget for the current
+	// period window, if the result does not exceed limit (0 means no limit). It returns
+	// the spent amount for the window, or ErrBudgetExceeded.
+	SpendBudget(name string, period time.Duration, amount, limit uint64) (uint64, error)
+	// BudgetSpent returns the spent counter of the named budget for the current period window.
+	BudgetSpent(name string, period time.Duration) (uint64, error)
+	// ReleaseBudget subtracts amount from the spent counter of the named budget for the period
+	// window of spentAt, down to 0, so an amount spent and then not used is available again.
+	ReleaseBudget(name string, period time.Duration, amount uint64, spentAt time.Time) error
+
+	// AddDenylistEntry adds the given entry to the denylist, replacing any previous entry
+	// with the same kind and value.
+	AddDenylistEntry(entry *DenylistEntry) error
+	// DenylistEntry returns the denylist entry for the given kind and value, or ErrNotFound.
+	DenylistEntry(kind, value string) (*DenylistEntry, error)
+	// DeleteDenylistEntry removes the denylist entry for the given kind and value.
+	DeleteDenylistEntry(kind, value string) error
+
+	// StartGarbageCollector starts a background routine that sweeps the storage every
+	// interval, removing the entries that expired more than retention ago.
+	StartGarbageCollector(interval, retention time.Duration)
+	// Sweep removes the entries that expired more than retention ago and returns the number
+	// of removed entries.
+	Sweep(retention time.Duration) (int, error)
+	// GCStats returns the counters of the storage garbage collector.
+	GCStats() GCStats
+
+	// Close stops the garbage collector and closes the storage.
+	Close() error
+}
+
+// LedgerEntry is a faucet package issued by the faucet.
+type LedgerEntry struct {
+	Time      time.Time `json:"time"`
+	Recipient string    `json:"recipient"`
+	Amount    uint64    `json:"amount"`
+	AuthType  string    `json:"authType"`
+	Reference string    `json:"reference,omitempty"`
+}
+
+// DenylistEntry is an identifier that is not allowed to use the faucet, such as an address or
+// a Stripe customer.
+type DenylistEntry struct {
+	Kind   string    `json:"kind"`
+	Value  string    `json:"value"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// PaymentState is the state of a payment record.
+type PaymentState string
+
+// Payment states. A payment is created when the checkout starts, paid once the payment
+// provider confirms it, and fulfilled once the faucet package has been issued. Paid or
+// fulfilled payments might be refunded or disputed, and created payments might fail or expire.
+const (
+	PaymentCreated   PaymentState = "created"
+	PaymentPaid      PaymentState = "paid"
+	PaymentFulfilled PaymentState = "fulfilled"
+	PaymentRefunded  PaymentState = "refunded"
+	PaymentDisputed  PaymentState = "disputed"
+	PaymentFailed    PaymentState = "failed"
+	PaymentExpired   PaymentState = "expired"
+)
+
+// paymentTransitions are the valid transitions between payment states.
+var paymentTransitions = map[PaymentState][]PaymentState{
+	PaymentCreated:   {PaymentPaid, PaymentFailed, PaymentExpired},
+	PaymentPaid:      {PaymentFulfilled, PaymentRefunded, PaymentDisputed},
+	PaymentFulfilled: {PaymentRefunded, PaymentDisputed},
+	PaymentDisputed:  {PaymentRefunded},
+}
+
+// CanTransitionTo returns true if a payment in state s can move to the next state.
+func (s PaymentState) CanTransitionTo(next PaymentState) bool {
+	for _, state := range paymentTransitions[s] {
+		if state == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Payment is the record of a purchase of tokens, keyed by the ID given by the payment
+// provider, such as the Stripe checkout session ID.
+type Payment struct {
+	ID        string       `json:"id"`
+	State     PaymentState `json:"state"`
+	Recipient string       `json:"recipient"`
+	Quantity  uint64       `json:"quantity"`
+	Price     int64        `json:"price"` // Total price in the smallest currency unit.
+	Currency  string       `json:"currency"`
+	Customer  string       `json:"customer,omitempty"` // The customer ID at the payment provider, if any.
+	Email     string       `json:"email,omitempty"`
+	Referral  string       `json:"referral,omitempty"` // The referral given at checkout, if any.
+	Gift      *Gift        `json:"gift,omitempty"`     // Set for gift purchases, bought without recipient.
+	Package   []byte       `json:"package,omitempty"`  // The faucet package issued, once fulfilled.
+	// DailyLimits are the names of the daily purchase limit budgets the quantity is counted in.
+	DailyLimits []string `json:"dailyLimits,omitempty"`
+	// StartBlock is the chain head when an on-chain payment was created, earlier transfers
+	// do not pay it.
+	StartBlock uint64    `json:"startBlock,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Gift is the claim of a gift purchase. Whoever knows the token can redeem the paid gift for
+// any address before it expires. The payment recipient is set once redeemed. The refund token
+// is only given to the buyer, who can refund the gift once expired if never redeemed.
+type Gift struct {
+	Token       string    `json:"token"`
+	RefundToken string    `json:"refundToken,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"` // Set once the gift is paid.
+}
+
+// copyPayment returns a deep copy of the given payment.
+func copyPayment(payment *Payment) *Payment {
+	p := *payment
+	p.Package = bytes.Clone(payment.Package)
+	p.DailyLimits = slices.Clone(payment.DailyLimits)
+	if payment.Gift != nil {
+		gift := *payment.Gift
+		p.Gift = &gift
+	}
+	return &p
+}
+
+// Referrer is a registered referrer, which earns a share of the tokens bought with its code.
+type Referrer struct {
+	Code      string    `json:"code"`
+	Address   string    `json:"address"` // The address the rewards are issued to.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RewardState is the state of a referral reward.
+type RewardState string
+
+// Referral reward states. A reward is pending until it is claimed by the referrer, and it is
+// revoked if its payment is refunded or disputed before that.
+const (
+	RewardPending RewardState = "pending"
+	RewardClaimed RewardState = "claimed"
+	RewardRevoked RewardState = "revoked"
+)
+
+// ReferralReward is the share of a purchase earned by the referrer of the buyer, keyed by the
+// ID of the payment.
+type ReferralReward struct {
+	PaymentID string      `json:"paymentId"`
+	Code      string      `json:"code"`
+	State     RewardState `json:"state"`
+	Recipient string      `json:"recipient"` // The recipient of the purchase.
+	Quantity  uint64      `json:"quantity"`  // The tokens bought.
+	Amount    uint64      `json:"amount"`    // The tokens earned by the referrer.
+	ClaimID   string      `json:"claimId,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+// ReferralClaim is a faucet package issued to a referrer for its pending rewards.
+type ReferralClaim struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code"`
+	Address   string    `json:"address"`
+	Amount    uint64    `json:"amount"`
+	Package   []byte    `json:"package"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Customer links a buyer, identified by its email, to an address it bought tokens for. It is
+// keyed by both, so a buyer has a customer for each address.
+type Customer struct {
+	Email           string    `json:"email"`
+	Address         string    `json:"address"`
+	ProviderID      string    `json:"providerId,omitempty"` // The latest customer ID at the payment provider, if any.
+	Purchases       uint64    `json:"purchases"`
+	Tokens          uint64    `json:"tokens"`
+	FirstPurchaseAt time.Time `json:"firstPurchaseAt"`
+	LastPurchaseAt  time.Time `json:"lastPurchaseAt"`
+}
+
+// Subscription is a recurring purchase of a token allowance for a subscriber address. Every
+// paid invoice credits the allowance, which the subscriber claims whenever it needs it.
+type Subscription struct {
+	ID          string    `json:"id"` // The subscription ID at the payment provider.
+	Subscriber  string    `json:"subscriber"`
+	Status      string    `json:"status"` // The status at the payment provider, such as active or canceled.
+	Customer    string    `json:"customer,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Allowance   uint64    `json:"allowance"` // The tokens credited per paid period.
+	Available   uint64    `json:"available"` // The tokens credited and not claimed yet.
+	Claimed     uint64    `json:"claimed"`
+	LastInvoice string    `json:"lastInvoice,omitempty"` // The last invoice credited.
+	PeriodEnd   time.Time `json:"periodEnd"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// OAuthState is an OAuth authorization started by the faucet for a recipient. It is created
+// with the authorization URL and used once, by the claim of the code the provider returns.
+type OAuthState struct {
+	State       string    `json:"state"` // The random state parameter of the authorization.
+	Provider    string    `json:"provider"`
+	Recipient   string    `json:"recipient"`
+	Verifier    string    `json:"verifier"`        // The PKCE code verifier.
+	Nonce       string    `json:"nonce,omitempty"` // The nonce of the ID token, for OpenID Connect providers.
+	RedirectURL string    `json:"redirectURL"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	UsedAt      time.Time `json:"usedAt"` // Zero until the state is used by a claim.
+}
+
+// WebhookJobState is the state of a webhook job.
+type WebhookJobState string
+
+// Webhook job states. A job is pending until it is processed, and dead once every attempt to
+// process it has failed, until it is retried by an operator.
+const (
+	WebhookJobPending WebhookJobState = "pending"
+	WebhookJobDone    WebhookJobState = "done"
+	WebhookJobDead    WebhookJobState = "dead"
+)
+
+// WebhookJob is a verified webhook event queued to be processed in the background.
+type WebhookJob struct {
+	ID          string          `json:"id"` // The event ID at the payment provider.
+	Provider    string          `json:"provider"`
+	Type        string          `json:"type"` // The event type.
+	Payload     []byte          `json:"payload,omitempty"`
+	State       WebhookJobState `json:"state"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError,omitempty"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// Reservation is an amount of tokens held for a pending purchase until it is fulfilled, so
+// they are not issued to anyone else. It is keyed by the ID of the payment.
+type Reservation struct {
+	ID        string    `json:"id"`
+	Amount    uint64    `json:"amount"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// budgetWindow returns the start of the current window of a budget with the given period.
+func budgetWindow(period time.Duration) time.Time {
+	return budgetWindowAt(time.Now(), period)
+}
+
+// budgetWindowAt returns the start of the budget window of the given period that contains t.
+func budgetWindowAt(t time.Time, period time.Duration) time.Time {
+	return t.Truncate(period)
+}
+
+// sortReferralRewards sorts the given rewards by creation time.
+func sortReferralRewards(rewards []*ReferralReward) {
+	sort.SliceStable(rewards, func(i, j int) bool {
+		return rewards[i].CreatedAt.Before(rewards[j].CreatedAt)
+	})
+}
+
+// sortReferralClaims sorts the given claims by creation time.
+func sortReferralClaims(claims []*ReferralClaim) {
+	sort.SliceStable(claims, func(i, j int) bool {
+		return claims[i].CreatedAt.Before(claims[j].CreatedAt)
+	})
+}
+
+// sortPayments sorts the given payments by creation time.
+func sortPayments(payments []*Payment) {
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+}
+
+// sortCustomers sorts the given customers by their first purchase.
+func sortCustomers(customers []*Customer) {
+	sort.SliceStable(customers, func(i, j int) bool {
+		return customers[i].FirstPurchaseAt.Before(customers[j].FirstPurchaseAt)
+	})
+}
+
+// sortSubscriptions sorts the given subscriptions by creation time.
+func sortSubscriptions(subscriptions []*Subscription) {
+	sort.SliceStable(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+}
+
+// sortWebhookJobs sorts the given webhook jobs by creation time.
+func sortWebhookJobs(jobs []*WebhookJob) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+}
+
+// sortLedgerEntries sorts the given entries by time.
+func sortLedgerEntries(entries []*LedgerEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
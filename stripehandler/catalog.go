@@ -0,0 +1,138 @@
+package stripehandler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/price"
+	"github.com/vocdoni/vocfaucet/pricing"
+)
+
+// DefaultPriceCacheTTL is the default time the price tiers are cached for.
+const DefaultPriceCacheTTL = 5 * time.Minute
+
+// priceCache keeps the price tiers fetched from Stripe for a while.
+type priceCache struct {
+	catalog *pricing.Catalog
+	fetched time.Time
+	lock    sync.Mutex
+}
+
+// PriceCatalog returns the price tiers of the product, by currency. If local prices are
+// configured they are used, otherwise the active prices of the product are fetched from Stripe
+// and cached for PriceCacheTTL.
+func (s *StripeHandler) PriceCatalog() (*pricing.Catalog, error) {
+	if s.LocalPrices != nil {
+		return s.LocalPrices, nil
+	}
+	s.prices.lock.Lock()
+	defer s.prices.lock.Unlock()
+	ttl := s.PriceCacheTTL
+	if ttl == 0 {
+		ttl = DefaultPriceCacheTTL
+	}
+	if s.prices.catalog != nil && time.Since(s.prices.fetched) < ttl {
+		return s.prices.catalog, nil
+	}
+	catalog, err := s.fetchPriceCatalog()
+	if err != nil {
+		return nil, err
+	}
+	s.prices.catalog, s.prices.fetched = catalog, time.Now()
+	return catalog, nil
+}
+
+// fetchPriceCatalog searches the active prices of the product in Stripe. Each price is a tier
+// for the packages of its transform quantity, and applies from that quantity on, except the
+// smallest package, which applies to any smaller quantity too. The prices are grouped by their
+// currency, and their currency options are tiers of the other currencies. The default currency
+// is DefaultCurrency, if there are prices in it, or the currency of the first price otherwise.
+func (s *StripeHandler) fetchPriceCatalog() (*pricing.Catalog, error) {
+	// get the different price packages
+	priceSearchParams := &stripe.PriceSearchParams{
+		SearchParams: stripe.SearchParams{
+			Query: fmt.Sprintf("product:'%s' AND active:'true'", s.ProductID),
+		},
+	}
+	priceSearchParams.Limit = stripe.Int64(100)
+	priceSearchParams.AddExpand("data.currency_options")
+	result := price.Search(priceSearchParams)
+	tiers := make(map[string][]pricing.Tier)
+	var first string
+	for result.Next() {
+		p := result.Price()
+		if first == "" {
+			first = string(p.Currency)
+		}
+		packageSize := int64(1)
+		if p.TransformQuantity != nil && p.TransformQuantity.DivideBy > 0 {
+			packageSize = p.TransformQuantity.DivideBy
+		}
+		amounts := map[string]int64{string(p.Currency): p.UnitAmount}
+		for currency, option := range p.CurrencyOptions {
+			if _, ok := amounts[currency]; !ok && option != nil {
+				amounts[currency] = option.UnitAmount
+			}
+		}
+		for currency, amount := range amounts {
+			tiers[currency] = append(tiers[currency], pricing.Tier{
+				MinQuantity:  packageSize,
+				PackageSize:  packageSize,
+				PackagePrice: amount,
+				PriceID:      p.ID,
+			})
+		}
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("no active prices found for product %s", s.ProductID)
+	}
+	var tables []*pricing.Table
+	for currency, currencyTiers := range tiers {
+		smallest := 0
+		for i := range currencyTiers {
+			if currencyTiers[i].MinQuantity < currencyTiers[smallest].MinQuantity {
+				smallest = i
+			}
+		}
+		currencyTiers[smallest].MinQuantity = 1
+		table, err := pricing.NewTable(currency, currencyTiers)
+		if err != nil {
+			return nil, fmt.Errorf("prices of product %s in %s: %w", s.ProductID, currency, err)
+		}
+		tables = append(tables, table)
+	}
+	defaultCurrency := strings.ToLower(s.DefaultCurrency)
+	if _, ok := tiers[defaultCurrency]; !ok {
+		defaultCurrency = first
+	}
+	return pricing.NewCatalog(defaultCurrency, tables...)
+}
+
+// Quote returns the price of the given quantity of tokens in the given currency, or in the
+// default currency if it is empty, as it is charged by the checkout.
+func (s *StripeHandler) Quote(quantity int64, currency string) (*pricing.Quote, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrQuantityOutOfRange, quantity)
+	}
+	catalog, err := s.PriceCatalog()
+	if err != nil {
+		return nil, err
+	}
+	return catalog.Quote(quantity, currency)
+}
+
+// ResolveCurrency returns the currency of a purchase, the requested one if any, or the one of
+// the client country or locales, as in pricing.Catalog.Resolve.
+func (s *StripeHandler) ResolveCurrency(currency, country, locales string) (string, error) {
+	catalog, err := s.PriceCatalog()
+	if err != nil {
+		return "", err
+	}
+	return catalog.Resolve(currency, country, locales)
+}
@@ -0,0 +1,359 @@
+package stripehandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+// alertTimeout is the timeout of the requests that post alerts.
+const alertTimeout = 10 * time.Second
+
+// paidReservationTTL is the time the tokens of a paid purchase stay reserved until it is
+// fulfilled. Purchases are fulfilled once paid, so it only covers the retries of the failed
+// ones, such as the ones over the daily limit until they are refunded.
+const paidReservationTTL = 24 * time.Hour
+
+// processEvent applies a verified Stripe event to the payment records. Unknown event types
+// are ignored.
+func (s *StripeHandler) processEvent(event *stripe.Event) error {
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		sess, err := unmarshalEventObject[stripe.CheckoutSession](event)
+		if err != nil {
+			return err
+		}
+		// subscriptions are credited when their invoices are paid
+		if sess.Mode == stripe.CheckoutSessionModeSubscription {
+			return nil
+		}
+		// delayed payment methods complete the checkout before the payment is received
+		if !isPaid(string(sess.Status), string(sess.PaymentStatus)) {
+			return nil
+		}
+		if sess.PaymentLink != nil {
+			if _, ok := s.PaymentLinks[sess.PaymentLink.ID]; !ok {
+				log.Debugw("ignoring checkout session of unknown payment link", "session", sess.ID, "link", sess.PaymentLink.ID)
+				return nil
+			}
+		}
+		if err := s.markPaid(sess); err != nil {
+			return err
+		}
+		s.fulfillPaid(sess.ID)
+		return nil
+	case stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+		sess, err := unmarshalEventObject[stripe.CheckoutSession](event)
+		if err != nil {
+			return err
+		}
+		return s.setPaymentState(sess.ID, storage.PaymentFailed)
+	case stripe.EventTypeCheckoutSessionExpired:
+		sess, err := unmarshalEventObject[stripe.CheckoutSession](event)
+		if err != nil {
+			return err
+		}
+		return s.setPaymentState(sess.ID, storage.PaymentExpired)
+	case stripe.EventTypeInvoicePaid:
+		invoice, err := unmarshalEventObject[stripe.Invoice](event)
+		if err != nil {
+			return err
+		}
+		return s.creditSubscription(invoice)
+	case stripe.EventTypeCustomerSubscriptionUpdated, stripe.EventTypeCustomerSubscriptionDeleted:
+		subscription, err := unmarshalEventObject[stripe.Subscription](event)
+		if err != nil {
+			return err
+		}
+		return s.updateSubscription(subscription)
+	case stripe.EventTypeChargeRefunded:
+		charge, err := unmarshalEventObject[stripe.Charge](event)
+		if err != nil {
+			return err
+		}
+		if charge.PaymentIntent == nil {
+			return fmt.Errorf("refunded charge %s has no payment intent", charge.ID)
+		}
+		var customer, email string
+		if charge.Customer != nil {
+			customer = charge.Customer.ID
+		}
+		if charge.BillingDetails != nil {
+			email = charge.BillingDetails.Email
+		}
+		reason := fmt.Sprintf("charge %s refunded (%d %s)", charge.ID, charge.AmountRefunded, charge.Currency)
+		if charge.AmountRefunded < charge.Amount {
+			// partial refunds, such as discounts, are not a sign of fraud and leave the
+			// payment as is
+			log.Infow("charge partially refunded", "charge", charge.ID, "refunded", charge.AmountRefunded,
+				"amount", charge.Amount, "currency", charge.Currency)
+			return nil
+		}
+		faucetRefund, err := s.faucetRefunds(charge.ID)
+		if err != nil {
+			return err
+		}
+		if faucetRefund {
+			return s.refundPayment(charge.PaymentIntent.ID, reason)
+		}
+		return s.revokePayment(charge.PaymentIntent.ID, storage.PaymentRefunded, customer, email, reason)
+	case stripe.EventTypeChargeDisputeCreated:
+		dispute, err := unmarshalEventObject[stripe.Dispute](event)
+		if err != nil {
+			return err
+		}
+		if dispute.PaymentIntent == nil {
+			return fmt.Errorf("dispute %s has no payment intent", dispute.ID)
+		}
+		reason := fmt.Sprintf("dispute %s created (%s)", dispute.ID, dispute.Reason)
+		return s.revokePayment(dispute.PaymentIntent.ID, storage.PaymentDisputed, "", "", reason)
+	}
+	return nil
+}
+
+// unmarshalEventObject decodes the object of the given event.
+func unmarshalEventObject[T any](event *stripe.Event) (*T, error) {
+	obj := new(T)
+	if err := json.Unmarshal(event.Data.Raw, obj); err != nil {
+		return nil, fmt.Errorf("cannot decode %s event: %w", event.Type, err)
+	}
+	return obj, nil
+}
+
+// markPaid moves the payment of the given checkout session to the paid state, creating the
+// payment record if there is none. Payments already paid or fulfilled are left untouched.
+func (s *StripeHandler) markPaid(sess *stripe.CheckoutSession) error {
+	now := time.Now()
+	payment, err := s.Storage.Payment(sess.ID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		// the checkout was not created by the faucet, such as the ones of payment links,
+		// whose recipient is the client reference ID
+		payment = &storage.Payment{
+			ID:        sess.ID,
+			State:     storage.PaymentCreated,
+			Recipient: sess.Metadata["to"],
+			CreatedAt: now,
+		}
+		if payment.Recipient == "" {
+			payment.Recipient = sess.ClientReferenceID
+		}
+	case err != nil:
+		return err
+	}
+	if payment.State == storage.PaymentPaid || payment.State == storage.PaymentFulfilled {
+		return nil
+	}
+	if !payment.State.CanTransitionTo(storage.PaymentPaid) {
+		log.Warnw("ignoring payment for checkout session", "session", sess.ID, "state", payment.State)
+		return nil
+	}
+	// the tokens stay reserved until the payment is fulfilled, gifts until they are redeemed
+	if s.Fulfiller != nil {
+		ttl := paidReservationTTL
+		if payment.Gift != nil {
+			ttl = s.Fulfiller.GiftTTL
+		}
+		if err := s.Faucet.ExtendReservation(sess.ID, now.Add(ttl)); err != nil {
+			log.Warnw("failed to extend reservation", "session", sess.ID, "err", err)
+		}
+	}
+	payment.State = storage.PaymentPaid
+	payment.Price = sess.AmountTotal
+	payment.Currency = string(sess.Currency)
+	if sess.Customer != nil {
+		payment.Customer = sess.Customer.ID
+	}
+	if sess.CustomerDetails != nil {
+		payment.Email = sess.CustomerDetails.Email
+	}
+	payment.UpdatedAt = now
+	return s.Storage.SetPayment(payment)
+}
+
+// fulfillPaid issues the faucet package of the given paid checkout session, so it is ready
+// for the customer whether it comes back from an embedded, hosted or payment link checkout.
+// Failures are alerted, since the payment is already received, but not returned, since the
+// package is issued again when the customer requests the session status.
+func (s *StripeHandler) fulfillPaid(sessionID string) {
+	if s.Fulfiller == nil {
+		return
+	}
+	if _, err := s.Fulfiller.Fulfill(s, sessionID); err != nil {
+		s.alert(fmt.Sprintf("stripe paid checkout session %s could not be fulfilled: %v", sessionID, err))
+	}
+}
+
+// setPaymentState moves the payment of the given checkout session to the given state, if the
+// transition is valid, and releases its reserved tokens and the daily limits counted for it.
+// Missing payments are ignored, since there is nothing to update.
+func (s *StripeHandler) setPaymentState(sessionID string, state storage.PaymentState) error {
+	if err := s.releaseTokens(sessionID); err != nil {
+		return err
+	}
+	payment, err := s.Storage.Payment(sessionID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !payment.State.CanTransitionTo(state) {
+		log.Warnw("ignoring payment state change", "session", sessionID, "from", payment.State, "to", state)
+		return nil
+	}
+	limits := payment.DailyLimits
+	payment.State = state
+	payment.DailyLimits = nil
+	payment.UpdatedAt = time.Now()
+	if err := s.Storage.SetPayment(payment); err != nil {
+		return err
+	}
+	s.releaseDailyLimits(limits, payment.Quantity, payment.CreatedAt)
+	return nil
+}
+
+// revokePayment marks the payment of the given payment intent as refunded or disputed, adds its
+// recipient address, customer and email to the denylist and raises an alert. It is called for
+// the disputes and the full refunds not made by the faucet. The customer and email are used
+// when the payment record does not have them. The denylisted buyers cannot buy again, for any
+// recipient.
+func (s *StripeHandler) revokePayment(paymentIntentID string, state storage.PaymentState, customer, email, reason string) error {
+	sessionID, err := s.CheckoutSessionForPaymentIntent(paymentIntentID)
+	if err != nil {
+		return err
+	}
+	p, err := s.Storage.Payment(sessionID)
+	if errors.Is(err, storage.ErrNotFound) {
+		// the session was never seen by the faucet, so nothing was issued, but still
+		// alert since the payment was made against the faucet product
+		s.alert(fmt.Sprintf("stripe %s for unknown checkout session %s", reason, sessionID))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the tokens of payments revoked before being fulfilled are not issued
+	if err := s.releaseTokens(sessionID); err != nil {
+		return err
+	}
+	if p.Gift != nil && p.State == storage.PaymentRefunded && state == storage.PaymentRefunded {
+		// the faucet refunds the gifts never redeemed, so the buyer is not denylisted
+		log.Infow("gift refunded", "session", sessionID, "reason", reason)
+		return nil
+	}
+	if p.Customer != "" {
+		customer = p.Customer
+	}
+	if p.Email != "" {
+		email = p.Email
+	}
+	if p.State.CanTransitionTo(state) {
+		p.State = state
+		p.UpdatedAt = time.Now()
+		if err := s.Storage.SetPayment(p); err != nil {
+			return err
+		}
+		if s.Fulfiller != nil {
+			s.Fulfiller.Revoked(p)
+		}
+	} else if p.State != state {
+		log.Warnw("ignoring payment state change", "session", sessionID, "from", p.State, "to", state)
+	}
+
+	now := time.Now()
+	entries := []*storage.DenylistEntry{}
+	if addr, err := helpers.StringToAddress(p.Recipient); err == nil {
+		entries = append(entries, &storage.DenylistEntry{Kind: storage.DenylistAddress, Value: addr.Hex()})
+	}
+	if customer != "" {
+		entries = append(entries, &storage.DenylistEntry{Kind: storage.DenylistCustomer, Value: customer})
+	}
+	if email = payment.NormalizeEmail(email); email != "" {
+		entries = append(entries, &storage.DenylistEntry{Kind: storage.DenylistEmail, Value: email})
+	}
+	for _, entry := range entries {
+		entry.Reason, entry.Time = reason, now
+		if err := s.Storage.AddDenylistEntry(entry); err != nil {
+			return err
+		}
+	}
+	s.alert(fmt.Sprintf("stripe %s: checkout session %s, recipient %s, quantity %d, state %s, %d denylist entries added",
+		reason, sessionID, p.Recipient, p.Quantity, p.State, len(entries)))
+	return nil
+}
+
+// refundPayment marks the payment of the given payment intent as refunded by the faucet,
+// without denylisting its buyer nor alerting, since it is not a sign of fraud.
+func (s *StripeHandler) refundPayment(paymentIntentID, reason string) error {
+	sessionID, err := s.CheckoutSessionForPaymentIntent(paymentIntentID)
+	if err != nil {
+		return err
+	}
+	if err := s.releaseTokens(sessionID); err != nil {
+		return err
+	}
+	payment, err := s.Storage.Payment(sessionID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infow("payment refunded by the faucet", "session", sessionID, "reason", reason)
+	if !payment.State.CanTransitionTo(storage.PaymentRefunded) {
+		return nil
+	}
+	payment.State = storage.PaymentRefunded
+	payment.UpdatedAt = time.Now()
+	if err := s.Storage.SetPayment(payment); err != nil {
+		return err
+	}
+	if s.Fulfiller != nil {
+		s.Fulfiller.Revoked(payment)
+	}
+	return nil
+}
+
+// releaseTokens releases the tokens reserved for the given checkout session, if any.
+func (s *StripeHandler) releaseTokens(sessionID string) error {
+	if s.Faucet == nil {
+		return nil
+	}
+	return s.Faucet.Release(sessionID)
+}
+
+// alert logs the given message as an error and, if an alert URL is configured, posts it there
+// in the background, as a JSON object with a text field.
+func (s *StripeHandler) alert(message string) {
+	log.Errorw(fmt.Errorf("%s", message), "stripe alert")
+	if s.AlertURL == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		log.Warnw("failed to encode alert", "err", err)
+		return
+	}
+	go func() {
+		client := &http.Client{Timeout: alertTimeout}
+		resp, err := client.Post(s.AlertURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Warnw("failed to post alert", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Warnw("failed to post alert", "status", resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,567 @@
+package stripehandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/form"
+	"github.com/stripe/stripe-go/v81/webhook"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultFakePrices are the price tiers of the product in the fake Stripe backend, when none
+// are given.
+const DefaultFakePrices = "eur=1:10,100:8,1000:5;usd=1:11,100:9,1000:6"
+
+// fakeSessionTTL is the time the checkout sessions of the fake Stripe backend are open for.
+const fakeSessionTTL = 24 * time.Hour
+
+// FakeBackend is a local stand-in of the Stripe API, so the purchases can be run end to end
+// without network, such as in development and CI. It simulates the price search of the
+// product, the checkout sessions, which are paid or expired on demand, and the refunds, and
+// delivers the signed webhook events of every change to Webhook, like Stripe does to the
+// webhook endpoint.
+type FakeBackend struct {
+	Prices        *pricing.Catalog // The active prices of the product.
+	WebhookSecret string           // The secret the webhook events are signed with.
+	// The URL of the hosted checkout pages, the sessions are paid at CheckoutURL/{id}.
+	CheckoutURL string
+	// Webhook receives the signed webhook events, if set.
+	Webhook      func(body []byte, header http.Header) error
+	sessions     map[string]*stripe.CheckoutSession
+	subscription map[string]map[string]string // The subscription metadata, by session ID.
+	refunds      []*stripe.Refund
+	counter      int
+	lock         sync.Mutex
+	delivering   sync.WaitGroup // The events being delivered in the background.
+}
+
+// check that FakeBackend implements the stripe.Backend interface
+var _ stripe.Backend = (*FakeBackend)(nil)
+
+// NewFakeBackend creates a new FakeBackend that sells the product at the given prices.
+func NewFakeBackend(prices *pricing.Catalog) *FakeBackend {
+	return &FakeBackend{
+		Prices:       prices,
+		sessions:     make(map[string]*stripe.CheckoutSession),
+		subscription: make(map[string]map[string]string),
+	}
+}
+
+// UseFakeBackend sends the Stripe API requests to the given fake backend, which delivers its
+// webhook events to the handler signed with its webhook secret, and enables the fake checkout
+// endpoints.
+func (s *StripeHandler) UseFakeBackend(fake *FakeBackend) {
+	fake.WebhookSecret = s.WebhookSecret
+	fake.Webhook = s.HandleWebhook
+	stripe.SetBackend(stripe.APIBackend, fake)
+	s.Fake = fake
+}
+
+// Call simulates the Stripe API requests with parameters.
+func (f *FakeBackend) Call(method, path, _ string, params stripe.ParamsContainer, v stripe.LastResponseSetter) error {
+	switch {
+	case method == http.MethodPost && path == "/v1/checkout/sessions":
+		p, ok := params.(*stripe.CheckoutSessionParams)
+		if !ok || p == nil {
+			return fakeError(http.StatusBadRequest, "missing checkout session parameters")
+		}
+		sess, err := f.newSession(p)
+		if err != nil {
+			return err
+		}
+		return decodeFake(sess, v)
+	case method == http.MethodPost && strings.HasPrefix(path, "/v1/checkout/sessions/") && strings.HasSuffix(path, "/expire"):
+		sess, event, err := f.expire(strings.TrimSuffix(strings.TrimPrefix(path, "/v1/checkout/sessions/"), "/expire"))
+		if err != nil {
+			return err
+		}
+		f.deliverAsync(event)
+		return decodeFake(sess, v)
+	case method == http.MethodGet && strings.HasPrefix(path, "/v1/checkout/sessions/"):
+		sess, err := f.session(strings.TrimPrefix(path, "/v1/checkout/sessions/"))
+		if err != nil {
+			return err
+		}
+		return decodeFake(sess, v)
+	case method == http.MethodPost && path == "/v1/refunds":
+		p, ok := params.(*stripe.RefundParams)
+		if !ok || p == nil || p.PaymentIntent == nil {
+			return fakeError(http.StatusBadRequest, "missing payment intent")
+		}
+		refund, event, err := f.refund(*p.PaymentIntent, stripe.Int64Value(p.Amount), p.Metadata)
+		if err != nil {
+			return err
+		}
+		f.deliverAsync(event)
+		return decodeFake(refund, v)
+	}
+	return fakeError(http.StatusNotFound, fmt.Sprintf("unrecognized request URL (%s: %s)", method, path))
+}
+
+// CallRaw simulates the Stripe API list and search requests.
+func (f *FakeBackend) CallRaw(method, path, _ string, body *form.Values, _ *stripe.Params, v stripe.LastResponseSetter) error {
+	switch {
+	case method == http.MethodGet && path == "/v1/prices/search":
+		return decodeFake(map[string]any{"object": "search_result", "data": f.prices(), "has_more": false}, v)
+	case method == http.MethodGet && path == "/v1/checkout/sessions":
+		return decodeFake(map[string]any{"object": "list", "data": f.listSessions(body), "has_more": false}, v)
+	case method == http.MethodGet && path == "/v1/refunds":
+		return decodeFake(map[string]any{"object": "list", "data": f.listRefunds(body), "has_more": false}, v)
+	}
+	return fakeError(http.StatusNotFound, fmt.Sprintf("unrecognized request URL (%s: %s)", method, path))
+}
+
+// CallStreaming is not supported by the fake backend.
+func (*FakeBackend) CallStreaming(method, path, _ string, _ stripe.ParamsContainer, _ stripe.StreamingLastResponseSetter) error {
+	return fakeError(http.StatusNotFound, fmt.Sprintf("unrecognized request URL (%s: %s)", method, path))
+}
+
+// CallMultipart is not supported by the fake backend.
+func (*FakeBackend) CallMultipart(method, path, _, _ string, _ *bytes.Buffer, _ *stripe.Params, _ stripe.LastResponseSetter) error {
+	return fakeError(http.StatusNotFound, fmt.Sprintf("unrecognized request URL (%s: %s)", method, path))
+}
+
+// SetMaxNetworkRetries does nothing, the fake backend never fails to connect.
+func (*FakeBackend) SetMaxNetworkRetries(int64) {}
+
+// Pay completes the open checkout session with the given ID as paid by a customer with the
+// given email, and delivers the checkout.session.completed event, and the invoice.paid event
+// of the subscription sessions.
+func (f *FakeBackend) Pay(id, email string) (*stripe.CheckoutSession, error) {
+	f.lock.Lock()
+	sess, ok := f.sessions[id]
+	if !ok {
+		f.lock.Unlock()
+		return nil, fakeError(http.StatusNotFound, fmt.Sprintf("no such checkout.session: '%s'", id))
+	}
+	if sess.Status != stripe.CheckoutSessionStatusOpen {
+		f.lock.Unlock()
+		return nil, fakeError(http.StatusBadRequest, fmt.Sprintf("checkout session %s is %s", id, sess.Status))
+	}
+	sess.Status = stripe.CheckoutSessionStatusComplete
+	sess.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	sess.Customer = &stripe.Customer{ID: f.newID("cus")}
+	sess.CustomerDetails = &stripe.CheckoutSessionCustomerDetails{Email: email}
+	events := [][]byte{f.event(stripe.EventTypeCheckoutSessionCompleted, sess)}
+	if sess.Mode == stripe.CheckoutSessionModeSubscription {
+		sess.Subscription = &stripe.Subscription{ID: f.newID("sub")}
+		now := time.Now()
+		events = append(events, f.event(stripe.EventTypeInvoicePaid, &stripe.Invoice{
+			ID:            f.newID("in"),
+			Object:        "invoice",
+			AmountPaid:    sess.AmountTotal,
+			Currency:      sess.Currency,
+			Customer:      sess.Customer,
+			CustomerEmail: email,
+			Paid:          true,
+			Subscription:  sess.Subscription,
+			SubscriptionDetails: &stripe.InvoiceSubscriptionDetails{
+				Metadata: f.subscription[id],
+			},
+			Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{{
+				Period: &stripe.Period{Start: now.Unix(), End: now.AddDate(0, 1, 0).Unix()},
+			}}},
+		}))
+	}
+	paid := copySession(sess)
+	f.lock.Unlock()
+	return paid, f.deliver(events...)
+}
+
+// Expire expires the open checkout session with the given ID, and delivers the
+// checkout.session.expired event.
+func (f *FakeBackend) Expire(id string) (*stripe.CheckoutSession, error) {
+	sess, event, err := f.expire(id)
+	if err != nil {
+		return nil, err
+	}
+	return sess, f.deliver(event)
+}
+
+// expire expires the open checkout session with the given ID, and returns it and its
+// checkout.session.expired event.
+func (f *FakeBackend) expire(id string) (*stripe.CheckoutSession, []byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sess, ok := f.sessions[id]
+	if !ok {
+		return nil, nil, fakeError(http.StatusNotFound, fmt.Sprintf("no such checkout.session: '%s'", id))
+	}
+	if sess.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, nil, fakeError(http.StatusBadRequest, fmt.Sprintf("checkout session %s is %s", id, sess.Status))
+	}
+	sess.Status = stripe.CheckoutSessionStatusExpired
+	return copySession(sess), f.event(stripe.EventTypeCheckoutSessionExpired, sess), nil
+}
+
+// newSession creates an open checkout session with the given parameters. The price of the line
+// items is their unit price, or the price of the product with their price ID.
+func (f *FakeBackend) newSession(p *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	sess := &stripe.CheckoutSession{
+		ID:            f.newID("cs"),
+		Object:        "checkout.session",
+		Created:       now.Unix(),
+		ExpiresAt:     now.Add(fakeSessionTTL).Unix(),
+		Mode:          stripe.CheckoutSessionModePayment,
+		UIMode:        stripe.CheckoutSessionUIModeHosted,
+		Status:        stripe.CheckoutSessionStatusOpen,
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+		Metadata:      p.Metadata,
+		LineItems:     &stripe.LineItemList{},
+	}
+	if sess.Metadata == nil {
+		sess.Metadata = map[string]string{}
+	}
+	if p.ExpiresAt != nil {
+		sess.ExpiresAt = *p.ExpiresAt
+	}
+	if p.Mode != nil {
+		sess.Mode = stripe.CheckoutSessionMode(*p.Mode)
+	}
+	if p.UIMode != nil {
+		sess.UIMode = stripe.CheckoutSessionUIMode(*p.UIMode)
+	}
+	if p.ClientReferenceID != nil {
+		sess.ClientReferenceID = *p.ClientReferenceID
+	}
+	if p.ReturnURL != nil {
+		sess.ReturnURL = *p.ReturnURL
+	}
+	if p.SuccessURL != nil {
+		sess.SuccessURL = *p.SuccessURL
+	}
+	if p.CancelURL != nil {
+		sess.CancelURL = *p.CancelURL
+	}
+	for _, item := range p.LineItems {
+		lineItem, err := f.lineItem(item)
+		if err != nil {
+			return nil, err
+		}
+		if sess.Currency != "" && lineItem.Currency != sess.Currency {
+			return nil, fakeError(http.StatusBadRequest, "line items with different currencies")
+		}
+		sess.Currency = lineItem.Currency
+		sess.AmountSubtotal += lineItem.AmountTotal
+		sess.AmountTotal += lineItem.AmountTotal
+		sess.LineItems.Data = append(sess.LineItems.Data, lineItem)
+	}
+	if len(sess.LineItems.Data) == 0 {
+		return nil, fakeError(http.StatusBadRequest, "missing line items")
+	}
+	switch sess.UIMode {
+	case stripe.CheckoutSessionUIModeEmbedded:
+		sess.ClientSecret = sess.ID + "_secret"
+	case stripe.CheckoutSessionUIModeHosted:
+		sess.URL = strings.TrimSuffix(f.CheckoutURL, "/") + "/" + sess.ID
+	}
+	if sess.Mode == stripe.CheckoutSessionModeSubscription {
+		if p.SubscriptionData != nil {
+			f.subscription[sess.ID] = p.SubscriptionData.Metadata
+		}
+	} else {
+		sess.PaymentIntent = &stripe.PaymentIntent{
+			ID:           f.newID("pi"),
+			Object:       "payment_intent",
+			LatestCharge: &stripe.Charge{ID: f.newID("ch"), Object: "charge"},
+		}
+	}
+	f.sessions[sess.ID] = sess
+	return copySession(sess), nil
+}
+
+// lineItem returns the line item of a checkout session with the given parameters.
+func (f *FakeBackend) lineItem(item *stripe.CheckoutSessionLineItemParams) (*stripe.LineItem, error) {
+	if item.Quantity == nil || *item.Quantity <= 0 {
+		return nil, fakeError(http.StatusBadRequest, "invalid line item quantity")
+	}
+	quantity := *item.Quantity
+	lineItem := &stripe.LineItem{ID: f.newID("li"), Object: "item", Quantity: quantity}
+	switch {
+	case item.PriceData != nil && item.PriceData.Currency != nil:
+		lineItem.Currency = stripe.Currency(*item.PriceData.Currency)
+		lineItem.Price = &stripe.Price{ID: f.newID("price"), Object: "price", Currency: lineItem.Currency}
+		switch {
+		case item.PriceData.UnitAmount != nil:
+			lineItem.Price.UnitAmount = *item.PriceData.UnitAmount
+			lineItem.AmountTotal = *item.PriceData.UnitAmount * quantity
+		case item.PriceData.UnitAmountDecimal != nil:
+			lineItem.Price.UnitAmountDecimal = *item.PriceData.UnitAmountDecimal
+			lineItem.AmountTotal = int64(math.Round(*item.PriceData.UnitAmountDecimal * float64(quantity)))
+		default:
+			return nil, fakeError(http.StatusBadRequest, "missing line item unit amount")
+		}
+	case item.Price != nil:
+		for _, price := range f.prices() {
+			if price.ID == *item.Price {
+				lineItem.Price = price
+				lineItem.Currency = price.Currency
+				lineItem.AmountTotal = price.UnitAmount * quantity
+			}
+		}
+		if lineItem.Price == nil {
+			return nil, fakeError(http.StatusBadRequest, fmt.Sprintf("no such price: '%s'", *item.Price))
+		}
+	default:
+		return nil, fakeError(http.StatusBadRequest, "missing line item price")
+	}
+	lineItem.AmountSubtotal = lineItem.AmountTotal
+	return lineItem, nil
+}
+
+// session returns a copy of the checkout session with the given ID.
+func (f *FakeBackend) session(id string) (*stripe.CheckoutSession, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sess, ok := f.sessions[id]
+	if !ok {
+		return nil, fakeError(http.StatusNotFound, fmt.Sprintf("no such checkout.session: '%s'", id))
+	}
+	return copySession(sess), nil
+}
+
+// listSessions returns the checkout sessions that match the given list parameters, the most
+// recent first, like Stripe does.
+func (f *FakeBackend) listSessions(query *form.Values) []*stripe.CheckoutSession {
+	param := func(key string) string {
+		if query == nil || len(query.Get(key)) == 0 {
+			return ""
+		}
+		return query.Get(key)[0]
+	}
+	createdFrom, _ := strconv.ParseInt(param("created[gte]"), 10, 64)
+	createdTo, _ := strconv.ParseInt(param("created[lt]"), 10, 64)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sessions := []*stripe.CheckoutSession{}
+	for _, sess := range f.sessions {
+		switch {
+		case param("status") != "" && string(sess.Status) != param("status"),
+			param("payment_intent") != "" && (sess.PaymentIntent == nil || sess.PaymentIntent.ID != param("payment_intent")),
+			createdFrom != 0 && sess.Created < createdFrom,
+			createdTo != 0 && sess.Created >= createdTo:
+			continue
+		}
+		sessions = append(sessions, copySession(sess))
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Created > sessions[j].Created
+	})
+	return sessions
+}
+
+// Refund refunds the given amount of the paid checkout session with the given ID, all that is
+// left if 0, with the given refund metadata, like the refunds made from the Stripe dashboard,
+// and delivers the charge.refunded event.
+func (f *FakeBackend) Refund(id string, amount int64, metadata map[string]string) (*stripe.Refund, error) {
+	f.lock.Lock()
+	sess, ok := f.sessions[id]
+	if !ok || sess.PaymentIntent == nil {
+		f.lock.Unlock()
+		return nil, fakeError(http.StatusNotFound, fmt.Sprintf("no such checkout.session: '%s'", id))
+	}
+	paymentIntentID := sess.PaymentIntent.ID
+	f.lock.Unlock()
+	refund, event, err := f.refund(paymentIntentID, amount, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return refund, f.deliver(event)
+}
+
+// refund refunds the given amount of the paid checkout session of the given payment intent,
+// all that is left if 0, and returns the refund and its charge.refunded event.
+func (f *FakeBackend) refund(paymentIntentID string, amount int64, metadata map[string]string) (*stripe.Refund, []byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var sess *stripe.CheckoutSession
+	for _, s := range f.sessions {
+		if s.PaymentIntent != nil && s.PaymentIntent.ID == paymentIntentID {
+			sess = s
+		}
+	}
+	if sess == nil || sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		return nil, nil, fakeError(http.StatusBadRequest, fmt.Sprintf("payment intent %s has no paid charge", paymentIntentID))
+	}
+	charge := sess.PaymentIntent.LatestCharge
+	if charge.Refunded {
+		return nil, nil, fakeError(http.StatusBadRequest, fmt.Sprintf("charge %s has already been refunded", charge.ID))
+	}
+	if amount == 0 {
+		amount = sess.AmountTotal - charge.AmountRefunded
+	}
+	if amount < 0 || charge.AmountRefunded+amount > sess.AmountTotal {
+		return nil, nil, fakeError(http.StatusBadRequest, fmt.Sprintf("refund amount %d is greater than the unrefunded amount", amount))
+	}
+	charge.AmountRefunded += amount
+	charge.Refunded = charge.AmountRefunded == sess.AmountTotal
+	refund := &stripe.Refund{
+		ID:            f.newID("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Charge:        &stripe.Charge{ID: charge.ID},
+		Currency:      sess.Currency,
+		Metadata:      metadata,
+		Status:        stripe.RefundStatusSucceeded,
+		PaymentIntent: &stripe.PaymentIntent{ID: paymentIntentID},
+	}
+	f.refunds = append(f.refunds, refund)
+	event := f.event(stripe.EventTypeChargeRefunded, &stripe.Charge{
+		ID:             charge.ID,
+		Object:         "charge",
+		Amount:         sess.AmountTotal,
+		AmountRefunded: charge.AmountRefunded,
+		Currency:       sess.Currency,
+		Customer:       sess.Customer,
+		Refunded:       charge.Refunded,
+		PaymentIntent:  &stripe.PaymentIntent{ID: paymentIntentID},
+		BillingDetails: &stripe.ChargeBillingDetails{Email: sess.CustomerDetails.Email},
+	})
+	return refund, event, nil
+}
+
+// listRefunds returns the refunds of the charge of the given list query, if any.
+func (f *FakeBackend) listRefunds(query *form.Values) []*stripe.Refund {
+	var charge string
+	if query != nil && len(query.Get("charge")) > 0 {
+		charge = query.Get("charge")[0]
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	refunds := []*stripe.Refund{}
+	for _, refund := range f.refunds {
+		if charge == "" || refund.Charge.ID == charge {
+			refunds = append(refunds, refund)
+		}
+	}
+	return refunds
+}
+
+// prices returns the prices of the product, one for each tier and currency. Each price sells
+// the packages of the minimum quantity of its tier, times its package size, so the prices
+// fetched from the fake backend have the same tiers as Prices.
+func (f *FakeBackend) prices() []*stripe.Price {
+	var prices []*stripe.Price
+	for _, currency := range f.Prices.Currencies() {
+		for _, tier := range f.Prices.Tables[currency].Tiers {
+			id := tier.PriceID
+			if id == "" {
+				id = fmt.Sprintf("price_fake_%s_%d", currency, tier.MinQuantity)
+			}
+			prices = append(prices, &stripe.Price{
+				ID:                id,
+				Object:            "price",
+				Active:            true,
+				Currency:          stripe.Currency(currency),
+				UnitAmount:        tier.PackagePrice * tier.MinQuantity,
+				TransformQuantity: &stripe.PriceTransformQuantity{DivideBy: tier.PackageSize * tier.MinQuantity},
+			})
+		}
+	}
+	return prices
+}
+
+// newID returns a new unique ID with the given prefix. The caller must hold the lock.
+func (f *FakeBackend) newID(prefix string) string {
+	f.counter++
+	return fmt.Sprintf("%s_fake_%d", prefix, f.counter)
+}
+
+// event returns an event of the given type for the given object, as sent by Stripe. The
+// caller must hold the lock.
+func (f *FakeBackend) event(eventType stripe.EventType, object any) []byte {
+	data, err := json.Marshal(object)
+	if err != nil {
+		panic(err)
+	}
+	event, err := json.Marshal(map[string]any{
+		"id":          f.newID("evt"),
+		"object":      "event",
+		"type":        eventType,
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"livemode":    false,
+		"data":        map[string]json.RawMessage{"object": data},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return event
+}
+
+// deliver signs the given events with the webhook secret and sends them to Webhook, in order.
+func (f *FakeBackend) deliver(events ...[]byte) error {
+	if f.Webhook == nil {
+		return nil
+	}
+	for _, event := range events {
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: event, Secret: f.WebhookSecret})
+		header := http.Header{}
+		header.Set("Stripe-Signature", signed.Header)
+		if err := f.Webhook(event, header); err != nil {
+			return fmt.Errorf("webhook event delivery failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// deliverAsync delivers in the background the events of the changes requested through the API,
+// which Stripe delivers after responding, so the caller can hold the locks the webhook handler
+// takes.
+func (f *FakeBackend) deliverAsync(events ...[]byte) {
+	f.delivering.Add(1)
+	go func() {
+		defer f.delivering.Done()
+		if err := f.deliver(events...); err != nil {
+			log.Warnw("fake stripe webhook delivery failed", "err", err)
+		}
+	}()
+}
+
+// Wait waits for the events being delivered in the background.
+func (f *FakeBackend) Wait() {
+	f.delivering.Wait()
+}
+
+// copySession returns a deep copy of the given checkout session, so the stored sessions are
+// never modified by their readers.
+func copySession(sess *stripe.CheckoutSession) *stripe.CheckoutSession {
+	cp := &stripe.CheckoutSession{}
+	if err := decodeFake(sess, cp); err != nil {
+		panic(err)
+	}
+	return cp
+}
+
+// decodeFake decodes the JSON encoding of the given object into v, like the responses of the
+// Stripe API are decoded.
+func decodeFake(object, v any) error {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// fakeError returns a Stripe API error with the given HTTP status and message.
+func fakeError(status int, msg string) error {
+	stripeErr := &stripe.Error{HTTPStatusCode: status, Msg: msg, Type: stripe.ErrorTypeInvalidRequest}
+	if status == http.StatusNotFound {
+		stripeErr.Code = stripe.ErrorCodeResourceMissing
+	}
+	return stripeErr
+}
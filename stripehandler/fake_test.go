@@ -0,0 +1,265 @@
+package stripehandler
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestFakeBackend(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	s, err := NewStripeClient("sk_test_fake", "prod_fake", "whsec_fake", 100, &faucet.Faucet{Signer: signer, Storage: st}, st)
+	if err != nil {
+		t.Fatalf("failed to create stripe client: %v", err)
+	}
+	prices, err := pricing.ParseCatalog("eur", DefaultFakePrices)
+	if err != nil {
+		t.Fatalf("failed to parse prices: %v", err)
+	}
+	fake := NewFakeBackend(prices)
+	s.UseFakeBackend(fake)
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+	defer fake.Wait()
+
+	// the price tiers are searched in the fake backend
+	quote, err := s.Quote(150, "usd")
+	if err != nil || quote.Total != 1350 {
+		t.Fatalf("unexpected quote %+v (%v)", quote, err)
+	}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	checkout, err := s.CreateCheckout(&payment.CheckoutRequest{Recipient: addr, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil || checkout.ClientSecret == "" || checkout.Payment.Price != 1200 || checkout.Payment.Currency != "eur" {
+		t.Fatalf("unexpected checkout %+v (%v)", checkout, err)
+	}
+	status, err := s.Fulfiller.Fulfill(s, checkout.ID)
+	if err != nil || status.Status != string(stripe.CheckoutSessionStatusOpen) || status.FaucetPackage != nil {
+		t.Fatalf("unexpected status of the open session %+v (%v)", status, err)
+	}
+
+	// paying the session delivers the completed event, which fulfills the payment
+	if _, err := fake.Pay(checkout.ID, "buyer@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if _, err := fake.Pay(checkout.ID, "buyer@example.com"); err == nil {
+		t.Fatalf("expected error paying twice")
+	}
+	p, err := st.Payment(checkout.ID)
+	if err != nil || p.State != storage.PaymentFulfilled || len(p.Package) == 0 {
+		t.Fatalf("unexpected payment %+v (%v)", p, err)
+	}
+	status, err = s.Fulfiller.Fulfill(s, checkout.ID)
+	if err != nil || status.Quantity != 150 || string(status.FaucetPackage) != string(p.Package) {
+		t.Fatalf("unexpected status of the paid session %+v (%v)", status, err)
+	}
+
+	// the refunds of the faucet are delivered in the background, like Stripe does, and mark
+	// the payment refunded without denylisting the recipient
+	if err := s.Refund(p); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	for i := 0; ; i++ {
+		if p, err = st.Payment(checkout.ID); err != nil {
+			t.Fatalf("failed to get payment: %v", err)
+		}
+		if p.State == storage.PaymentRefunded {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("payment not refunded: %+v", p)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := payment.CheckDenylist(st, addr); err != nil {
+		t.Fatalf("expected the recipient of a faucet refund not to be denylisted, got %v", err)
+	}
+
+	// the refunds made at Stripe revoke the payment
+	other := common.HexToAddress("0x00000000000000000000000000000000000000cc")
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: other, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	if _, err := fake.Pay(checkout.ID, "other@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if _, err := fake.Refund(checkout.ID, 0, nil); err != nil {
+		t.Fatalf("failed to refund: %v", err)
+	}
+	if p, err := st.Payment(checkout.ID); err != nil || p.State != storage.PaymentRefunded {
+		t.Fatalf("unexpected refunded payment %+v (%v)", p, err)
+	}
+	if err := payment.CheckDenylist(st, other); err == nil {
+		t.Fatalf("expected the refunded recipient to be denylisted")
+	}
+
+	// the refunded buyer cannot buy again for a fresh address, with its email given at
+	// checkout or once paid
+	fresh := common.HexToAddress("0x00000000000000000000000000000000000000dd")
+	if _, err := s.CreateCheckout(&payment.CheckoutRequest{Recipient: fresh, Quantity: 150, ReturnURL: "http://localhost",
+		Email: " Other@example.com"}); !errors.Is(err, payment.ErrDenylisted) {
+		t.Fatalf("expected the denylisted buyer email to be refused, got %v", err)
+	}
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: fresh, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	if _, err := fake.Pay(checkout.ID, "other@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if p, err := st.Payment(checkout.ID); err != nil || p.State != storage.PaymentPaid || len(p.Package) != 0 {
+		t.Fatalf("expected the payment of the denylisted buyer not to be fulfilled: %+v (%v)", p, err)
+	}
+	if _, err := s.Fulfiller.Fulfill(s, checkout.ID); !errors.Is(err, payment.ErrDenylisted) {
+		t.Fatalf("expected the denylisted buyer to be refused, got %v", err)
+	}
+
+	// partial refunds and the ones marked by the operator do not denylist the buyer
+	for i, refund := range []struct {
+		amount   int64
+		metadata map[string]string
+		state    storage.PaymentState
+	}{
+		{100, nil, storage.PaymentFulfilled},
+		{0, map[string]string{RefundMetadataKey: "goodwill"}, storage.PaymentRefunded},
+	} {
+		buyer := common.BigToAddress(big.NewInt(int64(0xe0 + i)))
+		checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: buyer, Quantity: 150, ReturnURL: "http://localhost"})
+		if err != nil {
+			t.Fatalf("failed to create checkout: %v", err)
+		}
+		if _, err := fake.Pay(checkout.ID, "good@example.com"); err != nil {
+			t.Fatalf("failed to pay: %v", err)
+		}
+		if _, err := fake.Refund(checkout.ID, refund.amount, refund.metadata); err != nil {
+			t.Fatalf("failed to refund: %v", err)
+		}
+		if p, err := st.Payment(checkout.ID); err != nil || p.State != refund.state {
+			t.Fatalf("unexpected refunded payment %+v (%v)", p, err)
+		}
+		if err := payment.CheckDenylist(st, buyer); err != nil {
+			t.Fatalf("expected the recipient not to be denylisted, got %v", err)
+		}
+		if err := payment.CheckBuyerDenylist(st, "", "good@example.com"); err != nil {
+			t.Fatalf("expected the buyer not to be denylisted, got %v", err)
+		}
+	}
+
+	// gifts are refunded once expired by their buyer, with the refund token of the checkout
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Gift: true, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil || checkout.RefundToken == "" || checkout.GiftToken == "" {
+		t.Fatalf("unexpected gift checkout %+v (%v)", checkout, err)
+	}
+	if _, err := fake.Pay(checkout.ID, "buyer@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if p, err = st.Payment(checkout.ID); err != nil {
+		t.Fatalf("failed to get payment: %v", err)
+	}
+	p.Gift.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := st.SetPayment(p); err != nil {
+		t.Fatalf("failed to set payment: %v", err)
+	}
+	if _, err := s.Fulfiller.RefundGift(s, checkout.ID, p.Gift.Token); !errors.Is(err, payment.ErrGiftNotFound) {
+		t.Fatalf("expected the claim token not to refund the gift, got %v", err)
+	}
+	if status, err := s.Fulfiller.RefundGift(s, checkout.ID, checkout.RefundToken); err != nil ||
+		status.State != string(storage.PaymentRefunded) {
+		t.Fatalf("unexpected refunded gift %+v (%v)", status, err)
+	}
+
+	// expired sessions are never fulfilled
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: common.HexToAddress("0xbb"), Quantity: 10,
+		ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	if _, err := fake.Expire(checkout.ID); err != nil {
+		t.Fatalf("failed to expire: %v", err)
+	}
+	if p, err := st.Payment(checkout.ID); err != nil || p.State != storage.PaymentExpired {
+		t.Fatalf("unexpected expired payment %+v (%v)", p, err)
+	}
+	if _, err := fake.Pay(checkout.ID, "buyer@example.com"); err == nil {
+		t.Fatalf("expected error paying an expired session")
+	}
+}
+
+func TestFakeBackendDailyLimits(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	s, err := NewStripeClient("sk_test_fake", "prod_fake", "whsec_fake", 100, &faucet.Faucet{Signer: signer, Storage: st}, st)
+	if err != nil {
+		t.Fatalf("failed to create stripe client: %v", err)
+	}
+	s.Limits.DailyLimit = 200
+	prices, err := pricing.ParseCatalog("eur", DefaultFakePrices)
+	if err != nil {
+		t.Fatalf("failed to parse prices: %v", err)
+	}
+	fake := NewFakeBackend(prices)
+	s.UseFakeBackend(fake)
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+	defer fake.Wait()
+
+	// the open checkouts count towards the daily limit, until they expire
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	checkout, err := s.CreateCheckout(&payment.CheckoutRequest{Recipient: addr, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	if _, err := s.CreateCheckout(&payment.CheckoutRequest{Recipient: addr, Quantity: 150,
+		ReturnURL: "http://localhost"}); !errors.Is(err, ErrDailyLimitExceeded) {
+		t.Fatalf("expected daily limit exceeded by the open checkout, got %v", err)
+	}
+	if _, err := fake.Expire(checkout.ID); err != nil {
+		t.Fatalf("failed to expire: %v", err)
+	}
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: addr, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("expected the expired checkout not to count, got %v", err)
+	}
+
+	// the buyer email known once paid is checked before fulfilling, whatever the recipient
+	if _, err := fake.Pay(checkout.ID, "buyer@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if p, err := st.Payment(checkout.ID); err != nil || p.State != storage.PaymentFulfilled {
+		t.Fatalf("unexpected payment %+v (%v)", p, err)
+	}
+	other := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	checkout, err = s.CreateCheckout(&payment.CheckoutRequest{Recipient: other, Quantity: 150, ReturnURL: "http://localhost"})
+	if err != nil {
+		t.Fatalf("failed to create checkout: %v", err)
+	}
+	if _, err := fake.Pay(checkout.ID, "Buyer@example.com"); err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	if p, err := st.Payment(checkout.ID); err != nil || p.State != storage.PaymentPaid || len(p.Package) != 0 {
+		t.Fatalf("expected the payment over the buyer limit not to be fulfilled: %+v (%v)", p, err)
+	}
+	if _, err := s.Fulfiller.Fulfill(s, checkout.ID); !errors.Is(err, ErrDailyLimitExceeded) {
+		t.Fatalf("expected daily limit exceeded by the buyer, got %v", err)
+	}
+	// its tokens are not held for as long as the ones of gifts
+	reservations, err := st.Reservations()
+	if err != nil || len(reservations) != 1 || reservations[0].ID != checkout.ID ||
+		reservations[0].ExpiresAt.After(time.Now().Add(paidReservationTTL)) {
+		t.Fatalf("unexpected reservations %+v (%v)", reservations, err)
+	}
+}
@@ -1,16 +1,28 @@
 package stripehandler
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/faucet"
 	hr "github.com/vocdoni/vocfaucet/handlersresponse"
 	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/reconcile"
+	"github.com/vocdoni/vocfaucet/storage"
 	"go.vocdoni.io/dvote/httprouter"
 	"go.vocdoni.io/dvote/httprouter/apirest"
 	"go.vocdoni.io/dvote/log"
+	"go.vocdoni.io/dvote/types"
 )
 
 // Register the handlers URLs
@@ -33,6 +45,42 @@ func (s *StripeHandler) RegisterHandlers(api *apirest.API) {
 		log.Fatal(err)
 	}
 
+	if err := api.RegisterMethod(
+		"/createGiftCheckoutSession",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.createCheckoutSession,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/createGiftCheckoutSession/{amount}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.createCheckoutSession,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/redeemGift/{session_id}/{token}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.redeemGift,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/refundGift/{session_id}/{refund_token}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.refundGift,
+	); err != nil {
+		log.Fatal(err)
+	}
+
 	if err := api.RegisterMethod(
 		"/sessionStatus/{session_id}",
 		"GET",
@@ -42,6 +90,123 @@ func (s *StripeHandler) RegisterHandlers(api *apirest.API) {
 		log.Fatal(err)
 	}
 
+	if err := api.RegisterMethod(
+		"/sessionStatus/{session_id}/{refund_token}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.retrieveCheckoutSession,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeLimits",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.purchaseLimits,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeLimits/{to}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.purchaseLimits,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripePrices",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.priceTiers,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeQuote/{amount}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.quote,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeQuote/{amount}/{currency}",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.quote,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripePaymentLinks",
+		"GET",
+		apirest.MethodAccessTypePublic,
+		s.paymentLinks,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/createSubscriptionCheckoutSession/{to}/{amount}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.createSubscriptionCheckoutSession,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeSubscriptions",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.subscriptions,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeSubscriptionClaim/{subscription_id}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.claimSubscription,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripePurchases",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.purchases,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeReceipt/{session_id}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.receipt,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeReceipt/{session_id}/{format}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.receipt,
+	); err != nil {
+		log.Fatal(err)
+	}
+
 	if err := api.RegisterMethod(
 		"/webhook",
 		"POST",
@@ -50,94 +215,631 @@ func (s *StripeHandler) RegisterHandlers(api *apirest.API) {
 	); err != nil {
 		log.Fatal(err)
 	}
+
+	if s.Fake == nil {
+		return
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeFake/pay/{session_id}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.fakePay,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/stripeFake/expire/{session_id}",
+		"POST",
+		apirest.MethodAccessTypePublic,
+		s.fakeExpire,
+	); err != nil {
+		log.Fatal(err)
+	}
 }
 
-// createCheckoutSession creates a new Stripe Checkout session
+// RegisterAdminHandlers registers the admin URLs, which require the API admin token
+func (s *StripeHandler) RegisterAdminHandlers(api *apirest.API) {
+	if err := api.RegisterMethod(
+		"/admin/stripeReconciliation/{from}/{to}",
+		"GET",
+		apirest.MethodAccessTypeAdmin,
+		s.reconciliation,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/admin/stripeReconciliation/{from}/{to}/{format}",
+		"GET",
+		apirest.MethodAccessTypeAdmin,
+		s.reconciliation,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if s.Queue == nil {
+		return
+	}
+
+	if err := api.RegisterMethod(
+		"/admin/webhookJobs",
+		"GET",
+		apirest.MethodAccessTypeAdmin,
+		s.webhookJobs,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/admin/webhookJobs/{state}",
+		"GET",
+		apirest.MethodAccessTypeAdmin,
+		s.webhookJobs,
+	); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := api.RegisterMethod(
+		"/admin/webhookJobs/{id}/retry",
+		"POST",
+		apirest.MethodAccessTypeAdmin,
+		s.retryWebhookJob,
+	); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// createCheckoutSession creates a new Stripe Checkout session, for a gift if there is no recipient.
+// Embedded sessions return the client secret, hosted sessions the URL to redirect the customer to.
 func (s *StripeHandler) createCheckoutSession(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
-	to := ctx.URLParam("to")
+	gift := ctx.URLParam("to") == ""
+	var addr common.Address
+	if !gift {
+		var err error
+		if addr, err = helpers.StringToAddress(ctx.URLParam("to")); err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+	}
+	var err error
 	defaultAmount := s.DefaultAmount
 	if amount := ctx.URLParam("amount"); amount != "" {
-		var err error
 		defaultAmount, err = strconv.ParseInt(amount, 10, 64)
 		if err != nil {
 			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
 		}
 	}
 	type r struct {
-		ReturnURL string `json:"returnURL"`
-		Referral  string `json:"referral"`
+		ReturnURL  string `json:"returnURL"`
+		Referral   string `json:"referral"`
+		UIMode     string `json:"uiMode"`
+		SuccessURL string `json:"successURL"`
+		CancelURL  string `json:"cancelURL"`
+		Currency   string `json:"currency"`
+		Email      string `json:"email"`
 	}
 	newRequest := r{}
 	if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
 	}
-	sess, err := s.CreateCheckoutSession(defaultAmount, to, newRequest.ReturnURL, newRequest.Referral)
+	currency, err := s.requestCurrency(ctx, newRequest.Currency)
 	if err != nil {
+		return sendCurrencyError(ctx, err)
+	}
+	switch newRequest.UIMode {
+	case "", UIModeEmbedded:
+	case UIModeHosted:
+		if newRequest.SuccessURL == "" {
+			return ctx.Send(new(hr.HandlerResponse).SetError("missing successURL").MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+	default:
+		errReason := fmt.Sprintf("invalid uiMode %q", newRequest.UIMode)
+		return ctx.Send(new(hr.HandlerResponse).SetError(errReason).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	checkout, err := s.CreateCheckout(&payment.CheckoutRequest{
+		Recipient:  addr,
+		Quantity:   defaultAmount,
+		ReturnURL:  newRequest.ReturnURL,
+		Referral:   newRequest.Referral,
+		Gift:       gift,
+		Hosted:     newRequest.UIMode == UIModeHosted,
+		SuccessURL: newRequest.SuccessURL,
+		CancelURL:  newRequest.CancelURL,
+		Currency:   currency,
+		Email:      newRequest.Email,
+	})
+	switch {
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case errors.Is(err, ErrQuantityOutOfRange):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrQuantityOutOfRange)
+	case errors.Is(err, ErrDailyLimitExceeded):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrDailyLimitExceeded)
+	case errors.Is(err, faucet.ErrInsufficientFunds):
+		log.Warnw("refused stripe checkout", "amount", defaultAmount, "err", err)
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrInsufficientFunds).MustMarshall(), hr.CodeErrInsufficientFunds)
+	case err != nil:
 		errReason := fmt.Sprintf("session.New: %v", err)
 		return ctx.Send(new(hr.HandlerResponse).SetError(errReason).MustMarshall(), hr.CodeErrProviderError)
 	}
-	if sess == nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError("session.New: nil session").MustMarshall(), hr.CodeErrProviderError)
+	// the claim of gifts is only returned here, to the buyer, which can get it again with the
+	// refund token
+	data := &struct {
+		ClientSecret string `json:"clientSecret,omitempty"`
+		URL          string `json:"url,omitempty"`
+		SessionID    string `json:"sessionId"`
+		RefundToken  string `json:"refundToken,omitempty"` // Only for gifts, to refund them once expired.
+		GiftToken    string `json:"giftToken,omitempty"`
+		GiftLink     string `json:"giftLink,omitempty"`
+	}{
+		ClientSecret: checkout.ClientSecret,
+		URL:          checkout.URL,
+		SessionID:    checkout.ID,
+		RefundToken:  checkout.RefundToken,
+		GiftToken:    checkout.GiftToken,
+	}
+	if checkout.GiftToken != "" {
+		data.GiftLink = s.giftLink(checkout.ID, checkout.GiftToken)
 	}
+	return ctx.Send(new(hr.HandlerResponse).Set(data).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// purchaseLimits returns the purchase limits and the default quantity. When there is a daily
+// limit, it also returns when it is reset, at the next midnight UTC, and if a recipient is
+// given, the tokens it can still buy until then.
+func (s *StripeHandler) purchaseLimits(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	data := &struct {
-		ClientSecret string `json:"clientSecret"`
+		PurchaseLimits
+		DefaultQuantity int64      `json:"defaultQuantity"`
+		DailyResetAt    *time.Time `json:"dailyResetAt,omitempty"`
+		DailyRemaining  *uint64    `json:"dailyRemaining,omitempty"`
 	}{
-		ClientSecret: sess.ClientSecret,
+		PurchaseLimits:  s.Limits,
+		DefaultQuantity: s.DefaultAmount,
+	}
+	if s.Limits.DailyLimit > 0 {
+		resetAt := time.Now().UTC().Truncate(dailyLimitPeriod).Add(dailyLimitPeriod)
+		data.DailyResetAt = &resetAt
+	}
+	if to := ctx.URLParam("to"); to != "" && s.Limits.DailyLimit > 0 {
+		addr, err := helpers.StringToAddress(to)
+		if err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+		bought, err := s.Storage.BudgetSpent(dailyBudgetName(addr.Hex()), dailyLimitPeriod)
+		if err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+		}
+		remaining := uint64(0)
+		if bought < s.Limits.DailyLimit {
+			remaining = s.Limits.DailyLimit - bought
+		}
+		data.DailyRemaining = &remaining
 	}
 	return ctx.Send(new(hr.HandlerResponse).Set(data).MustMarshall(), apirest.HTTPstatusOK)
 }
 
+// priceTiers returns the price tiers of the product by currency, and the default currency.
+func (s *StripeHandler) priceTiers(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	catalog, err := s.PriceCatalog()
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(catalog).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// quote returns the exact price of the requested amount of tokens, as it would be charged by
+// the checkout session, in the requested currency or the one of the client.
+func (s *StripeHandler) quote(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	amount, err := strconv.ParseInt(ctx.URLParam("amount"), 10, 64)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	if err := s.Limits.CheckQuantity(amount); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrQuantityOutOfRange)
+	}
+	currency, err := s.requestCurrency(ctx, ctx.URLParam("currency"))
+	if err != nil {
+		return sendCurrencyError(ctx, err)
+	}
+	quote, err := s.Quote(amount, currency)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(quote).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// requestCurrency returns the currency of a purchase request, the requested one if any, or the
+// one of the client country, as set in the countryHeader by the proxy, or of the client
+// Accept-Language header otherwise.
+func (s *StripeHandler) requestCurrency(ctx *httprouter.HTTPContext, currency string) (string, error) {
+	return s.ResolveCurrency(currency, ctx.Request.Header.Get(countryHeader), ctx.Request.Header.Get("Accept-Language"))
+}
+
+// sendCurrencyError sends the response of a currency that could not be resolved
+func sendCurrencyError(ctx *httprouter.HTTPContext, err error) error {
+	if errors.Is(err, pricing.ErrUnknownCurrency) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrUnknownCurrency)
+	}
+	return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+}
+
+// paymentLinks returns the payment links accepted by the faucet, which sell fixed packages of
+// tokens. Their purchases are fulfilled like the checkout sessions created by the faucet.
+func (s *StripeHandler) paymentLinks(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	links, err := s.AcceptedPaymentLinks()
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(links).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// retrieveCheckoutSession returns the status of a checkout session. Once Stripe reports the
+// session as complete and paid, the faucet package is issued and stored with the payment, so
+// it is issued only once and the following requests return the same package. The claim of
+// gifts is only returned along with the refund token, since anyone may know the session ID.
 func (s *StripeHandler) retrieveCheckoutSession(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	s.SessionLock.Lock()
 	defer s.SessionLock.Unlock()
-	sessionId := ctx.URLParam("session_id")
-	status, err := s.RetrieveCheckoutSession(sessionId)
-	if err != nil {
+	status, err := s.Fulfiller.Fulfill(s, ctx.URLParam("session_id"))
+	if errors.Is(err, payment.ErrProvider) {
 		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
 	}
-	_, err = s.Storage.Get([]byte(sessionId))
+	if errors.Is(err, ErrDailyLimitExceeded) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrDailyLimitExceeded)
+	}
 	if err != nil {
 		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
 	}
-	data, err := s.processPaymentTransfer(status.Quantity, status.Recipient)
+	if refundToken := ctx.URLParam("refund_token"); status.Gift != nil && refundToken != "" {
+		claim, err := s.Fulfiller.GiftClaim(status.Gift.ID, refundToken)
+		if err != nil {
+			return sendGiftError(ctx, err)
+		}
+		claim.Link = s.giftLink(claim.ID, claim.Token)
+		status.Gift = claim
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(status).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// giftLink returns the claim link of the gift with the given ID and token, if there is a gift
+// URL.
+func (s *StripeHandler) giftLink(id, token string) string {
+	if s.GiftURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.GiftURL, "/"), id, token)
+}
+
+// redeemGift issues the faucet package of a paid gift to the address in the request
+func (s *StripeHandler) redeemGift(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	newRequest := struct {
+		Address string `json:"address"`
+	}{}
+	if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	addr, err := helpers.StringToAddress(newRequest.Address)
 	if err != nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
 	}
-	if err := s.Storage.Delete([]byte(sessionId)); err != nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	s.SessionLock.Lock()
+	defer s.SessionLock.Unlock()
+	status, err := s.Fulfiller.RedeemGift(s, ctx.URLParam("session_id"), ctx.URLParam("token"), addr)
+	if err != nil {
+		return sendGiftError(ctx, err)
 	}
-	status.FaucetPackage = data
 	return ctx.Send(new(hr.HandlerResponse).Set(status).MustMarshall(), apirest.HTTPstatusOK)
 }
 
-func (s *StripeHandler) handleWebhook(apiData *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+// refundGift refunds an expired gift that was never redeemed, for the buyer with its refund token
+func (s *StripeHandler) refundGift(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
 	s.SessionLock.Lock()
 	defer s.SessionLock.Unlock()
-	sig := ctx.Request.Header.Get("Stripe-Signature")
-	// Pass the request body and Stripe-Signature header to ConstructEvent, along with the webhook signing key
-	sessionId, err := s.HandleWebhook(apiData, sig)
+	status, err := s.Fulfiller.RefundGift(s, ctx.URLParam("session_id"), ctx.URLParam("refund_token"))
 	if err != nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), http.StatusBadRequest)
+		return sendGiftError(ctx, err)
 	}
-	err = s.Storage.Set([]byte(sessionId), nil)
+	return ctx.Send(new(hr.HandlerResponse).Set(status).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// sendGiftError sends the response of a failed gift operation
+func sendGiftError(ctx *httprouter.HTTPContext, err error) error {
+	switch {
+	case errors.Is(err, payment.ErrGiftNotFound):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrGiftNotFound)
+	case errors.Is(err, payment.ErrGiftExpired):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrGiftExpired)
+	case errors.Is(err, payment.ErrGiftNotAvailable), errors.Is(err, payment.ErrGiftNotExpired):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrGiftNotAvailable)
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case errors.Is(err, ErrDailyLimitExceeded):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrDailyLimitExceeded)
+	case errors.Is(err, payment.ErrProvider):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+}
+
+// createSubscriptionCheckoutSession creates a new Stripe Checkout session for a subscription
+// that credits the given monthly allowance to the recipient. The request body and the response
+// are the same as in createCheckoutSession.
+func (s *StripeHandler) createSubscriptionCheckoutSession(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, err := helpers.StringToAddress(ctx.URLParam("to"))
 	if err != nil {
-		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), http.StatusBadRequest)
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
 	}
-	return ctx.Send([]byte("success"), http.StatusOK)
+	allowance, err := strconv.ParseInt(ctx.URLParam("amount"), 10, 64)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	newRequest := struct {
+		ReturnURL  string `json:"returnURL"`
+		UIMode     string `json:"uiMode"`
+		SuccessURL string `json:"successURL"`
+		CancelURL  string `json:"cancelURL"`
+		Currency   string `json:"currency"`
+	}{}
+	if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	currency, err := s.requestCurrency(ctx, newRequest.Currency)
+	if err != nil {
+		return sendCurrencyError(ctx, err)
+	}
+	sess, err := s.CreateSubscriptionCheckoutSession(allowance, addr, currency, newRequest.UIMode,
+		newRequest.ReturnURL, newRequest.SuccessURL, newRequest.CancelURL)
+	switch {
+	case errors.Is(err, ErrQuantityOutOfRange):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrQuantityOutOfRange)
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(struct {
+		ClientSecret string `json:"clientSecret,omitempty"`
+		URL          string `json:"url,omitempty"`
+		SessionID    string `json:"sessionId"`
+	}{sess.ClientSecret, sess.URL, sess.ID}).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// subscriptions returns the subscriptions of the address that signed the request.
+func (s *StripeHandler) subscriptions(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, ok := verifySignedRequest(msg, ctx, subscriptionsMessage)
+	if !ok {
+		return nil
+	}
+	subscriptions, err := s.Storage.Subscriptions(addr.Hex())
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(struct {
+		Subscriptions []*storage.Subscription `json:"subscriptions"`
+	}{subscriptions}).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// claimSubscription issues a faucet package with the available allowance of a subscription
+// to its subscriber, which must have signed the request.
+func (s *StripeHandler) claimSubscription(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, ok := verifySignedRequest(msg, ctx, subscriptionsMessage)
+	if !ok {
+		return nil
+	}
+	s.SessionLock.Lock()
+	defer s.SessionLock.Unlock()
+	claim, err := s.ClaimSubscription(ctx.URLParam("subscription_id"), addr)
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrSubscriptionNotFound)
+	case errors.Is(err, ErrNothingToClaim):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrNothingToClaim)
+	case errors.Is(err, payment.ErrDenylisted):
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrDenylisted).MustMarshall(), hr.CodeErrDenylisted)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(claim).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// signedRequest authenticates the recipient of the purchases or the subscriber by the signature
+// of the request data, a JSON object with the expected message and the unix timestamp of the
+// request.
+type signedRequest struct {
+	Data      string         `json:"data"`
+	Signature types.HexBytes `json:"signature"`
+}
+
+// verifySignedRequest returns the address that signed the request in the given body with the
+// given message, or sends the error response and returns false.
+func verifySignedRequest(msg *apirest.APIdata, ctx *httprouter.HTTPContext, message string) (common.Address, bool) {
+	req := signedRequest{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		return common.Address{}, false
+	}
+	addr, err := helpers.VerifySignedRequest(req.Data, req.Signature, message, signedRequestMaxAge)
+	if err != nil {
+		_ = ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrSignature)
+		return common.Address{}, false
+	}
+	return addr, true
+}
+
+// purchases returns the customer records and the purchases of the address that signed the request.
+// Only the purchases sent to the address are returned, the buyer emails are not verified.
+func (s *StripeHandler) purchases(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	addr, ok := verifySignedRequest(msg, ctx, purchasesMessage)
+	if !ok {
+		return nil
+	}
+	customers, err := s.Storage.Customers(addr.Hex())
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	payments, err := s.Storage.RecipientPayments(addr.Hex())
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	purchases := make([]*payment.Receipt, 0, len(payments))
+	for _, p := range payments {
+		purchases = append(purchases, payment.NewReceipt(s.Name(), p))
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(struct {
+		Customers []*storage.Customer `json:"customers"`
+		Purchases []*payment.Receipt  `json:"purchases"`
+	}{customers, purchases}).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// receipt returns the receipt of a purchase signed by the faucet, to the recipient that signed the
+// request. The receipt is returned as JSON, or as a base64 encoded PDF document if the format is pdf.
+func (s *StripeHandler) receipt(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	format := ctx.URLParam("format")
+	if format != "" && format != "json" && format != "pdf" {
+		return ctx.Send(new(hr.HandlerResponse).SetError("format must be json or pdf").MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	addr, ok := verifySignedRequest(msg, ctx, purchasesMessage)
+	if !ok {
+		return nil
+	}
+	p, err := s.Storage.Payment(ctx.URLParam("session_id"))
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && !strings.EqualFold(p.Recipient, addr.Hex())) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(hr.ReasonErrPurchaseNotFound).MustMarshall(), hr.CodeErrPurchaseNotFound)
+	}
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	signed, err := payment.NewReceipt(s.Name(), p).Sign(s.Faucet.Signer)
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	if format != "pdf" {
+		return ctx.Send(new(hr.HandlerResponse).Set(signed).MustMarshall(), apirest.HTTPstatusOK)
+	}
+	pdf, err := signed.PDF()
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+		Data        []byte `json:"data"`
+	}{"receipt-" + p.ID + ".pdf", "application/pdf", pdf}).MustMarshall(), apirest.HTTPstatusOK)
 }
 
-func (s *StripeHandler) processPaymentTransfer(amount int64, to string) ([]byte, error) {
-	if amount == 0 {
-		return nil, fmt.Errorf("invalid requested amount")
+// reconciliation returns the reconciliation report of the checkout sessions created within the
+// given dates, formatted as 2006-01-02 and both included. The report is returned as JSON, or
+// as a base64 encoded CSV document if the format is csv.
+func (s *StripeHandler) reconciliation(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	format := ctx.URLParam("format")
+	if format != "" && format != reconcile.FormatJSON && format != reconcile.FormatCSV {
+		return ctx.Send(new(hr.HandlerResponse).SetError("format must be json or csv").MustMarshall(), hr.CodeErrIncorrectParams)
 	}
-	addr, err := helpers.StringToAddress(to)
+	from, to, err := reconcile.ParseRange(ctx.URLParam("from"), ctx.URLParam("to"))
 	if err != nil {
-		return nil, err
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	report, err := reconcile.Generate(s, s.Storage, from, to)
+	if errors.Is(err, reconcile.ErrInvalidRange) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	if err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrProviderError)
+	}
+	if format != reconcile.FormatCSV {
+		return ctx.Send(new(hr.HandlerResponse).Set(report).MustMarshall(), apirest.HTTPstatusOK)
+	}
+	data := &bytes.Buffer{}
+	if err := report.Write(data, reconcile.FormatCSV); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+		Data        []byte `json:"data"`
+	}{
+		fmt.Sprintf("stripe-reconciliation-%s-%s.csv", ctx.URLParam("from"), ctx.URLParam("to")),
+		"text/csv",
+		data.Bytes(),
+	}).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// webhookJobs returns the webhook jobs in the requested state, or all of them, and the number
+// of jobs in each state.
+func (s *StripeHandler) webhookJobs(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	state := storage.WebhookJobState(ctx.URLParam("state"))
+	switch state {
+	case "", storage.WebhookJobPending, storage.WebhookJobDone, storage.WebhookJobDead:
+	default:
+		errReason := fmt.Sprintf("invalid webhook job state %q", state)
+		return ctx.Send(new(hr.HandlerResponse).SetError(errReason).MustMarshall(), hr.CodeErrIncorrectParams)
 	}
-	data, err := s.Faucet.PrepareFaucetPackageWithAmount(addr, uint64(amount))
+	status, err := s.Queue.Status(state)
 	if err != nil {
-		return nil, err
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
 	}
+	return ctx.Send(new(hr.HandlerResponse).Set(status).MustMarshall(), apirest.HTTPstatusOK)
+}
 
-	return data.FaucetPackage, nil
+// retryWebhookJob moves a dead-lettered webhook job back to the queue.
+func (s *StripeHandler) retryWebhookJob(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	job, err := s.Queue.Retry(ctx.URLParam("id"))
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return ctx.Send(new(hr.HandlerResponse).SetError("webhook job not found").MustMarshall(), hr.CodeErrIncorrectParams)
+	case errors.Is(err, payment.ErrWebhookJobNotDead):
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+	case err != nil:
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(job).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// fakePay pays a checkout session of the fake Stripe backend, as the customer in the email of
+// the request body, if any, and delivers its webhook events, like the Stripe checkout page.
+func (s *StripeHandler) fakePay(msg *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	newRequest := struct {
+		Email string `json:"email"`
+	}{}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, &newRequest); err != nil {
+			return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrIncorrectParams)
+		}
+	}
+	if newRequest.Email == "" {
+		newRequest.Email = "customer@example.com"
+	}
+	sess, err := s.Fake.Pay(ctx.URLParam("session_id"), newRequest.Email)
+	if err != nil {
+		return sendFakeError(ctx, err)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(sess).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// fakeExpire expires a checkout session of the fake Stripe backend and delivers its webhook
+// event.
+func (s *StripeHandler) fakeExpire(_ *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	sess, err := s.Fake.Expire(ctx.URLParam("session_id"))
+	if err != nil {
+		return sendFakeError(ctx, err)
+	}
+	return ctx.Send(new(hr.HandlerResponse).Set(sess).MustMarshall(), apirest.HTTPstatusOK)
+}
+
+// sendFakeError sends the response of a failed fake Stripe backend operation
+func sendFakeError(ctx *httprouter.HTTPContext, err error) error {
+	stripeErr := &stripe.Error{}
+	if errors.As(err, &stripeErr) {
+		return ctx.Send(new(hr.HandlerResponse).SetError(stripeErr.Msg).MustMarshall(), hr.CodeErrIncorrectParams)
+	}
+	return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), hr.CodeErrInternalError)
+}
+
+func (s *StripeHandler) handleWebhook(apiData *apirest.APIdata, ctx *httprouter.HTTPContext) error {
+	if err := s.HandleWebhook(apiData.Data, ctx.Request.Header); err != nil {
+		return ctx.Send(new(hr.HandlerResponse).SetError(err.Error()).MustMarshall(), http.StatusBadRequest)
+	}
+	return ctx.Send([]byte("success"), http.StatusOK)
 }
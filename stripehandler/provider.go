@@ -0,0 +1,213 @@
+package stripehandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+// ErrInvalidWebhook is returned when a webhook request cannot be verified.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// check that StripeHandler implements the payment.Provider, payment.Refunder and
+// payment.FulfillmentCheck interfaces
+var (
+	_ payment.Provider         = (*StripeHandler)(nil)
+	_ payment.Refunder         = (*StripeHandler)(nil)
+	_ payment.FulfillmentCheck = (*StripeHandler)(nil)
+)
+
+// Name returns the name of the provider.
+func (s *StripeHandler) Name() string {
+	return faucet.AuthTypeStripe
+}
+
+// CreateCheckout creates a Stripe checkout session for the purchase and stores its payment.
+// Gifts have no recipient until they are redeemed. The tokens are reserved until the session
+// expires, and the checkout is refused with faucet.ErrInsufficientFunds if they cannot be.
+// Denylisted recipients and buyer emails are refused, the buyers are checked again once paid.
+// The quantity is counted in the daily limits of the recipient and the buyer email when the
+// checkout is created, so concurrent checkouts cannot exceed them, until the session expires.
+func (s *StripeHandler) CreateCheckout(req *payment.CheckoutRequest) (*payment.Checkout, error) {
+	if err := payment.CheckBuyerDenylist(s.Storage, "", req.Email); err != nil {
+		return nil, err
+	}
+	to := ""
+	var gift *storage.Gift
+	if req.Gift {
+		var err error
+		if gift, err = payment.NewGift(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := payment.CheckDenylist(s.Storage, req.Recipient); err != nil {
+			return nil, err
+		}
+		to = req.Recipient.Hex()
+	}
+	if err := s.Limits.CheckQuantity(req.Quantity); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	limits, err := s.reserveDailyLimits(dailyLimitNames(to, "", req.Email), uint64(req.Quantity))
+	if err != nil {
+		return nil, err
+	}
+	p := &storage.Payment{
+		State:       storage.PaymentCreated,
+		Recipient:   to,
+		Quantity:    uint64(req.Quantity),
+		Referral:    req.Referral,
+		Gift:        gift,
+		DailyLimits: limits,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	checkout, err := s.createCheckout(req, p)
+	if err != nil {
+		s.releaseDailyLimits(limits, p.Quantity, now)
+		return nil, err
+	}
+	return checkout, nil
+}
+
+// createCheckout creates the checkout session of the given payment, reserves its tokens and
+// stores the payment with the session ID.
+func (s *StripeHandler) createCheckout(req *payment.CheckoutRequest, p *storage.Payment) (*payment.Checkout, error) {
+	var sess *stripe.CheckoutSession
+	var err error
+	if req.Hosted {
+		sess, err = s.CreateHostedCheckoutSession(req.Quantity, p.Recipient, req.SuccessURL, req.CancelURL, req.Referral, req.Currency, req.Email)
+	} else {
+		sess, err = s.CreateCheckoutSession(req.Quantity, p.Recipient, req.ReturnURL, req.Referral, req.Currency, req.Email)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		return nil, fmt.Errorf("%w: nil session", payment.ErrProvider)
+	}
+	if err := s.Faucet.Reserve(sess.ID, p.Quantity, time.Unix(sess.ExpiresAt, 0)); err != nil {
+		// the client secret is never returned, but expire the session so it cannot be paid
+		if _, expErr := session.Expire(sess.ID, nil); expErr != nil {
+			log.Warnw("failed to expire checkout session", "session", sess.ID, "err", expErr)
+		}
+		return nil, err
+	}
+	p.ID = sess.ID
+	p.Price = sess.AmountTotal
+	p.Currency = string(sess.Currency)
+	if err := s.Storage.SetPayment(p); err != nil {
+		return nil, err
+	}
+	checkout := &payment.Checkout{Payment: p, ID: sess.ID, ClientSecret: sess.ClientSecret, URL: sess.URL}
+	if p.Gift != nil {
+		checkout.RefundToken, checkout.GiftToken = p.Gift.RefundToken, p.Gift.Token
+	}
+	return checkout, nil
+}
+
+// ConfirmPayment returns the status of the checkout session with the given ID.
+func (s *StripeHandler) ConfirmPayment(id string) (*payment.Status, error) {
+	return s.RetrieveCheckoutSession(id)
+}
+
+// HandleWebhook verifies and processes a Stripe event. Events already processed are skipped,
+// since Stripe delivers them at least once. If there is a webhook queue the event is only
+// queued, and processed in the background.
+func (s *StripeHandler) HandleWebhook(body []byte, header http.Header) error {
+	event, err := s.VerifyWebhook(body, header.Get("Stripe-Signature"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	processed, err := s.Storage.CheckWebhookEvent(event.ID)
+	if err != nil {
+		return err
+	}
+	if processed {
+		return nil
+	}
+	if s.Queue != nil {
+		return s.Queue.Enqueue(s.Name(), event.ID, string(event.Type), body)
+	}
+	s.SessionLock.Lock()
+	defer s.SessionLock.Unlock()
+	return s.applyEvent(event)
+}
+
+// SetWebhookQueue makes the webhook events be processed from the given queue, and alerts of
+// the ones dead-lettered.
+func (s *StripeHandler) SetWebhookQueue(q *payment.WebhookQueue) {
+	q.Handle(s.Name(), s.processWebhookJob)
+	q.DeadLetter = func(job *storage.WebhookJob) {
+		s.alert(fmt.Sprintf("stripe %s event %s dead-lettered after %d attempts: %s",
+			job.Type, job.ID, job.Attempts, job.LastError))
+	}
+	s.Queue = q
+}
+
+// processWebhookJob processes a Stripe event queued by HandleWebhook.
+func (s *StripeHandler) processWebhookJob(job *storage.WebhookJob) error {
+	event := &stripe.Event{}
+	if err := json.Unmarshal(job.Payload, event); err != nil {
+		return fmt.Errorf("cannot decode event %s: %w", job.ID, err)
+	}
+	s.SessionLock.Lock()
+	defer s.SessionLock.Unlock()
+	return s.applyEvent(event)
+}
+
+// applyEvent processes the given event and records it as processed. The caller must hold
+// SessionLock.
+func (s *StripeHandler) applyEvent(event *stripe.Event) error {
+	if err := s.processEvent(event); err != nil {
+		return err
+	}
+	if err := s.Storage.AddWebhookEvent(event.ID); err != nil {
+		log.Warnw("failed to record webhook event", "id", event.ID, "err", err)
+	}
+	return nil
+}
+
+// CheckFulfillment counts the given paid payment in the daily limits of its recipient, Stripe
+// customer and buyer email not counted when its checkout was created, such as the customer,
+// only known once paid, or all of them for the checkouts of payment links. It returns
+// ErrDailyLimitExceeded if that exceeds any of them, so the package is not issued and the
+// payment can be refunded instead. Gifts are not counted for the address they are redeemed for.
+func (s *StripeHandler) CheckFulfillment(p *storage.Payment) error {
+	recipient := p.Recipient
+	if p.Gift != nil {
+		recipient = ""
+	}
+	names := []string{}
+	for _, name := range dailyLimitNames(recipient, p.Customer, p.Email) {
+		if !slices.Contains(p.DailyLimits, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	counted, err := s.reserveDailyLimits(names, p.Quantity)
+	if err != nil {
+		return err
+	}
+	if len(counted) == 0 {
+		return nil
+	}
+	// store the counted limits right away, so they are not counted again if the package
+	// cannot be issued now and the payment is fulfilled later
+	p.DailyLimits = append(p.DailyLimits, counted...)
+	p.UpdatedAt = time.Now()
+	return s.Storage.SetPayment(p)
+}
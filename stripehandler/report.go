@@ -0,0 +1,54 @@
+package stripehandler
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/vocdoni/vocfaucet/reconcile"
+)
+
+// check that StripeHandler implements the reconcile.Source interface
+var _ reconcile.Source = (*StripeHandler)(nil)
+
+// Charges returns the complete checkout sessions of the faucet created within [from, to), with
+// the refunds and disputes of their payments. The sessions of other products of the Stripe
+// account, which lack the faucet metadata, and of unknown payment links are skipped.
+func (s *StripeHandler) Charges(from, to time.Time) ([]*reconcile.Charge, error) {
+	params := &stripe.CheckoutSessionListParams{
+		CreatedRange: &stripe.RangeQueryParams{
+			GreaterThanOrEqual: from.Unix(),
+			LesserThan:         to.Unix(),
+		},
+		Status: stripe.String(string(stripe.CheckoutSessionStatusComplete)),
+	}
+	params.AddExpand("data.payment_intent.latest_charge")
+	var charges []*reconcile.Charge
+	iter := session.List(params)
+	for iter.Next() {
+		sess := iter.CheckoutSession()
+		if sess.PaymentLink != nil {
+			if _, ok := s.PaymentLinks[sess.PaymentLink.ID]; !ok {
+				continue
+			}
+		} else if _, ok := sess.Metadata["to"]; !ok {
+			continue
+		}
+		charge := &reconcile.Charge{
+			ID:        sess.ID,
+			Paid:      sess.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid,
+			Amount:    sess.AmountTotal,
+			Currency:  string(sess.Currency),
+			CreatedAt: time.Unix(sess.Created, 0),
+		}
+		if pi := sess.PaymentIntent; pi != nil {
+			charge.PaymentID = pi.ID
+			if pi.LatestCharge != nil {
+				charge.AmountRefunded = pi.LatestCharge.AmountRefunded
+				charge.Disputed = pi.LatestCharge.Disputed
+			}
+		}
+		charges = append(charges, charge)
+	}
+	return charges, iter.Err()
+}
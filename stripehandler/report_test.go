@@ -0,0 +1,112 @@
+package stripehandler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/reconcile"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+// checkoutSessionJSON returns a complete checkout session as listed by the Stripe API.
+func checkoutSessionJSON(id string, created int64, paymentStatus, metadata string, refunded int64) string {
+	return fmt.Sprintf(`{"id":%q,"object":"checkout.session","created":%d,"status":"complete",`+
+		`"payment_status":%q,"amount_total":500,"currency":"eur","metadata":%s,`+
+		`"payment_intent":{"id":"pi_%s","object":"payment_intent",`+
+		`"latest_charge":{"id":"ch_%s","object":"charge","amount_refunded":%d,"disputed":false}}}`,
+		id, created, paymentStatus, metadata, id, id, refunded)
+}
+
+func TestReconciliation(t *testing.T) {
+	now := time.Now()
+	to := "0x0000000000000000000000000000000000000001"
+	meta := fmt.Sprintf(`{"to":%q}`, to)
+	sessions := []string{
+		checkoutSessionJSON("cs_ok", now.Unix(), "paid", meta, 0),
+		checkoutSessionJSON("cs_unfulfilled", now.Unix(), "paid", meta, 0),
+		checkoutSessionJSON("cs_refunded", now.Unix(), "paid", meta, 500),
+		checkoutSessionJSON("cs_other", now.Unix(), "paid", `{}`, 0),
+	}
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/checkout/sessions" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		fmt.Fprintf(w, `{"object":"list","url":"/v1/checkout/sessions","has_more":false,"data":[%s]}`,
+			strings.Join(sessions, ","))
+	}))
+	defer server.Close()
+	stripe.Key = "sk_test_reconciliation"
+	SetAPIURL(server.URL)
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	st := storage.NewMemory(time.Hour)
+	for id, state := range map[string]storage.PaymentState{
+		"cs_ok":          storage.PaymentFulfilled,
+		"cs_unfulfilled": storage.PaymentPaid,
+		"cs_refunded":    storage.PaymentRefunded,
+		"cs_ghost":       storage.PaymentCreated,
+	} {
+		if err := st.SetPayment(&storage.Payment{
+			ID: id, State: state, Recipient: to, Quantity: 100, Price: 500, Currency: "eur", CreatedAt: now,
+		}); err != nil {
+			t.Fatalf("failed to set payment: %v", err)
+		}
+	}
+	for _, id := range []string{"cs_ok", "cs_refunded", "cs_ghost"} {
+		if err := st.AddLedgerEntry(&storage.LedgerEntry{
+			Time: now, Recipient: to, Amount: 100, AuthType: faucet.AuthTypeStripe, Reference: id,
+		}); err != nil {
+			t.Fatalf("failed to add ledger entry: %v", err)
+		}
+	}
+
+	s := &StripeHandler{Storage: st}
+	report, err := reconcile.Generate(s, st, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to generate report: %v", err)
+	}
+	if !strings.Contains(query, "created") || !strings.Contains(query, "status=complete") {
+		t.Fatalf("unexpected list query %q", query)
+	}
+	rows := make(map[string]*reconcile.Row)
+	for _, row := range report.Rows {
+		rows[row.ID] = row
+	}
+	if len(rows) != 4 || rows["cs_other"] != nil {
+		t.Fatalf("unexpected report rows %+v", rows)
+	}
+	for id, expected := range map[string]string{
+		"cs_ok":          "",
+		"cs_unfulfilled": reconcile.MismatchUnfulfilled,
+		"cs_refunded":    "",
+		"cs_ghost":       reconcile.MismatchUnpaid,
+	} {
+		if got := strings.Join(rows[id].Mismatches, ";"); got != expected {
+			t.Fatalf("%s: expected mismatches %q, got %q", id, expected, got)
+		}
+	}
+	if rows["cs_refunded"].Refund != "full" || rows["cs_ok"].Issued != 100 || rows["cs_ok"].PaymentID != "pi_cs_ok" {
+		t.Fatalf("unexpected rows %+v %+v", rows["cs_refunded"], rows["cs_ok"])
+	}
+	if total := report.Totals["eur"]; report.Mismatches != 2 || total.Charged != 1500 || total.Refunded != 500 || total.Issued != 300 {
+		t.Fatalf("unexpected totals %+v (%d mismatches)", total, report.Mismatches)
+	}
+
+	csv := &bytes.Buffer{}
+	if err := report.Write(csv, reconcile.FormatCSV); err != nil {
+		t.Fatalf("failed to write csv: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(csv.String()), "\n"); len(lines) != 5 || !strings.HasPrefix(lines[0], "id,") {
+		t.Fatalf("unexpected csv report %q", csv.String())
+	}
+}
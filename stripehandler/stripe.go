@@ -1,46 +1,145 @@
 package stripehandler
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/checkout/session"
-	"github.com/stripe/stripe-go/v81/price"
+	"github.com/stripe/stripe-go/v81/paymentlink"
+	"github.com/stripe/stripe-go/v81/refund"
 	"github.com/stripe/stripe-go/v81/webhook"
 	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/helpers"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/pricing"
 	"github.com/vocdoni/vocfaucet/storage"
-	"go.vocdoni.io/dvote/httprouter/apirest"
+	"go.vocdoni.io/dvote/log"
 )
 
+// dailyLimitPeriod is the period of the per recipient and per buyer purchase limits. The
+// budgets are counted in fixed windows, so the limits are reset at midnight UTC.
+const dailyLimitPeriod = 24 * time.Hour
+
+// purchasesMessage is the message that recipients sign to list their purchases and download
+// their receipts, subscriptionsMessage the one subscribers sign to list and claim their
+// subscriptions, and signedRequestMaxAge the maximum age of the signed requests.
+const (
+	purchasesMessage     = "vocfaucet purchases"
+	subscriptionsMessage = "vocfaucet subscriptions"
+	signedRequestMaxAge  = 10 * time.Minute
+)
+
+// RefundMetadataKey is the metadata key of the refunds made by the faucet, such as the ones of
+// the gifts never redeemed, which are not a sign of fraud, so their buyers are not denylisted
+// when Stripe notifies them. Operators set it on the refunds they make on purpose from the
+// Stripe dashboard too.
+const RefundMetadataKey = "vocfaucet_refund"
+
+// countryHeader is the request header with the client country, set by the proxy in front of
+// the faucet, used to choose the checkout currency when the client does not request one.
+const countryHeader = "CF-IPCountry"
+
+// The Stripe Checkout UI modes. Embedded checkouts are rendered by the client with Stripe.js,
+// hosted checkouts redirect the customer to a Stripe page.
+const (
+	UIModeEmbedded = "embedded"
+	UIModeHosted   = "hosted"
+)
+
+var (
+	// ErrQuantityOutOfRange is returned when the requested quantity is out of the configured range.
+	ErrQuantityOutOfRange = errors.New("quantity out of range")
+	// ErrDailyLimitExceeded is returned when the recipient or the buyer would exceed its daily
+	// purchase limit.
+	ErrDailyLimitExceeded = errors.New("daily purchase limit exceeded")
+	// ErrUnknownPaymentLink is returned for the checkout sessions of payment links not accepted
+	// by the faucet.
+	ErrUnknownPaymentLink = errors.New("unknown payment link")
+)
+
+// PurchaseLimits are the limits of the tokens that can be bought. Zero values mean no limit.
+type PurchaseLimits struct {
+	MinQuantity uint64 `json:"minQuantity"`
+	MaxQuantity uint64 `json:"maxQuantity"`
+	DailyLimit  uint64 `json:"dailyLimit"` // Max tokens bought per recipient and per buyer each UTC day.
+}
+
+// Validate returns an error if the limits are inconsistent.
+func (l *PurchaseLimits) Validate() error {
+	if l.MaxQuantity > 0 && l.MinQuantity > l.MaxQuantity {
+		return fmt.Errorf("min quantity %d is greater than max quantity %d", l.MinQuantity, l.MaxQuantity)
+	}
+	if l.DailyLimit > 0 && l.MinQuantity > l.DailyLimit {
+		return fmt.Errorf("min quantity %d is greater than the daily limit %d", l.MinQuantity, l.DailyLimit)
+	}
+	return nil
+}
+
+// dailyBudgetName returns the name of the storage budget that tracks the tokens bought by the
+// given recipient.
+func dailyBudgetName(recipient string) string {
+	return "stripe:" + recipient
+}
+
+// dailyLimitNames returns the names of the storage budgets of the daily limits a purchase for
+// the given recipient, Stripe customer and buyer email counts towards, the ones known.
+func dailyLimitNames(recipient, customer, email string) []string {
+	names := []string{}
+	if recipient != "" {
+		names = append(names, dailyBudgetName(recipient))
+	}
+	if customer != "" {
+		names = append(names, "stripe:customer:"+customer)
+	}
+	if email = payment.NormalizeEmail(email); email != "" {
+		names = append(names, "stripe:email:"+email)
+	}
+	return names
+}
+
 // StripeHandler represents the configuration for the stripe a provider for handling Stripe payments.
 type StripeHandler struct {
 	Key           string           // The API key for the Stripe account.
 	ProductID     string           // The ID of the price associated with the product.
 	DefaultAmount int64            // The default amount for the product.
 	WebhookSecret string           // The secret used to verify Stripe webhook events.
-	Storage       *storage.Storage // The storage instance for the faucet.
+	Storage       storage.Storage  // The storage instance for the faucet.
 	Faucet        *faucet.Faucet   // The faucet instance.
-	SessionLock   sync.RWMutex     // The lock for the session.
+	AlertURL      string           // The URL to post alerts to, such as a Slack webhook, if any.
+	Limits        PurchaseLimits   // The limits of the tokens that can be bought.
+	PriceCacheTTL time.Duration    // The time the price tiers are cached for.
+	LocalPrices   *pricing.Catalog // The price tiers to use instead of the Stripe prices, if any.
+	// The currency of the checkouts that do not request one and cannot derive it from the
+	// client, if the product has prices in it.
+	DefaultCurrency string
+	GiftURL         string           // The URL of the gift claim page, the gift links are GiftURL/{id}/{token}.
+	PaymentLinks    map[string]int64 // The tokens sold by each accepted payment link, by payment link ID.
+	// The unused monthly allowances carried over by the subscriptions, 0 disables the rollover.
+	SubscriptionRollover uint64
+	prices               priceCache
+	linkURLs             sync.Map           // The URLs of the payment links, by ID.
+	Fulfiller            *payment.Fulfiller // The fulfiller of the paid checkout sessions.
+	// The queue the webhook events are processed from, if any, otherwise they are processed
+	// as they are received.
+	Queue *payment.WebhookQueue
+	// The local stand-in of the Stripe API the requests are sent to, if any.
+	Fake        *FakeBackend
+	SessionLock sync.RWMutex // The lock for the session.
 }
 
 // ReturnStatus represents the response status and data returned by the client.
-type ReturnStatus struct {
-	Status        string `json:"status"`
-	CustomerEmail string `json:"customer_email"`
-	FaucetPackage []byte `json:"faucet_package"`
-	Recipient     string `json:"recipient"`
-	Quantity      int64  `json:"quantity"`
-}
+type ReturnStatus = payment.Status
 
 // NewStripeClient creates a new instance of the StripeHandler struct with the provided parameters.
 // It sets the Stripe API key, price ID, webhook secret, minimum quantity, maximum quantity, and default amount.
 // Returns a pointer to the created StripeHandler.
-func NewStripeClient(key, productID, webhookSecret string, defaultAmount int64, faucet *faucet.Faucet, storage *storage.Storage) (*StripeHandler, error) {
+func NewStripeClient(key, productID, webhookSecret string, defaultAmount int64, faucet *faucet.Faucet, storage storage.Storage) (*StripeHandler, error) {
 	if key == "" || productID == "" || webhookSecret == "" || storage == nil {
 		return nil, errors.New("missing required parameters")
 	}
@@ -51,70 +150,77 @@ func NewStripeClient(key, productID, webhookSecret string, defaultAmount int64,
 		WebhookSecret: webhookSecret,
 		Storage:       storage,
 		Faucet:        faucet,
+		Fulfiller:     payment.NewFulfiller(faucet, storage),
 	}, nil
 }
 
+// SetAPIURL sends the Stripe API requests to the given URL instead of the Stripe API, such as
+// a local mock server.
+func SetAPIURL(url string) {
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(url),
+	}))
+}
+
 // CreateCheckoutSession creates a new Stripe checkout session.
 // It takes the defaultAmount, to, and referral as parameters and returns a pointer to a stripe.CheckoutSession and an error.
 // The defaultAmount parameter specifies the default quantity for the checkout session.
 // The to parameter is the client reference ID for the checkout session.
 // The referral parameter is the referral URL for the checkout session.
+// The currency parameter is the currency of the price tiers to use, the default one if empty.
+// The email parameter is the buyer email, prefilled in the checkout if set.
+// If to is empty, the checkout session is a gift, redeemed later for any address.
+// The quantity is checked against the quantity range, returning ErrQuantityOutOfRange, the daily limits are reserved by CreateCheckout.
 // The function constructs a stripe.CheckoutSessionParams object with the provided parameters and creates a new session using the session.New function.
 // If the session creation is successful, it returns the session pointer, otherwise it returns an error.
-func (s *StripeHandler) CreateCheckoutSession(defaultAmount int64, to, returnURL, referral string) (*stripe.CheckoutSession, error) {
-	if defaultAmount <= 0 {
-		return nil, nil
+func (s *StripeHandler) CreateCheckoutSession(defaultAmount int64, to, returnURL, referral, currency, email string) (*stripe.CheckoutSession, error) {
+	checkoutParams, err := s.checkoutSessionParams(defaultAmount, to, referral, currency, email)
+	if err != nil {
+		return nil, err
 	}
-	// get the different price packages
-	priceSearchParams := &stripe.PriceSearchParams{
-		SearchParams: stripe.SearchParams{
-			Query: fmt.Sprintf("product:'%s' AND active:'true'", s.ProductID),
-		},
+	checkoutParams.UIMode = stripe.String(UIModeEmbedded)
+	checkoutParams.ReturnURL = stripe.String(returnURL + "/{CHECKOUT_SESSION_ID}")
+	return session.New(checkoutParams)
+}
+
+// CreateHostedCheckoutSession creates a new Stripe checkout session hosted by Stripe, which
+// the customer is redirected to with the URL of the session. After paying, the customer is
+// redirected to successURL/{CHECKOUT_SESSION_ID}, or to cancelURL if it goes back. The other
+// parameters and the limits are the same as in CreateCheckoutSession.
+func (s *StripeHandler) CreateHostedCheckoutSession(defaultAmount int64, to, successURL, cancelURL, referral, currency, email string) (*stripe.CheckoutSession, error) {
+	if successURL == "" {
+		return nil, errors.New("missing success URL")
 	}
-	priceSearchParams.Limit = stripe.Int64(100)
-	result := price.Search(priceSearchParams)
-	if result.Err() != nil {
-		return nil, result.Err()
-	}
-	var prices []stripe.Price
-	for result.Next() {
-		prices = append(prices, *result.Price())
-	}
-	var closestRoundedPrice *stripe.Price
-	// sorting prices in order to find the closest price to the default amount
-	sort.Slice(prices,
-		func(i, j int) bool {
-			return prices[i].TransformQuantity.DivideBy < prices[j].TransformQuantity.DivideBy
-		})
-	// find the closest price under the default amount
-	index := sort.Search(len(prices), func(i int) bool {
-		return prices[i].TransformQuantity.DivideBy > defaultAmount
-	})
-	if index == 0 {
-		closestRoundedPrice = &prices[0]
-	} else if index <= len(prices) {
-		closestRoundedPrice = &prices[index-1]
+	checkoutParams, err := s.checkoutSessionParams(defaultAmount, to, referral, currency, email)
+	if err != nil {
+		return nil, err
 	}
-	if closestRoundedPrice == nil {
-		return nil, nil
+	checkoutParams.UIMode = stripe.String(UIModeHosted)
+	checkoutParams.SuccessURL = stripe.String(successURL + "/{CHECKOUT_SESSION_ID}")
+	if cancelURL != "" {
+		checkoutParams.CancelURL = stripe.String(cancelURL)
+	}
+	return session.New(checkoutParams)
+}
+
+// checkoutSessionParams returns the parameters of a checkout session for the given quantity,
+// recipient, referral, currency and buyer email, common to all the UI modes, after checking
+// the quantity range.
+func (s *StripeHandler) checkoutSessionParams(defaultAmount int64, to, referral, currency, email string) (*stripe.CheckoutSessionParams, error) {
+	if err := s.Limits.CheckQuantity(defaultAmount); err != nil {
+		return nil, err
+	}
+	quote, err := s.Quote(defaultAmount, currency)
+	if err != nil {
+		return nil, err
 	}
-	// calculate the price per token according to the package and
-	// round in order to fullfill the two decimals limits limitation of stripe
-	tempCalc := math.Round(float64(float64(closestRoundedPrice.UnitAmount) / float64(closestRoundedPrice.TransformQuantity.DivideBy)))
 
 	checkoutParams := &stripe.CheckoutSessionParams{
-		ClientReferenceID: stripe.String(to),
-		UIMode:            stripe.String("embedded"),
-		Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
-		ReturnURL:         stripe.String(returnURL + "/{CHECKOUT_SESSION_ID}"),
+		Mode: stripe.String(string(stripe.CheckoutSessionModePayment)),
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
 			{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Product:           &s.ProductID,
-					Currency:          stripe.String(string(closestRoundedPrice.Currency)),
-					UnitAmountDecimal: stripe.Float64(tempCalc),
-				},
-				Quantity: stripe.Int64(defaultAmount),
+				PriceData: unitPriceData(s.ProductID, quote),
+				Quantity:  stripe.Int64(defaultAmount),
 			},
 		},
 		Metadata: map[string]string{
@@ -122,17 +228,76 @@ func (s *StripeHandler) CreateCheckoutSession(defaultAmount int64, to, returnURL
 			"referral": referral,
 		},
 	}
-	ses, err := session.New(checkoutParams)
-	if err != nil {
-		return nil, err
+	if to != "" {
+		checkoutParams.ClientReferenceID = stripe.String(to)
+	} else {
+		checkoutParams.Metadata["gift"] = "true"
+	}
+	if email != "" {
+		checkoutParams.CustomerEmail = stripe.String(email)
+	}
+	return checkoutParams, nil
+}
+
+// unitPriceData returns the price of a token for the checkout line item. Integer prices are
+// sent as is, so Stripe charges exactly the quoted total.
+func unitPriceData(productID string, quote *pricing.Quote) *stripe.CheckoutSessionLineItemPriceDataParams {
+	data := &stripe.CheckoutSessionLineItemPriceDataParams{
+		Product:  stripe.String(productID),
+		Currency: stripe.String(quote.Currency),
+	}
+	if quote.UnitAmount != 0 {
+		data.UnitAmount = stripe.Int64(quote.UnitAmount)
+	} else {
+		data.UnitAmountDecimal = stripe.Float64(quote.UnitAmountFloat())
+	}
+	return data
+}
+
+// CheckQuantity returns ErrQuantityOutOfRange if the given quantity is not within the
+// configured range.
+func (l *PurchaseLimits) CheckQuantity(quantity int64) error {
+	if quantity <= 0 || uint64(quantity) < l.MinQuantity || (l.MaxQuantity > 0 && uint64(quantity) > l.MaxQuantity) {
+		return fmt.Errorf("%w: %d is not within [%d, %d]", ErrQuantityOutOfRange, quantity, l.MinQuantity, l.MaxQuantity)
+	}
+	return nil
+}
+
+// reserveDailyLimits counts the given quantity in the named daily limit budgets, unless that
+// exceeds the daily limit of any of them, in which case none is counted and
+// ErrDailyLimitExceeded is returned. It returns the names counted, none if there is no limit.
+func (s *StripeHandler) reserveDailyLimits(names []string, quantity uint64) ([]string, error) {
+	if s.Limits.DailyLimit == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	for i, name := range names {
+		bought, err := s.Storage.SpendBudget(name, dailyLimitPeriod, quantity, s.Limits.DailyLimit)
+		if err != nil {
+			s.releaseDailyLimits(names[:i], quantity, now)
+			if errors.Is(err, storage.ErrBudgetExceeded) {
+				return nil, fmt.Errorf("%w: %d tokens already bought out of %d", ErrDailyLimitExceeded, bought, s.Limits.DailyLimit)
+			}
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// releaseDailyLimits subtracts the given quantity, counted at the given time, from the named
+// daily limit budgets. Failures are only logged, since they only make the limits stricter.
+func (s *StripeHandler) releaseDailyLimits(names []string, quantity uint64, countedAt time.Time) {
+	for _, name := range names {
+		if err := s.Storage.ReleaseBudget(name, dailyLimitPeriod, quantity, countedAt); err != nil {
+			log.Warnw("failed to release daily limit", "name", name, "quantity", quantity, "err", err)
+		}
 	}
-	return ses, nil
 }
 
 // RetrieveCheckoutSession retrieves a checkout session from Stripe by session ID.
 // It returns a ReturnStatus object and an error if any.
-// The ReturnStatus object contains information about the session status, customer email,
-// faucet package, recipient, and quantity.
+// The ReturnStatus object contains information about the session status, payment status,
+// customer email, recipient, quantity and price. The faucet package is not set.
 func (s *StripeHandler) RetrieveCheckoutSession(sessionID string) (*ReturnStatus, error) {
 	params := &stripe.CheckoutSessionParams{}
 	params.AddExpand("line_items")
@@ -140,36 +305,163 @@ func (s *StripeHandler) RetrieveCheckoutSession(sessionID string) (*ReturnStatus
 	if err != nil {
 		return nil, err
 	}
-	lineItems := sess.LineItems
+	if sess.LineItems == nil || len(sess.LineItems.Data) == 0 {
+		return nil, fmt.Errorf("checkout session %s has no line items", sessionID)
+	}
 	data := &ReturnStatus{
 		Status:        string(sess.Status),
-		CustomerEmail: sess.CustomerDetails.Email,
+		PaymentStatus: string(sess.PaymentStatus),
 		FaucetPackage: nil,
 		Recipient:     sess.Metadata["to"],
-		Quantity:      lineItems.Data[0].Quantity,
+		Quantity:      sess.LineItems.Data[0].Quantity,
+		Price:         sess.AmountTotal,
+		Currency:      string(sess.Currency),
+		Referral:      sess.Metadata["referral"],
+	}
+	if sess.PaymentLink != nil {
+		// payment links sell packages of tokens, and the customer sets the recipient
+		tokens, ok := s.PaymentLinks[sess.PaymentLink.ID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPaymentLink, sess.PaymentLink.ID)
+		}
+		data.Recipient = sess.ClientReferenceID
+		data.Quantity *= tokens
+		// the recipient of the checkouts created by the faucet is checked at creation
+		if addr, err := helpers.StringToAddress(data.Recipient); err == nil {
+			if err := payment.CheckDenylist(s.Storage, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if sess.CustomerDetails != nil {
+		data.CustomerEmail = sess.CustomerDetails.Email
+	}
+	if sess.Customer != nil {
+		data.Customer = sess.Customer.ID
 	}
 	return data, nil
 }
 
-// HandleWebhook handles the incoming webhook event from Stripe.
-// It takes the API data and signature as input parameters and returns the session ID and an error (if any).
+// isPaid returns true if the checkout session is complete and its payment has been received.
+func isPaid(status, paymentStatus string) bool {
+	return status == string(stripe.CheckoutSessionStatusComplete) &&
+		paymentStatus == string(stripe.CheckoutSessionPaymentStatusPaid)
+}
+
+// VerifyWebhook verifies the incoming webhook event from Stripe.
+// It takes the request body and signature as input parameters and returns the event and an error (if any).
 // The request body and Stripe-Signature header are passed to ConstructEvent, along with the webhook signing key.
-// If the event type is "checkout.session.completed", it unmarshals the event data into a CheckoutSession struct
-// and returns the session ID. Otherwise, it returns an empty string.
-func (s *StripeHandler) HandleWebhook(apiData *apirest.APIdata, sig string) (string, error) {
+func (s *StripeHandler) VerifyWebhook(body []byte, sig string) (*stripe.Event, error) {
 	// Pass the request body and Stripe-Signature header to ConstructEvent, along with the webhook signing key
-	event, err := webhook.ConstructEvent(apiData.Data, sig, s.WebhookSecret)
+	event, err := webhook.ConstructEvent(body, sig, s.WebhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// Refund refunds the payment of the given checkout session in full. The refund is marked with
+// RefundMetadataKey as made by the faucet.
+func (s *StripeHandler) Refund(p *storage.Payment) error {
+	sess, err := session.Get(p.ID, nil)
 	if err != nil {
+		return err
+	}
+	if sess.PaymentIntent == nil {
+		return fmt.Errorf("checkout session %s has no payment intent", p.ID)
+	}
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(sess.PaymentIntent.ID)}
+	params.AddMetadata(RefundMetadataKey, "faucet")
+	_, err = refund.New(params)
+	return err
+}
+
+// faucetRefunds returns true if all the refunds of the given charge are marked with
+// RefundMetadataKey, so they were made by the faucet.
+func (s *StripeHandler) faucetRefunds(chargeID string) (bool, error) {
+	params := &stripe.RefundListParams{Charge: stripe.String(chargeID)}
+	iter := refund.List(params)
+	marked := false
+	for iter.Next() {
+		if _, ok := iter.Refund().Metadata[RefundMetadataKey]; !ok {
+			return false, nil
+		}
+		marked = true
+	}
+	if err := iter.Err(); err != nil {
+		return false, err
+	}
+	return marked, nil
+}
+
+// CheckoutSessionForPaymentIntent returns the ID of the checkout session that created the
+// given payment intent.
+func (s *StripeHandler) CheckoutSessionForPaymentIntent(paymentIntentID string) (string, error) {
+	params := &stripe.CheckoutSessionListParams{PaymentIntent: stripe.String(paymentIntentID)}
+	params.Limit = stripe.Int64(1)
+	iter := session.List(params)
+	if iter.Next() {
+		return iter.CheckoutSession().ID, nil
+	}
+	if err := iter.Err(); err != nil {
 		return "", err
 	}
-	// Handle the checkout.session.completed event
-	if event.Type == "checkout.session.completed" {
-		var sess stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &sess)
-		if err != nil {
-			return "", err
+	return "", fmt.Errorf("no checkout session found for payment intent %s", paymentIntentID)
+}
+
+// ParsePaymentLinks parses the accepted payment links from a comma separated list of
+// paymentLinkID:tokens pairs, such as plink_1:100,plink_2:1000.
+func ParsePaymentLinks(s string) (map[string]int64, error) {
+	links := make(map[string]int64)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, tokens, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid payment link %q, expected paymentLinkID:tokens", pair)
+		}
+		quantity, err := strconv.ParseInt(tokens, 10, 64)
+		if err != nil || quantity <= 0 {
+			return nil, fmt.Errorf("invalid tokens of payment link %q", pair)
+		}
+		if _, ok := links[id]; ok {
+			return nil, fmt.Errorf("duplicated payment link %s", id)
+		}
+		links[id] = quantity
+	}
+	return links, nil
+}
+
+// PaymentLink is a payment link accepted by the faucet. The recipient is set by appending
+// ?client_reference_id={address} to the URL.
+type PaymentLink struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Tokens int64  `json:"tokens"` // The tokens sold by each unit bought with the link.
+}
+
+// AcceptedPaymentLinks returns the payment links accepted by the faucet, sorted by tokens.
+// Their URLs are retrieved from Stripe once.
+func (s *StripeHandler) AcceptedPaymentLinks() ([]*PaymentLink, error) {
+	links := make([]*PaymentLink, 0, len(s.PaymentLinks))
+	for id, tokens := range s.PaymentLinks {
+		url, ok := s.linkURLs.Load(id)
+		if !ok {
+			link, err := paymentlink.Get(id, nil)
+			if err != nil {
+				return nil, err
+			}
+			url = link.URL
+			s.linkURLs.Store(id, url)
 		}
-		return sess.ID, nil
+		links = append(links, &PaymentLink{ID: id, URL: url.(string), Tokens: tokens})
 	}
-	return "", nil
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Tokens != links[j].Tokens {
+			return links[i].Tokens < links[j].Tokens
+		}
+		return links[i].ID < links[j].ID
+	})
+	return links, nil
 }
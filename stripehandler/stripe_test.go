@@ -0,0 +1,167 @@
+package stripehandler
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/pricing"
+	"github.com/vocdoni/vocfaucet/storage"
+)
+
+func TestPurchaseLimits(t *testing.T) {
+	st := storage.NewMemory(time.Hour)
+	s := &StripeHandler{
+		Storage: st,
+		Limits:  PurchaseLimits{MinQuantity: 10, MaxQuantity: 100, DailyLimit: 150},
+	}
+	for quantity, expected := range map[int64]error{
+		0:   ErrQuantityOutOfRange,
+		9:   ErrQuantityOutOfRange,
+		10:  nil,
+		100: nil,
+		101: ErrQuantityOutOfRange,
+	} {
+		if err := s.Limits.CheckQuantity(quantity); !errors.Is(err, expected) {
+			t.Fatalf("quantity %d: expected %v, got %v", quantity, expected, err)
+		}
+	}
+
+	// the purchases of the day count towards the daily limits of the recipient and the buyer
+	to := "0x0000000000000000000000000000000000000001"
+	names := dailyLimitNames(to, "", " Buyer@example.com")
+	if len(names) != 2 || names[1] != "stripe:email:buyer@example.com" {
+		t.Fatalf("unexpected daily limit names %v", names)
+	}
+	if _, err := s.reserveDailyLimits(names, 100); err != nil {
+		t.Fatalf("failed to reserve daily limits: %v", err)
+	}
+	other := dailyLimitNames("0x0000000000000000000000000000000000000002", "cus_1", "buyer@example.com")
+	if _, err := s.reserveDailyLimits(other, 51); !errors.Is(err, ErrDailyLimitExceeded) {
+		t.Fatalf("expected daily limit exceeded for the buyer, got %v", err)
+	}
+	// nothing is counted when any limit is exceeded
+	for _, name := range other[:2] {
+		if bought, err := st.BudgetSpent(name, dailyLimitPeriod); err != nil || bought != 0 {
+			t.Fatalf("unexpected %d bought for %s (%v)", bought, name, err)
+		}
+	}
+	if _, err := s.reserveDailyLimits(other[:2], 51); err != nil {
+		t.Fatalf("expected the daily limits to be per recipient and customer, got %v", err)
+	}
+
+	// released purchases, such as the expired ones, do not count anymore
+	s.releaseDailyLimits(names, 100, time.Now())
+	if _, err := s.reserveDailyLimits(names, 100); err != nil {
+		t.Fatalf("expected the released purchase not to count, got %v", err)
+	}
+
+	// payments are checked again once paid, for the limits not counted at checkout
+	p := &storage.Payment{ID: "cs_1", Recipient: to, Quantity: 100, Email: "buyer@example.com", Customer: "cus_1",
+		DailyLimits: names}
+	if err := s.CheckFulfillment(p); !errors.Is(err, ErrDailyLimitExceeded) {
+		t.Fatalf("expected daily limit exceeded for the customer, got %v", err)
+	}
+	p.Customer = "cus_2"
+	if err := s.CheckFulfillment(p); err != nil || len(p.DailyLimits) != 3 {
+		t.Fatalf("unexpected check of %+v (%v)", p, err)
+	}
+	if err := s.CheckFulfillment(p); err != nil {
+		t.Fatalf("expected the counted limits not to be counted again, got %v", err)
+	}
+
+	if err := (&PurchaseLimits{MinQuantity: 10, MaxQuantity: 5}).Validate(); err == nil {
+		t.Fatalf("expected invalid limits")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	s := &StripeHandler{PriceCacheTTL: time.Hour}
+	// the cached tiers are used without reaching Stripe
+	cached, err := pricing.NewTable("eur", []pricing.Tier{
+		{MinQuantity: 1, PackageSize: 1, PackagePrice: 10, PriceID: "price_1"},
+		{MinQuantity: 100, PackageSize: 100, PackagePrice: 750, PriceID: "price_100"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create price table: %v", err)
+	}
+	catalog, err := pricing.NewCatalog("eur", cached)
+	if err != nil {
+		t.Fatalf("failed to create price catalog: %v", err)
+	}
+	s.prices.catalog, s.prices.fetched = catalog, time.Now()
+	quote, err := s.Quote(150, "")
+	if err != nil {
+		t.Fatalf("failed to quote: %v", err)
+	}
+	if quote.Tier.PriceID != "price_100" || quote.Total != 1125 || quote.UnitAmount != 0 {
+		t.Fatalf("unexpected quote: %+v", quote)
+	}
+	data := unitPriceData("prod_1", quote)
+	if data.UnitAmount != nil || *data.UnitAmountDecimal != 7.5 {
+		t.Fatalf("unexpected line item price: %+v", data)
+	}
+
+	// local prices take precedence, and apply the tiers of the chosen currency
+	if s.LocalPrices, err = pricing.ParseCatalog("usd", "usd=1:20;eur=1:18,100:15"); err != nil {
+		t.Fatalf("failed to parse price catalog: %v", err)
+	}
+	if quote, err = s.Quote(150, ""); err != nil || quote.Total != 3000 || quote.Currency != "usd" {
+		t.Fatalf("unexpected local quote %+v (%v)", quote, err)
+	}
+	if eur, err := s.Quote(150, "EUR"); err != nil || eur.Total != 2250 || eur.Currency != "eur" {
+		t.Fatalf("unexpected local quote in eur %+v (%v)", eur, err)
+	}
+	if _, err := s.Quote(150, "gbp"); !errors.Is(err, pricing.ErrUnknownCurrency) {
+		t.Fatalf("expected unknown currency, got %v", err)
+	}
+	if data := unitPriceData("prod_1", quote); data.UnitAmount == nil || *data.UnitAmount != 20 {
+		t.Fatalf("expected integer line item price: %+v", data)
+	}
+	if _, err := s.Quote(0, ""); !errors.Is(err, ErrQuantityOutOfRange) {
+		t.Fatalf("expected quantity out of range, got %v", err)
+	}
+}
+
+func TestPaymentLinks(t *testing.T) {
+	links, err := ParsePaymentLinks(" plink_1:100, plink_2:1000,")
+	if err != nil || len(links) != 2 || links["plink_1"] != 100 || links["plink_2"] != 1000 {
+		t.Fatalf("unexpected payment links %v (%v)", links, err)
+	}
+	for _, invalid := range []string{"plink_1", "plink_1:0", ":100", "plink_1:1,plink_1:2"} {
+		if _, err := ParsePaymentLinks(invalid); err == nil {
+			t.Fatalf("expected invalid payment links %q", invalid)
+		}
+	}
+
+	// the paid sessions of accepted payment links are recorded with the client reference ID
+	// as recipient, and the ones of other links are ignored
+	st := storage.NewMemory(time.Hour)
+	s := &StripeHandler{Storage: st, PaymentLinks: links}
+	to := "0x0000000000000000000000000000000000000001"
+	for id, link := range map[string]string{"cs_1": "plink_1", "cs_2": "plink_other"} {
+		raw, err := json.Marshal(map[string]any{
+			"id":                  id,
+			"status":              stripe.CheckoutSessionStatusComplete,
+			"payment_status":      stripe.CheckoutSessionPaymentStatusPaid,
+			"client_reference_id": to,
+			"payment_link":        link,
+		})
+		if err != nil {
+			t.Fatalf("failed to encode session: %v", err)
+		}
+		event := &stripe.Event{Type: stripe.EventTypeCheckoutSessionCompleted, Data: &stripe.EventData{Raw: raw}}
+		if err := s.processEvent(event); err != nil {
+			t.Fatalf("failed to process event: %v", err)
+		}
+	}
+	p, err := st.Payment("cs_1")
+	if err != nil || p.State != storage.PaymentPaid || p.Recipient != to {
+		t.Fatalf("unexpected payment %+v (%v)", p, err)
+	}
+	if _, err := st.Payment("cs_2"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected the unknown payment link to be ignored, got %v", err)
+	}
+}
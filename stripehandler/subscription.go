@@ -0,0 +1,196 @@
+package stripehandler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/payment"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/log"
+)
+
+var (
+	// ErrSubscriptionNotFound is returned when a subscription does not exist or belongs to
+	// another subscriber.
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrNothingToClaim is returned when a subscription has no allowance available.
+	ErrNothingToClaim = errors.New("no subscription allowance available")
+)
+
+// The metadata keys of the subscriptions created by the faucet, which are copied to their
+// invoices. The subscriptions without them are not faucet subscriptions and are ignored.
+const (
+	subscriberMetadata = "subscriber"
+	allowanceMetadata  = "allowance"
+)
+
+// SubscriptionClaim is the faucet package of the allowance claimed from a subscription.
+type SubscriptionClaim struct {
+	Subscription  *storage.Subscription `json:"subscription"`
+	Amount        uint64                `json:"amount"`
+	FaucetPackage []byte                `json:"faucetPackage"`
+}
+
+// CreateSubscriptionCheckoutSession creates a Stripe checkout session in subscription mode,
+// which bills the price of the given monthly allowance of tokens every month. The allowance
+// is checked against the quantity limits, and credited to the given subscriber every time an
+// invoice is paid. Embedded sessions return to returnURL, hosted sessions to successURL or
+// cancelURL, like the one-off checkout sessions, and the price is in the given currency, or
+// in the default one if empty.
+func (s *StripeHandler) CreateSubscriptionCheckoutSession(allowance int64, subscriber common.Address,
+	currency, uiMode, returnURL, successURL, cancelURL string,
+) (*stripe.CheckoutSession, error) {
+	if err := s.Limits.CheckQuantity(allowance); err != nil {
+		return nil, err
+	}
+	if err := payment.CheckDenylist(s.Storage, subscriber); err != nil {
+		return nil, err
+	}
+	quote, err := s.Quote(allowance, currency)
+	if err != nil {
+		return nil, err
+	}
+	priceData := unitPriceData(s.ProductID, quote)
+	priceData.Recurring = &stripe.CheckoutSessionLineItemPriceDataRecurringParams{
+		Interval: stripe.String(string(stripe.PriceRecurringIntervalMonth)),
+	}
+	params := &stripe.CheckoutSessionParams{
+		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				PriceData: priceData,
+				Quantity:  stripe.Int64(allowance),
+			},
+		},
+		ClientReferenceID: stripe.String(subscriber.Hex()),
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: map[string]string{
+				subscriberMetadata: subscriber.Hex(),
+				allowanceMetadata:  strconv.FormatInt(allowance, 10),
+			},
+		},
+	}
+	switch uiMode {
+	case "", UIModeEmbedded:
+		params.UIMode = stripe.String(UIModeEmbedded)
+		params.ReturnURL = stripe.String(returnURL + "/{CHECKOUT_SESSION_ID}")
+	case UIModeHosted:
+		if successURL == "" {
+			return nil, errors.New("missing success URL")
+		}
+		params.UIMode = stripe.String(UIModeHosted)
+		params.SuccessURL = stripe.String(successURL + "/{CHECKOUT_SESSION_ID}")
+		if cancelURL != "" {
+			params.CancelURL = stripe.String(cancelURL)
+		}
+	default:
+		return nil, fmt.Errorf("invalid uiMode %q", uiMode)
+	}
+	return session.New(params)
+}
+
+// creditSubscription credits the allowance of the subscription of the given paid invoice,
+// creating the subscription record on its first invoice. Every invoice is credited once. The
+// unused allowance is carried over for up to SubscriptionRollover periods, and lost otherwise.
+// Like all the webhook events, it is called holding SessionLock.
+func (s *StripeHandler) creditSubscription(invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil || invoice.SubscriptionDetails == nil {
+		return nil
+	}
+	subscriber := invoice.SubscriptionDetails.Metadata[subscriberMetadata]
+	allowance, err := strconv.ParseUint(invoice.SubscriptionDetails.Metadata[allowanceMetadata], 10, 64)
+	if subscriber == "" || err != nil {
+		log.Debugw("ignoring invoice of unknown subscription", "invoice", invoice.ID, "subscription", invoice.Subscription.ID)
+		return nil
+	}
+	now := time.Now()
+	sub, err := s.Storage.Subscription(invoice.Subscription.ID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		sub = &storage.Subscription{
+			ID:         invoice.Subscription.ID,
+			Subscriber: subscriber,
+			Status:     string(stripe.SubscriptionStatusActive),
+			Allowance:  allowance,
+			CreatedAt:  now,
+		}
+	case err != nil:
+		return err
+	}
+	if sub.LastInvoice == invoice.ID {
+		return nil
+	}
+	sub.Available = min(sub.Available, sub.Allowance*s.SubscriptionRollover) + sub.Allowance
+	sub.LastInvoice = invoice.ID
+	if invoice.Customer != nil {
+		sub.Customer = invoice.Customer.ID
+	}
+	if invoice.CustomerEmail != "" {
+		sub.Email = invoice.CustomerEmail
+	}
+	if invoice.Lines != nil && len(invoice.Lines.Data) > 0 && invoice.Lines.Data[0].Period != nil {
+		sub.PeriodEnd = time.Unix(invoice.Lines.Data[0].Period.End, 0)
+	}
+	sub.UpdatedAt = now
+	log.Infow("subscription allowance credited", "subscription", sub.ID, "subscriber", sub.Subscriber,
+		"invoice", invoice.ID, "available", sub.Available)
+	return s.Storage.SetSubscription(sub)
+}
+
+// updateSubscription records the status of the given subscription, if it is a faucet
+// subscription. Canceled subscriptions are not credited anymore, but their available
+// allowance can still be claimed.
+func (s *StripeHandler) updateSubscription(subscription *stripe.Subscription) error {
+	sub, err := s.Storage.Subscription(subscription.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sub.Status = string(subscription.Status)
+	if subscription.CurrentPeriodEnd != 0 {
+		sub.PeriodEnd = time.Unix(subscription.CurrentPeriodEnd, 0)
+	}
+	sub.UpdatedAt = time.Now()
+	return s.Storage.SetSubscription(sub)
+}
+
+// ClaimSubscription issues a faucet package with the allowance available in the subscription
+// with the given ID to its subscriber, which must be the given address. The caller must hold
+// SessionLock, so the allowance is not claimed twice or credited meanwhile.
+func (s *StripeHandler) ClaimSubscription(id string, subscriber common.Address) (*SubscriptionClaim, error) {
+	sub, err := s.Storage.Subscription(id)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && sub.Subscriber != subscriber.Hex()) {
+		return nil, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sub.Available == 0 {
+		return nil, ErrNothingToClaim
+	}
+	if err := payment.CheckDenylist(s.Storage, subscriber); err != nil {
+		return nil, err
+	}
+	amount := sub.Available
+	data, err := s.Faucet.IssueFaucetPackage(subscriber, amount, faucet.AuthTypeStripeSubscription, sub.ID)
+	if err != nil {
+		return nil, err
+	}
+	sub.Available = 0
+	sub.Claimed += amount
+	sub.UpdatedAt = time.Now()
+	// if the claim cannot be stored the package is not returned either, so it is never
+	// delivered twice
+	if err := s.Storage.SetSubscription(sub); err != nil {
+		return nil, err
+	}
+	return &SubscriptionClaim{Subscription: sub, Amount: amount, FaucetPackage: data.FaucetPackage}, nil
+}
@@ -0,0 +1,77 @@
+package stripehandler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/vocdoni/vocfaucet/faucet"
+	"github.com/vocdoni/vocfaucet/storage"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestSubscriptions(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatalf("failed to generate signer: %v", err)
+	}
+	st := storage.NewMemory(time.Hour)
+	s := &StripeHandler{
+		Storage:              st,
+		Faucet:               &faucet.Faucet{Signer: signer, Storage: st},
+		SubscriptionRollover: 1,
+	}
+	addr := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	invoice := func(id string) *stripe.Invoice {
+		return &stripe.Invoice{
+			ID:           id,
+			Subscription: &stripe.Subscription{ID: "sub_1"},
+			SubscriptionDetails: &stripe.InvoiceSubscriptionDetails{Metadata: map[string]string{
+				subscriberMetadata: addr.Hex(),
+				allowanceMetadata:  "100",
+			}},
+		}
+	}
+
+	// the invoices of other subscriptions are ignored, and every invoice is credited once
+	if err := s.creditSubscription(&stripe.Invoice{ID: "in_0", Subscription: &stripe.Subscription{ID: "sub_0"},
+		SubscriptionDetails: &stripe.InvoiceSubscriptionDetails{}}); err != nil {
+		t.Fatalf("failed to ignore invoice: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.creditSubscription(invoice("in_1")); err != nil {
+			t.Fatalf("failed to credit subscription: %v", err)
+		}
+	}
+	if subs, err := st.Subscriptions(addr.Hex()); err != nil || len(subs) != 1 || subs[0].Available != 100 {
+		t.Fatalf("unexpected subscriptions %+v (%v)", subs, err)
+	}
+
+	// up to a period of unused allowance is carried over
+	for _, id := range []string{"in_2", "in_3"} {
+		if err := s.creditSubscription(invoice(id)); err != nil {
+			t.Fatalf("failed to credit subscription: %v", err)
+		}
+	}
+	other := common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	if _, err := s.ClaimSubscription("sub_1", other); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Fatalf("expected subscription not found for another address, got %v", err)
+	}
+	claim, err := s.ClaimSubscription("sub_1", addr)
+	if err != nil || claim.Amount != 200 || len(claim.FaucetPackage) == 0 || claim.Subscription.Claimed != 200 {
+		t.Fatalf("unexpected claim %+v (%v)", claim, err)
+	}
+	if _, err := s.ClaimSubscription("sub_1", addr); !errors.Is(err, ErrNothingToClaim) {
+		t.Fatalf("expected nothing to claim, got %v", err)
+	}
+
+	// canceled subscriptions keep their status
+	if err := s.updateSubscription(&stripe.Subscription{ID: "sub_1", Status: stripe.SubscriptionStatusCanceled}); err != nil {
+		t.Fatalf("failed to update subscription: %v", err)
+	}
+	if sub, err := st.Subscription("sub_1"); err != nil || sub.Status != string(stripe.SubscriptionStatusCanceled) {
+		t.Fatalf("unexpected subscription %+v (%v)", sub, err)
+	}
+}